@@ -0,0 +1,55 @@
+package articles
+
+import (
+	"realworld-backend/common"
+	"realworld-backend/users"
+	"time"
+)
+
+// How long cached responses are served at most. Changes made through the models drop the affected
+// entries right away, the TTL only bounds how stale a response can get after a change made elsewhere.
+var (
+	TagsCacheTTL    = time.Minute
+	ArticleCacheTTL = 30 * time.Second
+)
+
+const (
+	tagsCacheKey   = "tags"
+	articleKeyBase = "article:"
+)
+
+// Anonymous readers all get the same article response, cached per slug and body format.
+func articleCacheKey(slug string, html bool) string {
+	if html {
+		return articleKeyBase + slug + ":html"
+	}
+	return articleKeyBase + slug + ":"
+}
+
+func init() {
+	// Tag lists are cached per query and count favorites
+	common.Subscribe(func(e common.Event) {
+		common.GetCache().DeletePrefix(tagsCacheKey + ":")
+	}, EventArticleCreated, EventArticleUpdated, EventArticleDeleted, EventArticleFavorited, EventArticleUnfavorited, EventTagChanged)
+
+	common.Subscribe(func(e common.Event) {
+		common.GetCache().DeletePrefix(articleKeyBase + e.Payload.(ArticleModel).Slug + ":")
+	}, EventArticleDeleted)
+
+	common.Subscribe(func(e common.Event) {
+		common.GetCache().DeletePrefix(articleKeyBase + e.Payload.(FavoriteModel).Favorite.Slug + ":")
+	}, EventArticleFavorited, EventArticleUnfavorited)
+
+	common.Subscribe(func(e common.Event) {
+		if reaction := e.Payload.(ReactionModel); reaction.TargetType == ReactionTargetArticle {
+			common.GetCache().DeletePrefix(articleKeyBase + reaction.Article.Slug + ":")
+		}
+	}, EventReactionAdded, EventReactionRemoved)
+
+	// An update may change the slug, a profile change shows up in every article of its author and
+	// a tag change in every article with the tag. None tells which cached slugs are affected so all
+	// articles are dropped.
+	common.Subscribe(func(e common.Event) {
+		common.GetCache().DeletePrefix(articleKeyBase)
+	}, EventArticleUpdated, EventTagChanged, users.EventUserUpdated)
+}
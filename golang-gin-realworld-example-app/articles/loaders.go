@@ -0,0 +1,196 @@
+package articles
+
+import (
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// Serializing a page of articles one by one runs several queries per article. Handlers load everything
+// the responses need for the whole page up front, in a constant number of queries, and keep it in the gin
+// context where ArticleSerializer picks it up. A single article goes through the same loader, so reading
+// it doesn't write anything and a failed query is answered instead of serialized as zero.
+const articleStateKey = "article_state"
+
+type articleState struct {
+	FavoritesCount map[uint]uint
+	Favorited      map[uint]bool
+}
+
+// Load the authors and tags of the articles with one query per association, whatever the page size.
+//
+//	err := preloadArticles(tx, models)
+func preloadArticles(tx *gorm.DB, models []ArticleModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+	authorIDs := make([]uint, 0, len(models))
+	articleIDs := make([]uint, 0, len(models))
+	for _, model := range models {
+		authorIDs = append(authorIDs, model.AuthorID)
+		articleIDs = append(articleIDs, model.ID)
+	}
+	authors, err := findArticleUsers(tx, authorIDs)
+	if err != nil {
+		return err
+	}
+
+	type articleTag struct {
+		ArticleModelID uint
+		TagModel
+	}
+	var tags []articleTag
+	err = tx.Table("tag_models").
+		Select("article_tags.article_model_id, tag_models.*").
+		Joins("JOIN article_tags ON article_tags.tag_model_id = tag_models.id").
+		Where("article_tags.article_model_id IN (?) AND tag_models.deleted_at IS NULL", articleIDs).
+		Order("article_tags.article_model_id, tag_models.id").
+		Scan(&tags).Error
+	if err != nil {
+		return err
+	}
+	tagsByArticle := map[uint][]TagModel{}
+	for _, tag := range tags {
+		tagsByArticle[tag.ArticleModelID] = append(tagsByArticle[tag.ArticleModelID], tag.TagModel)
+	}
+
+	for i := range models {
+		models[i].Author = authors[models[i].AuthorID]
+		models[i].Tags = tagsByArticle[models[i].ID]
+		if models[i].Tags == nil {
+			models[i].Tags = []TagModel{}
+		}
+	}
+	return nil
+}
+
+// Load the authors of the comments with one query per association.
+func preloadComments(tx *gorm.DB, models []CommentModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+	authorIDs := make([]uint, 0, len(models))
+	for _, model := range models {
+		authorIDs = append(authorIDs, model.AuthorID)
+	}
+	authors, err := findArticleUsers(tx, authorIDs)
+	if err != nil {
+		return err
+	}
+	for i := range models {
+		models[i].Author = authors[models[i].AuthorID]
+	}
+	return nil
+}
+
+// Find article users with their user models, by id.
+func findArticleUsers(tx *gorm.DB, ids []uint) (map[uint]ArticleUserModel, error) {
+	var articleUsers []ArticleUserModel
+	if err := tx.Where("id IN (?)", ids).Find(&articleUsers).Error; err != nil {
+		return nil, err
+	}
+	userIDs := make([]uint, 0, len(articleUsers))
+	for _, articleUser := range articleUsers {
+		userIDs = append(userIDs, articleUser.UserModelID)
+	}
+	var userModels []users.UserModel
+	if len(userIDs) > 0 {
+		if err := tx.Where("id IN (?)", userIDs).Find(&userModels).Error; err != nil {
+			return nil, err
+		}
+	}
+	byUserID := map[uint]users.UserModel{}
+	for _, userModel := range userModels {
+		byUserID[userModel.ID] = userModel
+	}
+	byID := make(map[uint]ArticleUserModel, len(articleUsers))
+	for _, articleUser := range articleUsers {
+		articleUser.UserModel = byUserID[articleUser.UserModelID]
+		byID[articleUser.ID] = articleUser
+	}
+	return byID, nil
+}
+
+// Keep the favorite counts of the articles of a page, and load whether the current user favorited them
+// and whether they follow the authors. Articles loaded before in the request are skipped.
+//
+//	err := loadArticleState(c, page.Articles)
+func loadArticleState(c *gin.Context, models []ArticleModel) error {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	state := articleState{
+		FavoritesCount: make(map[uint]uint, len(models)),
+		Favorited:      make(map[uint]bool, len(models)),
+	}
+	if loaded, ok := c.Get(articleStateKey); ok {
+		state = loaded.(articleState)
+	}
+
+	db := common.GetDB()
+	articleIDs := make([]uint, 0, len(models))
+	authorIDs := make([]uint, 0, len(models))
+	for _, model := range models {
+		if _, ok := state.FavoritesCount[model.ID]; ok {
+			continue
+		}
+		articleIDs = append(articleIDs, model.ID)
+		authorIDs = append(authorIDs, model.Author.UserModelID)
+	}
+	if len(articleIDs) == 0 {
+		c.Set(articleStateKey, state)
+		return nil
+	}
+
+	favorited := make(map[uint]bool, len(articleIDs))
+	if myUserModel.ID != 0 {
+		var favorites []FavoriteModel
+		err := db.Joins("JOIN article_user_models ON article_user_models.id = favorite_models.favorite_by_id").
+			Where("article_user_models.user_model_id = ? AND favorite_models.favorite_id IN (?)", myUserModel.ID, articleIDs).
+			Find(&favorites).Error
+		if err != nil {
+			return err
+		}
+		for _, favorite := range favorites {
+			favorited[favorite.FavoriteID] = true
+		}
+	}
+	for _, model := range models {
+		if _, ok := state.FavoritesCount[model.ID]; !ok {
+			state.FavoritesCount[model.ID] = model.FavoritesCount
+			state.Favorited[model.ID] = favorited[model.ID]
+		}
+	}
+
+	loadReactionState(c, ReactionTargetArticle, articleIDs)
+	users.PreloadFollowing(c, authorIDs)
+	c.Set(articleStateKey, state)
+	return nil
+}
+
+// The preloaded favorite count and favorited state of an article, ok is false when it wasn't loaded.
+func loadedArticleState(c *gin.Context, id uint) (count uint, favorited bool, ok bool) {
+	loaded, exists := c.Get(articleStateKey)
+	if !exists {
+		return 0, false, false
+	}
+	state := loaded.(articleState)
+	count, ok = state.FavoritesCount[id]
+	return count, state.Favorited[id], ok
+}
+
+// Load the reactions to the comments and their replies, and whether the current user follows their authors.
+func loadCommentState(c *gin.Context, models []CommentModel) {
+	var commentIDs, authorIDs []uint
+	var collect func(models []CommentModel)
+	collect = func(models []CommentModel) {
+		for _, model := range models {
+			commentIDs = append(commentIDs, model.ID)
+			authorIDs = append(authorIDs, model.Author.UserModelID)
+			collect(model.Replies)
+		}
+	}
+	collect(models)
+	loadReactionState(c, ReactionTargetComment, commentIDs)
+	users.PreloadFollowing(c, authorIDs)
+}
@@ -0,0 +1,173 @@
+package articles
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Where a mention was written.
+const (
+	MentionInArticle = "article"
+	MentionInComment = "comment"
+)
+
+// Published for every user newly mentioned in an article or a comment, with a MentionModel carrying
+// User, Article and MentionedBy.
+const EventUserMentioned = "user.mentioned"
+
+// A user mentioned with @username in the body of an article or a comment. The index is rebuilt
+// whenever a new body is saved, a user mentioned several times in one body has one entry.
+type MentionModel struct {
+	gorm.Model
+	UserModelID   uint   `gorm:"index"`
+	SourceType    string `gorm:"index:idx_mention_source"`
+	SourceID      uint   `gorm:"index:idx_mention_source"`
+	ArticleID     uint
+	MentionedBy   ArticleUserModel `gorm:"association_autoupdate:false"`
+	MentionedByID uint
+	User          users.UserModel `gorm:"-"`
+	Article       ArticleModel    `gorm:"-"`
+}
+
+var ErrUnknownMention = errors.New("no user with this name to mention")
+
+// The users mentioned in a body, resolved when an article or a comment is bound so that mentions of
+// unknown users are refused before anything is saved. The writer mentioning themselves is skipped.
+// The result isn't nil, nil stands for mentions which weren't parsed, see recordMentions.
+func resolveMentions(body string, writer users.UserModel) ([]users.UserModel, error) {
+	mentioned := []users.UserModel{}
+	usernames := common.ParseMentions(body)
+	if len(usernames) == 0 {
+		return mentioned, nil
+	}
+	var found []users.UserModel
+	if err := common.GetDB().Where("username IN (?)", usernames).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	byName := map[string]users.UserModel{}
+	for _, userModel := range found {
+		byName[userModel.Username] = userModel
+	}
+	var unknown []string
+	for _, username := range usernames {
+		userModel, ok := byName[username]
+		if !ok {
+			unknown = append(unknown, "@"+username)
+		} else if userModel.ID != writer.ID {
+			mentioned = append(mentioned, userModel)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMention, strings.Join(unknown, ", "))
+	}
+	return mentioned, nil
+}
+
+// Replace the mentions of an article or comment with the mentioned users, within the transaction which
+// saves the source. Users who weren't mentioned in the source before are told with EventUserMentioned.
+// Mentions which weren't resolved (nil) leave the index as it is.
+//
+//	err := recordMentions(tx, article, MentionInComment, comment.ID, comment.Author, comment.mentioned)
+func recordMentions(tx *gorm.DB, article ArticleModel, sourceType string, sourceID uint, by ArticleUserModel, mentioned []users.UserModel) error {
+	if mentioned == nil {
+		return nil
+	}
+	keep := map[uint]bool{}
+	for _, userModel := range mentioned {
+		keep[userModel.ID] = true
+	}
+
+	var existing []MentionModel
+	if err := tx.Where(&MentionModel{SourceType: sourceType, SourceID: sourceID}).Find(&existing).Error; err != nil {
+		return err
+	}
+	before := map[uint]bool{}
+	var dropped []uint
+	for _, mention := range existing {
+		before[mention.UserModelID] = true
+		if !keep[mention.UserModelID] {
+			dropped = append(dropped, mention.ID)
+		}
+	}
+	if len(dropped) > 0 {
+		if err := tx.Where("id IN (?)", dropped).Delete(MentionModel{}).Error; err != nil {
+			return err
+		}
+	}
+	for _, userModel := range mentioned {
+		if before[userModel.ID] {
+			continue
+		}
+		mention := MentionModel{
+			UserModelID:   userModel.ID,
+			SourceType:    sourceType,
+			SourceID:      sourceID,
+			ArticleID:     article.ID,
+			MentionedByID: by.ID,
+		}
+		if err := tx.Create(&mention).Error; err != nil {
+			return err
+		}
+		mention.User, mention.Article, mention.MentionedBy = userModel, article, by
+		if err := common.Record(tx, common.Event{Name: EventUserMentioned, Payload: mention}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop the mentions made in deleted articles or comments.
+func deleteMentions(tx *gorm.DB, sourceType string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Where("source_type = ? AND source_id IN (?)", sourceType, ids).Delete(MentionModel{}).Error
+}
+
+// The mentions of a user, newest first, with their article and comment. Returns the page and the
+// number of mentions in all pages.
+func FindMentions(userModel users.UserModel, limit, offset int) ([]MentionModel, int, error) {
+	db := common.GetDB()
+	tx := db.Model(&MentionModel{}).Where("user_model_id = ?", userModel.ID)
+	var count int
+	if err := tx.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	var mentions []MentionModel
+	if err := tx.Order("id DESC").Limit(limit).Offset(offset).Find(&mentions).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(mentions) == 0 {
+		return mentions, count, nil
+	}
+	articleIDs := make([]uint, 0, len(mentions))
+	byIDs := make([]uint, 0, len(mentions))
+	for _, mention := range mentions {
+		articleIDs = append(articleIDs, mention.ArticleID)
+		byIDs = append(byIDs, mention.MentionedByID)
+	}
+	var articleModels []ArticleModel
+	if err := db.Where("id IN (?)", articleIDs).Find(&articleModels).Error; err != nil {
+		return nil, 0, err
+	}
+	articlesByID := map[uint]ArticleModel{}
+	for _, articleModel := range articleModels {
+		articlesByID[articleModel.ID] = articleModel
+	}
+	mentionedBy, err := findArticleUsers(db, byIDs)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range mentions {
+		mentions[i].User = userModel
+		mentions[i].Article = articlesByID[mentions[i].ArticleID]
+		mentions[i].MentionedBy = mentionedBy[mentions[i].MentionedByID]
+	}
+	return mentions, count, nil
+}
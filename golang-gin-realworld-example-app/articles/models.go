@@ -1,11 +1,14 @@
 package articles
 
 import (
-	_ "fmt"
+	"fmt"
 	"realworld-backend/common"
 	"realworld-backend/users"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gosimple/slug"
 	"github.com/jinzhu/gorm"
 )
 
@@ -13,12 +16,19 @@ type ArticleModel struct {
 	gorm.Model
 	Slug        string `gorm:"unique_index"`
 	Title       string
-	Description string `gorm:"size:2048"`
-	Body        string `gorm:"size:2048"`
-	Author      ArticleUserModel
+	Description string           `gorm:"size:2048"`
+	Body        string           `gorm:"size:2048"`
+	BodyHTML    string           `gorm:"column:body_html;type:text"`
+	Author      ArticleUserModel `gorm:"association_autoupdate:false"`
 	AuthorID    uint
 	Tags        []TagModel     `gorm:"many2many:article_tags;"`
 	Comments    []CommentModel `gorm:"ForeignKey:ArticleID"`
+	// Maintained by favoriteBy/unFavoriteBy and the comment functions, recomputed by ReconcileCounters.
+	// Serializers read the loaded value.
+	FavoritesCount uint `gorm:"column:favorites_count;not null;default:0"`
+	CommentsCount  uint `gorm:"column:comments_count;not null;default:0"`
+	// The users mentioned in the body, resolved by the validator. nil leaves the mentions as they are.
+	mentioned []users.UserModel
 }
 
 type ArticleUserModel struct {
@@ -27,6 +37,7 @@ type ArticleUserModel struct {
 	UserModelID    uint
 	ArticleModels  []ArticleModel  `gorm:"ForeignKey:AuthorID"`
 	FavoriteModels []FavoriteModel `gorm:"ForeignKey:FavoriteByID"`
+	ArticlesCount  uint            `gorm:"column:articles_count;not null;default:0"`
 }
 
 type FavoriteModel struct {
@@ -39,17 +50,94 @@ type FavoriteModel struct {
 
 type TagModel struct {
 	gorm.Model
-	Tag           string         `gorm:"unique_index"`
-	ArticleModels []ArticleModel `gorm:"many2many:article_tags;"`
+	Tag           string          `gorm:"unique_index"`
+	Description   string          `gorm:"size:2048"`
+	ArticleModels []ArticleModel  `gorm:"many2many:article_tags;"`
+	Aliases       []TagAliasModel `gorm:"-"`
+	ArticlesCount int             `gorm:"-"`
 }
 
 type CommentModel struct {
 	gorm.Model
-	Article   ArticleModel
+	Article   ArticleModel `gorm:"association_autoupdate:false"`
 	ArticleID uint
-	Author    ArticleUserModel
+	Author    ArticleUserModel `gorm:"association_autoupdate:false"`
 	AuthorID  uint
 	Body      string `gorm:"size:2048"`
+	BodyHTML  string `gorm:"column:body_html;type:text"`
+	// Replies point to the comment they answer, top-level comments have no parent.
+	ParentID     *uint `gorm:"index"`
+	RepliesCount uint  `gorm:"column:replies_count;not null;default:0"`
+	// A removed comment which still has replies stays in the thread as a tombstone without a body.
+	RemovedAt *time.Time
+	EditedAt  *time.Time
+	Replies   []CommentModel `gorm:"-"`
+	// The users mentioned in the body, resolved by the validator. nil leaves the mentions as they are.
+	mentioned []users.UserModel
+}
+
+// The body a comment had before an edit, kept for moderators.
+type CommentRevisionModel struct {
+	gorm.Model
+	CommentID uint   `gorm:"index"`
+	Body      string `gorm:"size:2048"`
+	BodyHTML  string `gorm:"column:body_html;type:text"`
+}
+
+// Slugs an article was published under before it got a new one.
+// Old links keep working: ArticleRetrieve looks them up here and answers with a redirect.
+type SlugHistoryModel struct {
+	gorm.Model
+	Slug      string `gorm:"unique_index"`
+	ArticleID uint
+}
+
+// Events recorded with a change to articles and dispatched once it is committed, see common.Record.
+// Article events carry the ArticleModel, favorite events a FavoriteModel with Favorite and FavoriteBy filled in
+// (FavoriteBy is empty for likes from other servers), comment events the CommentModel. A deleted comment comes
+// as it is once removed: without its body, RemovedAt set.
+const (
+	EventArticleCreated     = "article.created"
+	EventArticleUpdated     = "article.updated"
+	EventArticleDeleted     = "article.deleted"
+	EventArticleFavorited   = "article.favorited"
+	EventArticleUnfavorited = "article.unfavorited"
+	EventCommentCreated     = "comment.created"
+	EventCommentEdited      = "comment.edited"
+	EventCommentDeleted     = "comment.deleted"
+)
+
+func init() {
+	common.RegisterEvent(EventArticleCreated, ArticleModel{})
+	common.RegisterEvent(EventArticleUpdated, ArticleModel{})
+	common.RegisterEvent(EventArticleDeleted, ArticleModel{})
+	common.RegisterEvent(EventArticleFavorited, FavoriteModel{})
+	common.RegisterEvent(EventArticleUnfavorited, FavoriteModel{})
+	common.RegisterEvent(EventCommentCreated, CommentModel{})
+	common.RegisterEvent(EventCommentEdited, CommentModel{})
+	common.RegisterEvent(EventCommentDeleted, CommentModel{})
+	common.RegisterEvent(EventReactionAdded, ReactionModel{})
+	common.RegisterEvent(EventReactionRemoved, ReactionModel{})
+	common.RegisterEvent(EventUserMentioned, MentionModel{})
+}
+
+// Migrate the schema of the articles package, the full-text index included. The error is the one
+// of the index, the backend it needs may be missing.
+func AutoMigrate() error {
+	db := common.GetDB()
+
+	db.AutoMigrate(&ArticleModel{})
+	db.AutoMigrate(&ArticleUserModel{})
+	db.AutoMigrate(&FavoriteModel{})
+	db.AutoMigrate(&TagModel{})
+	db.AutoMigrate(&TagAliasModel{})
+	db.AutoMigrate(&TagFollowModel{})
+	db.AutoMigrate(&CommentModel{})
+	db.AutoMigrate(&SlugHistoryModel{})
+	db.AutoMigrate(&CommentRevisionModel{})
+	db.AutoMigrate(&ReactionModel{})
+	db.AutoMigrate(&MentionModel{})
+	return MigrateSearchIndex(db)
 }
 
 func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
@@ -65,16 +153,12 @@ func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
 	return articleUserModel
 }
 
-func (article ArticleModel) favoritesCount() uint {
-	db := common.GetDB()
-	var count uint
-	db.Model(&FavoriteModel{}).Where(FavoriteModel{
-		FavoriteID: article.ID,
-	}).Count(&count)
-	return count
-}
-
+// Anonymous readers haven't favorited anything, their zero id would drop out of the query and
+// match anyone's favorite.
 func (article ArticleModel) isFavoriteBy(user ArticleUserModel) bool {
+	if user.ID == 0 {
+		return false
+	}
 	db := common.GetDB()
 	var favorite FavoriteModel
 	db.Where(FavoriteModel{
@@ -84,23 +168,84 @@ func (article ArticleModel) isFavoriteBy(user ArticleUserModel) bool {
 	return favorite.ID != 0
 }
 
-func (article ArticleModel) favoriteBy(user ArticleUserModel) error {
+// Favorite the article, the loaded FavoritesCount counts the new favorite.
+func (article *ArticleModel) favoriteBy(user ArticleUserModel) error {
 	db := common.GetDB()
+	tx := db.Begin()
 	var favorite FavoriteModel
-	err := db.FirstOrCreate(&favorite, &FavoriteModel{
+	query := tx.Where(&FavoriteModel{
 		FavoriteID:   article.ID,
 		FavoriteByID: user.ID,
-	}).Error
-	return err
+	}).First(&favorite)
+	if query.Error != nil && !query.RecordNotFound() {
+		tx.Rollback()
+		return query.Error
+	}
+	if favorite.ID != 0 {
+		return tx.Commit().Error
+	}
+	favorite = FavoriteModel{FavoriteID: article.ID, FavoriteByID: user.ID}
+	if err := tx.Create(&favorite).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := common.AdjustCounter(tx, "article_models", "id", article.ID, "favorites_count", 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	favorite.Favorite, favorite.FavoriteBy = *article, user
+	favorite.Favorite.FavoritesCount++
+	if err := common.Record(tx, common.Event{Name: EventArticleFavorited, Payload: favorite}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	article.FavoritesCount++
+	common.Dispatch()
+	return nil
 }
 
-func (article ArticleModel) unFavoriteBy(user ArticleUserModel) error {
+// Take the user's favorite back, the loaded FavoritesCount stops counting it.
+func (article *ArticleModel) unFavoriteBy(user ArticleUserModel) error {
 	db := common.GetDB()
-	err := db.Where(FavoriteModel{
+	tx := db.Begin()
+	deleted := tx.Where(FavoriteModel{
 		FavoriteID:   article.ID,
 		FavoriteByID: user.ID,
-	}).Delete(FavoriteModel{}).Error
-	return err
+	}).Delete(FavoriteModel{})
+	if deleted.Error != nil {
+		tx.Rollback()
+		return deleted.Error
+	}
+	if deleted.RowsAffected == 0 {
+		return tx.Commit().Error
+	}
+	err := common.AdjustCounter(tx, "article_models", "id", article.ID, "favorites_count", -deleted.RowsAffected)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	count := uint(0)
+	if article.FavoritesCount > uint(deleted.RowsAffected) {
+		count = article.FavoritesCount - uint(deleted.RowsAffected)
+	}
+	unfavorited := *article
+	unfavorited.FavoritesCount = count
+	err = common.Record(tx, common.Event{Name: EventArticleUnfavorited, Payload: FavoriteModel{
+		Favorite: unfavorited, FavoriteID: article.ID, FavoriteBy: user, FavoriteByID: user.ID,
+	}})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	article.FavoritesCount = count
+	common.Dispatch()
+	return nil
 }
 
 func SaveOne(data interface{}) error {
@@ -109,6 +254,74 @@ func SaveOne(data interface{}) error {
 	return err
 }
 
+// Build a slug from text which is not used by any other article, neither as its current slug
+// nor as a former one. Collisions get a numeric suffix: "my-title", "my-title-2", "my-title-3"...
+//
+//	slug := uniqueSlug("My Title", article.ID)
+func uniqueSlug(text string, articleID uint) string {
+	base := slug.Make(text)
+	if base == "" {
+		base = "article"
+	}
+	candidate := base
+	for i := 2; slugTaken(candidate, articleID); i++ {
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+	return candidate
+}
+
+// Route words next to /api/articles/:slug, an article with one of them as slug couldn't be reached.
+var reservedSlugs = map[string]bool{"search": true, "feed": true}
+
+func slugTaken(candidate string, articleID uint) bool {
+	if reservedSlugs[candidate] {
+		return true
+	}
+	db := common.GetDB()
+	var count int
+	// Soft deleted articles still hold their slug in the unique index.
+	db.Unscoped().Model(&ArticleModel{}).Where("slug = ? AND id <> ?", candidate, articleID).Count(&count)
+	if count > 0 {
+		return true
+	}
+	db.Model(&SlugHistoryModel{}).Where("slug = ? AND article_id <> ?", candidate, articleID).Count(&count)
+	return count > 0
+}
+
+// Remember oldSlug as a former slug of the article after it has been renamed to newSlug.
+func saveSlugHistory(articleID uint, oldSlug, newSlug string) error {
+	if oldSlug == newSlug || oldSlug == "" {
+		return nil
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	// Renaming back to a former slug makes it current again.
+	if err := tx.Unscoped().Where(SlugHistoryModel{Slug: newSlug, ArticleID: articleID}).Delete(SlugHistoryModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	var history SlugHistoryModel
+	if err := tx.FirstOrCreate(&history, SlugHistoryModel{Slug: oldSlug, ArticleID: articleID}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Find the current slug of an article which used to be reachable under a former slug.
+//
+//	currentSlug, err := findCurrentSlug("old-title")
+func findCurrentSlug(formerSlug string) (string, error) {
+	db := common.GetDB()
+	var history SlugHistoryModel
+	if err := db.Where(SlugHistoryModel{Slug: formerSlug}).First(&history).Error; err != nil {
+		return "", err
+	}
+	var model ArticleModel
+	err := db.Select("slug").Where("id = ?", history.ArticleID).First(&model).Error
+	return model.Slug, err
+}
+
 func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	db := common.GetDB()
 	var model ArticleModel
@@ -124,6 +337,19 @@ func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	return model, err
 }
 
+// The article with the slug, or the one which was published under it before getting a new slug.
+func FindArticleBySlug(slug string) (ArticleModel, error) {
+	model, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err == nil || !gorm.IsRecordNotFoundError(err) {
+		return model, err
+	}
+	currentSlug, err := findCurrentSlug(slug)
+	if err != nil {
+		return model, err
+	}
+	return FindOneArticle(&ArticleModel{Slug: currentSlug})
+}
+
 func (self *ArticleModel) getComments() error {
 	db := common.GetDB()
 	tx := db.Begin()
@@ -136,6 +362,118 @@ func (self *ArticleModel) getComments() error {
 	return err
 }
 
+// Position of a comment in an article's thread, comments are listed oldest first.
+type commentCursor struct {
+	Time time.Time `json:"t"`
+	ID   uint      `json:"i"`
+}
+
+// A CommentQuery selects one page of the comments of an article, by Offset or by a cursor in After / Before.
+type CommentQuery struct {
+	ArticleID uint
+	// The replies to this comment, or the top-level comments when it is 0.
+	ParentID uint
+	// How many levels of replies are loaded below each comment of the page.
+	Depth  int
+	Limit  int
+	Offset int
+	After  *commentCursor
+	Before *commentCursor
+}
+
+// One page of comments, with the cursors of the neighbouring pages if there are any.
+type CommentPage struct {
+	Comments   []CommentModel
+	Count      int
+	NextCursor string
+	PrevCursor string
+}
+
+func commentCursorFor(model CommentModel) string {
+	return common.EncodeCursor(commentCursor{Time: model.CreatedAt, ID: model.ID})
+}
+
+// Find one page of the comments of an article with their authors.
+//
+//	page, err := FindCommentPage(CommentQuery{ArticleID: article.ID, Limit: 20})
+func FindCommentPage(query CommentQuery) (CommentPage, error) {
+	db := common.GetDB()
+	var page CommentPage
+	var models []CommentModel
+
+	tx := db.Begin()
+	filtered := tx.Model(&CommentModel{}).Where("comment_models.article_id = ?", query.ArticleID)
+	if query.ParentID != 0 {
+		filtered = filtered.Where("comment_models.parent_id = ?", query.ParentID)
+	} else {
+		filtered = filtered.Where("comment_models.parent_id IS NULL")
+	}
+	if err := filtered.Count(&page.Count).Error; err != nil {
+		tx.Rollback()
+		return page, err
+	}
+	paged := filtered
+	switch {
+	case query.After != nil:
+		paged = paged.Where("comment_models.created_at > ? OR (comment_models.created_at = ? AND comment_models.id > ?)",
+			query.After.Time, query.After.Time, query.After.ID).
+			Order("comment_models.created_at ASC").Order("comment_models.id ASC")
+	case query.Before != nil:
+		paged = paged.Where("comment_models.created_at < ? OR (comment_models.created_at = ? AND comment_models.id < ?)",
+			query.Before.Time, query.Before.Time, query.Before.ID).
+			Order("comment_models.created_at DESC").Order("comment_models.id DESC")
+	default:
+		paged = paged.Order("comment_models.created_at ASC").Order("comment_models.id ASC").Offset(query.Offset)
+	}
+	if err := paged.Limit(query.Limit + 1).Find(&models).Error; err != nil {
+		tx.Rollback()
+		return page, err
+	}
+	more := len(models) > query.Limit
+	if more {
+		models = models[:query.Limit]
+	}
+	if query.Before != nil {
+		for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+			models[i], models[j] = models[j], models[i]
+		}
+	}
+	if len(models) > 0 {
+		first, last := models[0], models[len(models)-1]
+		switch {
+		case query.Before != nil:
+			page.NextCursor = commentCursorFor(last)
+			if more {
+				page.PrevCursor = commentCursorFor(first)
+			}
+		case query.After != nil:
+			page.PrevCursor = commentCursorFor(first)
+			if more {
+				page.NextCursor = commentCursorFor(last)
+			}
+		default:
+			if query.Offset > 0 {
+				page.PrevCursor = commentCursorFor(first)
+			}
+			if more {
+				page.NextCursor = commentCursorFor(last)
+			}
+		}
+	}
+
+	if err := preloadComments(tx, models); err != nil {
+		tx.Rollback()
+		return page, err
+	}
+	if err := loadReplies(tx, models, query.Depth); err != nil {
+		tx.Rollback()
+		return page, err
+	}
+	page.Comments = models
+	err := tx.Commit().Error
+	return page, err
+}
+
 func getAllTags() ([]TagModel, error) {
 	db := common.GetDB()
 	var models []TagModel
@@ -143,106 +481,337 @@ func getAllTags() ([]TagModel, error) {
 	return models, err
 }
 
-func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
-	var models []ArticleModel
-	var count int
+// Sort orders understood by ArticleQuery.
+const (
+	SortNewest    = "newest"
+	SortOldest    = "oldest"
+	SortFavorited = "favorited"
+	SortCommented = "commented"
+	SortUpdated   = "updated"
+)
 
-	offset_int, err := strconv.Atoi(offset)
+// Tag matching modes for ArticleQuery.Tags.
+const (
+	TagModeAny = "any"
+	TagModeAll = "all"
+)
+
+// An ArticleQuery describes which articles a list contains and in which order. All filters are combined,
+// empty ones are ignored:
+//
+//	models, count, err := FindArticles(ArticleQuery{Tags: []string{"go", "gin"}, TagMode: TagModeAll, Sort: SortFavorited, Limit: 20})
+//
+// Pages are addressed with Offset, or with a cursor handed out by a previous page in After / Before.
+type ArticleQuery struct {
+	Tags        []string
+	TagMode     string
+	ExcludeTags []string
+	Author      string
+	Favorited   string
+	// The feed of the user with this id: articles by the authors and with the tags they follow.
+	FollowedBy uint
+	// Only articles with at least this many favorites or comments.
+	MinFavorites uint
+	MinComments  uint
+	Since        time.Time
+	Until        time.Time
+	Sort         string
+	Limit        int
+	Offset       int
+	After        *articleCursor
+	Before       *articleCursor
+}
+
+// Position of an article in a list: the value of the sort key and the id which breaks ties.
+type articleCursor struct {
+	Sort  string    `json:"s"`
+	Time  time.Time `json:"t,omitempty"`
+	Count int       `json:"c,omitempty"`
+	ID    uint      `json:"i"`
+}
+
+// One page of articles, with the cursors of the neighbouring pages if there are any.
+type ArticlePage struct {
+	Articles   []ArticleModel
+	Count      int
+	NextCursor string
+	PrevCursor string
+}
+
+// Apply the filters to a query which has article_models in scope.
+func (q ArticleQuery) filter(tx *gorm.DB) *gorm.DB {
+	db := common.GetDB()
+	taggedWith := func(tags []string) *gorm.DB {
+		return db.Table("article_tags").
+			Select("article_tags.article_model_id").
+			Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+			Where("tag_models.tag IN (?)", tags)
+	}
+	// Tags are looked up by the tag their names stand for, aliases included
+	tags, err := resolveTags(db, q.Tags)
 	if err != nil {
-		offset_int = 0
+		tx.AddError(err)
 	}
-
-	limit_int, err := strconv.Atoi(limit)
+	excludeTags, err := resolveTags(db, q.ExcludeTags)
 	if err != nil {
-		limit_int = 20
+		tx.AddError(err)
+	}
+	if len(q.Tags) > 0 {
+		tagged := taggedWith(tags)
+		if q.TagMode == TagModeAll {
+			tagged = tagged.Group("article_tags.article_model_id").
+				Having("COUNT(DISTINCT tag_models.id) = ?", len(tags))
+		}
+		tx = tx.Where("article_models.id IN ?", tagged.SubQuery())
+	}
+	if len(excludeTags) > 0 {
+		tx = tx.Where("article_models.id NOT IN ?", taggedWith(excludeTags).SubQuery())
+	}
+	if q.Author != "" {
+		tx = tx.Where("article_models.author_id IN ?", db.Table("article_user_models").
+			Select("article_user_models.id").
+			Joins("JOIN user_models ON user_models.id = article_user_models.user_model_id").
+			Where("user_models.username = ?", q.Author).SubQuery())
+	}
+	if q.Favorited != "" {
+		tx = tx.Where("article_models.id IN ?", db.Table("favorite_models").
+			Select("favorite_models.favorite_id").
+			Joins("JOIN article_user_models ON article_user_models.id = favorite_models.favorite_by_id").
+			Joins("JOIN user_models ON user_models.id = article_user_models.user_model_id").
+			Where("favorite_models.deleted_at IS NULL AND user_models.username = ?", q.Favorited).SubQuery())
+	}
+	if q.FollowedBy != 0 {
+		// Articles by a followed author or with a followed tag, each once whichever way it matches
+		tx = tx.Where("article_models.author_id IN ? OR article_models.id IN ?", db.Table("article_user_models").
+			Select("article_user_models.id").
+			Joins("JOIN follow_models ON follow_models.following_id = article_user_models.user_model_id").
+			Where("follow_models.deleted_at IS NULL AND follow_models.followed_by_id = ?", q.FollowedBy).SubQuery(),
+			db.Table("article_tags").
+				Select("article_tags.article_model_id").
+				Joins("JOIN tag_follow_models ON tag_follow_models.tag_model_id = article_tags.tag_model_id").
+				Where("tag_follow_models.deleted_at IS NULL AND tag_follow_models.user_model_id = ?", q.FollowedBy).SubQuery())
+	}
+	if q.MinFavorites > 0 {
+		tx = tx.Where("article_models.favorites_count >= ?", q.MinFavorites)
+	}
+	if q.MinComments > 0 {
+		tx = tx.Where("article_models.comments_count >= ?", q.MinComments)
+	}
+	if !q.Since.IsZero() {
+		tx = tx.Where("article_models.created_at >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		tx = tx.Where("article_models.created_at <= ?", q.Until)
 	}
+	return tx
+}
+
+func (q ArticleQuery) sortName() string {
+	if q.Sort == "" {
+		return SortNewest
+	}
+	return q.Sort
+}
+
+// The expression a list is sorted by and whether it is descending, the id always breaks ties.
+func (q ArticleQuery) sortKey() (string, bool) {
+	switch q.sortName() {
+	case SortOldest:
+		return "article_models.created_at", false
+	case SortFavorited:
+		return "article_models.favorites_count", true
+	case SortCommented:
+		return "article_models.comments_count", true
+	case SortUpdated:
+		return "article_models.updated_at", true
+	default:
+		return "article_models.created_at", true
+	}
+}
+
+// Apply the sort order. Pages before a cursor are read in reverse and flipped back afterwards.
+func (q ArticleQuery) order(tx *gorm.DB) *gorm.DB {
+	key, desc := q.sortKey()
+	if q.Before != nil {
+		desc = !desc
+	}
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	return tx.Order(key + direction).Order("article_models.id" + direction)
+}
+
+// Keyset condition which only keeps the articles after (or before) a cursor in sort order.
+// Unlike an offset it doesn't shift when articles are added while a client is paging.
+func (q ArticleQuery) seek(tx *gorm.DB) *gorm.DB {
+	cursor := q.After
+	if cursor == nil {
+		cursor = q.Before
+	}
+	if cursor == nil {
+		return tx
+	}
+	key, desc := q.sortKey()
+	if q.Before != nil {
+		desc = !desc
+	}
+	comparison := " > "
+	if desc {
+		comparison = " < "
+	}
+	var value interface{} = cursor.Time
+	if q.sortName() == SortFavorited || q.sortName() == SortCommented {
+		value = cursor.Count
+	}
+	return tx.Where("("+key+comparison+"?) OR ("+key+" = ? AND article_models.id"+comparison+"?)", value, value, cursor.ID)
+}
+
+// The cursor pointing at an article within this query's sort order.
+func (q ArticleQuery) cursorFor(model ArticleModel) string {
+	cursor := articleCursor{Sort: q.sortName(), ID: model.ID}
+	switch cursor.Sort {
+	case SortFavorited:
+		cursor.Count = int(model.FavoritesCount)
+	case SortCommented:
+		cursor.Count = int(model.CommentsCount)
+	case SortUpdated:
+		cursor.Time = model.UpdatedAt
+	default:
+		cursor.Time = model.CreatedAt
+	}
+	return common.EncodeCursor(cursor)
+}
+
+// Find one page of the articles matching an ArticleQuery, how many articles match in total,
+// and the cursors of the pages around it.
+func FindArticlePage(query ArticleQuery) (ArticlePage, error) {
+	db := common.GetDB()
+	var page ArticlePage
+	var models []ArticleModel
 
 	tx := db.Begin()
-	if tag != "" {
-		var tagModel TagModel
-		tx.Where(TagModel{Tag: tag}).First(&tagModel)
-		if tagModel.ID != 0 {
-			tx.Model(&tagModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
-			count = tx.Model(&tagModel).Association("ArticleModels").Count()
-		}
-	} else if author != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: author}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
-
-		if articleUserModel.ID != 0 {
-			count = tx.Model(&articleUserModel).Association("ArticleModels").Count()
-			tx.Model(&articleUserModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
+	filtered := query.filter(tx.Model(&ArticleModel{}))
+	if err := filtered.Count(&page.Count).Error; err != nil {
+		tx.Rollback()
+		return page, err
+	}
+	paged := query.order(query.seek(filtered))
+	if query.After == nil && query.Before == nil {
+		paged = paged.Offset(query.Offset)
+	}
+	// One extra row tells whether there is another page in the direction we are reading.
+	if err := paged.Limit(query.Limit + 1).Find(&models).Error; err != nil {
+		tx.Rollback()
+		return page, err
+	}
+	more := len(models) > query.Limit
+	if more {
+		models = models[:query.Limit]
+	}
+	if query.Before != nil {
+		for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+			models[i], models[j] = models[j], models[i]
 		}
-	} else if favorited != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: favorited}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
-		if articleUserModel.ID != 0 {
-			var favoriteModels []FavoriteModel
-			tx.Where(FavoriteModel{
-				FavoriteByID: articleUserModel.ID,
-			}).Offset(offset_int).Limit(limit_int).Find(&favoriteModels)
-
-			count = tx.Model(&articleUserModel).Association("FavoriteModels").Count()
-			for _, favorite := range favoriteModels {
-				var model ArticleModel
-				tx.Model(&favorite).Related(&model, "Favorite")
-				models = append(models, model)
+	}
+
+	if len(models) > 0 {
+		first, last := models[0], models[len(models)-1]
+		switch {
+		case query.Before != nil:
+			page.NextCursor = query.cursorFor(last)
+			if more {
+				page.PrevCursor = query.cursorFor(first)
+			}
+		case query.After != nil:
+			page.PrevCursor = query.cursorFor(first)
+			if more {
+				page.NextCursor = query.cursorFor(last)
+			}
+		default:
+			if query.Offset > 0 {
+				page.PrevCursor = query.cursorFor(first)
+			}
+			if more {
+				page.NextCursor = query.cursorFor(last)
 			}
 		}
-	} else {
-		db.Model(&models).Count(&count)
-		db.Offset(offset_int).Limit(limit_int).Find(&models)
 	}
 
-	for i, _ := range models {
-		tx.Model(&models[i]).Related(&models[i].Author, "Author")
-		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
-		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
+	if err := preloadArticles(tx, models); err != nil {
+		tx.Rollback()
+		return page, err
 	}
-	err = tx.Commit().Error
-	return models, count, err
+	page.Articles = models
+	err := tx.Commit().Error
+	return page, err
 }
 
-func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
-	var models []ArticleModel
-	var count int
+// Find one page of the articles matching an ArticleQuery, and how many articles match in total.
+func FindArticles(query ArticleQuery) ([]ArticleModel, int, error) {
+	page, err := FindArticlePage(query)
+	return page.Articles, page.Count, err
+}
 
+// Parse the offset and limit of the legacy list parameters: invalid values fall back to the first page
+// of the default size, limits above the maximum are cut down.
+func offsetPage(limit, offset string) (int, int) {
 	offset_int, err := strconv.Atoi(offset)
-	if err != nil {
+	if err != nil || offset_int < 0 {
 		offset_int = 0
 	}
 	limit_int, err := strconv.Atoi(limit)
 	if err != nil {
-		limit_int = 20
+		limit_int = 0
 	}
+	return common.PageSize(limit_int), offset_int
+}
 
-	tx := db.Begin()
-	followings := self.UserModel.GetFollowings()
-	var articleUserModels []uint
-	for _, following := range followings {
-		articleUserModel := GetArticleUserModel(following)
-		articleUserModels = append(articleUserModels, articleUserModel.ID)
+func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
+	query := ArticleQuery{Author: author, Favorited: favorited}
+	if tag != "" {
+		query.Tags = []string{tag}
 	}
+	query.Limit, query.Offset = offsetPage(limit, offset)
+	return FindArticles(query)
+}
 
-	tx.Where("author_id in (?)", articleUserModels).Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
+// The articles written by the authors a user follows or tagged with the tags they follow, newest first.
+func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleModel, int, error) {
+	query := ArticleQuery{FollowedBy: self.UserModelID}
+	query.Limit, query.Offset = offsetPage(limit, offset)
+	return FindArticles(query)
+}
 
-	for i, _ := range models {
-		tx.Model(&models[i]).Related(&models[i].Author, "Author")
-		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
-		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
-	}
-	err = tx.Commit().Error
-	return models, count, err
+// The user model ids of the users whose feed has the article, the followers of its author and of its
+// tags, each once. Tags are stored resolved, so the followers of an alias follow the tag it stands for.
+func FeedReaders(article ArticleModel) ([]uint, error) {
+	db := common.GetDB()
+	var readers []uint
+	err := db.Raw(`SELECT follow_models.followed_by_id FROM follow_models
+			JOIN article_user_models ON article_user_models.user_model_id = follow_models.following_id
+			WHERE follow_models.deleted_at IS NULL AND article_user_models.id = ?
+		UNION
+		SELECT tag_follow_models.user_model_id FROM tag_follow_models
+			JOIN article_tags ON article_tags.tag_model_id = tag_follow_models.tag_model_id
+			WHERE tag_follow_models.deleted_at IS NULL AND article_tags.article_model_id = ?`, article.AuthorID, article.ID).
+		Pluck("followed_by_id", &readers).Error
+	return readers, err
 }
 
+// Tag the article with the tags names stand for, see resolveTags. Tags refused by checkTags leave
+// the article's tags as they were.
 func (model *ArticleModel) setTags(tags []string) error {
+	if err := checkTags(tags); err != nil {
+		return err
+	}
 	db := common.GetDB()
+	names, err := resolveTags(db, tags)
+	if err != nil {
+		return err
+	}
 	var tagList []TagModel
-	for _, tag := range tags {
+	for _, tag := range names {
 		var tagModel TagModel
 		err := db.FirstOrCreate(&tagModel, TagModel{Tag: tag}).Error
 		if err != nil {
@@ -255,19 +824,445 @@ func (model *ArticleModel) setTags(tags []string) error {
 }
 
 func (model *ArticleModel) Update(data interface{}) error {
+	return model.update(data, false)
+}
+
+// Update the article unless it was written since it was loaded, for writes made with If-Match.
+// The row is only updated while its updated_at is still the loaded one, otherwise
+// common.ErrPreconditionFailed is returned.
+func (model *ArticleModel) UpdateUnmodified(data interface{}) error {
+	return model.update(data, true)
+}
+
+// The version of the article for If-Match, the body is left alone by favorites, comments and reactions.
+func (model ArticleModel) Version() string {
+	return common.Version(model.ID, model.UpdatedAt.UnixNano())
+}
+
+// How often a write picks the next slug when the one it picked was taken in the meantime.
+const slugAttempts = 5
+
+// A slug taken by a concurrent write between uniqueSlug and the insert or update. The slug is the only
+// unique column of article_models besides the id.
+func slugConflict(err error) bool {
+	return common.IsUniqueViolation(err) && strings.Contains(err.Error(), "slug")
+}
+
+func (model *ArticleModel) update(data interface{}, unmodified bool) error {
+	loaded := *model
+	for attempt := 1; ; attempt++ {
+		err := model.tryUpdate(data, unmodified)
+		changed, ok := data.(ArticleModel)
+		if !ok || !slugConflict(err) || attempt == slugAttempts {
+			return err
+		}
+		// The failed update may have changed the loaded fields, updated_at included
+		*model = loaded
+		changed.Slug = uniqueSlug(changed.Slug, model.ID)
+		data = changed
+	}
+}
+
+func (model *ArticleModel) tryUpdate(data interface{}, unmodified bool) error {
 	db := common.GetDB()
-	err := db.Model(model).Update(data).Error
-	return err
+	tx := db.Begin()
+	loaded := model.UpdatedAt
+	query := tx.Model(model)
+	if unmodified {
+		query = query.Where("updated_at = ?", loaded)
+	}
+	result := query.Update(data)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if unmodified && result.RowsAffected == 0 {
+		// Nothing is written when nothing changed, the precondition fails only when the row did
+		var count int
+		if err := tx.Model(&ArticleModel{}).Where("id = ? AND updated_at = ?", model.ID, loaded).Count(&count).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if count == 0 {
+			tx.Rollback()
+			return common.ErrPreconditionFailed
+		}
+	}
+	if err := recordMentions(tx, *model, MentionInArticle, model.ID, model.Author, model.mentioned); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := common.Record(tx, common.Event{Name: EventArticleUpdated, Payload: *model}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Save a new article and count it for its author. A slug taken since it was picked is replaced by the
+// next free one.
+func CreateArticle(model *ArticleModel) error {
+	for attempt := 1; ; attempt++ {
+		err := createArticle(model)
+		if !slugConflict(err) || attempt == slugAttempts {
+			return err
+		}
+		model.ID = 0
+		model.Slug = uniqueSlug(model.Slug, 0)
+	}
+}
+
+func createArticle(model *ArticleModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Save(model).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := common.AdjustCounter(tx, "article_user_models", "id", model.AuthorID, "articles_count", 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := recordMentions(tx, *model, MentionInArticle, model.ID, model.Author, model.mentioned); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := common.Record(tx, common.Event{Name: EventArticleCreated, Payload: *model}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Save a new comment and count it for its article, and for the comment it replies to.
+func CreateComment(model *CommentModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Save(model).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := common.AdjustCounter(tx, "article_models", "id", model.ArticleID, "comments_count", 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if model.ParentID != nil {
+		if err := common.AdjustCounter(tx, "comment_models", "id", *model.ParentID, "replies_count", 1); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := recordMentions(tx, model.Article, MentionInComment, model.ID, model.Author, model.mentioned); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := common.Record(tx, common.Event{Name: EventCommentCreated, Payload: *model}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// How long after posting a comment its author may still edit it.
+var CommentEditWindow = 15 * time.Minute
+
+// Whether the author may still edit the comment, tombstones can't be edited at all.
+func (model CommentModel) editable(now time.Time) bool {
+	return model.RemovedAt == nil && now.Before(model.CreatedAt.Add(CommentEditWindow))
+}
+
+// Replace the body of a comment and its mentions, and keep the previous body as a revision.
+//
+//	err := commentModel.edit(body, common.RenderMarkdown(body), mentioned)
+func (model *CommentModel) edit(body, bodyHTML string, mentioned []users.UserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	revision := CommentRevisionModel{CommentID: model.ID, Body: model.Body, BodyHTML: model.BodyHTML}
+	if err := tx.Create(&revision).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	err := tx.Model(model).Updates(map[string]interface{}{"body": body, "body_html": bodyHTML, "edited_at": now}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	model.Body, model.BodyHTML, model.EditedAt = body, bodyHTML, &now
+	if mentioned != nil {
+		var article ArticleModel
+		var author ArticleUserModel
+		if err := tx.First(&article, model.ArticleID).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.First(&author, model.AuthorID).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := recordMentions(tx, article, MentionInComment, model.ID, author, mentioned); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := common.Record(tx, common.Event{Name: EventCommentEdited, Payload: *model}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// The earlier versions of a comment, the most recently replaced first.
+func (model CommentModel) revisions() ([]CommentRevisionModel, error) {
+	db := common.GetDB()
+	var revisions []CommentRevisionModel
+	err := db.Where(&CommentRevisionModel{CommentID: model.ID}).Order("created_at DESC").Order("id DESC").Find(&revisions).Error
+	return revisions, err
+}
+
+// Find the comment of an article a reply answers, tombstones can't be replied to.
+func findReplyParent(articleID, parentID uint) (CommentModel, error) {
+	db := common.GetDB()
+	var parent CommentModel
+	err := db.Where("id = ? AND article_id = ? AND removed_at IS NULL", parentID, articleID).First(&parent).Error
+	return parent, err
+}
+
+// Remove a comment from its thread. A comment with replies becomes a tombstone so its replies keep their
+// place, one without is deleted. A tombstone is deleted along with its last reply.
+//
+//	err := RemoveComment(commentModel)
+func RemoveComment(model CommentModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.First(&model, model.ID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	removed := model
+	removed.Body, removed.BodyHTML, removed.RemovedAt = "", "", &now
+	if err := common.AdjustCounter(tx, "article_models", "id", model.ArticleID, "comments_count", -1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if model.RepliesCount > 0 {
+		err := tx.Model(&model).UpdateColumns(map[string]interface{}{
+			"body": "", "body_html": "", "removed_at": now,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := deleteMentions(tx, MentionInComment, []uint{model.ID}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return commentRemoved(tx, removed)
+	}
+	for {
+		if err := tx.Delete(&model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := deleteReactions(tx, ReactionTargetComment, []uint{model.ID}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := deleteMentions(tx, MentionInComment, []uint{model.ID}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if model.ParentID == nil {
+			break
+		}
+		if err := common.AdjustCounter(tx, "comment_models", "id", *model.ParentID, "replies_count", -1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		var parent CommentModel
+		if err := tx.First(&parent, *model.ParentID).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if parent.RemovedAt == nil || parent.RepliesCount > 0 {
+			break
+		}
+		model = parent
+	}
+	return commentRemoved(tx, removed)
+}
+
+// Record the removal of a comment with it, and dispatch the event once it is committed.
+func commentRemoved(tx *gorm.DB, removed CommentModel) error {
+	if err := common.Record(tx, common.Event{Name: EventCommentDeleted, Payload: removed}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Load the replies below the comments, depth levels deep, with one round of queries per level.
+// Replies are ordered oldest first, RepliesCount tells about the ones below the last level.
+func loadReplies(tx *gorm.DB, models []CommentModel, depth int) error {
+	if depth <= 0 || len(models) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(models))
+	for _, model := range models {
+		if model.RepliesCount > 0 {
+			ids = append(ids, model.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var replies []CommentModel
+	err := tx.Where("parent_id IN (?)", ids).
+		Order("comment_models.created_at ASC").Order("comment_models.id ASC").
+		Find(&replies).Error
+	if err != nil {
+		return err
+	}
+	if err := preloadComments(tx, replies); err != nil {
+		return err
+	}
+	if err := loadReplies(tx, replies, depth-1); err != nil {
+		return err
+	}
+	byParent := map[uint][]CommentModel{}
+	for _, reply := range replies {
+		byParent[*reply.ParentID] = append(byParent[*reply.ParentID], reply)
+	}
+	for i := range models {
+		models[i].Replies = byParent[models[i].ID]
+	}
+	return nil
 }
 
 func DeleteArticleModel(condition interface{}) error {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(ArticleModel{}).Error
-	return err
+	tx := db.Begin()
+	var models []ArticleModel
+	if err := tx.Where(condition).Find(&models).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where(condition).Delete(ArticleModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	ids := make([]uint, 0, len(models))
+	for _, model := range models {
+		ids = append(ids, model.ID)
+	}
+	if err := deleteReactions(tx, ReactionTargetArticle, ids); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := deleteMentions(tx, MentionInArticle, ids); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, model := range models {
+		if err := common.AdjustCounter(tx, "article_user_models", "id", model.AuthorID, "articles_count", -1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := common.Record(tx, common.Event{Name: EventArticleDeleted, Payload: model}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
 }
 
+// Delete comments outright, replies included in the condition or not. RemoveComment keeps threads intact.
 func DeleteCommentModel(condition interface{}) error {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(CommentModel{}).Error
-	return err
+	tx := db.Begin()
+	var models []CommentModel
+	if err := tx.Where(condition).Find(&models).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where(condition).Delete(CommentModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	ids := make([]uint, 0, len(models))
+	for _, model := range models {
+		ids = append(ids, model.ID)
+	}
+	if err := deleteReactions(tx, ReactionTargetComment, ids); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := deleteMentions(tx, MentionInComment, ids); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, model := range models {
+		if model.RemovedAt == nil {
+			if err := common.AdjustCounter(tx, "article_models", "id", model.ArticleID, "comments_count", -1); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if model.ParentID != nil {
+			if err := common.AdjustCounter(tx, "comment_models", "id", *model.ParentID, "replies_count", -1); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Recompute the favorites and comments counts of every article and the articles count of every author.
+//
+//	err := articles.ReconcileCounters(db)
+func ReconcileCounters(db *gorm.DB) error {
+	tx := db.Begin()
+	statements := []string{
+		`UPDATE article_models SET
+			favorites_count = (SELECT COUNT(*) FROM favorite_models WHERE favorite_models.favorite_id = article_models.id AND favorite_models.deleted_at IS NULL),
+			comments_count = (SELECT COUNT(*) FROM comment_models WHERE comment_models.article_id = article_models.id
+				AND comment_models.deleted_at IS NULL AND comment_models.removed_at IS NULL)`,
+		`UPDATE comment_models SET
+			replies_count = (SELECT COUNT(*) FROM comment_models AS replies WHERE replies.parent_id = comment_models.id AND replies.deleted_at IS NULL)`,
+		`UPDATE article_user_models SET
+			articles_count = (SELECT COUNT(*) FROM article_models WHERE article_models.author_id = article_user_models.id AND article_models.deleted_at IS NULL)`,
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
 }
@@ -0,0 +1,255 @@
+package articles
+
+import (
+	"errors"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// The emoji users can react with, in the order responses list them. Set REACTION_EMOJIS to change it.
+var ReactionEmojis = []string{"👍", "👎", "😄", "🎉", "😕", "❤️", "🚀", "👀"}
+
+// What a reaction was given to.
+const (
+	ReactionTargetArticle = "article"
+	ReactionTargetComment = "comment"
+)
+
+// Reaction events carry the ReactionModel with ReactedBy and Article filled in, for comment reactions
+// Article is the article of the comment.
+const (
+	EventReactionAdded   = "reaction.added"
+	EventReactionRemoved = "reaction.removed"
+)
+
+var ErrUnknownReaction = errors.New("unknown reaction")
+
+// One user's emoji on an article or a comment. Like a favorite, a user reacts with an emoji once.
+type ReactionModel struct {
+	gorm.Model
+	TargetType  string `gorm:"index:idx_reaction_target"`
+	TargetID    uint   `gorm:"index:idx_reaction_target"`
+	Emoji       string
+	ReactedBy   ArticleUserModel `gorm:"association_autoupdate:false"`
+	ReactedByID uint
+	Article     ArticleModel `gorm:"-"`
+}
+
+func isReactionEmoji(emoji string) bool {
+	for _, known := range ReactionEmojis {
+		if known == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the reaction unless the user already reacted with the emoji. article is the article reacted to,
+// or the article of the comment reacted to.
+//
+//	err := addReaction(article, ReactionTargetComment, comment.ID, GetArticleUserModel(myUserModel), "🎉")
+func addReaction(article ArticleModel, targetType string, targetID uint, user ArticleUserModel, emoji string) error {
+	if !isReactionEmoji(emoji) {
+		return ErrUnknownReaction
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	reaction := ReactionModel{TargetType: targetType, TargetID: targetID, Emoji: emoji, ReactedByID: user.ID}
+	var existing ReactionModel
+	query := tx.Where(&reaction).First(&existing)
+	if query.Error != nil && !query.RecordNotFound() {
+		tx.Rollback()
+		return query.Error
+	}
+	if existing.ID != 0 {
+		return tx.Commit().Error
+	}
+	if err := tx.Create(&reaction).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	reaction.ReactedBy, reaction.Article = user, article
+	if err := common.Record(tx, common.Event{Name: EventReactionAdded, Payload: reaction}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Remove the reaction, removing one which doesn't exist is fine.
+func removeReaction(article ArticleModel, targetType string, targetID uint, user ArticleUserModel, emoji string) error {
+	if !isReactionEmoji(emoji) {
+		return ErrUnknownReaction
+	}
+	reaction := ReactionModel{TargetType: targetType, TargetID: targetID, Emoji: emoji, ReactedByID: user.ID}
+	tx := common.GetDB().Begin()
+	deleted := tx.Where(reaction).Delete(ReactionModel{})
+	if deleted.Error != nil || deleted.RowsAffected == 0 {
+		tx.Rollback()
+		return deleted.Error
+	}
+	reaction.ReactedBy, reaction.Article = user, article
+	if err := common.Record(tx, common.Event{Name: EventReactionRemoved, Payload: reaction}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Drop the reactions to deleted articles or comments.
+func deleteReactions(tx *gorm.DB, targetType string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Where("target_type = ? AND target_id IN (?)", targetType, ids).Delete(ReactionModel{}).Error
+}
+
+// How often an emoji was given to one article or comment, and whether the current user gave it.
+type reactionCount struct {
+	Emoji   string
+	Count   uint
+	Reacted bool
+}
+
+// Count the reactions to the targets by emoji, with one query for the counts and one for the emoji
+// the user gave. userID is the user model id, 0 for anonymous users.
+// Emoji nobody reacted with are left out, the others are in ReactionEmojis order.
+func findReactionCounts(tx *gorm.DB, targetType string, ids []uint, userID uint) (map[uint][]reactionCount, error) {
+	counts := make(map[uint][]reactionCount, len(ids))
+	if len(ids) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		TargetID uint
+		Emoji    string
+		Count    uint
+	}
+	err := tx.Model(&ReactionModel{}).
+		Select("target_id, emoji, COUNT(*) AS count").
+		Where("target_type = ? AND target_id IN (?)", targetType, ids).
+		Group("target_id, emoji").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	byTarget := map[uint]map[string]uint{}
+	for _, row := range rows {
+		if byTarget[row.TargetID] == nil {
+			byTarget[row.TargetID] = map[string]uint{}
+		}
+		byTarget[row.TargetID][row.Emoji] = row.Count
+	}
+
+	mine := map[uint]map[string]bool{}
+	if userID != 0 && len(rows) > 0 {
+		var reactions []ReactionModel
+		err := tx.Joins("JOIN article_user_models ON article_user_models.id = reaction_models.reacted_by_id").
+			Where("article_user_models.user_model_id = ? AND reaction_models.target_type = ? AND reaction_models.target_id IN (?)", userID, targetType, ids).
+			Find(&reactions).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, reaction := range reactions {
+			if mine[reaction.TargetID] == nil {
+				mine[reaction.TargetID] = map[string]bool{}
+			}
+			mine[reaction.TargetID][reaction.Emoji] = true
+		}
+	}
+
+	for _, id := range ids {
+		counts[id] = []reactionCount{}
+		for _, emoji := range ReactionEmojis {
+			if count := byTarget[id][emoji]; count > 0 {
+				counts[id] = append(counts[id], reactionCount{emoji, count, mine[id][emoji]})
+			}
+		}
+	}
+	return counts, nil
+}
+
+// Who reacted to an article or comment, oldest first, optionally with one emoji only.
+// Returns the page of reactions with ReactedBy loaded and the number of reactions in all pages.
+func findReactions(targetType string, targetID uint, emoji string, limit, offset int) ([]ReactionModel, int, error) {
+	db := common.GetDB()
+	tx := db.Model(&ReactionModel{}).Where("target_type = ? AND target_id = ?", targetType, targetID)
+	if emoji != "" {
+		tx = tx.Where("emoji = ?", emoji)
+	}
+	var count int
+	if err := tx.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	var reactions []ReactionModel
+	if err := tx.Order("id").Limit(limit).Offset(offset).Find(&reactions).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(reactions) == 0 {
+		return reactions, count, nil
+	}
+	ids := make([]uint, 0, len(reactions))
+	for _, reaction := range reactions {
+		ids = append(ids, reaction.ReactedByID)
+	}
+	reactedBy, err := findArticleUsers(db, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range reactions {
+		reactions[i].ReactedBy = reactedBy[reactions[i].ReactedByID]
+	}
+	return reactions, count, nil
+}
+
+// Reaction counts of articles and comments, loaded by the list serializers and kept in the gin context
+// by target type and id.
+const reactionStateKey = "reaction_state"
+
+type reactionState map[string]map[uint][]reactionCount
+
+// Load the reaction counts of a page of articles or comments for the current user.
+func loadReactionState(c *gin.Context, targetType string, ids []uint) {
+	state := reactionState{}
+	if loaded, ok := c.Get(reactionStateKey); ok {
+		state = loaded.(reactionState)
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	counts, err := findReactionCounts(common.GetDB(), targetType, ids, myUserModel.ID)
+	if err != nil {
+		return
+	}
+	if state[targetType] == nil {
+		state[targetType] = map[uint][]reactionCount{}
+	}
+	for id, count := range counts {
+		state[targetType][id] = count
+	}
+	c.Set(reactionStateKey, state)
+}
+
+// The reaction counts of an article or comment, preloaded or queried on their own.
+func reactionCountsOf(c *gin.Context, targetType string, id uint) []reactionCount {
+	if loaded, ok := c.Get(reactionStateKey); ok {
+		if counts, ok := loaded.(reactionState)[targetType][id]; ok {
+			return counts
+		}
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	counts, err := findReactionCounts(common.GetDB(), targetType, []uint{id}, myUserModel.ID)
+	if err != nil {
+		return []reactionCount{}
+	}
+	return counts[id]
+}
@@ -2,11 +2,16 @@ package articles
 
 import (
 	"errors"
-	"realworld-backend/common"
-	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"realworld-backend/common"
+	"realworld-backend/users"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
 )
 
 func ArticlesRegister(router *gin.RouterGroup) {
@@ -16,67 +21,182 @@ func ArticlesRegister(router *gin.RouterGroup) {
 	router.POST("/:slug/favorite", ArticleFavorite)
 	router.DELETE("/:slug/favorite", ArticleUnfavorite)
 	router.POST("/:slug/comments", ArticleCommentCreate)
+	router.PUT("/:slug/comments/:id", ArticleCommentUpdate)
 	router.DELETE("/:slug/comments/:id", ArticleCommentDelete)
+	router.GET("/:slug/comments/:id/revisions", ArticleCommentRevisions)
+	router.POST("/:slug/reactions/:emoji", ArticleReactionAdd)
+	router.DELETE("/:slug/reactions/:emoji", ArticleReactionRemove)
+	router.POST("/:slug/comments/:id/reactions/:emoji", ArticleCommentReactionAdd)
+	router.DELETE("/:slug/comments/:id/reactions/:emoji", ArticleCommentReactionRemove)
+}
+
+// Routes below /api/user for the current user.
+func MentionsRegister(router *gin.RouterGroup) {
+	router.GET("/mentions", MentionList)
+}
+
+// Routes below /api/user for the tags the current user follows.
+func FollowedTagsRegister(router *gin.RouterGroup) {
+	router.GET("/tags", FollowedTagList)
 }
 
 func ArticlesAnonymousRegister(router *gin.RouterGroup) {
 	router.GET("/", ArticleList)
+	router.GET("/search", ArticleSearch)
 	router.GET("/:slug", ArticleRetrieve)
 	router.GET("/:slug/comments", ArticleCommentList)
+	router.GET("/:slug/comments/:id/replies", ArticleCommentReplies)
+	router.GET("/:slug/reactions", ArticleReactionList)
+	router.GET("/:slug/comments/:id/reactions", ArticleCommentReactionList)
 }
 
 func TagsAnonymousRegister(router *gin.RouterGroup) {
 	router.GET("/", TagList)
+	router.GET("/:tag", TagRetrieve)
+}
+
+// Following tags, and tag management which only admins are allowed.
+func TagsRegister(router *gin.RouterGroup) {
+	router.POST("/:tag/follow", TagFollow)
+	router.DELETE("/:tag/follow", TagUnfollow)
+	router.PUT("/:tag", TagUpdate)
+	router.POST("/:tag/merge", TagMerge)
+	router.POST("/:tag/aliases", TagAliasAdd)
+	router.DELETE("/:tag/aliases/:alias", TagAliasRemove)
 }
 
 func ArticleCreate(c *gin.Context) {
 	articleModelValidator := NewArticleModelValidator()
 	if err := articleModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		c.JSON(http.StatusUnprocessableEntity, bindError("article", err))
 		return
 	}
 	//fmt.Println(articleModelValidator.articleModel.Author.UserModel)
 
-	if err := SaveOne(&articleModelValidator.articleModel); err != nil {
+	if err := CreateArticle(&articleModelValidator.articleModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	if !articleStateLoaded(c, articleModelValidator.articleModel) {
+		return
+	}
 	serializer := ArticleSerializer{c, articleModelValidator.articleModel}
 	c.JSON(http.StatusCreated, gin.H{"article": serializer.Response()})
 }
 
+// Load what the responses of the articles need, see loadArticleState, or answer why it can't be loaded.
+func articleStateLoaded(c *gin.Context, models ...ArticleModel) bool {
+	if err := loadArticleState(c, models); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return false
+	}
+	return true
+}
+
 func ArticleList(c *gin.Context) {
-	//condition := ArticleModel{}
-	tag := c.Query("tag")
-	author := c.Query("author")
-	favorited := c.Query("favorited")
-	limit := c.Query("limit")
-	offset := c.Query("offset")
-	articleModels, modelCount, err := FindManyArticle(tag, author, limit, offset, favorited)
+	articleListValidator := NewArticleListValidator()
+	if err := articleListValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	page, err := FindArticlePage(articleListValidator.query)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
+		return
+	}
+	if !articleStateLoaded(c, page.Articles...) {
+		return
+	}
+	serializer := ArticlesSerializer{c, page.Articles}
+	common.JSONWithETag(c, http.StatusOK, gin.H{
+		"articles":      serializer.Response(),
+		"articlesCount": page.Count,
+		"nextCursor":    cursorOrNull(page.NextCursor),
+		"prevCursor":    cursorOrNull(page.PrevCursor),
+	})
+}
+
+// Lists answer with null when there is no page in a direction.
+func cursorOrNull(cursor string) interface{} {
+	if cursor == "" {
+		return nil
+	}
+	return cursor
+}
+
+// Query strings fail to bind either on a validation rule or on a value which can't be parsed.
+func queryError(err error) common.CommonError {
+	if _, ok := err.(validator.ValidationErrors); ok {
+		return common.NewValidatorError(err)
+	}
+	return common.NewError("query", err)
+}
+
+// Binding an article or a comment fails on its fields, on its tags or on the users it mentions. Anything
+// else, like a body which isn't JSON, is reported under key.
+func bindError(key string, err error) common.CommonError {
+	if _, ok := err.(validator.ValidationErrors); ok {
+		return common.NewValidatorError(err)
+	}
+	if errors.Is(err, ErrInvalidTag) || errors.Is(err, ErrTagTooLong) || errors.Is(err, ErrTooManyTags) {
+		return common.NewError("tagList", err)
+	}
+	if errors.Is(err, ErrUnknownMention) {
+		return common.NewError("body", err)
+	}
+	return common.NewError(key, err)
+}
+
+func ArticleSearch(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("q", errors.New("can't be blank")))
+		return
+	}
+	articleListValidator := NewArticleListValidator()
+	if err := articleListValidator.BindSearch(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	articleModels, hits, modelCount, err := SearchArticles(q, articleListValidator.query)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
 	}
-	serializer := ArticlesSerializer{c, articleModels}
+	if !articleStateLoaded(c, articleModels...) {
+		return
+	}
+	serializer := SearchResultsSerializer{c, articleModels, hits}
 	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
 }
 
 func ArticleFeed(c *gin.Context) {
-	limit := c.Query("limit")
-	offset := c.Query("offset")
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 	if myUserModel.ID == 0 {
 		c.AbortWithError(http.StatusUnauthorized, errors.New("{error : \"Require auth!\"}"))
 		return
 	}
-	articleUserModel := GetArticleUserModel(myUserModel)
-	articleModels, modelCount, err := articleUserModel.GetArticleFeed(limit, offset)
+	articleListValidator := NewArticleListValidator()
+	if err := articleListValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	articleListValidator.query.FollowedBy = myUserModel.ID
+	page, err := FindArticlePage(articleListValidator.query)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
 	}
-	serializer := ArticlesSerializer{c, articleModels}
-	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
+	if !articleStateLoaded(c, page.Articles...) {
+		return
+	}
+	serializer := ArticlesSerializer{c, page.Articles}
+	common.JSONWithETag(c, http.StatusOK, gin.H{
+		"articles":      serializer.Response(),
+		"articlesCount": page.Count,
+		"nextCursor":    cursorOrNull(page.NextCursor),
+		"prevCursor":    cursorOrNull(page.PrevCursor),
+	})
 }
 
 func ArticleRetrieve(c *gin.Context) {
@@ -85,13 +205,45 @@ func ArticleRetrieve(c *gin.Context) {
 		ArticleFeed(c)
 		return
 	}
+	// Anonymous readers share one cached response, signed in readers see their own favorited and following state.
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if myUserModel.ID == 0 {
+		common.ServeCachedJSON(c, articleCacheKey(slug, wantsBodyHTML(c)), ArticleCacheTTL, func() (int, interface{}) {
+			_, status, response := retrieveArticle(c, slug)
+			return status, response
+		})
+		return
+	}
+	// Only signed in readers can edit, their ETag carries the version If-Match compares
+	articleModel, status, response := retrieveArticle(c, slug)
+	common.JSONWithVersion(c, status, articleModel.Version(), response)
+}
+
+func retrieveArticle(c *gin.Context, slug string) (ArticleModel, int, interface{}) {
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err == nil {
+		if err := loadArticleState(c, []ArticleModel{articleModel}); err != nil {
+			return articleModel, http.StatusUnprocessableEntity, common.NewError("database", err)
+		}
+		serializer := ArticleSerializer{c, articleModel}
+		return articleModel, http.StatusOK, gin.H{"article": serializer.Response()}
+	}
+	// A former slug of a renamed article answers with a redirect to the current one,
+	// the body carries the article too so clients which don't follow redirects can use it as an alias.
+	currentSlug, err := findCurrentSlug(slug)
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
-		return
+		return articleModel, http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug"))
 	}
+	articleModel, err = FindOneArticle(&ArticleModel{Slug: currentSlug})
+	if err != nil {
+		return articleModel, http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug"))
+	}
+	if err := loadArticleState(c, []ArticleModel{articleModel}); err != nil {
+		return articleModel, http.StatusUnprocessableEntity, common.NewError("database", err)
+	}
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, slug)+currentSlug)
 	serializer := ArticleSerializer{c, articleModel}
-	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+	return articleModel, http.StatusMovedPermanently, gin.H{"article": serializer.Response()}
 }
 
 func ArticleUpdate(c *gin.Context) {
@@ -101,24 +253,51 @@ func ArticleUpdate(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
+	// If-Match takes the ETag of GET /api/articles/:slug, the write checks the version again
+	// so an edit made in between isn't overwritten.
+	conditional := c.GetHeader("If-Match") != ""
+	if !common.CheckIfMatch(c, articleModel.Version) {
+		return
+	}
 	articleModelValidator := NewArticleModelValidatorFillWith(articleModel)
 	if err := articleModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		c.JSON(http.StatusUnprocessableEntity, bindError("article", err))
 		return
 	}
 
 	articleModelValidator.articleModel.ID = articleModel.ID
-	if err := articleModel.Update(articleModelValidator.articleModel); err != nil {
+	articleModel.mentioned = articleModelValidator.articleModel.mentioned
+	oldSlug := articleModel.Slug
+	update := articleModel.Update
+	if conditional {
+		update = articleModel.UpdateUnmodified
+	}
+	if err := update(articleModelValidator.articleModel); errors.Is(err, common.ErrPreconditionFailed) {
+		common.PreconditionFailed(c)
+		return
+	} else if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	if err := saveSlugHistory(articleModel.ID, oldSlug, articleModel.Slug); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if !articleStateLoaded(c, articleModel) {
+		return
+	}
 	serializer := ArticleSerializer{c, articleModel}
-	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+	common.JSONWithVersion(c, http.StatusOK, articleModel.Version(), gin.H{"article": serializer.Response()})
 }
 
 func ArticleDelete(c *gin.Context) {
 	slug := c.Param("slug")
-	err := DeleteArticleModel(&ArticleModel{Slug: slug})
+	_, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	err = DeleteArticleModel(&ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
@@ -134,7 +313,13 @@ func ArticleFavorite(c *gin.Context) {
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-	err = articleModel.favoriteBy(GetArticleUserModel(myUserModel))
+	if err := articleModel.favoriteBy(GetArticleUserModel(myUserModel)); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if !articleStateLoaded(c, articleModel) {
+		return
+	}
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
@@ -147,7 +332,13 @@ func ArticleUnfavorite(c *gin.Context) {
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-	err = articleModel.unFavoriteBy(GetArticleUserModel(myUserModel))
+	if err := articleModel.unFavoriteBy(GetArticleUserModel(myUserModel)); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if !articleStateLoaded(c, articleModel) {
+		return
+	}
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
@@ -161,12 +352,18 @@ func ArticleCommentCreate(c *gin.Context) {
 	}
 	commentModelValidator := NewCommentModelValidator()
 	if err := commentModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		c.JSON(http.StatusUnprocessableEntity, bindError("comment", err))
 		return
 	}
 	commentModelValidator.commentModel.Article = articleModel
+	if parentID := commentModelValidator.commentModel.ParentID; parentID != nil {
+		if _, err := findReplyParent(articleModel.ID, *parentID); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("parentId", errors.New("no comment to reply to")))
+			return
+		}
+	}
 
-	if err := SaveOne(&commentModelValidator.commentModel); err != nil {
+	if err := CreateComment(&commentModelValidator.commentModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -174,15 +371,96 @@ func ArticleCommentCreate(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{"comment": serializer.Response()})
 }
 
-func ArticleCommentDelete(c *gin.Context) {
+// Load the comment :id of the article :slug, answering 404 when either doesn't exist or the comment
+// belongs to another article. ok is false once the error response is written.
+func findArticleComment(c *gin.Context) (articleModel ArticleModel, commentModel CommentModel, ok bool) {
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
 	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	id := uint(id64)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
-	err = DeleteCommentModel([]uint{id})
+	if err := common.GetDB().Where("id = ? AND article_id = ?", uint(id64), articleModel.ID).First(&commentModel).Error; err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	return articleModel, commentModel, true
+}
+
+// Like findArticleComment for handlers changing the comment: besides its author only moderators, and
+// only when allowModerators is set, get the comment, everyone else gets 403.
+func commentForMutation(c *gin.Context, allowModerators bool) (CommentModel, bool) {
+	_, commentModel, ok := findArticleComment(c)
+	if !ok {
+		return commentModel, false
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if commentModel.AuthorID == GetArticleUserModel(myUserModel).ID || allowModerators && myUserModel.IsModerator() {
+		return commentModel, true
+	}
+	c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("you can only change your own comments")))
+	return commentModel, false
+}
+
+// Authors can edit their comments for CommentEditWindow after posting, the replaced body is kept as a revision.
+func ArticleCommentUpdate(c *gin.Context) {
+	commentModel, ok := commentForMutation(c, false)
+	if !ok {
+		return
+	}
+	if !commentModel.editable(time.Now()) {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("the comment can't be edited anymore")))
+		return
+	}
+	commentModelValidator := NewCommentModelValidator()
+	if err := commentModelValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, bindError("comment", err))
+		return
+	}
+	edit := commentModelValidator.commentModel
+	if err := commentModel.edit(edit.Body, edit.BodyHTML, edit.mentioned); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	edited := []CommentModel{commentModel}
+	if err := preloadComments(common.GetDB(), edited); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := CommentSerializer{c, edited[0]}
+	c.JSON(http.StatusOK, gin.H{"comment": serializer.Response()})
+}
+
+// The earlier versions of an edited comment, only moderators may read them.
+func ArticleCommentRevisions(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !myUserModel.IsModerator() {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("only moderators can read comment revisions")))
+		return
+	}
+	_, commentModel, ok := findArticleComment(c)
+	if !ok {
+		return
+	}
+	revisions, err := commentModel.revisions()
 	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Database error")))
+		return
+	}
+	serializer := CommentRevisionsSerializer{c, revisions}
+	c.JSON(http.StatusOK, gin.H{"revisions": serializer.Response(), "revisionsCount": len(revisions)})
+}
+
+func ArticleCommentDelete(c *gin.Context) {
+	commentModel, ok := commentForMutation(c, true)
+	if !ok {
+		return
+	}
+	if err := RemoveComment(commentModel); err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
@@ -196,20 +474,328 @@ func ArticleCommentList(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
 		return
 	}
-	err = articleModel.getComments()
+	commentListValidator := NewCommentListValidator()
+	if err := commentListValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	commentListValidator.query.ArticleID = articleModel.ID
+	page, err := FindCommentPage(commentListValidator.query)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
+		return
+	}
+	serializer := CommentsSerializer{c, page.Comments}
+	c.JSON(http.StatusOK, gin.H{
+		"comments":      serializer.Response(),
+		"commentsCount": page.Count,
+		"nextCursor":    cursorOrNull(page.NextCursor),
+		"prevCursor":    cursorOrNull(page.PrevCursor),
+	})
+}
+
+// The replies to one comment, paginated like the top-level comments and with the same depth parameter.
+func ArticleCommentReplies(c *gin.Context) {
+	articleModel, parent, ok := findArticleComment(c)
+	if !ok {
+		return
+	}
+	commentListValidator := NewCommentListValidator()
+	if err := commentListValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	commentListValidator.query.ArticleID = articleModel.ID
+	commentListValidator.query.ParentID = parent.ID
+	page, err := FindCommentPage(commentListValidator.query)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
 		return
 	}
-	serializer := CommentsSerializer{c, articleModel.Comments}
-	c.JSON(http.StatusOK, gin.H{"comments": serializer.Response()})
+	serializer := CommentsSerializer{c, page.Comments}
+	c.JSON(http.StatusOK, gin.H{
+		"comments":      serializer.Response(),
+		"commentsCount": page.Count,
+		"nextCursor":    cursorOrNull(page.NextCursor),
+		"prevCursor":    cursorOrNull(page.PrevCursor),
+	})
 }
+
+// The tags, most used first unless ?sort= asks for trending or alphabetical order.
 func TagList(c *gin.Context) {
-	tagModels, err := getAllTags()
+	tagListValidator := NewTagListValidator()
+	if err := tagListValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	common.ServeCachedJSON(c, tagListValidator.cacheKey(), TagsCacheTTL, func() (int, interface{}) {
+		usage, err := FindTagUsage(tagListValidator.query)
+		if err != nil {
+			return http.StatusNotFound, common.NewError("articles", errors.New("Invalid param"))
+		}
+		serializer := TagUsageSerializer{c, usage, tagListValidator.query.Sort}
+		tags, counts := serializer.Response()
+		return http.StatusOK, gin.H{"tags": tags, "tagCounts": counts}
+	})
+}
+
+// A tag by its name or an alias, the response has its current name.
+func TagRetrieve(c *gin.Context) {
+	tagModel, err := FindTag(c.Param("tag"))
 	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
+		c.JSON(http.StatusNotFound, common.NewError("tag", errors.New("Invalid tag")))
+		return
+	}
+	serializer := TagDetailSerializer{c, tagModel}
+	c.JSON(http.StatusOK, gin.H{"tag": serializer.Response()})
+}
+
+// Articles with a followed tag show up in the feed, next to those of followed authors.
+func TagFollow(c *gin.Context) {
+	tagFollow(c, TagModel.followBy)
+}
+
+func TagUnfollow(c *gin.Context) {
+	tagFollow(c, TagModel.unFollowBy)
+}
+
+func tagFollow(c *gin.Context, change func(TagModel, users.UserModel) error) {
+	tagModel, err := FindTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tag", errors.New("Invalid tag")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err := change(tagModel, myUserModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := TagDetailSerializer{c, tagModel}
+	c.JSON(http.StatusOK, gin.H{"tag": serializer.Response()})
+}
+
+func FollowedTagList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	tagModels, err := FindFollowedTags(myUserModel)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tags", errors.New("Database error")))
 		return
 	}
 	serializer := TagsSerializer{c, tagModels}
 	c.JSON(http.StatusOK, gin.H{"tags": serializer.Response()})
 }
+
+// The tag named in the path, if the current user may change it.
+func tagForMutation(c *gin.Context) (TagModel, bool) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !myUserModel.IsAdmin() {
+		c.JSON(http.StatusForbidden, common.NewError("tag", errors.New("only admins can manage tags")))
+		return TagModel{}, false
+	}
+	tagModel, err := FindTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tag", errors.New("Invalid tag")))
+		return tagModel, false
+	}
+	return tagModel, true
+}
+
+// Answer with the tag as it is after a change, or with why the change was refused.
+func tagChanged(c *gin.Context, name string, err error) {
+	if errors.Is(err, ErrInvalidTag) || errors.Is(err, ErrTagExists) || errors.Is(err, ErrSameTag) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("tag", err))
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, common.NewError("alias", errors.New("Invalid alias")))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	tagModel, err := FindTag(name)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := TagDetailSerializer{c, tagModel}
+	c.JSON(http.StatusOK, gin.H{"tag": serializer.Response()})
+}
+
+// Rename a tag and change its description, the former name becomes an alias.
+func TagUpdate(c *gin.Context) {
+	tagModel, ok := tagForMutation(c)
+	if !ok {
+		return
+	}
+	tagModelValidator := NewTagModelValidatorFillWith(tagModel)
+	if err := tagModelValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	err := tagModel.Update(tagModelValidator.Tag.Name, tagModelValidator.Tag.Description)
+	tagChanged(c, tagModel.Tag, err)
+}
+
+// Move the articles of a tag to another one and delete it, the response is the tag merged into.
+func TagMerge(c *gin.Context) {
+	tagModel, ok := tagForMutation(c)
+	if !ok {
+		return
+	}
+	tagMergeValidator := NewTagMergeValidator()
+	if err := tagMergeValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	target, err := FindTag(tagMergeValidator.Tag.Into)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tag", errors.New("Invalid tag to merge into")))
+		return
+	}
+	tagChanged(c, target.Tag, tagModel.MergeInto(&target))
+}
+
+func TagAliasAdd(c *gin.Context) {
+	tagModel, ok := tagForMutation(c)
+	if !ok {
+		return
+	}
+	tagAliasValidator := NewTagAliasValidator()
+	if err := tagAliasValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	tagChanged(c, tagModel.Tag, tagModel.AddAlias(tagAliasValidator.Alias.Name))
+}
+
+func TagAliasRemove(c *gin.Context) {
+	tagModel, ok := tagForMutation(c)
+	if !ok {
+		return
+	}
+	tagChanged(c, tagModel.Tag, tagModel.RemoveAlias(c.Param("alias")))
+}
+
+type changeReaction func(article ArticleModel, targetType string, targetID uint, user ArticleUserModel, emoji string) error
+
+// Adding a reaction twice or removing one which isn't there succeeds, the response is the article.
+func ArticleReactionAdd(c *gin.Context) {
+	articleReaction(c, addReaction)
+}
+
+func ArticleReactionRemove(c *gin.Context) {
+	articleReaction(c, removeReaction)
+}
+
+func articleReaction(c *gin.Context, change changeReaction) {
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	err = change(articleModel, ReactionTargetArticle, articleModel.ID, GetArticleUserModel(myUserModel), c.Param("emoji"))
+	if err == ErrUnknownReaction {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("emoji", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if !articleStateLoaded(c, articleModel) {
+		return
+	}
+	serializer := ArticleSerializer{c, articleModel}
+	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+}
+
+// Like ArticleReactionAdd for a comment of the article, the response is the comment.
+// Removed comments can't get new reactions.
+func ArticleCommentReactionAdd(c *gin.Context) {
+	commentReaction(c, addReaction)
+}
+
+func ArticleCommentReactionRemove(c *gin.Context) {
+	commentReaction(c, removeReaction)
+}
+
+func commentReaction(c *gin.Context, change changeReaction) {
+	articleModel, commentModel, ok := findArticleComment(c)
+	if !ok {
+		return
+	}
+	if commentModel.RemovedAt != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	err := change(articleModel, ReactionTargetComment, commentModel.ID, GetArticleUserModel(myUserModel), c.Param("emoji"))
+	if err == ErrUnknownReaction {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("emoji", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	reacted := []CommentModel{commentModel}
+	if err := preloadComments(common.GetDB(), reacted); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := CommentSerializer{c, reacted[0]}
+	c.JSON(http.StatusOK, gin.H{"comment": serializer.Response()})
+}
+
+// Who reacted to the article, ?emoji= narrows the list down to one emoji.
+func ArticleReactionList(c *gin.Context) {
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	listReactions(c, ReactionTargetArticle, articleModel.ID)
+}
+
+func ArticleCommentReactionList(c *gin.Context) {
+	_, commentModel, ok := findArticleComment(c)
+	if !ok {
+		return
+	}
+	listReactions(c, ReactionTargetComment, commentModel.ID)
+}
+
+func listReactions(c *gin.Context, targetType string, targetID uint) {
+	reactionListValidator := NewReactionListValidator()
+	if err := reactionListValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	reactions, count, err := findReactions(targetType, targetID, reactionListValidator.Emoji, reactionListValidator.Limit, reactionListValidator.Offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("reactions", errors.New("Invalid param")))
+		return
+	}
+	serializer := ReactionsSerializer{c, reactions}
+	c.JSON(http.StatusOK, gin.H{"reactions": serializer.Response(), "reactionsCount": count})
+}
+
+// Where the current user was mentioned, most recent first.
+func MentionList(c *gin.Context) {
+	mentionListValidator := NewMentionListValidator()
+	if err := mentionListValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, queryError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	mentions, count, err := FindMentions(myUserModel, mentionListValidator.Limit, mentionListValidator.Offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("mentions", errors.New("Invalid param")))
+		return
+	}
+	serializer := MentionsSerializer{c, mentions}
+	c.JSON(http.StatusOK, gin.H{"mentions": serializer.Response(), "mentionsCount": count})
+}
@@ -0,0 +1,377 @@
+package articles
+
+import (
+	"encoding/binary"
+	"fmt"
+	"html"
+	"realworld-backend/common"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The full-text index lives next to article_models and is kept in sync by the article and tag events.
+//
+// SQLite: an FTS5 table (bm25 ranking), the rowid is the article id. go-sqlite3 only ships FTS5 when built
+// with `-tags sqlite_fts5`, otherwise we fall back to FTS4 and rank the matches ourselves.
+//
+// Postgres: a tsvector column with a GIN index, ranked with ts_rank.
+const (
+	searchFTS5     = "fts5"
+	searchFTS4     = "fts4"
+	searchTSVector = "tsvector"
+)
+
+var searchBackend = searchFTS5
+
+// Column weights used for ranking: title, description, body, tags.
+var searchWeights = []float64{10, 4, 1, 6}
+
+// Highlighted terms are wrapped with these control characters while SQL builds the snippet,
+// the text around them is HTML escaped before they are turned into <mark> tags.
+const (
+	highlightOpen  = "\x02"
+	highlightClose = "\x03"
+)
+
+// The index follows the article events, an article is indexed as it is in the database when its
+// event is handled.
+func init() {
+	common.Handle(func(e common.Event) error {
+		var model ArticleModel
+		query := common.GetDB().Preload("Tags").First(&model, e.Payload.(ArticleModel).ID)
+		if query.Error != nil {
+			return ignoreNotFound(query)
+		}
+		return indexArticle(model)
+	}, EventArticleCreated, EventArticleUpdated)
+
+	common.Handle(func(e common.Event) error {
+		return unindexArticle(e.Payload.(ArticleModel).ID)
+	}, EventArticleDeleted)
+
+	// A renamed tag, or one which got the articles of a merged tag, is indexed under its name again
+	common.Handle(func(e common.Event) error {
+		return reindexTag(e.Payload.(TagModel).ID)
+	}, EventTagChanged)
+}
+
+// Articles deleted before their event is handled have nothing left to index.
+func ignoreNotFound(query *gorm.DB) error {
+	if query.RecordNotFound() {
+		return nil
+	}
+	return query.Error
+}
+
+// Create the full-text index if needed, and fill it from existing articles when it is empty.
+//
+//	articles.MigrateSearchIndex(db)
+func MigrateSearchIndex(db *gorm.DB) error {
+	switch db.Dialect().GetName() {
+	case "postgres":
+		searchBackend = searchTSVector
+		err := db.Exec(`CREATE TABLE IF NOT EXISTS article_search (
+			article_id integer PRIMARY KEY,
+			title text, description text, body text, tags text,
+			document tsvector)`).Error
+		if err != nil {
+			return err
+		}
+		err = db.Exec("CREATE INDEX IF NOT EXISTS idx_article_search_document ON article_search USING gin(document)").Error
+		if err != nil {
+			return err
+		}
+	default:
+		searchBackend = searchFTS5
+		err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS article_search USING fts5(title, description, body, tags, tokenize = 'porter unicode61')").Error
+		if err != nil {
+			searchBackend = searchFTS4
+			err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS article_search USING fts4(title, description, body, tags, tokenize=porter)").Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var indexed int
+	db.Table("article_search").Count(&indexed)
+	if indexed > 0 {
+		return nil
+	}
+	return RebuildSearchIndex()
+}
+
+// Drop every entry of the full-text index and index all articles again.
+func RebuildSearchIndex() error {
+	db := common.GetDB()
+	if err := db.Exec("DELETE FROM article_search").Error; err != nil {
+		return err
+	}
+	var models []ArticleModel
+	if err := db.Preload("Tags").Find(&models).Error; err != nil {
+		return err
+	}
+	for _, model := range models {
+		if err := indexArticle(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the searchable fields of an article into the full-text index, replacing the previous entry.
+//
+//	err := indexArticle(articleModel)
+func indexArticle(model ArticleModel) error {
+	db := common.GetDB()
+	tags := make([]string, 0, len(model.Tags))
+	for _, tag := range model.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	tx := db.Begin()
+	if err := unindexArticleWith(tx, model.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var err error
+	if searchBackend == searchTSVector {
+		err = tx.Exec(`INSERT INTO article_search (article_id, title, description, body, tags, document) VALUES (?, ?, ?, ?, ?,
+			setweight(to_tsvector('english', ?), 'A') || setweight(to_tsvector('english', ?), 'B') ||
+			setweight(to_tsvector('english', ?), 'C') || setweight(to_tsvector('english', ?), 'A'))`,
+			model.ID, model.Title, model.Description, model.Body, strings.Join(tags, " "),
+			model.Title, model.Description, model.Body, strings.Join(tags, " ")).Error
+	} else {
+		err = tx.Exec("INSERT INTO article_search (rowid, title, description, body, tags) VALUES (?, ?, ?, ?, ?)",
+			model.ID, model.Title, model.Description, model.Body, strings.Join(tags, " ")).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Index the articles with the tag again, so searches match its current name.
+func reindexTag(id uint) error {
+	var models []ArticleModel
+	err := common.GetDB().Preload("Tags").
+		Where("id IN (SELECT article_model_id FROM article_tags WHERE tag_model_id = ?)", id).
+		Find(&models).Error
+	if err != nil {
+		return err
+	}
+	for _, model := range models {
+		if err := indexArticle(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove an article from the full-text index.
+func unindexArticle(id uint) error {
+	return unindexArticleWith(common.GetDB(), id)
+}
+
+func unindexArticleWith(tx *gorm.DB, id uint) error {
+	if searchBackend == searchTSVector {
+		return tx.Exec("DELETE FROM article_search WHERE article_id = ?", id).Error
+	}
+	return tx.Exec("DELETE FROM article_search WHERE rowid = ?", id).Error
+}
+
+// Turn free text typed by a user into a MATCH expression: every word has to match, the last one as a prefix.
+// Quotes and operators are dropped so user input can't produce an FTS syntax error.
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	terms := make([]string, 0, len(words))
+	for i, word := range words {
+		term := `"` + word + `"`
+		if i == len(words)-1 && searchBackend == searchFTS4 {
+			term = `"` + word + `*"`
+		} else if i == len(words)-1 {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+type searchHit struct {
+	ArticleID      uint
+	Score          float64
+	TitleHighlight string
+	Snippet        string
+}
+
+// Ranked full-text search over title, description, body and tags.
+// The filters, limit and offset of an ArticleQuery apply, its sort order and cursors don't, see BindSearch.
+//
+//	models, hits, count, err := SearchArticles("gin middleware", ArticleQuery{Tags: []string{"golang"}, Limit: 20})
+func SearchArticles(q string, filters ArticleQuery) ([]ArticleModel, map[uint]searchHit, int, error) {
+	db := common.GetDB()
+	var models []ArticleModel
+	var count int
+	hits := map[uint]searchHit{}
+
+	match := ftsQuery(q)
+	if match == "" {
+		return models, hits, 0, nil
+	}
+
+	tx := db.Begin()
+	query := filters.filter(tx.Table("article_search"))
+	limit, offset := filters.Limit, filters.Offset
+	var rows []searchHit
+	var err error
+	switch searchBackend {
+	case searchTSVector:
+		tsquery := gorm.Expr("to_tsquery('english', ?)", tsQuery(q))
+		query = query.Joins("JOIN article_models ON article_models.id = article_search.article_id").
+			Where("article_models.deleted_at IS NULL").
+			Where("article_search.document @@ ?", tsquery)
+		err = query.Count(&count).Error
+		if err == nil {
+			err = query.Select("article_search.article_id, ts_rank(article_search.document, ?) AS score, "+
+				"ts_headline('english', article_search.title, ?, ?) AS title_highlight, "+
+				"ts_headline('english', article_search.body, ?, ?) AS snippet",
+				tsquery, tsquery, "StartSel="+highlightOpen+", StopSel="+highlightClose+", HighlightAll=true",
+				tsquery, "StartSel="+highlightOpen+", StopSel="+highlightClose+", MaxWords=32, MinWords=12").
+				Order("score DESC").Offset(offset).Limit(limit).Scan(&rows).Error
+		}
+	case searchFTS5:
+		query = query.Joins("JOIN article_models ON article_models.id = article_search.rowid").
+			Where("article_models.deleted_at IS NULL").
+			Where("article_search MATCH ?", match)
+		err = query.Count(&count).Error
+		if err == nil {
+			err = query.Select(fmt.Sprintf("article_search.rowid AS article_id, -bm25(article_search, %v, %v, %v, %v) AS score, "+
+				"highlight(article_search, 0, ?, ?) AS title_highlight, "+
+				"snippet(article_search, 2, ?, ?, '…', 24) AS snippet",
+				searchWeights[0], searchWeights[1], searchWeights[2], searchWeights[3]),
+				highlightOpen, highlightClose, highlightOpen, highlightClose).
+				Order("score DESC").Offset(offset).Limit(limit).Scan(&rows).Error
+		}
+	default:
+		rows, count, err = searchFTS4Ranked(tx, query, match, limit, offset)
+	}
+	if err != nil {
+		tx.Rollback()
+		return models, hits, count, err
+	}
+
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		row.TitleHighlight = markHighlights(row.TitleHighlight)
+		row.Snippet = markHighlights(row.Snippet)
+		hits[row.ArticleID] = row
+		ids = append(ids, row.ArticleID)
+	}
+	if len(ids) > 0 {
+		var found []ArticleModel
+		if err := tx.Where("id IN (?)", ids).Find(&found).Error; err != nil {
+			tx.Rollback()
+			return models, hits, count, err
+		}
+		byID := map[uint]ArticleModel{}
+		for _, model := range found {
+			byID[model.ID] = model
+		}
+		for _, id := range ids {
+			if model, ok := byID[id]; ok {
+				models = append(models, model)
+			}
+		}
+	}
+	if err := preloadArticles(tx, models); err != nil {
+		tx.Rollback()
+		return models, hits, count, err
+	}
+	err = tx.Commit().Error
+	return models, hits, count, err
+}
+
+// FTS4 has no ranking function, so all matches are ranked here from matchinfo() with the weighted
+// term frequency scheme from the SQLite documentation before the requested page is cut out.
+func searchFTS4Ranked(tx, query *gorm.DB, match string, limit, offset int) ([]searchHit, int, error) {
+	type matchRow struct {
+		ArticleID uint
+		Info      []byte
+	}
+	var matches []matchRow
+	query = query.Joins("JOIN article_models ON article_models.id = article_search.rowid").
+		Where("article_models.deleted_at IS NULL").
+		Where("article_search MATCH ?", match)
+	err := query.Select("article_search.rowid AS article_id, matchinfo(article_search, 'pcx') AS info").Scan(&matches).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ranked := make([]searchHit, 0, len(matches))
+	for _, m := range matches {
+		ranked = append(ranked, searchHit{ArticleID: m.ArticleID, Score: fts4Rank(m.Info)})
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+
+	count := len(ranked)
+	if offset > len(ranked) {
+		offset = len(ranked)
+	}
+	ranked = ranked[offset:]
+	if limit >= 0 && limit < len(ranked) {
+		ranked = ranked[:limit]
+	}
+	for i, hit := range ranked {
+		tx.Raw(`SELECT snippet(article_search, ?, ?, '…', 0, 64), snippet(article_search, ?, ?, '…', 2, 24)
+			FROM article_search WHERE article_search MATCH ? AND rowid = ?`,
+			highlightOpen, highlightClose, highlightOpen, highlightClose, match, hit.ArticleID).
+			Row().Scan(&ranked[i].TitleHighlight, &ranked[i].Snippet)
+	}
+	return ranked, count, nil
+}
+
+// matchinfo 'pcx' layout: phrase count, column count, then 3 values per phrase and column:
+// hits in this row, hits in all rows, rows with hits.
+func fts4Rank(info []byte) float64 {
+	if len(info) < 8 {
+		return 0
+	}
+	value := func(i int) float64 { return float64(binary.LittleEndian.Uint32(info[i*4:])) }
+	phrases, columns := int(value(0)), int(value(1))
+	if len(info) < (2+phrases*columns*3)*4 {
+		return 0
+	}
+	var score float64
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < columns; c++ {
+			base := 2 + (p*columns+c)*3
+			hitsThisRow, hitsAllRows := value(base), value(base+1)
+			if hitsThisRow > 0 && c < len(searchWeights) {
+				score += hitsThisRow / hitsAllRows * searchWeights[c]
+			}
+		}
+	}
+	return score
+}
+
+// Postgres counterpart of ftsQuery, every word is required and the last one matches as a prefix.
+func tsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) > 0 {
+		words[len(words)-1] += ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+func markHighlights(text string) string {
+	escaped := html.EscapeString(text)
+	escaped = strings.Replace(escaped, highlightOpen, "<mark>", -1)
+	return strings.Replace(escaped, highlightClose, "</mark>", -1)
+}
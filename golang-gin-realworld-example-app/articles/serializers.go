@@ -1,11 +1,24 @@
 package articles
 
 import (
-	"github.com/gosimple/slug"
-	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
+	"realworld-backend/common"
+	"realworld-backend/users"
 )
 
+// The rendered HTML body is only sent when a client asks for it with ?html=true
+func wantsBodyHTML(c *gin.Context) bool {
+	return c.Request != nil && c.Query("html") == "true"
+}
+
+// Rows saved before bodies were rendered at write time are rendered on the fly.
+func bodyHTML(body, cached string) string {
+	if cached == "" && body != "" {
+		return common.RenderMarkdown(body)
+	}
+	return cached
+}
+
 type TagSerializer struct {
 	C *gin.Context
 	TagModel
@@ -29,6 +42,70 @@ func (s *TagsSerializer) Response() []string {
 	return response
 }
 
+// A tag in the tag list with its counts, the recent ones only for trending tags.
+type TagUsageSerializer struct {
+	C     *gin.Context
+	Usage []TagUsage
+	Sort  string
+}
+
+type TagUsageResponse struct {
+	Tag                  string `json:"tag"`
+	ArticlesCount        int    `json:"articlesCount"`
+	FavoritesCount       int    `json:"favoritesCount"`
+	RecentArticlesCount  *int   `json:"recentArticlesCount,omitempty"`
+	RecentFavoritesCount *int   `json:"recentFavoritesCount,omitempty"`
+}
+
+// The names, which is the list RealWorld clients know, and the counts in the same order.
+func (s *TagUsageSerializer) Response() ([]string, []TagUsageResponse) {
+	names := []string{}
+	counts := []TagUsageResponse{}
+	for _, usage := range s.Usage {
+		response := TagUsageResponse{
+			Tag:            usage.Tag,
+			ArticlesCount:  usage.ArticlesCount,
+			FavoritesCount: usage.FavoritesCount,
+		}
+		if s.Sort == TagSortTrending {
+			recentArticles, recentFavorites := usage.RecentArticles, usage.RecentFavorites
+			response.RecentArticlesCount, response.RecentFavoritesCount = &recentArticles, &recentFavorites
+		}
+		names = append(names, usage.Tag)
+		counts = append(counts, response)
+	}
+	return names, counts
+}
+
+// A tag with what admins have set up about it, as GET /api/tags/:tag returns it.
+type TagDetailSerializer struct {
+	C *gin.Context
+	TagModel
+}
+
+type TagDetailResponse struct {
+	Tag           string   `json:"tag"`
+	Description   string   `json:"description"`
+	Aliases       []string `json:"aliases"`
+	ArticlesCount int      `json:"articlesCount"`
+	Following     bool     `json:"following"`
+}
+
+func (s *TagDetailSerializer) Response() TagDetailResponse {
+	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
+	response := TagDetailResponse{
+		Tag:           s.Tag,
+		Description:   s.Description,
+		Aliases:       []string{},
+		ArticlesCount: s.ArticlesCount,
+		Following:     s.isFollowedBy(myUserModel),
+	}
+	for _, alias := range s.Aliases {
+		response.Aliases = append(response.Aliases, alias.Alias)
+	}
+	return response
+}
+
 type ArticleUserSerializer struct {
 	C *gin.Context
 	ArticleUserModel
@@ -45,17 +122,19 @@ type ArticleSerializer struct {
 }
 
 type ArticleResponse struct {
-	ID             uint                  `json:"-"`
-	Title          string                `json:"title"`
-	Slug           string                `json:"slug"`
-	Description    string                `json:"description"`
-	Body           string                `json:"body"`
-	CreatedAt      string                `json:"createdAt"`
-	UpdatedAt      string                `json:"updatedAt"`
-	Author         users.ProfileResponse `json:"author"`
-	Tags           []string              `json:"tagList"`
-	Favorite       bool                  `json:"favorited"`
-	FavoritesCount uint                  `json:"favoritesCount"`
+	ID             uint                    `json:"-"`
+	Title          string                  `json:"title"`
+	Slug           string                  `json:"slug"`
+	Description    string                  `json:"description"`
+	Body           string                  `json:"body"`
+	BodyHTML       string                  `json:"bodyHtml,omitempty"`
+	CreatedAt      string                  `json:"createdAt"`
+	UpdatedAt      string                  `json:"updatedAt"`
+	Author         users.ProfileResponse   `json:"author"`
+	Tags           []string                `json:"tagList"`
+	Favorite       bool                    `json:"favorited"`
+	FavoritesCount uint                    `json:"favoritesCount"`
+	Reactions      []ReactionCountResponse `json:"reactions"`
 }
 
 type ArticlesSerializer struct {
@@ -64,21 +143,31 @@ type ArticlesSerializer struct {
 }
 
 func (s *ArticleSerializer) Response() ArticleResponse {
-	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
 	authorSerializer := ArticleUserSerializer{s.C, s.Author}
 	response := ArticleResponse{
 		ID:          s.ID,
-		Slug:        slug.Make(s.Title),
+		Slug:        s.Slug,
 		Title:       s.Title,
 		Description: s.Description,
 		Body:        s.Body,
 		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		//UpdatedAt:      s.UpdatedAt.UTC().Format(time.RFC3339Nano),
-		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
-		Author:         authorSerializer.Response(),
-		Favorite:       s.isFavoriteBy(GetArticleUserModel(myUserModel)),
-		FavoritesCount: s.favoritesCount(),
+		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Author:    authorSerializer.Response(),
+	}
+	// Handlers load the state first and answer its error, a serializer used on its own loads it here
+	if _, _, ok := loadedArticleState(s.C, s.ID); !ok {
+		loadArticleState(s.C, []ArticleModel{s.ArticleModel})
+	}
+	if count, favorited, ok := loadedArticleState(s.C, s.ID); ok {
+		response.FavoritesCount, response.Favorite = count, favorited
+	} else {
+		response.FavoritesCount = s.FavoritesCount
 	}
+	if wantsBodyHTML(s.C) {
+		response.BodyHTML = bodyHTML(s.Body, s.ArticleModel.BodyHTML)
+	}
+	response.Reactions = reactionCountsResponse(reactionCountsOf(s.C, ReactionTargetArticle, s.ID))
 	response.Tags = make([]string, 0)
 	for _, tag := range s.Tags {
 		serializer := TagSerializer{s.C, tag}
@@ -88,6 +177,8 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 }
 
 func (s *ArticlesSerializer) Response() []ArticleResponse {
+	// Loaded by the handler already, unless the serializer is used on its own
+	loadArticleState(s.C, s.Articles)
 	response := []ArticleResponse{}
 	for _, article := range s.Articles {
 		serializer := ArticleSerializer{s.C, article}
@@ -107,11 +198,18 @@ type CommentsSerializer struct {
 }
 
 type CommentResponse struct {
-	ID        uint                  `json:"id"`
-	Body      string                `json:"body"`
-	CreatedAt string                `json:"createdAt"`
-	UpdatedAt string                `json:"updatedAt"`
-	Author    users.ProfileResponse `json:"author"`
+	ID           uint                    `json:"id"`
+	Body         string                  `json:"body"`
+	BodyHTML     string                  `json:"bodyHtml,omitempty"`
+	CreatedAt    string                  `json:"createdAt"`
+	UpdatedAt    string                  `json:"updatedAt"`
+	Author       users.ProfileResponse   `json:"author"`
+	ParentID     *uint                   `json:"parentId"`
+	Removed      bool                    `json:"removed"`
+	Edited       bool                    `json:"edited"`
+	RepliesCount uint                    `json:"repliesCount"`
+	Replies      []CommentResponse       `json:"replies,omitempty"`
+	Reactions    []ReactionCountResponse `json:"reactions"`
 }
 
 func (s *CommentSerializer) Response() CommentResponse {
@@ -122,11 +220,25 @@ func (s *CommentSerializer) Response() CommentResponse {
 		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Author:    authorSerializer.Response(),
+		// Tombstones keep their place in the thread, without a body
+		ParentID:     s.ParentID,
+		Removed:      s.RemovedAt != nil,
+		Edited:       s.EditedAt != nil,
+		RepliesCount: s.RepliesCount,
+	}
+	if wantsBodyHTML(s.C) && s.RemovedAt == nil {
+		response.BodyHTML = bodyHTML(s.Body, s.CommentModel.BodyHTML)
+	}
+	response.Reactions = reactionCountsResponse(reactionCountsOf(s.C, ReactionTargetComment, s.ID))
+	for _, reply := range s.Replies {
+		serializer := CommentSerializer{s.C, reply}
+		response.Replies = append(response.Replies, serializer.Response())
 	}
 	return response
 }
 
 func (s *CommentsSerializer) Response() []CommentResponse {
+	loadCommentState(s.C, s.Comments)
 	response := []CommentResponse{}
 	for _, comment := range s.Comments {
 		serializer := CommentSerializer{s.C, comment}
@@ -134,3 +246,156 @@ func (s *CommentsSerializer) Response() []CommentResponse {
 	}
 	return response
 }
+
+type CommentRevisionsSerializer struct {
+	C         *gin.Context
+	Revisions []CommentRevisionModel
+}
+
+// A former version of a comment, replacedAt is when an edit replaced it.
+type CommentRevisionResponse struct {
+	Body       string `json:"body"`
+	BodyHTML   string `json:"bodyHtml,omitempty"`
+	ReplacedAt string `json:"replacedAt"`
+}
+
+func (s *CommentRevisionsSerializer) Response() []CommentRevisionResponse {
+	response := []CommentRevisionResponse{}
+	for _, revision := range s.Revisions {
+		revisionResponse := CommentRevisionResponse{
+			Body:       revision.Body,
+			ReplacedAt: revision.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		}
+		if wantsBodyHTML(s.C) {
+			revisionResponse.BodyHTML = bodyHTML(revision.Body, revision.BodyHTML)
+		}
+		response = append(response, revisionResponse)
+	}
+	return response
+}
+
+type SearchResultsSerializer struct {
+	C        *gin.Context
+	Articles []ArticleModel
+	Hits     map[uint]searchHit
+}
+
+type SearchHighlightResponse struct {
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+}
+
+// A search result is an article with its relevance and the matched terms wrapped in <mark> tags.
+type SearchResultResponse struct {
+	ArticleResponse
+	Score     float64                 `json:"score"`
+	Highlight SearchHighlightResponse `json:"highlight"`
+}
+
+func (s *SearchResultsSerializer) Response() []SearchResultResponse {
+	// Loaded by the handler already, unless the serializer is used on its own
+	loadArticleState(s.C, s.Articles)
+	response := []SearchResultResponse{}
+	for _, article := range s.Articles {
+		serializer := ArticleSerializer{s.C, article}
+		hit := s.Hits[article.ID]
+		response = append(response, SearchResultResponse{
+			ArticleResponse: serializer.Response(),
+			Score:           hit.Score,
+			Highlight: SearchHighlightResponse{
+				Title:   hit.TitleHighlight,
+				Snippet: hit.Snippet,
+			},
+		})
+	}
+	return response
+}
+
+// How many users reacted with an emoji, and whether the current user is one of them.
+type ReactionCountResponse struct {
+	Emoji   string `json:"emoji"`
+	Count   uint   `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+func reactionCountsResponse(counts []reactionCount) []ReactionCountResponse {
+	response := []ReactionCountResponse{}
+	for _, count := range counts {
+		response = append(response, ReactionCountResponse{count.Emoji, count.Count, count.Reacted})
+	}
+	return response
+}
+
+type ReactionsSerializer struct {
+	C         *gin.Context
+	Reactions []ReactionModel
+}
+
+type ReactionResponse struct {
+	Emoji     string                `json:"emoji"`
+	CreatedAt string                `json:"createdAt"`
+	Profile   users.ProfileResponse `json:"profile"`
+}
+
+func (s *ReactionsSerializer) Response() []ReactionResponse {
+	userIDs := make([]uint, 0, len(s.Reactions))
+	for _, reaction := range s.Reactions {
+		userIDs = append(userIDs, reaction.ReactedBy.UserModelID)
+	}
+	users.PreloadFollowing(s.C, userIDs)
+	response := []ReactionResponse{}
+	for _, reaction := range s.Reactions {
+		profileSerializer := ArticleUserSerializer{s.C, reaction.ReactedBy}
+		response = append(response, ReactionResponse{
+			Emoji:     reaction.Emoji,
+			CreatedAt: reaction.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			Profile:   profileSerializer.Response(),
+		})
+	}
+	return response
+}
+
+type MentionsSerializer struct {
+	C        *gin.Context
+	Mentions []MentionModel
+}
+
+// Where a user was mentioned: in the article itself, or in the comment commentId of the article.
+type MentionResponse struct {
+	ID          uint                  `json:"id"`
+	CreatedAt   string                `json:"createdAt"`
+	Source      string                `json:"source"`
+	Article     MentionArticle        `json:"article"`
+	CommentID   *uint                 `json:"commentId"`
+	MentionedBy users.ProfileResponse `json:"mentionedBy"`
+}
+
+type MentionArticle struct {
+	Slug  string `json:"slug"`
+	Title string `json:"title"`
+}
+
+func (s *MentionsSerializer) Response() []MentionResponse {
+	userIDs := make([]uint, 0, len(s.Mentions))
+	for _, mention := range s.Mentions {
+		userIDs = append(userIDs, mention.MentionedBy.UserModelID)
+	}
+	users.PreloadFollowing(s.C, userIDs)
+	response := []MentionResponse{}
+	for _, mention := range s.Mentions {
+		profileSerializer := ArticleUserSerializer{s.C, mention.MentionedBy}
+		mentionResponse := MentionResponse{
+			ID:          mention.ID,
+			CreatedAt:   mention.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			Source:      mention.SourceType,
+			Article:     MentionArticle{mention.Article.Slug, mention.Article.Title},
+			MentionedBy: profileSerializer.Response(),
+		}
+		if mention.SourceType == MentionInComment {
+			commentID := mention.SourceID
+			mentionResponse.CommentID = &commentID
+		}
+		response = append(response, mentionResponse)
+	}
+	return response
+}
@@ -0,0 +1,441 @@
+package articles
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Limits against tag spam, checked when an article is saved.
+const (
+	MaxTagsPerArticle = 10
+	MaxTagLength      = 32
+)
+
+// Published with the TagModel after it was renamed, described, merged into or given an alias.
+const EventTagChanged = "tag.changed"
+
+var (
+	ErrInvalidTag  = errors.New("tag is empty once normalized")
+	ErrTagTooLong  = fmt.Errorf("tag is longer than %d characters", MaxTagLength)
+	ErrTooManyTags = fmt.Errorf("an article can't have more than %d tags", MaxTagsPerArticle)
+	ErrTagExists   = errors.New("a tag or alias with this name exists already")
+	ErrSameTag     = errors.New("a tag can't be merged into itself")
+)
+
+// Another name of a tag. Aliases are resolved whenever tags are written or queried, so articles tagged
+// "golang" get the "go" tag and ?tag=golang lists them.
+type TagAliasModel struct {
+	gorm.Model
+	Alias      string `gorm:"unique_index"`
+	TagModelID uint   `gorm:"index"`
+}
+
+// A user following a tag, the articles with the tag show up in their feed.
+type TagFollowModel struct {
+	gorm.Model
+	UserModelID uint `gorm:"unique_index:idx_tag_follow"`
+	TagModelID  uint `gorm:"unique_index:idx_tag_follow;index"`
+}
+
+func init() {
+	common.RegisterEvent(EventTagChanged, TagModel{})
+}
+
+// The form tags are stored in: lower case without a leading #, words joined by single dashes, so
+// "Go", "#go" and " GO " are the same tag, and so are "Machine Learning" and "machine_learning".
+func NormalizeTag(name string) string {
+	name = strings.TrimLeft(strings.ToLower(strings.TrimSpace(name)), "#")
+	return strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '_' || r == '-'
+	}), "-")
+}
+
+// Normalize the names and drop the empty and repeated ones.
+func normalizeTags(names []string) []string {
+	seen := map[string]bool{}
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		name = NormalizeTag(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			normalized = append(normalized, name)
+		}
+	}
+	return normalized
+}
+
+// Refuse the tags of an article when one of them is empty once normalized or too long, or when
+// there are too many, so nothing but the tags the author asked for gets saved.
+func checkTags(names []string) error {
+	for _, name := range names {
+		name = NormalizeTag(name)
+		if name == "" {
+			return ErrInvalidTag
+		}
+		if len(name) > MaxTagLength {
+			return ErrTagTooLong
+		}
+	}
+	if len(normalizeTags(names)) > MaxTagsPerArticle {
+		return ErrTooManyTags
+	}
+	return nil
+}
+
+// The tags names stand for: normalized, with aliases replaced by the tag they belong to.
+func resolveTags(db *gorm.DB, names []string) ([]string, error) {
+	names = normalizeTags(names)
+	if len(names) == 0 {
+		return names, nil
+	}
+	var aliases []struct {
+		Alias string
+		Tag   string
+	}
+	err := db.Table("tag_alias_models").
+		Select("tag_alias_models.alias, tag_models.tag").
+		Joins("JOIN tag_models ON tag_models.id = tag_alias_models.tag_model_id").
+		Where("tag_alias_models.deleted_at IS NULL AND tag_models.deleted_at IS NULL AND tag_alias_models.alias IN (?)", names).
+		Scan(&aliases).Error
+	if err != nil {
+		return nil, err
+	}
+	canonical := map[string]string{}
+	for _, alias := range aliases {
+		canonical[alias.Alias] = alias.Tag
+	}
+	for i, name := range names {
+		if tag, ok := canonical[name]; ok {
+			names[i] = tag
+		}
+	}
+	return normalizeTags(names), nil
+}
+
+// A tag by its name or one of its aliases, with its aliases and how many articles it's on.
+func FindTag(name string) (TagModel, error) {
+	db := common.GetDB()
+	var tag TagModel
+	names, err := resolveTags(db, []string{name})
+	if err != nil {
+		return tag, err
+	}
+	if len(names) == 0 {
+		return tag, gorm.ErrRecordNotFound
+	}
+	if err := db.Where("tag = ?", names[0]).First(&tag).Error; err != nil {
+		return tag, err
+	}
+	if err := db.Where("tag_model_id = ?", tag.ID).Order("alias").Find(&tag.Aliases).Error; err != nil {
+		return tag, err
+	}
+	err = db.Table("article_tags").
+		Joins("JOIN article_models ON article_models.id = article_tags.article_model_id").
+		Where("article_models.deleted_at IS NULL AND article_tags.tag_model_id = ?", tag.ID).
+		Count(&tag.ArticlesCount).Error
+	return tag, err
+}
+
+// Following a tag twice or unfollowing one which isn't followed succeeds.
+func (tag TagModel) followBy(userModel users.UserModel) error {
+	db := common.GetDB()
+	var follow TagFollowModel
+	return db.Where(TagFollowModel{UserModelID: userModel.ID, TagModelID: tag.ID}).FirstOrCreate(&follow).Error
+}
+
+// Deleted for good, the unique index would keep the user from following the tag again.
+func (tag TagModel) unFollowBy(userModel users.UserModel) error {
+	db := common.GetDB()
+	return db.Unscoped().Where("user_model_id = ? AND tag_model_id = ?", userModel.ID, tag.ID).Delete(&TagFollowModel{}).Error
+}
+
+func (tag TagModel) isFollowedBy(userModel users.UserModel) bool {
+	if userModel.ID == 0 {
+		return false
+	}
+	db := common.GetDB()
+	var count int
+	db.Model(&TagFollowModel{}).Where("user_model_id = ? AND tag_model_id = ?", userModel.ID, tag.ID).Count(&count)
+	return count > 0
+}
+
+// The tags a user follows, by name.
+func FindFollowedTags(userModel users.UserModel) ([]TagModel, error) {
+	db := common.GetDB()
+	var tags []TagModel
+	err := db.Joins("JOIN tag_follow_models ON tag_follow_models.tag_model_id = tag_models.id").
+		Where("tag_follow_models.deleted_at IS NULL AND tag_follow_models.user_model_id = ?", userModel.ID).
+		Order("tag_models.tag").Find(&tags).Error
+	return tags, err
+}
+
+// Whether name is free to become the name or an alias of the tag: no other tag has it, as name or alias.
+func (tag TagModel) nameAvailable(tx *gorm.DB, name string) error {
+	var count int
+	if err := tx.Model(&TagModel{}).Where("tag = ? AND id <> ?", name, tag.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		err := tx.Model(&TagAliasModel{}).Where("alias = ? AND tag_model_id <> ?", name, tag.ID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+	}
+	if count > 0 {
+		return ErrTagExists
+	}
+	return nil
+}
+
+func (tag TagModel) changed(tx *gorm.DB) error {
+	if err := common.Record(tx, common.Event{Name: EventTagChanged, Payload: tag}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Keep the name of a renamed or merged tag as an alias of the tag with the id. Names from before
+// normalization are skipped, they're normalized to the new name anyway.
+func (tag TagModel) keepName(tx *gorm.DB, id uint) error {
+	if NormalizeTag(tag.Tag) != tag.Tag {
+		return nil
+	}
+	return tx.Create(&TagAliasModel{Alias: tag.Tag, TagModelID: id}).Error
+}
+
+// Rename the tag and change its description. The former name becomes an alias, so links and
+// queries using it keep working. A name taken by another tag is refused, merge the tags instead.
+func (tag *TagModel) Update(name, description string) error {
+	name = NormalizeTag(name)
+	if name == "" {
+		return ErrInvalidTag
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	if name != tag.Tag {
+		if err := tag.nameAvailable(tx, name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		// The new name may have been an alias of this tag, the old one takes its place
+		if err := tx.Unscoped().Where("alias = ?", name).Delete(&TagAliasModel{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tag.keepName(tx, tag.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Model(tag).Updates(map[string]interface{}{"tag": name, "description": description}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	tag.Tag, tag.Description = name, description
+	return tag.changed(tx)
+}
+
+// Move the articles, aliases and followers of the tag to target and delete it, its name becomes an alias of
+// target. Articles which had both tags keep one, and users who followed both follow target once.
+func (tag TagModel) MergeInto(target *TagModel) error {
+	if tag.ID == target.ID {
+		return ErrSameTag
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	statements := []struct {
+		sql  string
+		vars []interface{}
+	}{
+		{`DELETE FROM article_tags WHERE tag_model_id = ?
+			AND article_model_id IN (SELECT article_model_id FROM article_tags WHERE tag_model_id = ?)`, []interface{}{tag.ID, target.ID}},
+		{`UPDATE article_tags SET tag_model_id = ? WHERE tag_model_id = ?`, []interface{}{target.ID, tag.ID}},
+		{`UPDATE tag_alias_models SET tag_model_id = ? WHERE tag_model_id = ?`, []interface{}{target.ID, tag.ID}},
+		{`DELETE FROM tag_follow_models WHERE tag_model_id = ?
+			AND user_model_id IN (SELECT user_model_id FROM tag_follow_models WHERE tag_model_id = ?)`, []interface{}{tag.ID, target.ID}},
+		{`UPDATE tag_follow_models SET tag_model_id = ? WHERE tag_model_id = ?`, []interface{}{target.ID, tag.ID}},
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement.sql, statement.vars...).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// Deleted for good, so the unique name is free for the alias
+	if err := tx.Unscoped().Delete(&tag).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tag.keepName(tx, target.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if target.Description == "" && tag.Description != "" {
+		if err := tx.Model(target).Update("description", tag.Description).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return target.changed(tx)
+}
+
+// Add an alias of the tag. A name which is a tag itself can't be an alias, merge the tags instead.
+func (tag TagModel) AddAlias(name string) error {
+	name = NormalizeTag(name)
+	if name == "" {
+		return ErrInvalidTag
+	}
+	if name == tag.Tag {
+		return ErrTagExists
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tag.nameAvailable(tx, name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var alias TagAliasModel
+	if err := tx.Where(TagAliasModel{Alias: name, TagModelID: tag.ID}).FirstOrCreate(&alias).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tag.changed(tx)
+}
+
+func (tag TagModel) RemoveAlias(name string) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	query := tx.Unscoped().Where("alias = ? AND tag_model_id = ?", NormalizeTag(name), tag.ID).Delete(&TagAliasModel{})
+	if query.Error != nil {
+		tx.Rollback()
+		return query.Error
+	}
+	if query.RowsAffected == 0 {
+		tx.Rollback()
+		return gorm.ErrRecordNotFound
+	}
+	return tag.changed(tx)
+}
+
+// Bring the tags created before names were normalized in line: each is renamed to its normalized
+// name, or merged into the tag which has it already. Safe to run on every start.
+func NormalizeExistingTags() error {
+	db := common.GetDB()
+	var tags []TagModel
+	if err := db.Order("id").Find(&tags).Error; err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		name := NormalizeTag(tag.Tag)
+		if name == tag.Tag || name == "" {
+			continue
+		}
+		var target TagModel
+		query := db.Where("tag = ?", name).First(&target)
+		switch {
+		case query.Error == nil:
+			if err := tag.MergeInto(&target); err != nil {
+				return err
+			}
+		case query.RecordNotFound():
+			if err := tag.Update(name, tag.Description); err != nil {
+				return err
+			}
+		default:
+			return query.Error
+		}
+	}
+	return nil
+}
+
+// Orders of the tag list. Popular tags are on the most articles, trending ones got the most new
+// articles and favorites within a time window.
+const (
+	TagSortPopular  = "popular"
+	TagSortTrending = "trending"
+	TagSortName     = "name"
+)
+
+// The window trending tags are found in when the query doesn't set one.
+var TrendingWindow = 7 * 24 * time.Hour
+
+// A TagQuery describes a tag list:
+//
+//	usage, err := FindTagUsage(TagQuery{Sort: TagSortTrending, Since: time.Now().Add(-TrendingWindow), Limit: 10})
+type TagQuery struct {
+	Sort string
+	// Trending counts the articles and favorites since then.
+	Since time.Time
+	// Without a limit all tags are listed.
+	Limit int
+	// Leave out tags without articles, trending tags always need some recent activity.
+	HideUnused bool
+}
+
+// How much a tag is used: the articles it's on and their favorites, and for trending tags how many
+// of those are recent.
+type TagUsage struct {
+	Tag             string
+	ArticlesCount   int
+	FavoritesCount  int
+	RecentArticles  int
+	RecentFavorites int
+}
+
+func (usage TagUsage) TrendingScore() int {
+	return usage.RecentArticles + usage.RecentFavorites
+}
+
+// The tags in the order of the query, counted in one grouped query over article_tags.
+func FindTagUsage(q TagQuery) ([]TagUsage, error) {
+	db := common.GetDB()
+	articlesCount := "COUNT(article_models.id)"
+	favoritesCount := "COALESCE(SUM(article_models.favorites_count), 0)"
+	tx := db.Table("tag_models").
+		Joins("LEFT JOIN article_tags ON article_tags.tag_model_id = tag_models.id").
+		Joins("LEFT JOIN article_models ON article_models.id = article_tags.article_model_id AND article_models.deleted_at IS NULL").
+		Where("tag_models.deleted_at IS NULL").
+		Group("tag_models.id, tag_models.tag")
+
+	switch q.Sort {
+	case TagSortTrending:
+		recentArticles := "SUM(CASE WHEN article_models.created_at >= ? THEN 1 ELSE 0 END)"
+		recentFavorites := "COALESCE(SUM(recent_favorites.count), 0)"
+		tx = tx.Joins(`LEFT JOIN (SELECT favorite_id, COUNT(*) AS count FROM favorite_models
+			WHERE deleted_at IS NULL AND created_at >= ? GROUP BY favorite_id) AS recent_favorites
+			ON recent_favorites.favorite_id = article_models.id`, q.Since).
+			Select("tag_models.tag, "+articlesCount+" AS articles_count, "+favoritesCount+" AS favorites_count, "+
+				recentArticles+" AS recent_articles, "+recentFavorites+" AS recent_favorites", q.Since).
+			Having(recentArticles+" + "+recentFavorites+" > 0", q.Since).
+			// Postgres only takes bare aliases in ORDER BY, the sum is ordered by its aggregates
+			Order(gorm.Expr("("+recentArticles+" + "+recentFavorites+") DESC, articles_count DESC, tag_models.tag", q.Since))
+	case TagSortName:
+		tx = tx.Select("tag_models.tag, " + articlesCount + " AS articles_count, " + favoritesCount + " AS favorites_count").
+			Order("tag_models.tag")
+	default:
+		tx = tx.Select("tag_models.tag, " + articlesCount + " AS articles_count, " + favoritesCount + " AS favorites_count").
+			Order("articles_count DESC, favorites_count DESC, tag_models.tag")
+	}
+	if q.HideUnused && q.Sort != TagSortTrending {
+		tx = tx.Having(articlesCount + " > 0")
+	}
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+	var usage []TagUsage
+	err := tx.Scan(&usage).Error
+	return usage, err
+}
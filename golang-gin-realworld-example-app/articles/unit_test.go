@@ -2,9 +2,11 @@ package articles
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"realworld-backend/common"
 	"realworld-backend/users"
@@ -20,13 +22,8 @@ var test_db *gorm.DB
 // Setup test database and auto-migrate models
 func setupTestDB() *gorm.DB {
 	db := common.TestDBInit()
-	db.AutoMigrate(&ArticleModel{})
-	db.AutoMigrate(&ArticleUserModel{})
-	db.AutoMigrate(&FavoriteModel{})
-	db.AutoMigrate(&TagModel{})
-	db.AutoMigrate(&CommentModel{})
-	db.AutoMigrate(&users.UserModel{})
-	db.AutoMigrate(&users.FollowModel{})
+	users.AutoMigrate()
+	AutoMigrate()
 	return db
 }
 
@@ -124,7 +121,7 @@ func TestFavoriteArticle(t *testing.T) {
 	article := createTestArticle("Favorite Test", "Description", "Body", authorModel)
 
 	// Test initial favorite count
-	asserts.Equal(uint(0), article.favoritesCount(), "Initial favorites count should be 0")
+	asserts.Equal(uint(0), article.FavoritesCount, "Initial favorites count should be 0")
 
 	// Test isFavoriteBy before favoriting
 	asserts.False(article.isFavoriteBy(favoriterModel), "Article should not be favorited initially")
@@ -137,7 +134,7 @@ func TestFavoriteArticle(t *testing.T) {
 	test_db.First(&article, article.ID)
 
 	// Test after favoriting
-	asserts.Equal(uint(1), article.favoritesCount(), "Favorites count should be 1 after favoriting")
+	asserts.Equal(uint(1), article.FavoritesCount, "Favorites count should be 1 after favoriting")
 	asserts.True(article.isFavoriteBy(favoriterModel), "Article should be favorited")
 }
 
@@ -162,7 +159,7 @@ func TestUnfavoriteArticle(t *testing.T) {
 	asserts.NoError(err, "Unfavoriting should succeed")
 
 	// Test after unfavoriting
-	asserts.Equal(uint(0), article.favoritesCount(), "Favorites count should be 0 after unfavoriting")
+	asserts.Equal(uint(0), article.FavoritesCount, "Favorites count should be 0 after unfavoriting")
 	asserts.False(article.isFavoriteBy(favoriterModel), "Article should not be favorited after unfavoriting")
 }
 
@@ -191,7 +188,7 @@ func TestMultipleFavorites(t *testing.T) {
 	article.favoriteBy(favoriterModel3)
 
 	// Test favorites count
-	asserts.Equal(uint(3), article.favoritesCount(), "Favorites count should be 3")
+	asserts.Equal(uint(3), article.FavoritesCount, "Favorites count should be 3")
 
 	// Each user should show favorited
 	asserts.True(article.isFavoriteBy(favoriterModel1), "User 1 should have favorited")
@@ -1090,7 +1087,15 @@ func TestArticleFavoriteHandler(t *testing.T) {
 	req := httptest.NewRequest("POST", "/api/articles/"+article.Slug+"/favorite", nil)
 	w := httptest.NewRecorder()
 
+	// A favorite whose event can't be recorded isn't saved, and isn't reported as saved
+	test_db.Exec("ALTER TABLE outbox_models RENAME TO outbox_models_gone")
 	router.ServeHTTP(w, req)
+	test_db.Exec("ALTER TABLE outbox_models_gone RENAME TO outbox_models")
+	asserts.Equal(422, w.Code)
+	asserts.False(article.isFavoriteBy(authorModel))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/articles/"+article.Slug+"/favorite", nil))
 
 	asserts.Equal(200, w.Code, "Should return 200 OK")
 }
@@ -1121,7 +1126,14 @@ func TestArticleUnfavoriteHandler(t *testing.T) {
 	req := httptest.NewRequest("DELETE", "/api/articles/"+article.Slug+"/favorite", nil)
 	w := httptest.NewRecorder()
 
+	test_db.Exec("ALTER TABLE outbox_models RENAME TO outbox_models_gone")
 	router.ServeHTTP(w, req)
+	test_db.Exec("ALTER TABLE outbox_models_gone RENAME TO outbox_models")
+	asserts.Equal(422, w.Code)
+	asserts.True(article.isFavoriteBy(authorModel))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/articles/"+article.Slug+"/favorite", nil))
 
 	asserts.Equal(200, w.Code, "Should return 200 OK")
 }
@@ -1178,6 +1190,10 @@ func TestArticleCommentDeleteHandler(t *testing.T) {
 
 	// Setup router
 	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", author)
+		c.Next()
+	})
 	router.DELETE("/api/articles/:slug/comments/:id", ArticleCommentDelete)
 
 	// Create request
@@ -1574,3 +1590,1826 @@ func TestCommentsSerializerFullCoverage(t *testing.T) {
 	// Check response length
 	asserts.Equal(2, len(response), "Should have 2 comments")
 }
+
+// =============================================================================
+// Slug Tests
+// =============================================================================
+
+func TestUniqueSlug(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	author := createTestUser("slugauthor", "slugauthor@test.com")
+	authorModel := GetArticleUserModel(author)
+
+	first := createTestArticle("Same Title", "Desc", "Body", authorModel)
+	asserts.Equal("same-title", first.Slug)
+	asserts.Equal("same-title", uniqueSlug("Same Title", first.ID), "An article keeps its own slug")
+	asserts.Equal("same-title-2", uniqueSlug("Same Title", 0), "A colliding slug should get a suffix")
+
+	second := createTestArticle("Other Title", "Desc", "Body", authorModel)
+	test_db.Model(&second).Update("slug", "same-title-2")
+	asserts.Equal("same-title-3", uniqueSlug("Same Title", 0), "Suffixes should keep counting")
+
+	// Former slugs are reserved for the article they belonged to
+	asserts.NoError(saveSlugHistory(first.ID, "old-title", first.Slug))
+	asserts.Equal("old-title-2", uniqueSlug("Old Title", 0))
+	asserts.Equal("old-title", uniqueSlug("Old Title", first.ID))
+
+	// Route words would be shadowed by their routes
+	asserts.Equal("search-2", uniqueSlug("Search", 0))
+	asserts.Equal("feed-2", uniqueSlug("Feed", first.ID))
+}
+
+func TestSlugTakenConcurrently(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	author := createTestUser("slugraceauthor", "slugraceauthor@test.com")
+	authorModel := GetArticleUserModel(author)
+	createTestArticle("Race", "Desc", "Body", authorModel)
+
+	// Both writes picked "race" before the other article saved it, they move on to the next slug
+	created := ArticleModel{Slug: "race", Title: "Race", AuthorID: authorModel.ID}
+	asserts.NoError(CreateArticle(&created))
+	asserts.Equal("race-2", created.Slug)
+
+	other := createTestArticle("Other", "Desc", "Body", authorModel)
+	asserts.NoError(other.UpdateUnmodified(ArticleModel{Slug: "race", Title: "Race again"}))
+	asserts.Equal("race-3", other.Slug)
+	var stored ArticleModel
+	test_db.First(&stored, other.ID)
+	asserts.Equal("race-3", stored.Slug)
+	asserts.Equal("Race again", stored.Title)
+}
+
+func TestArticleSlugRenameAndRedirect(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("slugrenameauthor", "slugrenameauthor@test.com")
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Stable Slug", "Desc", "Body", authorModel)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", author)
+		c.Next()
+	})
+	router.GET("/api/articles/:slug", ArticleRetrieve)
+	router.PUT("/api/articles/:slug", ArticleUpdate)
+
+	put := func(slug, body string) map[string]interface{} {
+		req := httptest.NewRequest("PUT", "/api/articles/"+slug, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		asserts.Equal(200, w.Code, w.Body.String())
+		var response map[string]map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response["article"]
+	}
+
+	// Editing the title keeps the slug
+	updated := put(article.Slug, `{"article":{"title":"A Brand New Title"}}`)
+	asserts.Equal("A Brand New Title", updated["title"])
+	asserts.Equal("stable-slug", updated["slug"], "Slug should stay stable across title edits")
+
+	// An explicit slug renames the article
+	updated = put(article.Slug, `{"article":{"slug":"Brand New"}}`)
+	asserts.Equal("brand-new", updated["slug"])
+
+	// The former slug redirects to the current one
+	req := httptest.NewRequest("GET", "/api/articles/stable-slug", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(301, w.Code)
+	asserts.Equal("/api/articles/brand-new", w.Header().Get("Location"))
+	asserts.Contains(w.Body.String(), `"slug":"brand-new"`)
+
+	// Renaming back makes the former slug current again
+	updated = put("brand-new", `{"article":{"slug":"stable-slug"}}`)
+	asserts.Equal("stable-slug", updated["slug"])
+	req = httptest.NewRequest("GET", "/api/articles/stable-slug", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(200, w.Code)
+
+	req = httptest.NewRequest("GET", "/api/articles/unknown-slug", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(404, w.Code)
+}
+
+// =============================================================================
+// Markdown Tests
+// =============================================================================
+
+func TestArticleBodyHTML(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("htmlauthor", "htmlauthor@test.com")
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", author)
+		c.Next()
+	})
+	router.POST("/api/articles", ArticleCreate)
+	router.GET("/api/articles/:slug", ArticleRetrieve)
+	router.POST("/api/articles/:slug/comments", ArticleCommentCreate)
+	router.GET("/api/articles/:slug/comments", ArticleCommentList)
+
+	body := `{"article":{"title":"Markdown Article","description":"Desc","body":"**bold** <script>alert(1)</script>"}}`
+	req := httptest.NewRequest("POST", "/api/articles", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(201, w.Code)
+	asserts.NotContains(w.Body.String(), "bodyHtml", "bodyHtml should only be sent on request")
+
+	var stored ArticleModel
+	test_db.Where(ArticleModel{Slug: "markdown-article"}).First(&stored)
+	asserts.Contains(stored.BodyHTML, "<strong>bold</strong>", "Rendered body should be cached on the model")
+	asserts.NotContains(stored.BodyHTML, "<script", "Rendered body should be sanitized")
+
+	req = httptest.NewRequest("GET", "/api/articles/markdown-article?html=true", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(200, w.Code)
+	var response map[string]map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(stored.BodyHTML, response["article"]["bodyHtml"])
+
+	body = `{"comment":{"body":"_nice_"}}`
+	req = httptest.NewRequest("POST", "/api/articles/markdown-article/comments?html=true", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Equal(201, w.Code)
+	var commentResponse map[string]map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &commentResponse)
+	asserts.Equal("<p><em>nice</em></p>\n", commentResponse["comment"]["bodyHtml"])
+
+	req = httptest.NewRequest("GET", "/api/articles/markdown-article/comments?html=true", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	asserts.Contains(w.Body.String(), "bodyHtml")
+}
+
+// =============================================================================
+// Search Tests
+// =============================================================================
+
+func TestArticleSearch(t *testing.T) {
+	// FTS5 needs go-sqlite3 built with -tags sqlite_fts5, FTS4 is the fallback and always available
+	for _, backend := range []string{"migrated", searchFTS4} {
+		t.Run(backend, func(t *testing.T) {
+			test_db = setupTestDB()
+			defer common.TestDBFree(test_db)
+			if backend == searchFTS4 {
+				migrated := searchBackend
+				test_db.Exec("DROP TABLE article_search")
+				test_db.Exec("CREATE VIRTUAL TABLE article_search USING fts4(title, description, body, tags, tokenize=porter)")
+				searchBackend = searchFTS4
+				defer func() { searchBackend = migrated }()
+			}
+			testArticleSearch(t)
+		})
+	}
+}
+
+func testArticleSearch(t *testing.T) {
+	asserts := assert.New(t)
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("searchauthor", "searchauthor@test.com")
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", author)
+		c.Next()
+	})
+	router.POST("/api/articles", ArticleCreate)
+	router.PUT("/api/articles/:slug", ArticleUpdate)
+	router.DELETE("/api/articles/:slug", ArticleDelete)
+	router.GET("/api/articles/search", ArticleSearch)
+	router.GET("/api/articles/:slug", ArticleRetrieve)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	search := func(query string) (float64, []map[string]interface{}) {
+		w := send("GET", "/api/articles/search?"+query, "")
+		asserts.Equal(200, w.Code, w.Body.String())
+		var response struct {
+			Articles      []map[string]interface{} `json:"articles"`
+			ArticlesCount float64                  `json:"articlesCount"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.ArticlesCount, response.Articles
+	}
+
+	send("POST", "/api/articles", `{"article":{"title":"Writing Gin middleware","description":"Desc","body":"How to write middleware <b>safely</b>","tagList":["golang"]}}`)
+	send("POST", "/api/articles", `{"article":{"title":"Cooking pasta","description":"Desc","body":"Some words about middleware","tagList":["food"]}}`)
+	send("POST", "/api/articles", `{"article":{"title":"Unrelated","description":"Desc","body":"Nothing to see","tagList":["golang"]}}`)
+
+	count, results := search("q=middleware")
+	asserts.Equal(float64(2), count)
+	asserts.Equal("writing-gin-middleware", results[0]["slug"], "Title matches should rank first")
+	highlight := results[0]["highlight"].(map[string]interface{})
+	asserts.Contains(highlight["title"], "<mark>middleware</mark>")
+	asserts.Contains(highlight["snippet"], "<mark>middleware</mark>")
+	asserts.Contains(highlight["snippet"], "&lt;b&gt;safely&lt;/b&gt;", "Snippets should be HTML escaped")
+
+	count, _ = search("q=midd")
+	asserts.Equal(float64(2), count, "The last word should match as a prefix")
+
+	count, results = search("q=middleware&tag=golang")
+	asserts.Equal(float64(1), count, "Search should combine with the list filters")
+	asserts.Equal("writing-gin-middleware", results[0]["slug"])
+
+	count, results = search("q=middleware&limit=1&offset=1")
+	asserts.Equal(float64(2), count)
+	asserts.Len(results, 1)
+
+	count, _ = search("q=golang")
+	asserts.Equal(float64(2), count, "Tags should be searchable")
+
+	count, _ = search(`q=%22AND(`)
+	asserts.Equal(float64(0), count, "FTS syntax in the query should not break the search")
+
+	// Renaming a tag reindexes its articles under the new name
+	tagModel, err := FindTag("golang")
+	asserts.NoError(err)
+	asserts.NoError(tagModel.Update("gopher", ""))
+	count, _ = search("q=gopher")
+	asserts.Equal(float64(2), count, "The new tag name should be searchable")
+	count, _ = search("q=golang")
+	asserts.Equal(float64(0), count, "The old tag name should be gone from the index")
+
+	// The index follows updates and deletes
+	send("PUT", "/api/articles/cooking-pasta", `{"article":{"body":"Boil water"}}`)
+	count, _ = search("q=middleware")
+	asserts.Equal(float64(1), count)
+	send("DELETE", "/api/articles/writing-gin-middleware", "")
+	count, _ = search("q=middleware")
+	asserts.Equal(float64(0), count)
+
+	w := send("GET", "/api/articles/search", "")
+	asserts.Equal(422, w.Code)
+
+	// Results come by relevance and page by offset, sort orders and cursors aren't ignored silently
+	w = send("GET", "/api/articles/search?q=body&sort=oldest", "")
+	asserts.Equal(422, w.Code, w.Body.String())
+	asserts.Contains(w.Body.String(), "relevance")
+	cursor := common.EncodeCursor(articleCursor{Sort: SortNewest, ID: 1})
+	w = send("GET", "/api/articles/search?q=body&after="+cursor, "")
+	asserts.Equal(422, w.Code, w.Body.String())
+	asserts.Contains(w.Body.String(), "offset")
+}
+
+// =============================================================================
+// Article Query Tests
+// =============================================================================
+
+func TestFindArticlesWithQuery(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	author1 := createTestUser("queryauthor1", "queryauthor1@test.com")
+	author2 := createTestUser("queryauthor2", "queryauthor2@test.com")
+	authorModel1 := GetArticleUserModel(author1)
+	authorModel2 := GetArticleUserModel(author2)
+
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	create := func(title string, author ArticleUserModel, created time.Time, tags ...string) ArticleModel {
+		article := createTestArticle(title, "Desc", "Body", author)
+		article.setTags(tags)
+		test_db.Save(&article)
+		test_db.Model(&article).UpdateColumns(map[string]interface{}{"created_at": created, "updated_at": created})
+		return article
+	}
+	goGin := create("Go and Gin", authorModel1, day(1), "go", "gin")
+	goOnly := create("Only Go", authorModel2, day(2), "go")
+	ginDraft := create("Gin Draft", authorModel1, day(3), "gin", "draft")
+	plain := create("No Tags", authorModel2, day(4))
+
+	goOnly.favoriteBy(authorModel1)
+	goOnly.favoriteBy(authorModel2)
+	ginDraft.favoriteBy(authorModel2)
+	CreateComment(&CommentModel{ArticleID: plain.ID, AuthorID: authorModel1.ID, Body: "first"})
+	CreateComment(&CommentModel{ArticleID: plain.ID, AuthorID: authorModel1.ID, Body: "second"})
+	CreateComment(&CommentModel{ArticleID: goGin.ID, AuthorID: authorModel1.ID, Body: "third"})
+
+	titles := func(query ArticleQuery) ([]string, int) {
+		query.Limit = 20
+		models, count, err := FindArticles(query)
+		asserts.NoError(err)
+		var titles []string
+		for _, model := range models {
+			titles = append(titles, model.Title)
+		}
+		return titles, count
+	}
+
+	found, count := titles(ArticleQuery{})
+	asserts.Equal([]string{"No Tags", "Gin Draft", "Only Go", "Go and Gin"}, found, "Newest articles should come first by default")
+	asserts.Equal(4, count)
+
+	found, count = titles(ArticleQuery{Tags: []string{"go", "gin"}})
+	asserts.Equal([]string{"Gin Draft", "Only Go", "Go and Gin"}, found, "Any of the tags should match by default")
+	asserts.Equal(3, count)
+
+	found, count = titles(ArticleQuery{Tags: []string{"go", "gin"}, TagMode: TagModeAll})
+	asserts.Equal([]string{"Go and Gin"}, found, "All of the tags should match")
+	asserts.Equal(1, count)
+
+	found, _ = titles(ArticleQuery{Tags: []string{"gin"}, ExcludeTags: []string{"draft"}})
+	asserts.Equal([]string{"Go and Gin"}, found)
+
+	found, count = titles(ArticleQuery{Tags: []string{"go"}, Author: "queryauthor2"})
+	asserts.Equal([]string{"Only Go"}, found, "Tag and author filters should combine")
+	asserts.Equal(1, count)
+
+	found, _ = titles(ArticleQuery{Favorited: "queryauthor2", ExcludeTags: []string{"draft"}})
+	asserts.Equal([]string{"Only Go"}, found)
+
+	found, count = titles(ArticleQuery{Since: day(2), Until: day(3)})
+	asserts.Equal([]string{"Gin Draft", "Only Go"}, found)
+	asserts.Equal(2, count)
+
+	found, _ = titles(ArticleQuery{Sort: SortOldest})
+	asserts.Equal([]string{"Go and Gin", "Only Go", "Gin Draft", "No Tags"}, found)
+
+	found, _ = titles(ArticleQuery{Sort: SortFavorited})
+	asserts.Equal([]string{"Only Go", "Gin Draft", "No Tags", "Go and Gin"}, found)
+
+	found, _ = titles(ArticleQuery{Sort: SortCommented})
+	asserts.Equal([]string{"No Tags", "Go and Gin", "Gin Draft", "Only Go"}, found)
+
+	test_db.Model(&goGin).UpdateColumn("updated_at", day(10))
+	found, _ = titles(ArticleQuery{Sort: SortUpdated})
+	asserts.Equal("Go and Gin", found[0])
+
+	models, count, err := FindArticles(ArticleQuery{Tags: []string{"go", "gin"}, Sort: SortOldest, Limit: 1, Offset: 1})
+	asserts.NoError(err)
+	asserts.Equal(3, count, "The count should ignore the page")
+	asserts.Equal("Only Go", models[0].Title)
+}
+
+func TestArticleListQueryString(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("querystringauthor", "querystringauthor@test.com")
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Tagged One", "Desc", "Body", authorModel)
+	article.setTags([]string{"go", "gin"})
+	test_db.Save(&article)
+	createTestArticle("Untagged", "Desc", "Body", authorModel)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", author)
+		c.Next()
+	})
+	router.GET("/api/articles", ArticleList)
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/articles?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := list("tag=go,gin&tagMode=all&sort=oldest")
+	asserts.Equal(200, w.Code)
+	asserts.Contains(w.Body.String(), `"articlesCount":1`)
+
+	w = list("tag=go&tag=gin&excludeTag=gin")
+	asserts.Contains(w.Body.String(), `"articlesCount":0`)
+
+	w = list("since=2000-01-01T00:00:00Z&author=querystringauthor")
+	asserts.Contains(w.Body.String(), `"articlesCount":2`)
+
+	w = list("sort=random")
+	asserts.Equal(422, w.Code)
+	asserts.Contains(w.Body.String(), "Sort")
+
+	w = list("since=yesterday")
+	asserts.Equal(422, w.Code)
+}
+
+// =============================================================================
+// Pagination Tests
+// =============================================================================
+
+type pageResponse struct {
+	Articles      []map[string]interface{} `json:"articles"`
+	Comments      []map[string]interface{} `json:"comments"`
+	ArticlesCount int                      `json:"articlesCount"`
+	CommentsCount int                      `json:"commentsCount"`
+	NextCursor    *string                  `json:"nextCursor"`
+	PrevCursor    *string                  `json:"prevCursor"`
+}
+
+func TestArticleCursorPagination(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("cursorauthor", "cursorauthor@test.com")
+	reader := createTestUser("cursorreader", "cursorreader@test.com")
+	authorModel := GetArticleUserModel(author)
+	test_db.Create(&users.FollowModel{FollowingID: author.ID, FollowedByID: reader.ID})
+	for i := 1; i <= 5; i++ {
+		createTestArticle(fmt.Sprintf("Cursor %d", i), "Desc", "Body", authorModel)
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", reader)
+		c.Next()
+	})
+	router.GET("/api/articles", ArticleList)
+	router.GET("/api/articles/feed", ArticleFeed)
+
+	get := func(url string) (int, pageResponse) {
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page pageResponse
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return w.Code, page
+	}
+	titles := func(page pageResponse) []string {
+		var titles []string
+		for _, article := range page.Articles {
+			titles = append(titles, article["title"].(string))
+		}
+		return titles
+	}
+
+	code, first := get("/api/articles?limit=2")
+	asserts.Equal(200, code)
+	asserts.Equal([]string{"Cursor 5", "Cursor 4"}, titles(first))
+	asserts.Equal(5, first.ArticlesCount)
+	asserts.Nil(first.PrevCursor, "The first page has no previous page")
+	asserts.NotNil(first.NextCursor)
+
+	// Articles published while paging don't shift the next page
+	createTestArticle("Cursor 6", "Desc", "Body", authorModel)
+
+	_, second := get("/api/articles?limit=2&after=" + *first.NextCursor)
+	asserts.Equal([]string{"Cursor 3", "Cursor 2"}, titles(second))
+	asserts.NotNil(second.PrevCursor)
+
+	_, third := get("/api/articles?limit=2&after=" + *second.NextCursor)
+	asserts.Equal([]string{"Cursor 1"}, titles(third))
+	asserts.Nil(third.NextCursor, "The last page has no next page")
+
+	_, back := get("/api/articles?limit=2&before=" + *second.PrevCursor)
+	asserts.Equal([]string{"Cursor 5", "Cursor 4"}, titles(back))
+	asserts.NotNil(back.PrevCursor, "The article published meanwhile is before the first page now")
+
+	// Offset mode still works and hands out cursors
+	_, offset := get("/api/articles?limit=2&offset=2")
+	asserts.Equal([]string{"Cursor 4", "Cursor 3"}, titles(offset))
+	asserts.NotNil(offset.PrevCursor)
+
+	// Cursors work for every sort order
+	_, oldest := get("/api/articles?limit=2&sort=oldest")
+	_, oldest = get("/api/articles?limit=2&sort=oldest&after=" + *oldest.NextCursor)
+	asserts.Equal([]string{"Cursor 3", "Cursor 4"}, titles(oldest))
+
+	// The feed is paginated the same way and counts its articles
+	_, feed := get("/api/articles/feed?limit=4")
+	asserts.Equal(6, feed.ArticlesCount)
+	asserts.Len(feed.Articles, 4)
+	_, feed = get("/api/articles/feed?limit=4&after=" + *feed.NextCursor)
+	asserts.Equal([]string{"Cursor 2", "Cursor 1"}, titles(feed))
+
+	code, _ = get("/api/articles?after=" + *first.NextCursor + "x")
+	asserts.Equal(422, code, "Tampered cursors should be rejected")
+	code, _ = get("/api/articles?sort=oldest&after=" + *first.NextCursor)
+	asserts.Equal(422, code, "Cursors only work with the sort order they were made for")
+	code, _ = get("/api/articles?limit=abc")
+	asserts.Equal(422, code)
+	code, _ = get("/api/articles?offset=-1")
+	asserts.Equal(422, code)
+
+	for i := 7; i <= common.MaxPageSize+2; i++ {
+		test_db.Create(&ArticleModel{Slug: fmt.Sprintf("bulk-%d", i), Title: "Bulk", AuthorID: authorModel.ID})
+	}
+	_, all := get("/api/articles?limit=1000")
+	asserts.Len(all.Articles, common.MaxPageSize, "The page size should be capped")
+}
+
+func TestCommentCursorPagination(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("commentcursor", "commentcursor@test.com")
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Comment Cursor", "Desc", "Body", authorModel)
+	for i := 1; i <= 5; i++ {
+		test_db.Create(&CommentModel{ArticleID: article.ID, AuthorID: authorModel.ID, Body: fmt.Sprintf("Comment %d", i)})
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", author)
+		c.Next()
+	})
+	router.GET("/api/articles/:slug/comments", ArticleCommentList)
+
+	get := func(query string) (int, pageResponse) {
+		req := httptest.NewRequest("GET", "/api/articles/comment-cursor/comments?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page pageResponse
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return w.Code, page
+	}
+	bodies := func(page pageResponse) []string {
+		var bodies []string
+		for _, comment := range page.Comments {
+			bodies = append(bodies, comment["body"].(string))
+		}
+		return bodies
+	}
+
+	_, all := get("")
+	asserts.Len(all.Comments, 5, "Without a limit all comments fit on a page")
+	asserts.Nil(all.NextCursor)
+
+	_, first := get("limit=2")
+	asserts.Equal([]string{"Comment 1", "Comment 2"}, bodies(first))
+	asserts.Equal(5, first.CommentsCount)
+	_, second := get("limit=2&after=" + *first.NextCursor)
+	asserts.Equal([]string{"Comment 3", "Comment 4"}, bodies(second))
+	_, back := get("limit=2&before=" + *second.PrevCursor)
+	asserts.Equal([]string{"Comment 1", "Comment 2"}, bodies(back))
+	asserts.Nil(back.PrevCursor)
+
+	code, _ := get("after=nope")
+	asserts.Equal(422, code)
+}
+
+// =============================================================================
+// Query Count Tests
+// =============================================================================
+
+// Counts the SQL statements gorm runs while it is the logger of the database.
+type queryCounter struct {
+	count int
+}
+
+func (q *queryCounter) Print(v ...interface{}) {
+	if len(v) > 0 && v[0] == "sql" {
+		q.count++
+	}
+}
+
+func TestArticleListQueryCount(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	reader := createTestUser("countreader", "countreader@test.com")
+	readerModel := GetArticleUserModel(reader)
+	for i := 1; i <= 20; i++ {
+		author := createTestUser(fmt.Sprintf("countauthor%d", i), fmt.Sprintf("countauthor%d@test.com", i))
+		article := createTestArticle(fmt.Sprintf("Count %d", i), "Desc", "Body", GetArticleUserModel(author))
+		article.setTags([]string{"golang", fmt.Sprintf("tag%d", i)})
+		test_db.Save(&article)
+		if i%2 == 0 {
+			article.favoriteBy(readerModel)
+			test_db.Create(&users.FollowModel{FollowingID: author.ID, FollowedByID: reader.ID})
+		}
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", reader)
+		c.Next()
+	})
+	router.GET("/api/articles", ArticleList)
+
+	list := func(limit int) (int, []map[string]interface{}) {
+		counter := &queryCounter{}
+		test_db.LogMode(true)
+		test_db.SetLogger(counter)
+		defer test_db.LogMode(false)
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/articles?limit=%d", limit), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		asserts.Equal(200, w.Code)
+		var response struct {
+			Articles []map[string]interface{} `json:"articles"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return counter.count, response.Articles
+	}
+
+	small, _ := list(2)
+	queries, articles := list(20)
+	asserts.Len(articles, 20)
+	asserts.Equal(small, queries, "The number of queries shouldn't depend on the page size")
+	asserts.True(queries <= 10, "A page of articles should take a handful of queries, took %d", queries)
+
+	for _, article := range articles {
+		var i int
+		fmt.Sscanf(article["title"].(string), "Count %d", &i)
+		author := article["author"].(map[string]interface{})
+		asserts.Equal(fmt.Sprintf("countauthor%d", i), author["username"])
+		asserts.Equal(i%2 == 0, author["following"], "following %s", author["username"])
+		asserts.Equal(i%2 == 0, article["favorited"])
+		if i%2 == 0 {
+			asserts.Equal(float64(1), article["favoritesCount"])
+		} else {
+			asserts.Equal(float64(0), article["favoritesCount"])
+		}
+		asserts.Equal([]interface{}{"golang", fmt.Sprintf("tag%d", i)}, article["tagList"])
+	}
+}
+
+func TestArticleRetrieveReadsOnly(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("readonlyauthor", "readonlyauthor@test.com")
+	fan := createTestUser("readonlyfan", "readonlyfan@test.com")
+	reader := createTestUser("readonlyreader", "readonlyreader@test.com")
+	article := createTestArticle("Read Only", "Desc", "Body", GetArticleUserModel(author))
+	asserts.NoError(article.favoriteBy(GetArticleUserModel(fan)))
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.GET("/api/articles/:slug", ArticleRetrieve)
+	get := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/articles/read-only", nil))
+		var response map[string]map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response["article"]
+	}
+	articleUsers := func() int {
+		var count int
+		test_db.Model(&ArticleUserModel{}).Count(&count)
+		return count
+	}
+
+	// A reader who never wrote or favorited anything has no article user, reading doesn't create one
+	before := articleUsers()
+	me = reader
+	code, response := get()
+	asserts.Equal(200, code)
+	asserts.Equal(false, response["favorited"])
+	asserts.Equal(float64(1), response["favoritesCount"])
+	asserts.Equal(before, articleUsers(), "Reading an article shouldn't write")
+
+	me = fan
+	_, response = get()
+	asserts.Equal(true, response["favorited"])
+
+	// A failed favorites query is answered instead of served as not favorited
+	test_db.Exec("ALTER TABLE favorite_models RENAME TO favorite_models_gone")
+	code, _ = get()
+	test_db.Exec("ALTER TABLE favorite_models_gone RENAME TO favorite_models")
+	asserts.Equal(422, code)
+}
+
+// =============================================================================
+// Counter Tests
+// =============================================================================
+
+func TestArticleCounters(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	author := GetArticleUserModel(createTestUser("counterauthor", "counterauthor@test.com"))
+	reader := GetArticleUserModel(createTestUser("counterreader", "counterreader@test.com"))
+	reload := func(model interface{}, id uint) {
+		test_db.First(model, id)
+	}
+
+	article := ArticleModel{Slug: "counted", Title: "Counted", Author: author, AuthorID: author.ID}
+	asserts.NoError(CreateArticle(&article))
+	other := ArticleModel{Slug: "counted-too", Title: "Counted Too", Author: author, AuthorID: author.ID}
+	asserts.NoError(CreateArticle(&other))
+	reload(&author, author.ID)
+	asserts.Equal(uint(2), author.ArticlesCount)
+
+	asserts.NoError(article.favoriteBy(reader))
+	asserts.NoError(article.favoriteBy(reader), "Favoriting twice shouldn't count twice")
+	asserts.NoError(article.favoriteBy(author))
+	reload(&article, article.ID)
+	asserts.Equal(uint(2), article.FavoritesCount)
+	asserts.NoError(article.unFavoriteBy(reader))
+	asserts.NoError(article.unFavoriteBy(reader), "Unfavoriting twice shouldn't count twice")
+	reload(&article, article.ID)
+	asserts.Equal(uint(1), article.FavoritesCount)
+
+	first := CommentModel{ArticleID: article.ID, AuthorID: reader.ID, Body: "first"}
+	asserts.NoError(CreateComment(&first))
+	asserts.NoError(CreateComment(&CommentModel{ArticleID: article.ID, AuthorID: reader.ID, Body: "second"}))
+	reload(&article, article.ID)
+	asserts.Equal(uint(2), article.CommentsCount)
+	asserts.NoError(DeleteCommentModel([]uint{first.ID}))
+	reload(&article, article.ID)
+	asserts.Equal(uint(1), article.CommentsCount)
+
+	// Saving a comment with a stale article doesn't overwrite the counters
+	stale := article
+	stale.CommentsCount, stale.FavoritesCount = 0, 0
+	asserts.NoError(CreateComment(&CommentModel{Article: stale, ArticleID: article.ID, AuthorID: reader.ID, Body: "third"}))
+	reload(&article, article.ID)
+	asserts.Equal(uint(2), article.CommentsCount)
+	asserts.Equal(uint(1), article.FavoritesCount)
+
+	found, _, err := FindArticles(ArticleQuery{MinFavorites: 1, Limit: 20})
+	asserts.NoError(err)
+	asserts.Len(found, 1)
+	asserts.Equal("counted", found[0].Slug)
+	found, _, _ = FindArticles(ArticleQuery{MinComments: 3, Limit: 20})
+	asserts.Len(found, 0)
+
+	asserts.NoError(DeleteArticleModel(&ArticleModel{Slug: "counted-too"}))
+	reload(&author, author.ID)
+	asserts.Equal(uint(1), author.ArticlesCount)
+
+	test_db.Model(&ArticleModel{}).UpdateColumns(map[string]interface{}{"favorites_count": 9, "comments_count": 9})
+	test_db.Model(&ArticleUserModel{}).UpdateColumn("articles_count", 9)
+	asserts.NoError(ReconcileCounters(test_db))
+	reload(&article, article.ID)
+	reload(&author, author.ID)
+	asserts.Equal(uint(1), article.FavoritesCount, "Reconciling should recount favorites")
+	asserts.Equal(uint(2), article.CommentsCount, "Reconciling should recount comments")
+	asserts.Equal(uint(1), author.ArticlesCount, "Reconciling should recount articles")
+}
+
+// =============================================================================
+// Cache Tests
+// =============================================================================
+
+func TestResponseCaching(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("cacheauthor", "cacheauthor@test.com")
+	authorModel := GetArticleUserModel(author)
+	article := ArticleModel{Slug: "cached", Title: "Cached", Body: "Body", Author: authorModel, AuthorID: authorModel.ID}
+	article.setTags([]string{"first"})
+	asserts.NoError(CreateArticle(&article))
+
+	var reader users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", reader)
+		c.Next()
+	})
+	router.GET("/api/articles/:slug", ArticleRetrieve)
+	router.GET("/api/tags", TagList)
+	get := func(url string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	w, _ := get("/api/tags")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"))
+	w, _ = get("/api/tags")
+	asserts.Equal("HIT", w.Header().Get("X-Cache"))
+
+	other := ArticleModel{Slug: "new-tags", Title: "New Tags", Author: authorModel, AuthorID: authorModel.ID}
+	other.setTags([]string{"second"})
+	asserts.NoError(CreateArticle(&other))
+	w, body := get("/api/tags")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "Creating an article should drop the cached tags")
+	asserts.Len(body["tags"], 2)
+
+	w, _ = get("/api/articles/cached")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"))
+	w, _ = get("/api/articles/cached")
+	asserts.Equal("HIT", w.Header().Get("X-Cache"))
+	w, _ = get("/api/articles/cached?html=true")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "The HTML variant is cached separately")
+
+	article.favoriteBy(authorModel)
+	w, body = get("/api/articles/cached")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "Favoriting should drop the cached article")
+	asserts.Equal(float64(1), body["article"].(map[string]interface{})["favoritesCount"])
+	asserts.Equal(false, body["article"].(map[string]interface{})["favorited"], "Anonymous readers haven't favorited it")
+	asserts.False(article.isFavoriteBy(ArticleUserModel{}))
+
+	article.Update(ArticleModel{Title: "Cached Again"})
+	w, body = get("/api/articles/cached")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "Updating should drop the cached article")
+	asserts.Equal("Cached Again", body["article"].(map[string]interface{})["title"])
+
+	w, _ = get("/api/articles/missing")
+	asserts.Equal(404, w.Code)
+	w, _ = get("/api/articles/missing")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "Errors aren't cached")
+
+	reader = author
+	w, body = get("/api/articles/cached")
+	asserts.Equal("", w.Header().Get("X-Cache"), "Signed in readers aren't served from the cache")
+	asserts.Equal(true, body["article"].(map[string]interface{})["favorited"])
+
+	reader = users.UserModel{}
+	DeleteArticleModel(&ArticleModel{Slug: "cached"})
+	w, _ = get("/api/articles/cached")
+	asserts.Equal(404, w.Code, "Deleting should drop the cached article")
+}
+
+// =============================================================================
+// Conditional Request Tests
+// =============================================================================
+
+func TestArticleConditionalRequests(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("etagauthor", "etagauthor@test.com")
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Tagged Entity", "Desc", "Body", authorModel)
+
+	var reader users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", reader)
+		c.Next()
+	})
+	router.GET("/api/articles", ArticleList)
+	router.GET("/api/articles/:slug", ArticleRetrieve)
+	router.PUT("/api/articles/:slug", ArticleUpdate)
+	router.GET("/api/tags", TagList)
+	request := func(method, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, url := range []string{"/api/articles", "/api/tags", "/api/articles/" + article.Slug} {
+		for _, signedIn := range []bool{false, true} {
+			reader = users.UserModel{}
+			if signedIn {
+				reader = author
+			}
+			w := request("GET", url, "", nil)
+			etag := w.Header().Get("ETag")
+			asserts.NotEmpty(etag, url)
+			w = request("GET", url, "", map[string]string{"If-None-Match": etag})
+			asserts.Equal(304, w.Code, url)
+			asserts.Empty(w.Body.String(), url)
+		}
+	}
+
+	reader = author
+	read := request("GET", "/api/articles/"+article.Slug, "", nil).Header().Get("ETag")
+	w := request("PUT", "/api/articles/"+article.Slug, `{"article":{"title":"Tagged Entity","body":"First edit"}}`,
+		map[string]string{"If-Match": read})
+	asserts.Equal(200, w.Code)
+	written := w.Header().Get("ETag")
+	asserts.NotEqual(read, written)
+
+	w = request("PUT", "/api/articles/"+article.Slug, `{"article":{"title":"Tagged Entity","body":"Lost update"}}`,
+		map[string]string{"If-Match": read})
+	asserts.Equal(412, w.Code, "An edit based on a stale read should be refused")
+	var found ArticleModel
+	test_db.First(&found, article.ID)
+	asserts.Equal("First edit", found.Body)
+
+	w = request("GET", "/api/articles/"+article.Slug, "", map[string]string{"If-None-Match": written})
+	asserts.Equal(304, w.Code, "The ETag of a write response should match the next read")
+
+	fan := createTestUser("etagfan", "etagfan@test.com")
+	test_db.First(&found, article.ID)
+	asserts.NoError(found.favoriteBy(GetArticleUserModel(fan)))
+	w = request("GET", "/api/articles/"+article.Slug, "", map[string]string{"If-None-Match": written})
+	asserts.Equal(200, w.Code, "A new favorite changes the body")
+	w = request("PUT", "/api/articles/"+article.Slug, `{"article":{"title":"Tagged Entity","body":"Second edit"}}`,
+		map[string]string{"If-Match": written})
+	asserts.Equal(200, w.Code, "Favorites by others don't change the version of the article")
+
+	// Two edits of the same read, the second finds the row changed inside its write
+	var first, second ArticleModel
+	test_db.First(&first, article.ID)
+	test_db.First(&second, article.ID)
+	asserts.NoError(first.UpdateUnmodified(ArticleModel{Body: "Won"}))
+	asserts.Equal(common.ErrPreconditionFailed, second.UpdateUnmodified(ArticleModel{Body: "Lost"}))
+	test_db.First(&found, article.ID)
+	asserts.Equal("Won", found.Body)
+	asserts.NoError(first.UpdateUnmodified(ArticleModel{Body: "Won"}), "Writing the same state again is no conflict")
+}
+
+// =============================================================================
+// Comment Thread Tests
+// =============================================================================
+
+func TestCommentThreads(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("threadauthor", "threadauthor@test.com")
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Threaded", "Desc", "Body", authorModel)
+	elsewhere := createTestArticle("Elsewhere", "Desc", "Body", authorModel)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", author)
+		c.Next()
+	})
+	router.POST("/api/articles/:slug/comments", ArticleCommentCreate)
+	router.GET("/api/articles/:slug/comments", ArticleCommentList)
+	router.GET("/api/articles/:slug/comments/:id/replies", ArticleCommentReplies)
+	router.DELETE("/api/articles/:slug/comments/:id", ArticleCommentDelete)
+
+	type thread struct {
+		Comments []struct {
+			CommentResponse
+			Replies []struct {
+				CommentResponse
+				Replies []CommentResponse `json:"replies"`
+			} `json:"replies"`
+		} `json:"comments"`
+		CommentsCount int     `json:"commentsCount"`
+		NextCursor    *string `json:"nextCursor"`
+	}
+	request := func(method, url, body string) (int, thread, map[string]CommentResponse) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var page thread
+		var created map[string]CommentResponse
+		json.Unmarshal(w.Body.Bytes(), &page)
+		json.Unmarshal(w.Body.Bytes(), &created)
+		return w.Code, page, created
+	}
+	comments := "/api/articles/" + article.Slug + "/comments"
+	reply := func(body string, parent *uint) uint {
+		payload := fmt.Sprintf(`{"comment":{"body":%q}}`, body)
+		if parent != nil {
+			payload = fmt.Sprintf(`{"comment":{"body":%q,"parentId":%d}}`, body, *parent)
+		}
+		code, _, created := request("POST", comments, payload)
+		asserts.Equal(201, code, body)
+		return created["comment"].ID
+	}
+
+	first := reply("first", nil)
+	second := reply("second", nil)
+	answer := reply("answer", &first)
+	deeper := reply("deeper", &answer)
+	deepest := reply("deepest", &deeper)
+
+	code, page, _ := request("GET", comments, "")
+	asserts.Equal(200, code)
+	asserts.Equal(2, page.CommentsCount, "Only top-level comments are counted")
+	asserts.Len(page.Comments, 2)
+	asserts.Equal(first, page.Comments[0].ID)
+	asserts.Equal(uint(1), page.Comments[0].RepliesCount)
+	asserts.Len(page.Comments[0].Replies, 1)
+	asserts.Equal(answer, page.Comments[0].Replies[0].ID)
+	asserts.Equal(first, *page.Comments[0].Replies[0].ParentID)
+	asserts.Len(page.Comments[0].Replies[0].Replies, 1, "Two levels of replies are loaded by default")
+	asserts.Equal(uint(1), page.Comments[0].Replies[0].Replies[0].RepliesCount)
+	asserts.Len(page.Comments[1].Replies, 0)
+
+	_, page, _ = request("GET", comments+"?depth=0", "")
+	asserts.Len(page.Comments[0].Replies, 0)
+	code, _, _ = request("GET", comments+"?depth=9", "")
+	asserts.Equal(422, code)
+
+	_, page, _ = request("GET", comments+"?limit=1", "")
+	asserts.Len(page.Comments, 1, "Top-level comments are paginated")
+	asserts.NotNil(page.NextCursor)
+	_, page, _ = request("GET", comments+"?limit=1&after="+*page.NextCursor, "")
+	asserts.Equal(second, page.Comments[0].ID)
+
+	_, page, _ = request("GET", fmt.Sprintf("%s/%d/replies", comments, deeper), "")
+	asserts.Len(page.Comments, 1)
+	asserts.Equal(deepest, page.Comments[0].ID)
+	code, _, _ = request("GET", fmt.Sprintf("/api/articles/%s/comments/%d/replies", elsewhere.Slug, deeper), "")
+	asserts.Equal(404, code, "Replies are only found under their own article")
+
+	code, _, _ = request("POST", "/api/articles/"+elsewhere.Slug+"/comments", fmt.Sprintf(`{"comment":{"body":"x","parentId":%d}}`, first))
+	asserts.Equal(422, code, "Replies must answer a comment of the same article")
+
+	var removed []CommentModel
+	unsubscribe := common.Subscribe(func(e common.Event) {
+		removed = append(removed, e.Payload.(CommentModel))
+	}, EventCommentDeleted)
+	defer unsubscribe()
+
+	// A comment with replies becomes a tombstone
+	code, _, _ = request("DELETE", fmt.Sprintf("%s/%d", comments, answer), "")
+	asserts.Equal(200, code)
+	asserts.Len(removed, 1, "Removing a comment is an event")
+	asserts.Equal(answer, removed[0].ID)
+	asserts.Equal("", removed[0].Body, "The event carries the comment as it is once removed")
+	asserts.NotNil(removed[0].RemovedAt)
+	_, page, _ = request("GET", comments, "")
+	tombstone := page.Comments[0].Replies[0]
+	asserts.Equal(answer, tombstone.ID)
+	asserts.True(tombstone.Removed)
+	asserts.Equal("", tombstone.Body)
+	asserts.Len(tombstone.Replies, 1, "The replies of a tombstone stay in the thread")
+	code, _, _ = request("POST", comments, fmt.Sprintf(`{"comment":{"body":"x","parentId":%d}}`, answer))
+	asserts.Equal(422, code, "Tombstones can't be replied to")
+	var counted ArticleModel
+	test_db.First(&counted, article.ID)
+	asserts.Equal(uint(4), counted.CommentsCount)
+
+	// Removing the last reply below a tombstone removes the tombstone too
+	request("DELETE", fmt.Sprintf("%s/%d", comments, deepest), "")
+	request("DELETE", fmt.Sprintf("%s/%d", comments, deeper), "")
+	asserts.Len(removed, 3, "One event per removed comment, the tombstone goes along silently")
+	asserts.Equal(deeper, removed[2].ID)
+	_, page, _ = request("GET", comments, "")
+	asserts.Equal(uint(0), page.Comments[0].RepliesCount)
+	asserts.Len(page.Comments[0].Replies, 0)
+	test_db.First(&counted, article.ID)
+	asserts.Equal(uint(2), counted.CommentsCount)
+
+	code, _, _ = request("DELETE", fmt.Sprintf("%s/%d", comments, deepest), "")
+	asserts.Equal(404, code)
+
+	test_db.Model(&CommentModel{}).UpdateColumn("replies_count", 7)
+	asserts.NoError(ReconcileCounters(test_db))
+	_, page, _ = request("GET", comments, "")
+	asserts.Equal(uint(0), page.Comments[0].RepliesCount, "Reconciling should recount replies")
+}
+
+// =============================================================================
+// Comment Editing Tests
+// =============================================================================
+
+func TestCommentEditing(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("editauthor", "editauthor@test.com")
+	other := createTestUser("editother", "editother@test.com")
+	moderator := createTestUser("editmoderator", "editmoderator@test.com")
+	test_db.Model(&moderator).UpdateColumn("role", users.RoleModerator)
+	moderator.Role = users.RoleModerator
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Editable", "Desc", "Body", authorModel)
+	elsewhere := createTestArticle("Not Here", "Desc", "Body", authorModel)
+	comment := CommentModel{ArticleID: article.ID, AuthorID: authorModel.ID, Body: "orginal"}
+	asserts.NoError(CreateComment(&comment))
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.PUT("/api/articles/:slug/comments/:id", ArticleCommentUpdate)
+	router.GET("/api/articles/:slug/comments/:id/revisions", ArticleCommentRevisions)
+	url := fmt.Sprintf("/api/articles/%s/comments/%d", article.Slug, comment.ID)
+	request := func(method, url, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	me = author
+	code, response := request("PUT", url, `{"comment":{"body":"original"}}`)
+	asserts.Equal(200, code)
+	edited := response["comment"].(map[string]interface{})
+	asserts.Equal("original", edited["body"])
+	asserts.Equal(true, edited["edited"])
+	asserts.Equal("editauthor", edited["author"].(map[string]interface{})["username"])
+	code, _ = request("PUT", url, `{"comment":{"body":"*original*"}}`)
+	asserts.Equal(200, code)
+
+	code, _ = request("PUT", fmt.Sprintf("/api/articles/%s/comments/%d", elsewhere.Slug, comment.ID), `{"comment":{"body":"x"}}`)
+	asserts.Equal(404, code)
+
+	me = other
+	code, _ = request("PUT", url, `{"comment":{"body":"hijacked"}}`)
+	asserts.Equal(403, code, "Only the author can edit a comment")
+
+	me = author
+	defer func(window time.Duration) { CommentEditWindow = window }(CommentEditWindow)
+	CommentEditWindow = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	code, _ = request("PUT", url, `{"comment":{"body":"too late"}}`)
+	asserts.Equal(403, code, "Comments can't be edited after the edit window")
+
+	code, _ = request("GET", url+"/revisions", "")
+	asserts.Equal(403, code, "Only moderators can read revisions")
+
+	me = moderator
+	code, response = request("GET", url+"/revisions", "")
+	asserts.Equal(200, code)
+	asserts.Equal(float64(2), response["revisionsCount"])
+	revisions := response["revisions"].([]interface{})
+	asserts.Equal("original", revisions[0].(map[string]interface{})["body"], "The latest replaced version comes first")
+	asserts.Equal("orginal", revisions[1].(map[string]interface{})["body"])
+
+	var saved CommentModel
+	test_db.First(&saved, comment.ID)
+	asserts.Equal("*original*", saved.Body)
+	asserts.Equal("<p><em>original</em></p>\n", saved.BodyHTML)
+}
+
+func TestCommentMutationScoping(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("scopeauthor", "scopeauthor@test.com")
+	other := createTestUser("scopeother", "scopeother@test.com")
+	moderator := createTestUser("scopemoderator", "scopemoderator@test.com")
+	test_db.Model(&moderator).UpdateColumn("role", users.RoleModerator)
+	moderator.Role = users.RoleModerator
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Scoped", "Desc", "Body", authorModel)
+	elsewhere := createTestArticle("Elsewhere", "Desc", "Body", authorModel)
+	comment := CommentModel{ArticleID: article.ID, AuthorID: authorModel.ID, Body: "mine"}
+	asserts.NoError(CreateComment(&comment))
+	second := CommentModel{ArticleID: article.ID, AuthorID: authorModel.ID, Body: "also mine"}
+	asserts.NoError(CreateComment(&second))
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.PUT("/api/articles/:slug/comments/:id", ArticleCommentUpdate)
+	router.DELETE("/api/articles/:slug/comments/:id", ArticleCommentDelete)
+	request := func(method, slug string, id uint) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, fmt.Sprintf("/api/articles/%s/comments/%d", slug, id), bytes.NewBufferString(`{"comment":{"body":"changed"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	exists := func(id uint) bool {
+		var count int
+		test_db.Model(&CommentModel{}).Where("id = ?", id).Count(&count)
+		return count == 1
+	}
+
+	// The comment has to belong to the article in the URL
+	me = author
+	asserts.Equal(404, request("DELETE", elsewhere.Slug, comment.ID))
+	asserts.Equal(404, request("PUT", elsewhere.Slug, comment.ID))
+	asserts.Equal(404, request("DELETE", "missing-article", comment.ID))
+	asserts.Equal(404, request("DELETE", article.Slug, 99999))
+	asserts.True(exists(comment.ID))
+
+	// Other users can't change it
+	me = other
+	asserts.Equal(403, request("DELETE", article.Slug, comment.ID))
+	asserts.Equal(403, request("PUT", article.Slug, comment.ID))
+	asserts.True(exists(comment.ID))
+
+	// Moderators may delete it, but not rewrite it
+	me = moderator
+	asserts.Equal(403, request("PUT", article.Slug, second.ID))
+	asserts.Equal(200, request("DELETE", article.Slug, second.ID))
+	asserts.False(exists(second.ID))
+
+	// The author may do both
+	me = author
+	asserts.Equal(200, request("PUT", article.Slug, comment.ID))
+	asserts.Equal(200, request("DELETE", article.Slug, comment.ID))
+	asserts.False(exists(comment.ID))
+	asserts.Equal(404, request("DELETE", article.Slug, comment.ID))
+}
+
+func TestReactions(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("reactauthor", "reactauthor@test.com")
+	reader := createTestUser("reactreader", "reactreader@test.com")
+	authorModel := GetArticleUserModel(author)
+	article := createTestArticle("Reactions", "Desc", "Body", authorModel)
+	elsewhere := createTestArticle("No Reactions", "Desc", "Body", authorModel)
+	comment := CommentModel{ArticleID: article.ID, AuthorID: authorModel.ID, Body: "react to me"}
+	asserts.NoError(CreateComment(&comment))
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.GET("/api/articles/", ArticleList)
+	router.GET("/api/articles/:slug/comments", ArticleCommentList)
+	router.GET("/api/articles/:slug/reactions", ArticleReactionList)
+	router.GET("/api/articles/:slug/comments/:id/reactions", ArticleCommentReactionList)
+	router.POST("/api/articles/:slug/reactions/:emoji", ArticleReactionAdd)
+	router.DELETE("/api/articles/:slug/reactions/:emoji", ArticleReactionRemove)
+	router.POST("/api/articles/:slug/comments/:id/reactions/:emoji", ArticleCommentReactionAdd)
+	router.DELETE("/api/articles/:slug/comments/:id/reactions/:emoji", ArticleCommentReactionRemove)
+	request := func(method, url string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	reactions := func(response map[string]interface{}, key string) []interface{} {
+		return response[key].(map[string]interface{})["reactions"].([]interface{})
+	}
+	counted := func(emoji string, count int, reacted bool) map[string]interface{} {
+		return map[string]interface{}{"emoji": emoji, "count": float64(count), "reacted": reacted}
+	}
+	articleURL := "/api/articles/" + article.Slug
+	commentURL := fmt.Sprintf("%s/comments/%d", articleURL, comment.ID)
+
+	// Reacting twice with the same emoji counts once, counts follow the configured emoji order
+	me = author
+	code, _ := request("POST", articleURL+"/reactions/🎉")
+	asserts.Equal(200, code)
+	me = reader
+	request("POST", articleURL+"/reactions/🎉")
+	request("POST", articleURL+"/reactions/🎉")
+	code, response := request("POST", articleURL+"/reactions/👍")
+	asserts.Equal(200, code)
+	asserts.Equal([]interface{}{counted("👍", 1, true), counted("🎉", 2, true)}, reactions(response, "article"))
+
+	code, response = request("POST", articleURL+"/reactions/🦄")
+	asserts.Equal(422, code)
+	asserts.Contains(response["errors"], "emoji")
+	code, _ = request("POST", "/api/articles/missing/reactions/🎉")
+	asserts.Equal(404, code)
+
+	// Removing is idempotent too
+	code, response = request("DELETE", articleURL+"/reactions/👍")
+	asserts.Equal(200, code)
+	asserts.Equal([]interface{}{counted("🎉", 2, true)}, reactions(response, "article"))
+	code, response = request("DELETE", articleURL+"/reactions/👍")
+	asserts.Equal(200, code)
+	asserts.Equal([]interface{}{counted("🎉", 2, true)}, reactions(response, "article"))
+
+	// Lists show the counts, and whether the current user reacted
+	me = author
+	request("DELETE", articleURL+"/reactions/🎉")
+	request("POST", articleURL+"/reactions/❤️")
+	_, response = request("GET", "/api/articles/")
+	for _, listed := range response["articles"].([]interface{}) {
+		listed := listed.(map[string]interface{})
+		switch listed["slug"] {
+		case article.Slug:
+			asserts.Equal([]interface{}{counted("🎉", 1, false), counted("❤️", 1, true)}, listed["reactions"])
+		case elsewhere.Slug:
+			asserts.Equal([]interface{}{}, listed["reactions"])
+		}
+	}
+
+	// Comments of the article get reactions the same way
+	code, response = request("POST", commentURL+"/reactions/👀")
+	asserts.Equal(200, code)
+	asserts.Equal([]interface{}{counted("👀", 1, true)}, reactions(response, "comment"))
+	code, _ = request("POST", fmt.Sprintf("/api/articles/%s/comments/%d/reactions/👀", elsewhere.Slug, comment.ID))
+	asserts.Equal(404, code)
+	me = users.UserModel{}
+	_, response = request("GET", articleURL+"/comments")
+	listed := response["comments"].([]interface{})[0].(map[string]interface{})
+	asserts.Equal([]interface{}{counted("👀", 1, false)}, listed["reactions"])
+
+	// Who reacted, optionally with one emoji
+	code, response = request("GET", articleURL+"/reactions")
+	asserts.Equal(200, code)
+	asserts.Equal(float64(2), response["reactionsCount"])
+	listedReactions := response["reactions"].([]interface{})
+	asserts.Equal("🎉", listedReactions[0].(map[string]interface{})["emoji"])
+	asserts.Equal("reactreader", listedReactions[0].(map[string]interface{})["profile"].(map[string]interface{})["username"])
+	asserts.Equal("reactauthor", listedReactions[1].(map[string]interface{})["profile"].(map[string]interface{})["username"])
+	_, response = request("GET", articleURL+"/reactions?emoji=❤️")
+	asserts.Equal(float64(1), response["reactionsCount"])
+	code, _ = request("GET", articleURL+"/reactions?emoji=🦄")
+	asserts.Equal(422, code)
+	_, response = request("GET", commentURL+"/reactions")
+	asserts.Equal(float64(1), response["reactionsCount"])
+
+	// Reactions go with the comment
+	asserts.NoError(RemoveComment(comment))
+	var count int
+	test_db.Model(&ReactionModel{}).Where("target_type = ?", ReactionTargetComment).Count(&count)
+	asserts.Equal(0, count)
+}
+
+func TestMentions(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("mentionauthor", "mentionauthor@test.com")
+	alice := createTestUser("alice", "alice@test.com")
+	bob := createTestUser("bob", "bob@test.com")
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.POST("/api/articles/", ArticleCreate)
+	router.PUT("/api/articles/:slug", ArticleUpdate)
+	router.POST("/api/articles/:slug/comments", ArticleCommentCreate)
+	router.PUT("/api/articles/:slug/comments/:id", ArticleCommentUpdate)
+	router.DELETE("/api/articles/:slug/comments/:id", ArticleCommentDelete)
+	router.GET("/api/user/mentions", MentionList)
+	request := func(method, url, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	mentioned := func(sourceType string) []string {
+		var usernames []string
+		test_db.Table("mention_models").
+			Joins("JOIN user_models ON user_models.id = mention_models.user_model_id").
+			Where("mention_models.deleted_at IS NULL AND mention_models.source_type = ?", sourceType).
+			Order("user_models.username").
+			Pluck("user_models.username", &usernames)
+		return usernames
+	}
+
+	// Mentions of unknown users are refused, the author mentioning themselves isn't recorded
+	me = author
+	code, response := request("POST", "/api/articles/", `{"article":{"title":"Mentions","description":"d","body":"hi @alice, @nobody and @mentionauthor"}}`)
+	asserts.Equal(422, code)
+	asserts.Equal(ErrUnknownMention.Error()+": @nobody", response["errors"].(map[string]interface{})["body"])
+	code, response = request("POST", "/api/articles/", `{"article":{"title":"Mentions","description":"d","body":"hi @alice and @mentionauthor"}}`)
+	asserts.Equal(201, code)
+	slug := response["article"].(map[string]interface{})["slug"].(string)
+	asserts.Equal([]string{"alice"}, mentioned(MentionInArticle))
+
+	// Saving the body again rebuilds the index
+	code, _ = request("PUT", "/api/articles/"+slug, `{"article":{"title":"Mentions","body":"now @bob, @bob"}}`)
+	asserts.Equal(200, code)
+	asserts.Equal([]string{"bob"}, mentioned(MentionInArticle))
+
+	code, response = request("POST", "/api/articles/"+slug+"/comments", `{"comment":{"body":"@alice @carol look"}}`)
+	asserts.Equal(422, code)
+	asserts.Equal(ErrUnknownMention.Error()+": @carol", response["errors"].(map[string]interface{})["body"])
+	code, response = request("POST", "/api/articles/"+slug+"/comments", `{"comment":{"body":"@alice @bob look"}}`)
+	asserts.Equal(201, code)
+	commentID := uint(response["comment"].(map[string]interface{})["id"].(float64))
+	asserts.Equal([]string{"alice", "bob"}, mentioned(MentionInComment))
+	code, _ = request("PUT", fmt.Sprintf("/api/articles/%s/comments/%d", slug, commentID), `{"comment":{"body":"@alice and @nobody"}}`)
+	asserts.Equal(422, code)
+	asserts.Equal([]string{"alice", "bob"}, mentioned(MentionInComment))
+	code, _ = request("PUT", fmt.Sprintf("/api/articles/%s/comments/%d", slug, commentID), `{"comment":{"body":"@alice only"}}`)
+	asserts.Equal(200, code)
+	asserts.Equal([]string{"alice"}, mentioned(MentionInComment))
+
+	// A body saved before a mentioned user was renamed doesn't fail an edit which leaves it alone
+	test_db.Model(&bob).Update("username", "robert")
+	code, _ = request("PUT", "/api/articles/"+slug, `{"article":{"title":"Mentions again"}}`)
+	asserts.Equal(200, code)
+	asserts.Equal([]string{"robert"}, mentioned(MentionInArticle))
+	test_db.Model(&bob).Update("username", "bob")
+
+	// Each user sees where they were mentioned, most recent first
+	me = alice
+	code, response = request("GET", "/api/user/mentions", "")
+	asserts.Equal(200, code)
+	asserts.Equal(float64(1), response["mentionsCount"])
+	mention := response["mentions"].([]interface{})[0].(map[string]interface{})
+	asserts.Equal(MentionInComment, mention["source"])
+	asserts.Equal(float64(commentID), mention["commentId"])
+	asserts.Equal(slug, mention["article"].(map[string]interface{})["slug"])
+	asserts.Equal("mentionauthor", mention["mentionedBy"].(map[string]interface{})["username"])
+	me = bob
+	_, response = request("GET", "/api/user/mentions", "")
+	asserts.Equal(float64(1), response["mentionsCount"])
+	mention = response["mentions"].([]interface{})[0].(map[string]interface{})
+	asserts.Equal(MentionInArticle, mention["source"])
+	asserts.Nil(mention["commentId"])
+
+	// Mentions go with the comment
+	me = author
+	code, _ = request("DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, commentID), "")
+	asserts.Equal(200, code)
+	asserts.Empty(mentioned(MentionInComment))
+}
+
+func TestNormalizeTag(t *testing.T) {
+	asserts := assert.New(t)
+
+	for name, normalized := range map[string]string{
+		"go":                  "go",
+		" Go ":                "go",
+		"#golang":             "golang",
+		"Machine Learning":    "machine-learning",
+		"machine_learning":    "machine-learning",
+		"--machine--learning": "machine-learning",
+		"c++":                 "c++",
+		"#":                   "",
+	} {
+		asserts.Equal(normalized, NormalizeTag(name), name)
+	}
+	asserts.Equal([]string{"go", "rust"}, normalizeTags([]string{"Go", "#go", "", "rust", " GO"}))
+}
+
+func TestTagManagement(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := createTestUser("tagauthor", "tagauthor@test.com")
+	admin := createTestUser("tagadmin", "tagadmin@test.com")
+	test_db.Model(&admin).Update("role", users.RoleAdmin)
+	admin.Role = users.RoleAdmin
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.POST("/api/articles/", ArticleCreate)
+	router.GET("/api/articles/", ArticleList)
+	TagsAnonymousRegister(router.Group("/api/tags"))
+	TagsRegister(router.Group("/api/tags"))
+	request := func(method, url, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	create := func(title string, tags string) (int, []interface{}) {
+		code, response := request("POST", "/api/articles/", `{"article":{"title":"`+title+`","body":"b","tagList":[`+tags+`]}}`)
+		if code != 201 {
+			return code, nil
+		}
+		return code, response["article"].(map[string]interface{})["tagList"].([]interface{})
+	}
+	slugs := func(tag string) []string {
+		_, response := request("GET", "/api/articles/?tag="+tag+"&sort=oldest", "")
+		list := []string{}
+		for _, article := range response["articles"].([]interface{}) {
+			list = append(list, article.(map[string]interface{})["slug"].(string))
+		}
+		return list
+	}
+
+	// Tags are normalized and repeated ones dropped
+	me = author
+	code, tags := create("Tagged Go", `"Go", "#go", "Web Dev"`)
+	asserts.Equal(201, code)
+	asserts.ElementsMatch([]interface{}{"go", "web-dev"}, tags)
+
+	// Too many or too long tags are refused
+	code, _ = create("Tag Spam", `"a","b","c","d","e","f","g","h","i","j","k"`)
+	asserts.Equal(422, code)
+	code, _ = create("Long Tag", `"abcdefghijklmnopqrstuvwxyz0123456789"`)
+	asserts.Equal(422, code)
+
+	// A tag which is empty once normalized is refused, the article isn't saved with the other tags
+	code, response := request("POST", "/api/articles/", `{"article":{"title":"Hash Tag","body":"b","tagList":["go","#"]}}`)
+	asserts.Equal(422, code)
+	asserts.Equal(ErrInvalidTag.Error(), response["errors"].(map[string]interface{})["tagList"])
+	_, err := FindOneArticle(&ArticleModel{Slug: "hash-tag"})
+	asserts.Error(err, "the article shouldn't be saved")
+
+	create("Tagged Golang", `"golang"`)
+	asserts.Equal([]string{"tagged-go"}, slugs("go"))
+
+	// Only admins manage tags
+	code, _ = request("POST", "/api/tags/golang/merge", `{"tag":{"into":"go"}}`)
+	asserts.Equal(403, code)
+
+	// Merging moves the articles, the merged name resolves as an alias from then on
+	me = admin
+	code, response = request("POST", "/api/tags/golang/merge", `{"tag":{"into":"go"}}`)
+	asserts.Equal(200, code)
+	tag := response["tag"].(map[string]interface{})
+	asserts.Equal("go", tag["tag"])
+	asserts.Equal([]interface{}{"golang"}, tag["aliases"])
+	asserts.Equal(float64(2), tag["articlesCount"])
+	asserts.Equal([]string{"tagged-go", "tagged-golang"}, slugs("golang"))
+	code, tags = create("Tagged Again", `"GoLang", "go"`)
+	asserts.Equal(201, code)
+	asserts.Equal([]interface{}{"go"}, tags, "aliases resolve when articles are tagged")
+	code, _ = request("POST", "/api/tags/go/merge", `{"tag":{"into":"golang"}}`)
+	asserts.Equal(422, code)
+	code, _ = request("POST", "/api/tags/go/merge", `{"tag":{"into":"nothing"}}`)
+	asserts.Equal(404, code)
+
+	// Articles which had both tags keep one
+	create("Both Tags", `"web-dev", "web"`)
+	code, _ = request("POST", "/api/tags/web/merge", `{"tag":{"into":"web-dev"}}`)
+	asserts.Equal(200, code)
+	var count int
+	test_db.Table("article_tags").
+		Joins("JOIN article_models ON article_models.id = article_tags.article_model_id").
+		Where("article_models.slug = ?", "both-tags").Count(&count)
+	asserts.Equal(1, count)
+
+	// Renaming keeps the former name as an alias
+	code, response = request("PUT", "/api/tags/web-dev", `{"tag":{"name":"Web Development","description":"Building for the web"}}`)
+	asserts.Equal(200, code)
+	tag = response["tag"].(map[string]interface{})
+	asserts.Equal("web-development", tag["tag"])
+	asserts.Equal("Building for the web", tag["description"])
+	asserts.Equal([]interface{}{"web", "web-dev"}, tag["aliases"])
+	code, _ = request("PUT", "/api/tags/web-development", `{"tag":{"name":"go"}}`)
+	asserts.Equal(422, code, "a name taken by another tag is refused")
+	code, _ = request("PUT", "/api/tags/web-development", `{"tag":{"name":"golang"}}`)
+	asserts.Equal(422, code, "so is an alias of another tag")
+	code, response = request("PUT", "/api/tags/web", `{"tag":{"description":"Anything web"}}`)
+	asserts.Equal(200, code, "the name is kept when only the description changes")
+	asserts.Equal("web-development", response["tag"].(map[string]interface{})["tag"])
+
+	// Aliases
+	code, response = request("POST", "/api/tags/go/aliases", `{"alias":{"name":"Go Lang"}}`)
+	asserts.Equal(200, code)
+	asserts.Equal([]interface{}{"go-lang", "golang"}, response["tag"].(map[string]interface{})["aliases"])
+	asserts.Len(slugs("go-lang"), 3)
+	code, _ = request("POST", "/api/tags/go/aliases", `{"alias":{"name":"web"}}`)
+	asserts.Equal(422, code, "an alias of another tag is refused")
+	code, _ = request("POST", "/api/tags/go/aliases", `{"alias":{"name":"web-development"}}`)
+	asserts.Equal(422, code, "so is another tag")
+	code, _ = request("DELETE", "/api/tags/go/aliases/go-lang", "")
+	asserts.Equal(200, code)
+	asserts.Empty(slugs("go-lang"))
+	code, _ = request("DELETE", "/api/tags/go/aliases/go-lang", "")
+	asserts.Equal(404, code)
+
+	// Anyone can read a tag, by any of its names
+	me = users.UserModel{}
+	code, response = request("GET", "/api/tags/Golang", "")
+	asserts.Equal(200, code)
+	asserts.Equal("go", response["tag"].(map[string]interface{})["tag"])
+	code, _ = request("GET", "/api/tags/nothing", "")
+	asserts.Equal(404, code)
+
+	// Tags created before normalization are renamed, or merged into their normalized twin
+	legacy := TagModel{Tag: "Rust Lang"}
+	test_db.Create(&legacy)
+	twin := TagModel{Tag: "GO"}
+	test_db.Create(&twin)
+	asserts.NoError(NormalizeExistingTags())
+	var names []string
+	test_db.Model(&TagModel{}).Order("tag").Pluck("tag", &names)
+	asserts.Equal([]string{"go", "rust-lang", "web-development"}, names)
+}
+
+func TestTagPopularity(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+	common.GetCache().DeletePrefix(tagsCacheKey)
+
+	author := createTestUser("popularauthor", "popularauthor@test.com")
+	reader := createTestUser("popularreader", "popularreader@test.com")
+	authorModel := GetArticleUserModel(author)
+	readerModel := GetArticleUserModel(reader)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	tagged := func(title string, created time.Time, tags ...string) ArticleModel {
+		article := ArticleModel{Slug: slug.Make(title), Title: title, AuthorID: authorModel.ID}
+		asserts.NoError(article.setTags(tags))
+		asserts.NoError(CreateArticle(&article))
+		test_db.Model(&article).UpdateColumn("created_at", created)
+		return article
+	}
+	// go is on most articles, rust's are new and favorited, python's article was deleted
+	tagged("Go One", old, "go")
+	tagged("Go Two", old, "go")
+	goThree := tagged("Go Three", old, "go", "rust")
+	rust := tagged("Rust Now", time.Now(), "rust")
+	asserts.NoError(rust.favoriteBy(readerModel))
+	asserts.NoError(goThree.favoriteBy(readerModel))
+	test_db.Model(&FavoriteModel{}).Where("favorite_id = ?", goThree.ID).UpdateColumn("created_at", old)
+	python := tagged("Python", old, "python")
+	asserts.NoError(DeleteArticleModel(&ArticleModel{Slug: python.Slug}))
+	test_db.Create(&TagModel{Tag: "unused"})
+
+	router := gin.New()
+	router.GET("/api/tags", TagList)
+	get := func(url string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	// Most used first, with the counts in the same order
+	w, response := get("/api/tags")
+	asserts.Equal(200, w.Code)
+	asserts.Equal([]interface{}{"go", "rust", "python", "unused"}, response["tags"])
+	counts := response["tagCounts"].([]interface{})
+	asserts.Equal(map[string]interface{}{"tag": "go", "articlesCount": float64(3), "favoritesCount": float64(1)}, counts[0])
+	asserts.Equal(map[string]interface{}{"tag": "rust", "articlesCount": float64(2), "favoritesCount": float64(2)}, counts[1])
+	asserts.Equal(float64(0), counts[2].(map[string]interface{})["articlesCount"], "deleted articles don't count")
+
+	_, response = get("/api/tags?hideUnused=true&limit=2")
+	asserts.Equal([]interface{}{"go", "rust"}, response["tags"])
+	_, response = get("/api/tags?hideUnused=true")
+	asserts.Equal([]interface{}{"go", "rust"}, response["tags"])
+	_, response = get("/api/tags?sort=name")
+	asserts.Equal([]interface{}{"go", "python", "rust", "unused"}, response["tags"])
+
+	// Trending counts the articles and favorites of the window
+	_, response = get("/api/tags?sort=trending")
+	asserts.Equal([]interface{}{"rust"}, response["tags"])
+	trending := response["tagCounts"].([]interface{})[0].(map[string]interface{})
+	asserts.Equal(float64(1), trending["recentArticlesCount"])
+	asserts.Equal(float64(1), trending["recentFavoritesCount"])
+	_, response = get("/api/tags?sort=trending&window=60d")
+	asserts.Equal([]interface{}{"go", "rust"}, response["tags"], "ties go to the tag on more articles")
+	_, response = get("/api/tags?sort=trending&window=1h")
+	asserts.Equal([]interface{}{"rust"}, response["tags"])
+
+	w, _ = get("/api/tags?sort=trending&window=soon")
+	asserts.Equal(422, w.Code)
+	w, _ = get("/api/tags?sort=random")
+	asserts.Equal(422, w.Code)
+
+	// Each query is cached on its own, favorites drop them
+	w, _ = get("/api/tags?sort=name")
+	asserts.Equal("HIT", w.Header().Get("X-Cache"))
+	w, _ = get("/api/tags?sort=name&limit=1")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"))
+	asserts.NoError(rust.unFavoriteBy(readerModel))
+	w, response = get("/api/tags?sort=name")
+	asserts.Equal("MISS", w.Header().Get("X-Cache"))
+	asserts.Equal(float64(1), response["tagCounts"].([]interface{})[2].(map[string]interface{})["favoritesCount"])
+}
+
+func TestTagFollowing(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	reader := createTestUser("tagreader", "tagreader@test.com")
+	followed := createTestUser("tagfollowed", "tagfollowed@test.com")
+	other := createTestUser("tagother", "tagother@test.com")
+	test_db.Create(&users.FollowModel{FollowingID: followed.ID, FollowedByID: reader.ID})
+	write := func(title string, author users.UserModel, tags ...string) {
+		article := ArticleModel{Slug: slug.Make(title), Title: title, AuthorID: GetArticleUserModel(author).ID}
+		asserts.NoError(article.setTags(tags))
+		asserts.NoError(CreateArticle(&article))
+	}
+	write("By Followed", followed, "rust")
+	write("Tagged Go", other, "go")
+	write("Both Ways", followed, "go")
+	write("Tagged Golang", other, "golang")
+	write("Unrelated", other, "python")
+	goTag, _ := FindTag("go")
+	asserts.NoError(goTag.AddAlias("go-lang"))
+
+	me := reader
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.GET("/api/articles/:slug", ArticleRetrieve)
+	TagsRegister(router.Group("/api/tags"))
+	FollowedTagsRegister(router.Group("/api/user"))
+	counter := &queryCounter{}
+	request := func(method, url string) (int, map[string]interface{}) {
+		counter.count = 0
+		test_db.LogMode(true)
+		test_db.SetLogger(counter)
+		defer test_db.LogMode(false)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	feed := func() []interface{} {
+		_, response := request("GET", "/api/articles/feed")
+		titles := []interface{}{}
+		for _, article := range response["articles"].([]interface{}) {
+			titles = append(titles, article.(map[string]interface{})["title"])
+		}
+		asserts.Equal(float64(len(titles)), response["articlesCount"])
+		return titles
+	}
+
+	asserts.Equal([]interface{}{"Both Ways", "By Followed"}, feed())
+	authorsOnly := counter.count
+
+	// Following by an alias follows the tag
+	code, response := request("POST", "/api/tags/Go-Lang/follow")
+	asserts.Equal(200, code)
+	asserts.Equal("go", response["tag"].(map[string]interface{})["tag"])
+	asserts.Equal(true, response["tag"].(map[string]interface{})["following"])
+	code, _ = request("POST", "/api/tags/go/follow")
+	asserts.Equal(200, code, "following twice succeeds")
+	code, _ = request("POST", "/api/tags/nothing/follow")
+	asserts.Equal(404, code)
+	request("POST", "/api/tags/golang/follow")
+	_, response = request("GET", "/api/user/tags")
+	asserts.Equal([]interface{}{"go", "golang"}, response["tags"])
+
+	// The feed merges both, newest first, an article matching both ways once
+	asserts.Equal([]interface{}{"Tagged Golang", "Both Ways", "Tagged Go", "By Followed"}, feed())
+	asserts.Equal(authorsOnly, counter.count, "followed tags don't add queries")
+
+	// Followers move with a merge, following both tags leaves one follow
+	golang, _ := FindTag("golang")
+	asserts.NoError(golang.MergeInto(&goTag))
+	var follows int
+	test_db.Model(&TagFollowModel{}).Where("user_model_id = ?", reader.ID).Count(&follows)
+	asserts.Equal(1, follows)
+	asserts.Equal([]interface{}{"Tagged Golang", "Both Ways", "Tagged Go", "By Followed"}, feed())
+
+	code, response = request("DELETE", "/api/tags/go/follow")
+	asserts.Equal(200, code)
+	asserts.Equal(false, response["tag"].(map[string]interface{})["following"])
+	_, response = request("GET", "/api/user/tags")
+	asserts.Empty(response["tags"])
+	asserts.Equal([]interface{}{"Both Ways", "By Followed"}, feed())
+
+	// Following again after unfollowing works
+	code, _ = request("POST", "/api/tags/go/follow")
+	asserts.Equal(200, code)
+	asserts.Len(feed(), 4)
+}
@@ -1,18 +1,23 @@
 package articles
 
 import (
-	"github.com/gosimple/slug"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
 	"realworld-backend/common"
 	"realworld-backend/users"
-	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ArticleModelValidator struct {
 	Article struct {
 		Title       string   `form:"title" json:"title" binding:"required,min=4"`
+		Slug        string   `form:"slug" json:"slug" binding:"max=255"`
 		Description string   `form:"description" json:"description" binding:"max=2048"`
 		Body        string   `form:"body" json:"body" binding:"max=2048"`
-		Tags        []string `form:"tagList" json:"tagList"`
+		Tags        []string `form:"tagList" json:"tagList" binding:"max=10,dive,max=32"`
 	} `json:"article"`
 	articleModel ArticleModel `json:"-"`
 }
@@ -23,6 +28,10 @@ func NewArticleModelValidator() ArticleModelValidator {
 
 func NewArticleModelValidatorFillWith(articleModel ArticleModel) ArticleModelValidator {
 	articleModelValidator := NewArticleModelValidator()
+	// The slug stays stable across title edits, it only changes when a new one is sent explicitly.
+	articleModelValidator.articleModel.ID = articleModel.ID
+	articleModelValidator.articleModel.Slug = articleModel.Slug
+	articleModelValidator.articleModel.Body = articleModel.Body
 	articleModelValidator.Article.Title = articleModel.Title
 	articleModelValidator.Article.Description = articleModel.Description
 	articleModelValidator.Article.Body = articleModel.Body
@@ -39,18 +48,29 @@ func (s *ArticleModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
-	s.articleModel.Slug = slug.Make(s.Article.Title)
+	if s.Article.Slug != "" && s.Article.Slug != s.articleModel.Slug {
+		s.articleModel.Slug = uniqueSlug(s.Article.Slug, s.articleModel.ID)
+	} else if s.articleModel.Slug == "" {
+		s.articleModel.Slug = uniqueSlug(s.Article.Title, s.articleModel.ID)
+	}
+	// The mentions of a saved body were checked when it was saved, users renamed since don't fail the update
+	if s.articleModel.ID == 0 || s.Article.Body != s.articleModel.Body {
+		if s.articleModel.mentioned, err = resolveMentions(s.Article.Body, myUserModel); err != nil {
+			return err
+		}
+	}
 	s.articleModel.Title = s.Article.Title
 	s.articleModel.Description = s.Article.Description
 	s.articleModel.Body = s.Article.Body
+	s.articleModel.BodyHTML = common.RenderMarkdown(s.Article.Body)
 	s.articleModel.Author = GetArticleUserModel(myUserModel)
-	s.articleModel.setTags(s.Article.Tags)
-	return nil
+	return s.articleModel.setTags(s.Article.Tags)
 }
 
 type CommentModelValidator struct {
 	Comment struct {
-		Body string `form:"body" json:"body" binding:"max=2048"`
+		Body     string `form:"body" json:"body" binding:"max=2048"`
+		ParentID *uint  `form:"parentId" json:"parentId"`
 	} `json:"comment"`
 	commentModel CommentModel `json:"-"`
 }
@@ -67,6 +87,311 @@ func (s *CommentModelValidator) Bind(c *gin.Context) error {
 		return err
 	}
 	s.commentModel.Body = s.Comment.Body
+	s.commentModel.BodyHTML = common.RenderMarkdown(s.Comment.Body)
+	s.commentModel.ParentID = s.Comment.ParentID
 	s.commentModel.Author = GetArticleUserModel(myUserModel)
+	s.commentModel.mentioned, err = resolveMentions(s.Comment.Body, myUserModel)
+	return err
+}
+
+// Renames and describes a tag, only admins may.
+type TagModelValidator struct {
+	Tag struct {
+		Name        string `form:"name" json:"name" binding:"required,max=32"`
+		Description string `form:"description" json:"description" binding:"max=2048"`
+	} `json:"tag"`
+}
+
+func NewTagModelValidatorFillWith(tagModel TagModel) TagModelValidator {
+	tagModelValidator := TagModelValidator{}
+	tagModelValidator.Tag.Name = tagModel.Tag
+	tagModelValidator.Tag.Description = tagModel.Description
+	return tagModelValidator
+}
+
+func (s *TagModelValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// The tag another one is merged into.
+type TagMergeValidator struct {
+	Tag struct {
+		Into string `form:"into" json:"into" binding:"required,max=32"`
+	} `json:"tag"`
+}
+
+func NewTagMergeValidator() TagMergeValidator {
+	return TagMergeValidator{}
+}
+
+func (s *TagMergeValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type TagAliasValidator struct {
+	Alias struct {
+		Name string `form:"name" json:"name" binding:"required,max=32"`
+	} `json:"alias"`
+}
+
+func NewTagAliasValidator() TagAliasValidator {
+	return TagAliasValidator{}
+}
+
+func (s *TagAliasValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// Query string of the tag list, e.g. ?sort=trending&window=7d&limit=10 or ?sort=popular&hideUnused=true
+// The window of trending tags is a duration such as 12h, or a number of days such as 30d.
+type TagListValidator struct {
+	Sort       string `form:"sort" binding:"omitempty,oneof=popular trending name"`
+	Window     string `form:"window"`
+	Limit      int    `form:"limit" binding:"min=0"`
+	HideUnused bool   `form:"hideUnused"`
+	window     time.Duration
+	query      TagQuery
+}
+
+func NewTagListValidator() TagListValidator {
+	return TagListValidator{}
+}
+
+func (s *TagListValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	s.query.Sort = s.Sort
+	if s.query.Sort == "" {
+		s.query.Sort = TagSortPopular
+	}
+	s.query.Limit = s.Limit
+	s.query.HideUnused = s.HideUnused
+	s.window = TrendingWindow
+	if s.Window != "" {
+		window, err := parseWindow(s.Window)
+		if err != nil {
+			return err
+		}
+		s.window = window
+	}
+	if s.query.Sort == TagSortTrending {
+		s.query.Since = time.Now().Add(-s.window)
+	}
 	return nil
 }
+
+// Lists are cached per query, the window only matters to trending tags.
+func (s *TagListValidator) cacheKey() string {
+	key := fmt.Sprintf("%s:%s:%d:%t", tagsCacheKey, s.query.Sort, s.query.Limit, s.query.HideUnused)
+	if s.query.Sort == TagSortTrending {
+		key += ":" + s.window.String()
+	}
+	return key
+}
+
+func parseWindow(value string) (time.Duration, error) {
+	var window time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		window, err = time.ParseDuration(value)
+	}
+	if err != nil || window <= 0 {
+		return 0, errors.New("window must be a duration such as 12h or 7d")
+	}
+	return window, nil
+}
+
+// Query string of the article list, e.g. ?tag=go,gin&tagMode=all&excludeTag=draft&minFavorites=10&sort=favorited
+// Tags can be repeated or separated by commas. Pages are addressed with offset, or with the
+// after / before cursors handed out as nextCursor / prevCursor.
+type ArticleListValidator struct {
+	Tags         []string  `form:"tag"`
+	TagMode      string    `form:"tagMode" binding:"omitempty,oneof=any all"`
+	ExcludeTags  []string  `form:"excludeTag"`
+	Author       string    `form:"author"`
+	Favorited    string    `form:"favorited"`
+	MinFavorites uint      `form:"minFavorites"`
+	MinComments  uint      `form:"minComments"`
+	Since        time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until        time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	Sort         string    `form:"sort" binding:"omitempty,oneof=newest oldest favorited commented updated"`
+	Limit        int       `form:"limit" binding:"min=0"`
+	Offset       int       `form:"offset" binding:"min=0"`
+	After        string    `form:"after"`
+	Before       string    `form:"before"`
+	query        ArticleQuery
+}
+
+func NewArticleListValidator() ArticleListValidator {
+	return ArticleListValidator{}
+}
+
+func (s *ArticleListValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	s.query.Tags = splitList(s.Tags)
+	s.query.TagMode = s.TagMode
+	s.query.ExcludeTags = splitList(s.ExcludeTags)
+	s.query.Author = s.Author
+	s.query.Favorited = s.Favorited
+	s.query.MinFavorites = s.MinFavorites
+	s.query.MinComments = s.MinComments
+	s.query.Since = s.Since
+	s.query.Until = s.Until
+	s.query.Sort = s.Sort
+	s.query.Limit = common.PageSize(s.Limit)
+	s.query.Offset = s.Offset
+
+	if s.After != "" && s.Before != "" {
+		return errors.New("after and before can't be combined")
+	}
+	var err error
+	if s.query.After, err = decodeArticleCursor(s.After, s.query); err != nil {
+		return err
+	}
+	if s.query.Before, err = decodeArticleCursor(s.Before, s.query); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Search results are ordered by relevance and paged with limit and offset, a sort order or a cursor
+// would be ignored, so they are refused.
+func (s *ArticleListValidator) BindSearch(c *gin.Context) error {
+	if err := s.Bind(c); err != nil {
+		return err
+	}
+	if s.Sort != "" {
+		return errors.New("search results are sorted by relevance")
+	}
+	if s.After != "" || s.Before != "" {
+		return errors.New("search results are paged with offset")
+	}
+	return nil
+}
+
+// A cursor is only valid for the sort order of the list which handed it out.
+func decodeArticleCursor(value string, query ArticleQuery) (*articleCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var cursor articleCursor
+	if err := common.DecodeCursor(value, &cursor); err != nil {
+		return nil, err
+	}
+	if cursor.Sort != query.sortName() {
+		return nil, common.ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// Query string of the comment list. Without a limit a page holds as many comments as allowed.
+// Without depth each comment comes with DefaultReplyDepth levels of replies, at most MaxReplyDepth.
+type CommentListValidator struct {
+	Limit  int    `form:"limit" binding:"min=0"`
+	Offset int    `form:"offset" binding:"min=0"`
+	After  string `form:"after"`
+	Before string `form:"before"`
+	Depth  *int   `form:"depth" binding:"omitempty,min=0,max=5"`
+	query  CommentQuery
+}
+
+const (
+	DefaultReplyDepth = 2
+	MaxReplyDepth     = 5
+)
+
+func NewCommentListValidator() CommentListValidator {
+	return CommentListValidator{}
+}
+
+func (s *CommentListValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	s.query.Limit = common.MaxPageSize
+	if s.Limit > 0 {
+		s.query.Limit = common.PageSize(s.Limit)
+	}
+	s.query.Offset = s.Offset
+	s.query.Depth = DefaultReplyDepth
+	if s.Depth != nil {
+		s.query.Depth = *s.Depth
+	}
+
+	if s.After != "" && s.Before != "" {
+		return errors.New("after and before can't be combined")
+	}
+	if s.After != "" {
+		s.query.After = &commentCursor{}
+		if err := common.DecodeCursor(s.After, s.query.After); err != nil {
+			return err
+		}
+	}
+	if s.Before != "" {
+		s.query.Before = &commentCursor{}
+		if err := common.DecodeCursor(s.Before, s.query.Before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query string of the list of reactions, without an emoji all reactions are listed.
+type ReactionListValidator struct {
+	Emoji  string `form:"emoji"`
+	Limit  int    `form:"limit" binding:"min=0"`
+	Offset int    `form:"offset" binding:"min=0"`
+}
+
+func NewReactionListValidator() ReactionListValidator {
+	return ReactionListValidator{}
+}
+
+func (s *ReactionListValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	if s.Emoji != "" && !isReactionEmoji(s.Emoji) {
+		return ErrUnknownReaction
+	}
+	s.Limit = common.PageSize(s.Limit)
+	return nil
+}
+
+// Query string of the mentions of the current user.
+type MentionListValidator struct {
+	Limit  int `form:"limit" binding:"min=0"`
+	Offset int `form:"offset" binding:"min=0"`
+}
+
+func NewMentionListValidator() MentionListValidator {
+	return MentionListValidator{}
+}
+
+func (s *MentionListValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	s.Limit = common.PageSize(s.Limit)
+	return nil
+}
+
+// Flatten repeated and comma separated query values: ["a,b", "c"] -> ["a", "b", "c"]
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache stores serialized values by key. The in-process LRU cache is the default, a shared store
+// (e.g. Redis) can be plugged in with SetCache as long as it can delete keys by prefix.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+	DeletePrefix(prefix string)
+}
+
+// Hit and miss counts of the cache since the process started.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+const DefaultCacheSize = 1024
+
+var cache Cache = NewLRUCache(DefaultCacheSize)
+
+var cacheHits, cacheMisses uint64
+
+// Replace the cache, e.g. with a Redis backed implementation.
+func SetCache(c Cache) {
+	cache = c
+}
+
+// Using this function to get the cache, every cache access counts as a hit or a miss.
+func GetCache() Cache {
+	return meteredCache{cache}
+}
+
+// Counts hits and misses of whatever cache is plugged in.
+type meteredCache struct {
+	Cache
+}
+
+func (m meteredCache) Get(key string) ([]byte, bool) {
+	value, ok := m.Cache.Get(key)
+	if ok {
+		atomic.AddUint64(&cacheHits, 1)
+	} else {
+		atomic.AddUint64(&cacheMisses, 1)
+	}
+	return value, ok
+}
+
+// The current cache metrics, evictions and entries are only known for the LRU cache.
+func CacheMetrics() CacheStats {
+	stats := CacheStats{
+		Hits:   atomic.LoadUint64(&cacheHits),
+		Misses: atomic.LoadUint64(&cacheMisses),
+	}
+	if lru, ok := cache.(*LRUCache); ok {
+		stats.Evictions, stats.Entries = lru.evictions(), lru.Len()
+	}
+	return stats
+}
+
+// Serve a JSON response from the cache, or render it and cache it when its status is 200 OK.
+// The X-Cache header tells whether the response came from the cache. Like JSONWithETag, 200 OK
+// responses carry an ETag and answer If-None-Match.
+//
+//	common.ServeCachedJSON(c, "tags", time.Minute, func() (int, interface{}) {
+//		return http.StatusOK, gin.H{"tags": tags}
+//	})
+func ServeCachedJSON(c *gin.Context, key string, ttl time.Duration, render func() (int, interface{})) {
+	store := GetCache()
+	if body, ok := store.Get(key); ok {
+		c.Header("X-Cache", "HIT")
+		writeJSONWithETag(c, http.StatusOK, "", body)
+		return
+	}
+	c.Header("X-Cache", "MISS")
+	status, response := render()
+	if status != http.StatusOK {
+		c.JSON(status, response)
+		return
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, NewError("cache", err))
+		return
+	}
+	store.Set(key, body, ttl)
+	writeJSONWithETag(c, status, "", body)
+}
+
+// A fixed-size in-process cache, the least recently used entry is evicted when it is full.
+// Expired entries are dropped when they are read.
+type LRUCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	evicted uint64
+	now     func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (l *LRUCache) Get(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if !entry.expires.IsZero() && !l.now().Before(entry.expires) {
+		l.remove(element)
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Store a value, a ttl of 0 keeps it until it is evicted or deleted.
+func (l *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var expires time.Time
+	if ttl > 0 {
+		expires = l.now().Add(ttl)
+	}
+	if element, ok := l.entries[key]; ok {
+		element.Value = &lruEntry{key: key, value: value, expires: expires}
+		l.order.MoveToFront(element)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+		l.evicted++
+	}
+}
+
+func (l *LRUCache) Delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.entries[key]; ok {
+		l.remove(element)
+	}
+}
+
+func (l *LRUCache) DeletePrefix(prefix string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, element := range l.entries {
+		if strings.HasPrefix(key, prefix) {
+			l.remove(element)
+		}
+	}
+}
+
+func (l *LRUCache) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+func (l *LRUCache) evictions() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.evicted
+}
+
+func (l *LRUCache) remove(element *list.Element) {
+	l.order.Remove(element)
+	delete(l.entries, element.Value.(*lruEntry).key)
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Page sizes of every paginated list, larger limits are cut down to MaxPageSize.
+const DefaultPageSize = 20
+const MaxPageSize = 100
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursors are opaque to clients: the position is JSON encoded and signed, so a client can't
+// forge or edit one to make the server run a query it didn't hand out.
+//
+//	cursor := common.EncodeCursor(articleCursor{Sort: "newest", Time: last.CreatedAt, ID: last.ID})
+func EncodeCursor(position interface{}) string {
+	payload, _ := json.Marshal(position)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + cursorSignature(encoded)
+}
+
+// Verify the signature of a cursor made by EncodeCursor and decode the position into v.
+//
+//	var position articleCursor
+//	if err := common.DecodeCursor(c.Query("after"), &position); err != nil { ... }
+func DecodeCursor(cursor string, v interface{}) error {
+	parts := strings.Split(cursor, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(cursorSignature(parts[0]))) {
+		return ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+func cursorSignature(encoded string) string {
+	mac := hmac.New(sha256.New, []byte(NBSecretPassword))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Clamp a requested page size: no value means the default, anything above the maximum is cut.
+func PageSize(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
@@ -1,12 +1,14 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/mattn/go-sqlite3"
 )
 
 type Database struct {
@@ -42,7 +44,10 @@ func TestDBInit() *gorm.DB {
 	}
 	test_db.DB().SetMaxIdleConns(3)
 	test_db.LogMode(true)
+	test_db.AutoMigrate(&OutboxModel{})
 	DB = test_db
+	// Responses cached from a previous test database would be stale
+	SetCache(NewLRUCache(DefaultCacheSize))
 	return DB
 }
 
@@ -57,3 +62,24 @@ func TestDBFree(test_db *gorm.DB) error {
 func GetDB() *gorm.DB {
 	return DB
 }
+
+// Add delta to a counter column of one row in the same statement, so concurrent updates don't get lost.
+// Counters never drop below zero.
+//
+//	err := common.AdjustCounter(tx, "article_models", "id", article.ID, "favorites_count", 1)
+func AdjustCounter(tx *gorm.DB, table, key string, id uint, column string, delta int64) error {
+	return tx.Table(table).Where(key+" = ?", id).
+		UpdateColumn(column, gorm.Expr("CASE WHEN "+column+" + ? < 0 THEN 0 ELSE "+column+" + ? END", delta, delta)).Error
+}
+
+// Whether a write failed because a unique index already holds the row, e.g. when two requests insert
+// the same row at once. Writers treat it as the row being there.
+//
+//	if err := tx.Create(&follow).Error; err != nil && !common.IsUniqueViolation(err) { ... }
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A write made with If-Match whose resource changed since the client read it.
+var ErrPreconditionFailed = errors.New("resource changed since it was read")
+
+// A strong ETag of a response body: equal bodies, and only equal bodies, get the same tag.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// The ETag of the JSON encoding of a response, as JSONWithETag would send it.
+func ETagOf(response interface{}) string {
+	body, _ := json.Marshal(response)
+	return ETag(body)
+}
+
+// The version of a stored row, made of the id and the state a write changes, usually updated_at.
+// Counters and the state of the reader are left out, so they don't make writes with If-Match fail.
+//
+//	common.Version(model.ID, model.UpdatedAt.UnixNano())
+func Version(id uint, state ...interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%#v", id, state)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// The ETag of a response showing a version of a row: the version, which If-Match compares, followed
+// by the hash of the body, which If-None-Match compares.
+func versionedETag(version string, body []byte) string {
+	if version == "" {
+		return ETag(body)
+	}
+	return `"` + version + "." + strings.Trim(ETag(body), `"`) + `"`
+}
+
+// The version an ETag was made for, the whole tag when it's not versioned.
+func etagVersion(etag string) string {
+	version, _, _ := strings.Cut(strings.Trim(etag, `"`), ".")
+	return version
+}
+
+// Whether an If-None-Match or If-Match header lists the tag. Weak tags (W/"...") only count when weak is set,
+// If-None-Match compares weakly, If-Match strongly.
+func etagListed(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Send a JSON body. A 200 OK response gets an ETag, and a client that sent the same tag in
+// If-None-Match gets an empty 304 Not Modified instead. The ETag carries the version when there is one.
+func writeJSONWithETag(c *gin.Context, status int, version string, body []byte) {
+	writeWithETag(c, status, versionedETag(version, body), "application/json; charset=utf-8", body)
+}
+
+func writeWithETag(c *gin.Context, status int, etag, contentType string, body []byte) {
+	if status == http.StatusOK {
+		c.Header("ETag", etag)
+		if header := c.GetHeader("If-None-Match"); header != "" && etagListed(header, etag, true) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Data(status, contentType, body)
+}
+
+// Like c.Data, with an ETag of the body and If-None-Match support on 200 OK responses.
+//
+//	common.DataWithETag(c, http.StatusOK, "application/atom+xml; charset=utf-8", body)
+func DataWithETag(c *gin.Context, status int, contentType string, body []byte) {
+	writeWithETag(c, status, ETag(body), contentType, body)
+}
+
+// Like c.JSON, with an ETag and If-None-Match support on 200 OK responses.
+//
+//	common.JSONWithETag(c, http.StatusOK, gin.H{"articles": articles})
+func JSONWithETag(c *gin.Context, status int, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, NewError("json", err))
+		return
+	}
+	writeJSONWithETag(c, status, "", body)
+}
+
+// Like JSONWithETag, for a response showing a version of a row. If-Match compares only the version,
+// so writes don't fail because a counter or the reader's own state changed the body.
+//
+//	common.JSONWithVersion(c, http.StatusOK, articleModel.Version(), gin.H{"article": serializer.Response()})
+func JSONWithVersion(c *gin.Context, status int, version string, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, NewError("json", err))
+		return
+	}
+	writeJSONWithETag(c, status, version, body)
+}
+
+// Optimistic concurrency for writes: a client sends the ETag it read in If-Match, when the resource
+// has changed since then the write is refused with 412 Precondition Failed. current computes the version
+// or ETag the resource has now, it is only called when the client sent If-Match.
+// Returns false after answering 412, without If-Match the write always goes ahead.
+//
+// The check alone leaves a gap until the write, so stored rows are also written conditionally, see
+// ArticleModel.UpdateUnmodified, and a write that finds the row changed answers with PreconditionFailed.
+//
+//	if !common.CheckIfMatch(c, articleModel.Version) {
+//		return
+//	}
+func CheckIfMatch(c *gin.Context, current func() string) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" || versionListed(header, etagVersion(current())) {
+		return true
+	}
+	PreconditionFailed(c)
+	return false
+}
+
+// Whether an If-Match header lists a tag of the version. The comparison is strong, weak tags never match.
+func versionListed(header, version string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (!strings.HasPrefix(candidate, "W/") && etagVersion(candidate) == version) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer a write whose If-Match precondition doesn't hold.
+func PreconditionFailed(c *gin.Context) {
+	c.JSON(http.StatusPreconditionFailed, NewError("precondition", ErrPreconditionFailed))
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Something that happened to a model, e.g. articles.EventArticleUpdated with the article as payload.
+// The packages publishing events define their names and payload types. ID is the outbox entry of
+// events recorded with Record, 0 for events only published in memory.
+type Event struct {
+	ID      uint
+	Name    string
+	Payload interface{}
+}
+
+type subscription struct {
+	id      int
+	handler func(Event) error
+}
+
+var subscribersMu sync.RWMutex
+var subscribers = map[string][]subscription{}
+var lastSubscription int
+
+// Call handler for every event published under one of the names, usually from an init function.
+// The returned function unsubscribes the handler again.
+//
+//	common.Subscribe(func(e common.Event) { ... }, articles.EventArticleUpdated, articles.EventArticleDeleted)
+func Subscribe(handler func(Event), names ...string) (unsubscribe func()) {
+	return Handle(func(e Event) error {
+		handler(e)
+		return nil
+	}, names...)
+}
+
+// Like Subscribe, for handlers which can fail: an error makes the dispatcher deliver a recorded event
+// again later, to every handler, not only to the failed one. Handlers of recorded events therefore have
+// to be idempotent on Event.ID, handling an event they already handled must not change anything.
+//
+//	common.Handle(func(e common.Event) error { return indexArticle(e.Payload.(ArticleModel)) }, EventArticleCreated)
+func Handle(handler func(Event) error, names ...string) (unsubscribe func()) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	lastSubscription++
+	id := lastSubscription
+	for _, name := range names {
+		subscribers[name] = append(subscribers[name], subscription{id, handler})
+	}
+	return func() {
+		subscribersMu.Lock()
+		defer subscribersMu.Unlock()
+		for _, name := range names {
+			kept := []subscription{}
+			for _, subscribed := range subscribers[name] {
+				if subscribed.id != id {
+					kept = append(kept, subscribed)
+				}
+			}
+			subscribers[name] = kept
+		}
+	}
+}
+
+// Call the handlers subscribed to the event, in the order they subscribed, before returning.
+// Publish after the change is committed so handlers see it. Errors of handlers are only logged,
+// events which have to reach their handlers are recorded in the outbox instead, see Record.
+//
+//	common.Publish(common.Event{Name: EventNotificationCreated, Payload: notification})
+func Publish(event Event) {
+	if err := publish(event); err != nil {
+		fmt.Println("events err: ", event.Name, err)
+	}
+}
+
+// Call every handler, returns the first error.
+func publish(event Event) error {
+	subscribersMu.RLock()
+	subscribed := append([]subscription{}, subscribers[event.Name]...)
+	subscribersMu.RUnlock()
+	var first error
+	for _, subscription := range subscribed {
+		if err := subscription.handler(event); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// CommonMark with the GitHub flavoured extensions (tables, strikethrough, autolinks and task lists).
+// Raw HTML in the source is not rendered by goldmark unless html.WithUnsafe() is set.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// Allow-list of everything markdown may produce, anything else (scripts, styles, event handlers,
+// javascript: urls...) is stripped before the HTML leaves the API.
+var markdownPolicy = newMarkdownPolicy()
+
+func newMarkdownPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w-]+$`)).OnElements("code")
+	policy.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	policy.AllowAttrs("checked", "disabled").OnElements("input")
+	policy.RequireNoFollowOnLinks(true)
+	return policy
+}
+
+// Render user supplied markdown to HTML which is safe to embed into a page.
+//
+//	bodyHTML := common.RenderMarkdown("# Title\n\n**bold** ~~gone~~")
+func RenderMarkdown(source string) string {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "<p>" + html.EscapeString(source) + "</p>"
+	}
+	return markdownPolicy.Sanitize(buf.String())
+}
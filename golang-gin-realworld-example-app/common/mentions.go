@@ -0,0 +1,26 @@
+package common
+
+import "regexp"
+
+// @username where usernames are alphanumeric, like the users validator requires. The mark must not
+// follow a word character, so addresses like me@example.com are no mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9]+)`)
+
+// Code blocks and code spans quote text, mentions in them don't count.
+var markdownCodePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+
+// The usernames mentioned in a markdown text, each once, in the order they first appear.
+//
+//	ParseMentions("thanks @alice and @bob, cc @alice") // ["alice", "bob"]
+func ParseMentions(text string) []string {
+	text = markdownCodePattern.ReplaceAllString(text, " ")
+	var usernames []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if username := match[1]; !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
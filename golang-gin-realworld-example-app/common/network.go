@@ -0,0 +1,98 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Requests to URLs users chose, webhooks and federated servers, must not reach the network the server
+// runs in: cloud metadata, admin interfaces, databases on localhost.
+var (
+	ErrURLScheme      = errors.New("only http and https URLs are allowed")
+	ErrPrivateAddress = errors.New("private, loopback and link-local addresses are not allowed")
+)
+
+// Let outgoing requests reach private addresses, for tests and deployments federating on a private network.
+var AllowPrivateAddresses = false
+
+// Ranges the net.IP predicates don't cover: "this network", shared address space, benchmarking.
+var nonPublicRanges = func() []*net.IPNet {
+	var ranges []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		ranges = append(ranges, network)
+	}
+	return ranges
+}()
+
+// Whether an address is reachable on the internet, rather than private, loopback or link-local.
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range nonPublicRanges {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check a URL a user gave as the target of outgoing requests: http or https, and not a private address
+// or localhost. Host names are only resolved when connecting, by the dialer of NewPublicClient.
+//
+//	if err := common.CheckPublicURL(webhook.URL); err != nil { ... }
+func CheckPublicURL(raw string) error {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return ErrURLScheme
+	}
+	if AllowPrivateAddresses {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(target.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && !IsPublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// An HTTP client for URLs users chose. Its dialer checks the address a host name resolved to right
+// before connecting, so neither DNS nor a redirect can lead a request to a private address.
+// No proxy is used, the dialer would only see the address of the proxy.
+//
+//	var client = common.NewPublicClient(10 * time.Second)
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if AllowPrivateAddresses {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
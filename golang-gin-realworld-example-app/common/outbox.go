@@ -0,0 +1,201 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The outbox makes events as durable as the change they describe: Record writes an event in the
+// transaction of the change, and Dispatch hands it to the subscribers once it is committed. An event
+// whose handlers fail, or whose process dies before dispatching it, is dispatched again later, so
+// every recorded event reaches its handlers at least once. A redelivered event keeps its ID, handlers
+// use it to recognise events they already handled.
+//
+//	tx := db.Begin()
+//	... change the models with tx ...
+//	if err := common.Record(tx, common.Event{Name: EventArticleCreated, Payload: article}); err != nil {
+//		tx.Rollback()
+//		return err
+//	}
+//	if err := tx.Commit().Error; err != nil {
+//		return err
+//	}
+//	common.Dispatch()
+type OutboxModel struct {
+	ID           uint `gorm:"primary_key"`
+	Name         string
+	Payload      string `gorm:"type:text"`
+	CreatedAt    time.Time
+	AvailableAt  time.Time  `gorm:"index"`
+	DispatchedAt *time.Time `gorm:"index"`
+	Attempts     int
+	LastError    string
+}
+
+// Failed events are dispatched again after OutboxRetryDelay, twice as long after every failure,
+// and given up after MaxDispatchAttempts. They stay in the outbox for inspection, dispatched events
+// are pruned after OutboxRetention.
+var (
+	MaxDispatchAttempts = 10
+	OutboxRetryDelay    = 10 * time.Second
+	OutboxRetention     = 7 * 24 * time.Hour
+)
+
+var ErrUnregisteredEvent = errors.New("unregistered event")
+
+var payloadTypesMu sync.RWMutex
+var payloadTypes = map[string]reflect.Type{}
+
+// Declare the payload type of an event so it can be recorded and read back from the outbox,
+// usually from the init function of the package which defines the event.
+//
+//	common.RegisterEvent(EventArticleCreated, ArticleModel{})
+func RegisterEvent(name string, payload interface{}) {
+	payloadTypesMu.Lock()
+	defer payloadTypesMu.Unlock()
+	payloadTypes[name] = reflect.TypeOf(payload)
+}
+
+func payloadType(name string) (reflect.Type, bool) {
+	payloadTypesMu.RLock()
+	defer payloadTypesMu.RUnlock()
+	payloadType, ok := payloadTypes[name]
+	return payloadType, ok
+}
+
+// Write an event to the outbox in the transaction tx. Call Dispatch after committing it.
+func Record(tx *gorm.DB, event Event) error {
+	if _, ok := payloadType(event.Name); !ok {
+		return fmt.Errorf("%w: %s", ErrUnregisteredEvent, event.Name)
+	}
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return tx.Create(&OutboxModel{Name: event.Name, Payload: string(payload), CreatedAt: now, AvailableAt: now}).Error
+}
+
+var dispatching sync.Mutex
+var dispatchRequested int32
+
+// Hand the recorded events which are due to their handlers, in the order they were recorded.
+// Handlers run on the goroutine which happens to be dispatching, events recorded by handlers are
+// dispatched before Dispatch returns. A Dispatch called while another one runs leaves its events
+// to the running one.
+func Dispatch() {
+	atomic.StoreInt32(&dispatchRequested, 1)
+	for atomic.LoadInt32(&dispatchRequested) == 1 {
+		if !dispatching.TryLock() {
+			return
+		}
+		atomic.StoreInt32(&dispatchRequested, 0)
+		if _, err := dispatchDue(time.Now()); err != nil {
+			fmt.Println("outbox err: (Dispatch) ", err)
+		}
+		dispatching.Unlock()
+	}
+}
+
+// Dispatch the events due at now, returns how many were dispatched successfully.
+func dispatchDue(now time.Time) (int, error) {
+	db := GetDB()
+	var due []OutboxModel
+	err := db.Where("dispatched_at IS NULL AND available_at <= ? AND attempts < ?", now, MaxDispatchAttempts).
+		Order("id").Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+	dispatched := 0
+	for _, entry := range due {
+		// Another process dispatching the same outbox may have taken the entry
+		claimed := db.Model(&OutboxModel{}).
+			Where("id = ? AND dispatched_at IS NULL AND available_at = ?", entry.ID, entry.AvailableAt).
+			UpdateColumn("available_at", now.Add(OutboxRetryDelay))
+		if claimed.Error != nil {
+			return dispatched, claimed.Error
+		}
+		if claimed.RowsAffected == 0 {
+			continue
+		}
+		if err := dispatchEntry(entry); err != nil {
+			entry.Attempts++
+			delay := OutboxRetryDelay << uint(entry.Attempts-1)
+			fmt.Println("outbox err: ", entry.Name, entry.ID, err)
+			err = db.Model(&entry).UpdateColumns(map[string]interface{}{
+				"attempts":     entry.Attempts,
+				"available_at": now.Add(delay),
+				"last_error":   err.Error(),
+			}).Error
+			if err != nil {
+				return dispatched, err
+			}
+			continue
+		}
+		if err := db.Model(&entry).UpdateColumn("dispatched_at", now).Error; err != nil {
+			return dispatched, err
+		}
+		dispatched++
+	}
+	return dispatched, nil
+}
+
+// Read the payload back and call the handlers, a panicking handler counts as failed.
+func dispatchEntry(entry OutboxModel) (err error) {
+	payloadType, ok := payloadType(entry.Name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnregisteredEvent, entry.Name)
+	}
+	payload := reflect.New(payloadType)
+	if err := json.Unmarshal([]byte(entry.Payload), payload.Interface()); err != nil {
+		return err
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("handler panicked: %v", recovered)
+		}
+	}()
+	return publish(Event{ID: entry.ID, Name: entry.Name, Payload: payload.Elem().Interface()})
+}
+
+// Delete the events dispatched before the time.
+func PruneOutbox(before time.Time) error {
+	return GetDB().Where("dispatched_at < ?", before).Delete(&OutboxModel{}).Error
+}
+
+// Dispatch every interval, for events recorded by a process which died before dispatching them and
+// for events whose handlers failed, and prune the outbox. stop waits for a running dispatch to finish.
+//
+//	stop := common.StartDispatcher(10 * time.Second)
+//	defer stop()
+func StartDispatcher(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				Dispatch()
+				if err := PruneOutbox(now.Add(-OutboxRetention)); err != nil {
+					fmt.Println("outbox err: (PruneOutbox) ", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The address of the public site the articles are read on, e.g. https://conduit.example.com, set from
+// SITE_URL. When it's empty, links point at the scheme and host of the request.
+var SiteURL = ""
+
+// The origin of the request, honouring X-Forwarded-Proto from a proxy in front of the API.
+func RequestOrigin(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// The base of site links, SiteURL without a trailing slash or the origin of the request.
+func SiteBase(c *gin.Context) string {
+	if SiteURL != "" {
+		return strings.TrimRight(SiteURL, "/")
+	}
+	return RequestOrigin(c)
+}
+
+// The host name of the site, used in ids which have to stay the same when URLs change.
+func SiteHost(c *gin.Context) string {
+	parsed, err := url.Parse(SiteBase(c))
+	if err != nil || parsed.Hostname() == "" {
+		return "localhost"
+	}
+	return parsed.Hostname()
+}
+
+// Links to the pages of the site, as the RealWorld frontends route them.
+func ArticleURL(c *gin.Context, slug string) string {
+	return SiteBase(c) + "/article/" + url.PathEscape(slug)
+}
+
+func ProfileURL(c *gin.Context, username string) string {
+	return SiteBase(c) + "/profile/" + url.PathEscape(username)
+}
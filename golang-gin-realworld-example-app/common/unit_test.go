@@ -3,10 +3,13 @@ package common
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -309,3 +312,362 @@ func TestCommonErrorStructure(t *testing.T) {
 	err3 := NewError("authentication", errors.New("invalid token"))
 	asserts.Equal("invalid token", err3.Errors["authentication"], "Auth error should match")
 }
+
+func TestRenderMarkdown(t *testing.T) {
+	asserts := assert.New(t)
+
+	html := RenderMarkdown("# Title\n\n**bold** ~~gone~~ https://example.com\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n- [x] done")
+	asserts.Contains(html, "<h1>Title</h1>", "headings should be rendered")
+	asserts.Contains(html, "<strong>bold</strong>", "emphasis should be rendered")
+	asserts.Contains(html, "<del>gone</del>", "GFM strikethrough should be rendered")
+	asserts.Contains(html, "<table>", "GFM tables should be rendered")
+	asserts.Contains(html, `href="https://example.com"`, "GFM autolinks should be rendered")
+	asserts.Contains(html, `type="checkbox"`, "GFM task lists should be rendered")
+
+	html = RenderMarkdown("<script>alert(1)</script>\n\n[x](javascript:alert(1)) <img src=x onerror=alert(1)>")
+	asserts.NotContains(html, "<script", "scripts should be stripped")
+	asserts.NotContains(html, "javascript:", "javascript urls should be stripped")
+	asserts.NotContains(html, "onerror", "event handlers should be stripped")
+
+	asserts.Equal("", RenderMarkdown(""), "empty source should render nothing")
+}
+
+func TestParseMentions(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal([]string{"alice", "bob"}, ParseMentions("thanks @alice and @bob, cc @alice"))
+	asserts.Equal([]string{"carol"}, ParseMentions("@carol: mail me@example.com"), "addresses aren't mentions")
+	asserts.Equal([]string{"dave"}, ParseMentions("`@code` and\n```\n@block\n```\n(@dave)"), "code isn't searched")
+	asserts.Nil(ParseMentions("no mentions @ all"))
+}
+
+func TestCursor(t *testing.T) {
+	asserts := assert.New(t)
+
+	type position struct {
+		Time time.Time `json:"t"`
+		ID   uint      `json:"i"`
+	}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	cursor := EncodeCursor(position{Time: at, ID: 42})
+
+	var decoded position
+	asserts.NoError(DecodeCursor(cursor, &decoded))
+	asserts.True(at.Equal(decoded.Time), "time should survive with nanoseconds")
+	asserts.Equal(uint(42), decoded.ID)
+
+	tampered := EncodeCursor(position{Time: at, ID: 43})
+	forged := tampered[:strings.Index(tampered, ".")] + cursor[strings.Index(cursor, "."):]
+	asserts.Equal(ErrInvalidCursor, DecodeCursor(forged, &decoded), "edited cursors should be rejected")
+	asserts.Equal(ErrInvalidCursor, DecodeCursor("garbage", &decoded))
+	asserts.Equal(ErrInvalidCursor, DecodeCursor("", &decoded))
+
+	asserts.Equal(DefaultPageSize, PageSize(0))
+	asserts.Equal(5, PageSize(5))
+	asserts.Equal(MaxPageSize, PageSize(MaxPageSize+1))
+}
+
+func TestLRUCache(t *testing.T) {
+	asserts := assert.New(t)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lru := NewLRUCache(2)
+	lru.now = func() time.Time { return now }
+
+	lru.Set("a", []byte("1"), 0)
+	lru.Set("b", []byte("2"), time.Minute)
+	value, ok := lru.Get("a")
+	asserts.True(ok)
+	asserts.Equal("1", string(value))
+
+	lru.Set("c", []byte("3"), 0)
+	_, ok = lru.Get("b")
+	asserts.False(ok, "The least recently used entry should be evicted")
+	asserts.Equal(2, lru.Len())
+	asserts.Equal(uint64(1), lru.evictions())
+
+	lru.Set("c", []byte("4"), time.Minute)
+	value, _ = lru.Get("c")
+	asserts.Equal("4", string(value), "Setting a key again should replace its value")
+	now = now.Add(time.Minute)
+	_, ok = lru.Get("c")
+	asserts.False(ok, "Expired entries shouldn't be served")
+	_, ok = lru.Get("a")
+	asserts.True(ok, "Entries without ttl don't expire")
+
+	lru.Set("article:one:", []byte("1"), 0)
+	lru.Set("article:one:html", []byte("1"), 0)
+	lru.DeletePrefix("article:one:")
+	asserts.Equal(0, lru.Len(), "Every key with the prefix should be deleted")
+	lru.Set("a", []byte("1"), 0)
+	lru.Delete("a")
+	_, ok = lru.Get("a")
+	asserts.False(ok)
+}
+
+func TestServeCachedJSON(t *testing.T) {
+	asserts := assert.New(t)
+	SetCache(NewLRUCache(DefaultCacheSize))
+	defer SetCache(NewLRUCache(DefaultCacheSize))
+	gin.SetMode(gin.TestMode)
+
+	renders := 0
+	status := http.StatusNotFound
+	router := gin.New()
+	router.GET("/cached", func(c *gin.Context) {
+		ServeCachedJSON(c, "cached", time.Minute, func() (int, interface{}) {
+			renders++
+			return status, gin.H{"renders": renders}
+		})
+	})
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/cached", nil))
+		return w
+	}
+
+	before := CacheMetrics()
+	w := get()
+	asserts.Equal(http.StatusNotFound, w.Code)
+	get()
+	asserts.Equal(2, renders, "Errors shouldn't be cached")
+
+	status = http.StatusOK
+	w = get()
+	asserts.Equal("MISS", w.Header().Get("X-Cache"))
+	w = get()
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("HIT", w.Header().Get("X-Cache"))
+	asserts.Equal(`{"renders":3}`, w.Body.String())
+	asserts.Equal(3, renders)
+
+	after := CacheMetrics()
+	asserts.Equal(uint64(1), after.Hits-before.Hits)
+	asserts.Equal(uint64(3), after.Misses-before.Misses)
+	asserts.Equal(1, after.Entries)
+
+	GetCache().Delete("cached")
+	get()
+	asserts.Equal(4, renders, "Deleted entries should be rendered again")
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	asserts := assert.New(t)
+
+	var received []string
+	defer Subscribe(func(e Event) {
+		received = append(received, "first "+e.Payload.(string))
+	}, "test.one", "test.two")()
+	unsubscribe := Subscribe(func(e Event) {
+		received = append(received, "second "+e.Payload.(string))
+	}, "test.one")
+
+	Publish(Event{Name: "test.one", Payload: "a"})
+	Publish(Event{Name: "test.two", Payload: "b"})
+	Publish(Event{Name: "test.none", Payload: "c"})
+	asserts.Equal([]string{"first a", "second a", "first b"}, received)
+
+	unsubscribe()
+	Publish(Event{Name: "test.one", Payload: "d"})
+	asserts.Equal([]string{"first a", "second a", "first b", "first d"}, received, "Unsubscribed handlers aren't called")
+}
+
+func TestETag(t *testing.T) {
+	asserts := assert.New(t)
+	gin.SetMode(gin.TestMode)
+
+	asserts.Equal(ETag([]byte("a")), ETag([]byte("a")))
+	asserts.NotEqual(ETag([]byte("a")), ETag([]byte("b")))
+	asserts.Equal(ETag([]byte(`{"a":1}`)), ETagOf(map[string]int{"a": 1}))
+
+	etag := ETag([]byte("x"))
+	asserts.True(etagListed(etag, etag, false))
+	asserts.True(etagListed(`"other", `+etag, etag, false))
+	asserts.True(etagListed("*", etag, false))
+	asserts.True(etagListed("W/"+etag, etag, true), "Weak comparison ignores the weak flag")
+	asserts.False(etagListed("W/"+etag, etag, false), "Strong comparison never matches weak tags")
+	asserts.False(etagListed(`"other"`, etag, true))
+
+	rowVersion := Version(1, int64(2))
+	asserts.Equal(rowVersion, Version(1, int64(2)))
+	asserts.NotEqual(rowVersion, Version(1, int64(3)))
+	tagged := versionedETag(rowVersion, []byte("x"))
+	asserts.NotEqual(tagged, versionedETag(rowVersion, []byte("y")), "If-None-Match sees a changed body")
+	asserts.True(versionListed(tagged, rowVersion))
+	asserts.True(versionListed(versionedETag(rowVersion, []byte("y")), rowVersion), "If-Match only compares the version")
+	asserts.False(versionListed("W/"+tagged, rowVersion))
+	asserts.False(versionListed(versionedETag(Version(1, int64(3)), []byte("x")), rowVersion))
+
+	version := 1
+	router := gin.New()
+	router.GET("/resource", func(c *gin.Context) {
+		JSONWithETag(c, http.StatusOK, gin.H{"version": version})
+	})
+	router.PUT("/resource", func(c *gin.Context) {
+		if !CheckIfMatch(c, func() string { return ETagOf(gin.H{"version": version}) }) {
+			return
+		}
+		version++
+		JSONWithETag(c, http.StatusOK, gin.H{"version": version})
+	})
+	request := func(method, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/resource", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("GET", "", "")
+	read := w.Header().Get("ETag")
+	asserts.NotEmpty(read)
+	w = request("GET", "If-None-Match", read)
+	asserts.Equal(http.StatusNotModified, w.Code)
+	asserts.Empty(w.Body.String())
+
+	w = request("PUT", "If-Match", read)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.NotEqual(read, w.Header().Get("ETag"))
+	w = request("PUT", "If-Match", read)
+	asserts.Equal(http.StatusPreconditionFailed, w.Code, "Writing over a change made since the read should fail")
+	asserts.Equal(2, version)
+	w = request("PUT", "", "")
+	asserts.Equal(http.StatusOK, w.Code, "Writes without If-Match always go ahead")
+
+	w = request("GET", "If-None-Match", read)
+	asserts.Equal(http.StatusOK, w.Code, "A changed resource is sent again")
+}
+
+type outboxPayload struct {
+	Title string
+	Tags  []string
+}
+
+func TestOutbox(t *testing.T) {
+	asserts := assert.New(t)
+	db := TestDBInit()
+	defer TestDBFree(db)
+
+	RegisterEvent("test.recorded", outboxPayload{})
+	RegisterEvent("test.followup", outboxPayload{})
+	var received []string
+	failures := 1
+	defer Handle(func(e Event) error {
+		payload := e.Payload.(outboxPayload)
+		received = append(received, fmt.Sprintf("%d %s %v", e.ID, payload.Title, payload.Tags))
+		if payload.Title == "followup" {
+			return nil
+		}
+		if failures > 0 {
+			failures--
+			return errors.New("not now")
+		}
+		// Events recorded by handlers are dispatched by the running Dispatch
+		tx := GetDB().Begin()
+		Record(tx, Event{Name: "test.followup", Payload: outboxPayload{Title: "followup"}})
+		tx.Commit()
+		Dispatch()
+		return nil
+	}, "test.recorded", "test.followup")()
+	defer Handle(func(e Event) error {
+		panic("broken handler")
+	}, "test.broken")()
+	RegisterEvent("test.broken", "")
+
+	asserts.ErrorIs(Record(db, Event{Name: "test.unknown"}), ErrUnregisteredEvent)
+
+	// Rolled back events are never dispatched
+	tx := db.Begin()
+	asserts.NoError(Record(tx, Event{Name: "test.recorded", Payload: outboxPayload{Title: "rolled back"}}))
+	tx.Rollback()
+	tx = db.Begin()
+	asserts.NoError(Record(tx, Event{Name: "test.recorded", Payload: outboxPayload{Title: "a", Tags: []string{"x"}}}))
+	asserts.NoError(tx.Commit().Error)
+	Dispatch()
+	var entry OutboxModel
+	db.Last(&entry)
+	first := fmt.Sprintf("%d a [x]", entry.ID)
+	asserts.Equal([]string{first}, received, "the payload is read back with its type")
+
+	// A failed event is dispatched again after the retry delay
+	asserts.Nil(entry.DispatchedAt)
+	asserts.Equal(1, entry.Attempts)
+	asserts.Equal("not now", entry.LastError)
+	Dispatch()
+	asserts.Len(received, 1, "not before the retry delay")
+	dispatched, err := dispatchDue(entry.AvailableAt)
+	asserts.NoError(err)
+	asserts.Equal(1, dispatched)
+	asserts.Equal([]string{first, first, fmt.Sprintf("%d followup []", entry.ID+1)}, received)
+	db.First(&entry, entry.ID)
+	asserts.NotNil(entry.DispatchedAt)
+
+	// Panicking handlers fail the event instead of the process
+	asserts.NoError(Record(db, Event{Name: "test.broken", Payload: "boom"}))
+	Dispatch()
+	var broken OutboxModel
+	db.Last(&broken)
+	asserts.Nil(broken.DispatchedAt)
+	asserts.Equal("handler panicked: broken handler", broken.LastError)
+
+	asserts.NoError(PruneOutbox(time.Now().Add(time.Hour)))
+	var count int
+	db.Model(&OutboxModel{}).Count(&count)
+	asserts.Equal(1, count, "only undispatched events are kept")
+}
+
+func TestSiteURL(t *testing.T) {
+	asserts := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	defer func(site string) { SiteURL = site }(SiteURL)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/feeds/articles.atom", nil)
+	SiteURL = ""
+	asserts.Equal("http://example.com", SiteBase(c), "without SITE_URL links point at the request")
+	asserts.Equal("example.com", SiteHost(c))
+	c.Request.Header.Set("X-Forwarded-Proto", "https")
+	asserts.Equal("https://example.com", RequestOrigin(c))
+
+	SiteURL = "https://conduit.example.com:8443/"
+	asserts.Equal("https://conduit.example.com:8443", SiteBase(c))
+	asserts.Equal("conduit.example.com", SiteHost(c))
+	asserts.Equal("https://conduit.example.com:8443/article/a%20b", ArticleURL(c, "a b"))
+	asserts.Equal("https://conduit.example.com:8443/profile/jake", ProfileURL(c, "jake"))
+	asserts.Equal("https://example.com", RequestOrigin(c), "the API keeps its own origin")
+}
+
+func TestPublicAddresses(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "172.16.5.4", "192.168.1.1", "169.254.169.254", "0.0.0.0", "100.64.0.1", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		asserts.False(IsPublicIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1::1"} {
+		asserts.True(IsPublicIP(net.ParseIP(ip)), ip)
+	}
+
+	asserts.NoError(CheckPublicURL("https://example.com/hook"))
+	asserts.NoError(CheckPublicURL("http://93.184.216.34:8080/hook"))
+	asserts.ErrorIs(CheckPublicURL("ftp://example.com/hook"), ErrURLScheme)
+	asserts.ErrorIs(CheckPublicURL("file:///etc/passwd"), ErrURLScheme)
+	asserts.ErrorIs(CheckPublicURL("http://127.0.0.1:6379"), ErrPrivateAddress)
+	asserts.ErrorIs(CheckPublicURL("http://[::1]/"), ErrPrivateAddress)
+	asserts.ErrorIs(CheckPublicURL("http://LOCALHOST./"), ErrPrivateAddress)
+	asserts.ErrorIs(CheckPublicURL("http://169.254.169.254/latest/meta-data"), ErrPrivateAddress)
+
+	// Host names are checked once they're resolved, when connecting
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	client := NewPublicClient(time.Second)
+	_, err := client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	asserts.ErrorIs(err, ErrPrivateAddress)
+	AllowPrivateAddresses = true
+	defer func() { AllowPrivateAddresses = false }()
+	response, err := client.Get(server.URL)
+	if asserts.NoError(err) {
+		response.Body.Close()
+	}
+}
@@ -0,0 +1,115 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/jobs"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// Activities are delivered by jobs of the Queue queue, one job per inbox.
+const (
+	Queue      = "federation"
+	deliverJob = "federation.deliver"
+)
+
+type deliveryJob struct {
+	UserID   uint            `json:"userId"`
+	Inbox    string          `json:"inbox"`
+	Activity json.RawMessage `json:"activity"`
+}
+
+// Queue an activity of a user to each of the inboxes, in the transaction tx. An activity waiting for
+// an inbox isn't queued for it again.
+func enqueueDeliveries(tx *gorm.DB, user users.UserModel, activity gin.H, inboxes []string) error {
+	body, err := json.Marshal(withContext(activity))
+	if err != nil {
+		return err
+	}
+	for _, inbox := range inboxes {
+		options := jobs.EnqueueOptions{Queue: Queue, UniqueKey: fmt.Sprintf("%s %s", activity["id"], inbox)}
+		if _, err := jobs.Enqueue(tx, deliverJob, deliveryJob{UserID: user.ID, Inbox: inbox, Activity: body}, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// New articles are sent to the servers of the author's remote followers.
+func init() {
+	jobs.Register(deliverJob, deliver)
+
+	common.Handle(func(e common.Event) error {
+		created := e.Payload.(articles.ArticleModel)
+		article, err := articles.FindOneArticle(map[string]interface{}{"id": created.ID})
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		author := article.Author.UserModel
+		inboxes, err := followerInboxes(author.ID)
+		if err != nil || len(inboxes) == 0 {
+			return err
+		}
+		tx := common.GetDB().Begin()
+		if err := enqueueDeliveries(tx, author, createActivity(article), inboxes); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit().Error
+	}, articles.EventArticleCreated)
+}
+
+// POST an activity to an inbox, signed with the key of the user it comes from.
+func deliver(ctx context.Context, job jobs.Job) error {
+	var payload deliveryJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	user, err := users.FindOneUser(&users.UserModel{ID: payload.UserID})
+	if err != nil {
+		return err
+	}
+	key, err := FindActorKey(user.ID)
+	if err != nil {
+		return err
+	}
+	private, err := key.privateKey()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", payload.Inbox, bytes.NewReader(payload.Activity))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", activityContentType)
+	request.Header.Set("Accept", activityContentType)
+	request.Header.Set("User-Agent", "realworld-federation")
+	if err := Sign(request, ActorURL(user.Username)+"#main-key", private, payload.Activity); err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("delivering to %s: unexpected status %d", payload.Inbox, response.StatusCode)
+	}
+	return nil
+}
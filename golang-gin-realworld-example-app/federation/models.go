@@ -0,0 +1,411 @@
+package federation
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The public address the API is reachable at, e.g. https://api.conduit.example.com, set from
+// FEDERATION_URL. Actor and object ids are made from it, so it mustn't change once other servers
+// know them.
+var BaseURL = "http://localhost:8081"
+
+// Remote actors are fetched again after ActorCacheTTL, requests to other servers give up after
+// RequestTimeout. A signature made with an unknown key refreshes the actor, at most once per
+// ActorRefreshInterval, so unsigned junk can't make this server fetch actors over and over.
+var (
+	ActorCacheTTL        = 24 * time.Hour
+	ActorRefreshInterval = time.Minute
+	RequestTimeout       = 10 * time.Second
+)
+
+const KeyBits = 2048
+
+var ErrNotFederated = errors.New("not a federated actor")
+
+// The key pair a user signs outgoing activities with, created on first use.
+type ActorKeyModel struct {
+	gorm.Model
+	UserModelID   uint   `gorm:"unique_index"`
+	PrivateKeyPEM string `gorm:"type:text"`
+	PublicKeyPEM  string `gorm:"type:text"`
+}
+
+// An actor of another server as last fetched, with the key its requests are signed with.
+type RemoteActorModel struct {
+	gorm.Model
+	ActorID           string `gorm:"unique_index"`
+	PreferredUsername string
+	Inbox             string
+	SharedInbox       string
+	KeyID             string
+	PublicKeyPEM      string `gorm:"type:text"`
+	FetchedAt         time.Time
+}
+
+// A remote actor following a user, the fediverse counterpart of users.FollowModel. Taking a follow
+// back deletes the row, the unique index only allows one per actor.
+type RemoteFollowerModel struct {
+	gorm.Model
+	UserModelID uint   `gorm:"unique_index:idx_remote_follower"`
+	ActorID     string `gorm:"unique_index:idx_remote_follower;index"`
+	ActivityID  string
+}
+
+// A remote actor's Like of an article, counted in the article's favorites. Like follows, likes which
+// are taken back are deleted.
+type RemoteLikeModel struct {
+	gorm.Model
+	ArticleID  uint   `gorm:"unique_index:idx_remote_like"`
+	ActorID    string `gorm:"unique_index:idx_remote_like;index"`
+	ActivityID string
+}
+
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&ActorKeyModel{})
+	db.AutoMigrate(&RemoteActorModel{})
+	// Follows and likes taken back used to be kept, and racing activities could store one twice,
+	// neither fits the unique indexes
+	dropDuplicates(db, "remote_follower_models", "user_model_id, actor_id")
+	dropDuplicates(db, "remote_like_models", "article_id, actor_id")
+	db.AutoMigrate(&RemoteFollowerModel{})
+	db.AutoMigrate(&RemoteLikeModel{})
+}
+
+func dropDuplicates(db *gorm.DB, table, columns string) {
+	if !db.HasTable(table) {
+		return
+	}
+	db.Exec("DELETE FROM " + table + " WHERE deleted_at IS NOT NULL OR id NOT IN " +
+		"(SELECT MIN(id) FROM " + table + " WHERE deleted_at IS NULL GROUP BY " + columns + ")")
+}
+
+func base() string {
+	return strings.TrimRight(BaseURL, "/")
+}
+
+// The host other servers know this one by, the domain of acct: URIs.
+func Host() string {
+	parsed, err := url.Parse(base())
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+func ActorURL(username string) string {
+	return base() + "/ap/users/" + url.PathEscape(username)
+}
+
+func ArticleObjectURL(articleID uint) string {
+	return fmt.Sprintf("%s/ap/articles/%d", base(), articleID)
+}
+
+// The article id in the URL of an article object of this server.
+func articleIDOf(objectURL string) (uint, bool) {
+	var id uint
+	prefix := base() + "/ap/articles/"
+	if !strings.HasPrefix(objectURL, prefix) {
+		return 0, false
+	}
+	_, err := fmt.Sscanf(strings.TrimPrefix(objectURL, prefix), "%d", &id)
+	return id, err == nil && id > 0
+}
+
+// Links to the site pages, on SITE_URL when it's set.
+func siteBase() string {
+	if common.SiteURL != "" {
+		return strings.TrimRight(common.SiteURL, "/")
+	}
+	return base()
+}
+
+// The key pair of a user, generated the first time it's needed.
+func FindActorKey(userID uint) (ActorKeyModel, error) {
+	db := common.GetDB()
+	var key ActorKeyModel
+	query := db.Where("user_model_id = ?", userID).First(&key)
+	if query.Error == nil || !query.RecordNotFound() {
+		return key, query.Error
+	}
+	private, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return key, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return key, err
+	}
+	key = ActorKeyModel{
+		UserModelID:   userID,
+		PrivateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})),
+		PublicKeyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+	}
+	// Two requests may race to create the key, the one which loses reads the winner's
+	if err := db.Where("user_model_id = ?", userID).Attrs(key).FirstOrCreate(&key).Error; err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
+func (key ActorKeyModel) privateKey() (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKeyPEM))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func parsePublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key isn't RSA")
+	}
+	return public, nil
+}
+
+// Actor ids and inboxes come from other servers, requests never reach private addresses.
+var client = common.NewPublicClient(RequestTimeout)
+
+// The parts of an actor document this server uses.
+type remoteActor struct {
+	ID                string `json:"id"`
+	Type              string `json:"type"`
+	PreferredUsername string `json:"preferredUsername"`
+	Inbox             string `json:"inbox"`
+	Endpoints         struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// A remote actor from the cache, fetched when it isn't cached or the cached copy is older than
+// ActorCacheTTL, or refresh is set and it's older than ActorRefreshInterval.
+func FindRemoteActor(actorID string, refresh bool) (RemoteActorModel, error) {
+	db := common.GetDB()
+	var actor RemoteActorModel
+	query := db.Where("actor_id = ?", actorID).First(&actor)
+	if query.Error != nil && !query.RecordNotFound() {
+		return actor, query.Error
+	}
+	age := time.Since(actor.FetchedAt)
+	if query.Error == nil && age < ActorCacheTTL && (!refresh || age < ActorRefreshInterval) {
+		return actor, nil
+	}
+	fetched, err := fetchActor(actorID)
+	if err != nil {
+		return actor, err
+	}
+	actor.ActorID = fetched.ID
+	actor.PreferredUsername = fetched.PreferredUsername
+	actor.Inbox = fetched.Inbox
+	actor.SharedInbox = fetched.Endpoints.SharedInbox
+	actor.KeyID = fetched.PublicKey.ID
+	actor.PublicKeyPEM = fetched.PublicKey.PublicKeyPem
+	actor.FetchedAt = time.Now()
+	err = db.Save(&actor).Error
+	return actor, err
+}
+
+func fetchActor(actorID string) (remoteActor, error) {
+	var actor remoteActor
+	if err := common.CheckPublicURL(actorID); err != nil {
+		return actor, fmt.Errorf("%w: %s: %w", ErrNotFederated, actorID, err)
+	}
+	request, err := http.NewRequest("GET", actorID, nil)
+	if err != nil {
+		return actor, err
+	}
+	request.Header.Set("Accept", activityContentType)
+	response, err := client.Do(request)
+	if err != nil {
+		return actor, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return actor, fmt.Errorf("fetching %s: unexpected status %d", actorID, response.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&actor); err != nil {
+		return actor, err
+	}
+	if actor.ID != actorID || actor.Inbox == "" || actor.PublicKey.PublicKeyPem == "" || actor.PublicKey.Owner != actor.ID {
+		return actor, fmt.Errorf("%w: %s", ErrNotFederated, actorID)
+	}
+	return actor, nil
+}
+
+// Where activities for a remote actor are delivered, the shared inbox of its server if it has one.
+func (actor RemoteActorModel) deliveryInbox() string {
+	if actor.SharedInbox != "" {
+		return actor.SharedInbox
+	}
+	return actor.Inbox
+}
+
+func addFollower(user users.UserModel, actorID, activityID string) error {
+	db := common.GetDB()
+	var follower RemoteFollowerModel
+	err := db.Where(RemoteFollowerModel{UserModelID: user.ID, ActorID: actorID}).
+		Assign(RemoteFollowerModel{ActivityID: activityID}).FirstOrCreate(&follower).Error
+	if common.IsUniqueViolation(err) {
+		// The same Follow delivered twice at once, the other one stored it
+		return nil
+	}
+	return err
+}
+
+// Remove a follow by the follower and, when the Undo only names it, by the id of the Follow activity.
+func removeFollower(actorID, activityID string, userID uint) error {
+	db := common.GetDB()
+	query := db.Where("actor_id = ?", actorID)
+	if userID != 0 {
+		query = query.Where("user_model_id = ?", userID)
+	} else {
+		query = query.Where("activity_id = ?", activityID)
+	}
+	return query.Unscoped().Delete(&RemoteFollowerModel{}).Error
+}
+
+func CountFollowers(userID uint) (int, error) {
+	var count int
+	err := common.GetDB().Model(&RemoteFollowerModel{}).Where("user_model_id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+// The inboxes the activities of a user go to, each shared inbox once.
+func followerInboxes(userID uint) ([]string, error) {
+	db := common.GetDB()
+	var actors []RemoteActorModel
+	err := db.Joins("JOIN remote_follower_models ON remote_follower_models.actor_id = remote_actor_models.actor_id").
+		Where("remote_follower_models.deleted_at IS NULL AND remote_follower_models.user_model_id = ?", userID).
+		Find(&actors).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	inboxes := []string{}
+	for _, actor := range actors {
+		inbox := actor.deliveryInbox()
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return inboxes, nil
+}
+
+// Count a Like as a favorite of the article, once per actor. It is recorded as a favorite without
+// FavoriteBy, so the cached article, the real-time streams and the author hear about it like about
+// a local favorite.
+func addLike(articleID uint, actorID, activityID string) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	like := RemoteLikeModel{ArticleID: articleID, ActorID: actorID, ActivityID: activityID}
+	if err := tx.Create(&like).Error; common.IsUniqueViolation(err) {
+		// Liked before, it's only counted once
+		tx.Rollback()
+		return nil
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := common.AdjustCounter(tx, "article_models", "id", articleID, "favorites_count", 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := recordLike(tx, articles.EventArticleFavorited, articleID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Take back a Like, found by the article it liked or by the id of the Like activity.
+func removeLike(actorID, activityID string, articleID uint) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	query := tx.Where("actor_id = ?", actorID)
+	if articleID != 0 {
+		query = query.Where("article_id = ?", articleID)
+	} else {
+		query = query.Where("activity_id = ?", activityID)
+	}
+	var likes []RemoteLikeModel
+	if err := query.Find(&likes).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, like := range likes {
+		if err := tx.Unscoped().Delete(&like).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := common.AdjustCounter(tx, "article_models", "id", like.ArticleID, "favorites_count", -1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := recordLike(tx, articles.EventArticleUnfavorited, like.ArticleID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Record a remote like, or its Undo, as a favorite event of the article as it is after the change.
+func recordLike(tx *gorm.DB, event string, articleID uint) error {
+	var article articles.ArticleModel
+	if err := tx.First(&article, articleID).Error; err != nil {
+		return err
+	}
+	favorite := articles.FavoriteModel{Favorite: article, FavoriteID: articleID}
+	return common.Record(tx, common.Event{Name: event, Payload: favorite})
+}
+
+// Count the local favorites and the remote likes into favorites_count. articles.ReconcileCounters only
+// counts local favorites, the count set here doesn't depend on it having run before.
+func ReconcileCounters(db *gorm.DB) error {
+	return db.Exec(`UPDATE article_models SET
+		favorites_count = (SELECT COUNT(*) FROM favorite_models
+			WHERE favorite_models.favorite_id = article_models.id AND favorite_models.deleted_at IS NULL)
+		+ (SELECT COUNT(*) FROM remote_like_models
+			WHERE remote_like_models.article_id = article_models.id AND remote_like_models.deleted_at IS NULL)`).Error
+}
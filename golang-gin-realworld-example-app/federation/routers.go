@@ -0,0 +1,336 @@
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Public route at the root: other servers look users up with WebFinger.
+func WellKnownRegister(router *gin.RouterGroup) {
+	router.GET("/.well-known/webfinger", WebFinger)
+}
+
+// Public routes below /ap, the ActivityPub documents and inboxes.
+func FederationRegister(router *gin.RouterGroup) {
+	router.GET("/users/:username", Actor)
+	router.GET("/users/:username/outbox", Outbox)
+	router.GET("/users/:username/followers", Followers)
+	router.POST("/users/:username/inbox", Inbox)
+	router.POST("/inbox", Inbox)
+	router.GET("/articles/:id", ArticleObject)
+	router.GET("/articles/:id/activity", ArticleActivity)
+}
+
+// Outbox pages hold OutboxPageSize activities.
+const OutboxPageSize = 20
+
+func activityJSON(c *gin.Context, status int, document gin.H) {
+	body, err := json.Marshal(withContext(document))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("json", err))
+		return
+	}
+	c.Data(status, activityContentType+"; charset=utf-8", body)
+}
+
+func notFound(c *gin.Context, key string) {
+	c.JSON(http.StatusNotFound, common.NewError(key, errors.New("Invalid "+key)))
+}
+
+func findUser(c *gin.Context) (users.UserModel, bool) {
+	user, err := users.FindOneUser(&users.UserModel{Username: c.Param("username")})
+	if err != nil {
+		notFound(c, "actor")
+		return user, false
+	}
+	return user, true
+}
+
+// The user an actor URL of this server belongs to.
+func userOf(actorURL string) (users.UserModel, error) {
+	prefix := base() + "/ap/users/"
+	if !strings.HasPrefix(actorURL, prefix) {
+		return users.UserModel{}, ErrNotFederated
+	}
+	username, err := url.PathUnescape(strings.TrimPrefix(actorURL, prefix))
+	if err != nil {
+		return users.UserModel{}, err
+	}
+	return users.FindOneUser(&users.UserModel{Username: username})
+}
+
+// Answers ?resource=acct:jake@host, or the actor URL, with the links to the user's actor.
+func WebFinger(c *gin.Context) {
+	resource := c.Query("resource")
+	var user users.UserModel
+	var err error
+	if strings.HasPrefix(resource, "acct:") {
+		username, host, ok := strings.Cut(strings.TrimPrefix(resource, "acct:"), "@")
+		if !ok || !strings.EqualFold(host, Host()) {
+			notFound(c, "resource")
+			return
+		}
+		user, err = users.FindOneUser(&users.UserModel{Username: username})
+	} else {
+		user, err = userOf(resource)
+	}
+	if err != nil {
+		notFound(c, "resource")
+		return
+	}
+	actor := ActorURL(user.Username)
+	profile := siteBase() + "/profile/" + url.PathEscape(user.Username)
+	body, _ := json.Marshal(gin.H{
+		"subject": fmt.Sprintf("acct:%s@%s", user.Username, Host()),
+		"aliases": []string{actor, profile},
+		"links": []gin.H{
+			{"rel": "self", "type": activityContentType, "href": actor},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": profile},
+		},
+	})
+	c.Data(http.StatusOK, "application/jrd+json; charset=utf-8", body)
+}
+
+func Actor(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	key, err := FindActorKey(user.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	activityJSON(c, http.StatusOK, actorDocument(user, key))
+}
+
+// The Create activities of the user's articles, newest first. Without ?page= it's the collection
+// pointing at its first page.
+func Outbox(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	outbox := ActorURL(user.Username) + "/outbox"
+	page, err := strconv.Atoi(c.Query("page"))
+	if c.Query("page") != "" && (err != nil || page < 1) {
+		notFound(c, "page")
+		return
+	}
+	models, count, err := articles.FindManyArticle("", user.Username, strconv.Itoa(OutboxPageSize), strconv.Itoa((max(page, 1)-1)*OutboxPageSize), "")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if page == 0 {
+		activityJSON(c, http.StatusOK, gin.H{
+			"id":         outbox,
+			"type":       "OrderedCollection",
+			"totalItems": count,
+			"first":      outbox + "?page=1",
+		})
+		return
+	}
+	items := []gin.H{}
+	for _, model := range models {
+		items = append(items, createActivity(model))
+	}
+	document := gin.H{
+		"id":           fmt.Sprintf("%s?page=%d", outbox, page),
+		"type":         "OrderedCollectionPage",
+		"partOf":       outbox,
+		"totalItems":   count,
+		"orderedItems": items,
+	}
+	if page*OutboxPageSize < count {
+		document["next"] = fmt.Sprintf("%s?page=%d", outbox, page+1)
+	}
+	if page > 1 {
+		document["prev"] = fmt.Sprintf("%s?page=%d", outbox, page-1)
+	}
+	activityJSON(c, http.StatusOK, document)
+}
+
+// Only the number of remote followers is public.
+func Followers(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	count, err := CountFollowers(user.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	activityJSON(c, http.StatusOK, gin.H{
+		"id":         ActorURL(user.Username) + "/followers",
+		"type":       "OrderedCollection",
+		"totalItems": count,
+	})
+}
+
+func findArticle(c *gin.Context) (articles.ArticleModel, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		notFound(c, "article")
+		return articles.ArticleModel{}, false
+	}
+	article, err := articles.FindOneArticle(map[string]interface{}{"id": id})
+	if err != nil {
+		notFound(c, "article")
+		return article, false
+	}
+	return article, true
+}
+
+func ArticleObject(c *gin.Context) {
+	if article, ok := findArticle(c); ok {
+		activityJSON(c, http.StatusOK, articleObject(article))
+	}
+}
+
+func ArticleActivity(c *gin.Context) {
+	if article, ok := findArticle(c); ok {
+		activityJSON(c, http.StatusOK, createActivity(article))
+	}
+}
+
+// The parts of incoming activities the inbox looks at. Object is an id, or an embedded object such as
+// the Follow an Undo takes back.
+type activity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// The id of the object, whether it's embedded or referenced.
+func (a activity) objectID() string {
+	var id string
+	if json.Unmarshal(a.Object, &id) == nil {
+		return id
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(a.Object, &object)
+	return object.ID
+}
+
+// Activities from other servers, which have to be signed by their actor. Follow, Undo of a Follow or
+// Like, and Like are handled, anything else is accepted and dropped.
+func Inbox(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("activity", err))
+		return
+	}
+	actor, err := Verify(c.Request, body)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, common.NewError("signature", err))
+		return
+	}
+	var received activity
+	if err := json.Unmarshal(body, &received); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("activity", err))
+		return
+	}
+	if received.Actor != actor.ActorID {
+		c.JSON(http.StatusUnauthorized, common.NewError("signature", errors.New("activities can only be sent by their actor")))
+		return
+	}
+
+	switch received.Type {
+	case "Follow":
+		user, err := userOf(received.objectID())
+		if err != nil {
+			notFound(c, "actor")
+			return
+		}
+		if err := follow(user, actor, received, body); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	case "Like":
+		articleID, ok := articleIDOf(received.objectID())
+		if !ok {
+			notFound(c, "article")
+			return
+		}
+		if _, err := articles.FindOneArticle(map[string]interface{}{"id": articleID}); err != nil {
+			notFound(c, "article")
+			return
+		}
+		if err := addLike(articleID, actor.ActorID, received.ID); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	case "Undo":
+		if err := undo(actor, received); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// Record the follower and send it an Accept.
+func follow(user users.UserModel, actor RemoteActorModel, received activity, body []byte) error {
+	if err := addFollower(user, actor.ActorID, received.ID); err != nil {
+		return err
+	}
+	var followActivity gin.H
+	json.Unmarshal(body, &followActivity)
+	delete(followActivity, "@context")
+	accept := gin.H{
+		"id":     fmt.Sprintf("%s#accepts/follows/%s", ActorURL(user.Username), url.QueryEscape(received.ID)),
+		"type":   "Accept",
+		"actor":  ActorURL(user.Username),
+		"object": followActivity,
+	}
+	tx := common.GetDB().Begin()
+	if err := enqueueDeliveries(tx, user, accept, []string{actor.Inbox}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func undo(actor RemoteActorModel, received activity) error {
+	var undone activity
+	if json.Unmarshal(received.Object, &undone) != nil {
+		// Only the id of the undone activity, it's a follow or a like of the actor
+		id := received.objectID()
+		if err := removeFollower(actor.ActorID, id, 0); err != nil {
+			return err
+		}
+		return removeLike(actor.ActorID, id, 0)
+	}
+	if undone.Actor != "" && undone.Actor != actor.ActorID {
+		return nil
+	}
+	switch undone.Type {
+	case "Follow":
+		user, err := userOf(undone.objectID())
+		if err != nil {
+			return removeFollower(actor.ActorID, undone.ID, 0)
+		}
+		return removeFollower(actor.ActorID, undone.ID, user.ID)
+	case "Like":
+		articleID, _ := articleIDOf(undone.objectID())
+		return removeLike(actor.ActorID, undone.ID, articleID)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package federation
+
+import (
+	"net/url"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	activityContentType = "application/activity+json"
+	activityStreams     = "https://www.w3.org/ns/activitystreams"
+	publicCollection    = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// The Person document of a user, with the key other servers check signatures against.
+func actorDocument(user users.UserModel, key ActorKeyModel) gin.H {
+	actor := ActorURL(user.Username)
+	document := gin.H{
+		"@context":          []string{activityStreams, "https://w3id.org/security/v1"},
+		"id":                actor,
+		"type":              "Person",
+		"preferredUsername": user.Username,
+		"name":              user.Username,
+		"summary":           user.Bio,
+		"url":               siteBase() + "/profile/" + url.PathEscape(user.Username),
+		"inbox":             actor + "/inbox",
+		"outbox":            actor + "/outbox",
+		"followers":         actor + "/followers",
+		"endpoints":         gin.H{"sharedInbox": base() + "/ap/inbox"},
+		"publicKey": gin.H{
+			"id":           actor + "#main-key",
+			"owner":        actor,
+			"publicKeyPem": key.PublicKeyPEM,
+		},
+	}
+	if user.Image != nil && *user.Image != "" {
+		document["icon"] = gin.H{"type": "Image", "url": *user.Image}
+	}
+	return document
+}
+
+// An article as an ActivityStreams Article, addressed to the public and the author's followers.
+func articleObject(article articles.ArticleModel) gin.H {
+	author := ActorURL(article.Author.UserModel.Username)
+	content := article.BodyHTML
+	if content == "" {
+		content = common.RenderMarkdown(article.Body)
+	}
+	tags := []gin.H{}
+	for _, tag := range article.Tags {
+		tags = append(tags, gin.H{"type": "Hashtag", "name": "#" + tag.Tag})
+	}
+	return gin.H{
+		"id":           ArticleObjectURL(article.ID),
+		"type":         "Article",
+		"attributedTo": author,
+		"name":         article.Title,
+		"summary":      article.Description,
+		"content":      content,
+		"mediaType":    "text/html",
+		"url":          siteBase() + "/article/" + url.PathEscape(article.Slug),
+		"published":    timestamp(article.CreatedAt),
+		"updated":      timestamp(article.UpdatedAt),
+		"tag":          tags,
+		"to":           []string{publicCollection},
+		"cc":           []string{author + "/followers"},
+	}
+}
+
+func createActivity(article articles.ArticleModel) gin.H {
+	object := articleObject(article)
+	return gin.H{
+		"id":        ArticleObjectURL(article.ID) + "/activity",
+		"type":      "Create",
+		"actor":     object["attributedTo"],
+		"published": object["published"],
+		"to":        object["to"],
+		"cc":        object["cc"],
+		"object":    object,
+	}
+}
+
+func withContext(document gin.H) gin.H {
+	if _, ok := document["@context"]; !ok {
+		document["@context"] = activityStreams
+	}
+	return document
+}
@@ -0,0 +1,162 @@
+package federation
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Requests between servers are signed as in draft-cavage-http-signatures, the way Mastodon and most
+// of the fediverse do it: rsa-sha256 over the request target, host, date and the digest of the body.
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// Signed requests older or newer than MaxClockSkew are refused, so captured ones can't be replayed later.
+var MaxClockSkew = 12 * time.Hour
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+func digestOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func signingString(request *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, header := range headers {
+		var value string
+		switch header {
+		case "(request-target)":
+			value = strings.ToLower(request.Method) + " " + request.URL.RequestURI()
+		case "host":
+			value = request.Host
+			if value == "" {
+				value = request.URL.Host
+			}
+		default:
+			value = request.Header.Get(header)
+		}
+		if value == "" {
+			return "", fmt.Errorf("%w: %s isn't set", ErrInvalidSignature, header)
+		}
+		lines = append(lines, header+": "+value)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Sign a request with the key of an actor, setting the Date, Digest and Signature headers.
+//
+//	err := federation.Sign(request, federation.ActorURL("jake")+"#main-key", key, body)
+func Sign(request *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	if request.Header.Get("Date") == "" {
+		request.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	request.Header.Set("Digest", digestOf(body))
+	signed, err := signingString(request, signedHeaders)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+type signatureHeader struct {
+	KeyID     string
+	Headers   []string
+	Signature []byte
+}
+
+func parseSignature(header string) (signatureHeader, error) {
+	var parsed signatureHeader
+	for _, part := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return parsed, ErrInvalidSignature
+		}
+		value = strings.Trim(value, `"`)
+		switch name {
+		case "keyId":
+			parsed.KeyID = value
+		case "headers":
+			parsed.Headers = strings.Fields(value)
+		case "signature":
+			signature, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return parsed, ErrInvalidSignature
+			}
+			parsed.Signature = signature
+		case "algorithm":
+			if value != "rsa-sha256" && value != "hs2019" {
+				return parsed, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidSignature, value)
+			}
+		}
+	}
+	if parsed.KeyID == "" || len(parsed.Signature) == 0 {
+		return parsed, ErrInvalidSignature
+	}
+	if len(parsed.Headers) == 0 {
+		parsed.Headers = []string{"date"}
+	}
+	return parsed, nil
+}
+
+// Check the signature of an incoming request and return the remote actor whose key signed it.
+// The key is fetched with the actor, once more when the cached one doesn't match, as actors may
+// have rotated their key.
+func Verify(request *http.Request, body []byte) (RemoteActorModel, error) {
+	var actor RemoteActorModel
+	signature, err := parseSignature(request.Header.Get("Signature"))
+	if err != nil {
+		return actor, err
+	}
+	required := map[string]bool{"(request-target)": true, "host": true, "date": true, "digest": true}
+	for _, header := range signature.Headers {
+		delete(required, header)
+	}
+	if len(required) > 0 {
+		return actor, fmt.Errorf("%w: not every required header is signed", ErrInvalidSignature)
+	}
+	date, err := http.ParseTime(request.Header.Get("Date"))
+	if err != nil || time.Since(date) > MaxClockSkew || time.Until(date) > MaxClockSkew {
+		return actor, fmt.Errorf("%w: date out of range", ErrInvalidSignature)
+	}
+	if request.Header.Get("Digest") != digestOf(body) {
+		return actor, fmt.Errorf("%w: digest doesn't match the body", ErrInvalidSignature)
+	}
+	signed, err := signingString(request, signature.Headers)
+	if err != nil {
+		return actor, err
+	}
+	hash := sha256.Sum256([]byte(signed))
+
+	actorID, _, _ := strings.Cut(signature.KeyID, "#")
+	for _, refresh := range []bool{false, true} {
+		actor, err = FindRemoteActor(actorID, refresh)
+		if err != nil {
+			return actor, err
+		}
+		if actor.KeyID != signature.KeyID {
+			continue
+		}
+		public, err := parsePublicKey(actor.PublicKeyPEM)
+		if err != nil {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(public, crypto.SHA256, hash[:], signature.Signature) == nil {
+			return actor, nil
+		}
+	}
+	return actor, ErrInvalidSignature
+}
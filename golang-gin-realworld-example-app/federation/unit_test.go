@@ -0,0 +1,415 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/jobs"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() *gorm.DB {
+	db := common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	jobs.AutoMigrate()
+	AutoMigrate()
+	return db
+}
+
+// A server of the fediverse with one actor, which checks the signatures of what it's sent against
+// the keys this server publishes.
+type peer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	mu       sync.Mutex
+	received []map[string]interface{}
+	failing  bool
+	fetches  int
+}
+
+func newPeer(t *testing.T) *peer {
+	key, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	assert.NoError(t, err)
+	p := &peer{key: key}
+	// The peer listens on localhost
+	common.AllowPrivateAddresses = true
+	t.Cleanup(func() { common.AllowPrivateAddresses = false })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/actor", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.fetches++
+		p.mu.Unlock()
+		public, _ := x509.MarshalPKIXPublicKey(&p.key.PublicKey)
+		w.Header().Set("Content-Type", activityContentType)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":                p.actor(),
+			"type":              "Person",
+			"preferredUsername": "remote",
+			"inbox":             p.URL + "/inbox",
+			"publicKey": map[string]string{
+				"id":           p.actor() + "#main-key",
+				"owner":        p.actor(),
+				"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+			},
+		})
+	})
+	mux.HandleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if p.failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if !p.verify(t, r, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var activity map[string]interface{}
+		json.Unmarshal(body, &activity)
+		p.mu.Lock()
+		p.received = append(p.received, activity)
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *peer) actor() string {
+	return p.URL + "/actor"
+}
+
+// Check a delivery was signed with the key of the actor it names.
+func (p *peer) verify(t *testing.T, r *http.Request, body []byte) bool {
+	signature, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil || r.Header.Get("Digest") != digestOf(body) {
+		return false
+	}
+	var activity struct {
+		Actor string `json:"actor"`
+	}
+	json.Unmarshal(body, &activity)
+	if signature.KeyID != activity.Actor+"#main-key" {
+		return false
+	}
+	user, err := userOf(activity.Actor)
+	if err != nil {
+		return false
+	}
+	key, err := FindActorKey(user.ID)
+	if err != nil {
+		return false
+	}
+	public, err := parsePublicKey(key.PublicKeyPEM)
+	if err != nil {
+		return false
+	}
+	signed, err := signingString(r, signature.Headers)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(signed))
+	return rsa.VerifyPKCS1v15(public, crypto.SHA256, hash[:], signature.Signature) == nil
+}
+
+func (p *peer) fetched() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fetches
+}
+
+func (p *peer) activities() []map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	received := p.received
+	p.received = nil
+	return received
+}
+
+// An activity of the peer's actor, signed unless key is nil.
+func (p *peer) request(t *testing.T, path string, activity map[string]interface{}, key *rsa.PrivateKey) *http.Request {
+	activity["@context"] = activityStreams
+	activity["actor"] = p.actor()
+	body, _ := json.Marshal(activity)
+	request := httptest.NewRequest("POST", base()+path, bytes.NewReader(body))
+	request.Header.Set("Content-Type", activityContentType)
+	if key != nil {
+		assert.NoError(t, Sign(request, p.actor()+"#main-key", key, body))
+	}
+	return request
+}
+
+func newRouter() *gin.Engine {
+	r := gin.New()
+	WellKnownRegister(r.Group(""))
+	FederationRegister(r.Group("/ap"))
+	return r
+}
+
+func serve(r *gin.Engine, request *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	return w
+}
+
+func getJSON(t *testing.T, r *gin.Engine, url string) (int, map[string]interface{}) {
+	w := serve(r, httptest.NewRequest("GET", url, nil))
+	var document map[string]interface{}
+	if w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &document))
+	}
+	return w.Code, document
+}
+
+func TestSignatures(t *testing.T) {
+	asserts := assert.New(t)
+
+	parsed, err := parseSignature(`keyId="https://a.example/actor#main-key",algorithm="rsa-sha256",headers="(request-target) host date digest",signature="AAAA"`)
+	asserts.NoError(err)
+	asserts.Equal("https://a.example/actor#main-key", parsed.KeyID)
+	asserts.Equal(signedHeaders, parsed.Headers)
+	_, err = parseSignature(`keyId="x",algorithm="hmac-sha256",signature="AAAA"`)
+	asserts.ErrorIs(err, ErrInvalidSignature)
+	_, err = parseSignature(`keyId="x"`)
+	asserts.ErrorIs(err, ErrInvalidSignature)
+
+	request := httptest.NewRequest("POST", "http://b.example/ap/inbox?x=1", nil)
+	request.Header.Set("Date", "Mon, 19 Oct 2026 10:00:00 GMT")
+	request.Header.Set("Digest", digestOf([]byte("{}")))
+	signed, err := signingString(request, signedHeaders)
+	asserts.NoError(err)
+	asserts.Equal("(request-target): post /ap/inbox?x=1\nhost: b.example\ndate: Mon, 19 Oct 2026 10:00:00 GMT\ndigest: SHA-256=RBNvo1WzZ4oRRq0W9+hknpT7T8If536DEMBg9hyq/4o=", signed)
+}
+
+func TestFederation(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+	gin.SetMode(gin.TestMode)
+
+	defer func(url string) { BaseURL = url }(BaseURL)
+	BaseURL = "http://conduit.test"
+	remote := newPeer(t)
+	defer remote.Close()
+	r := newRouter()
+	ctx := context.Background()
+
+	image := "https://img.example/jake.png"
+	jake := users.UserModel{Username: "fedjake", Email: "fedjake@test.com", Bio: "I work at statefarm", Image: &image}
+	test_db.Create(&jake)
+
+	// WebFinger and the actor document
+	code, finger := getJSON(t, r, "/.well-known/webfinger?resource=acct:fedjake@conduit.test")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("acct:fedjake@conduit.test", finger["subject"])
+	self := finger["links"].([]interface{})[0].(map[string]interface{})
+	asserts.Equal("http://conduit.test/ap/users/fedjake", self["href"])
+	asserts.Equal(activityContentType, self["type"])
+	code, _ = getJSON(t, r, "/.well-known/webfinger?resource=http://conduit.test/ap/users/fedjake")
+	asserts.Equal(http.StatusOK, code)
+	code, _ = getJSON(t, r, "/.well-known/webfinger?resource=acct:fedjake@elsewhere.test")
+	asserts.Equal(http.StatusNotFound, code)
+	code, _ = getJSON(t, r, "/.well-known/webfinger?resource=acct:nobody@conduit.test")
+	asserts.Equal(http.StatusNotFound, code)
+
+	w := serve(r, httptest.NewRequest("GET", "/ap/users/fedjake", nil))
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(activityContentType+"; charset=utf-8", w.Header().Get("Content-Type"))
+	var actor remoteActor
+	json.Unmarshal(w.Body.Bytes(), &actor)
+	asserts.Equal("http://conduit.test/ap/users/fedjake", actor.ID)
+	asserts.Equal("Person", actor.Type)
+	asserts.Equal(actor.ID+"/inbox", actor.Inbox)
+	asserts.Equal("http://conduit.test/ap/inbox", actor.Endpoints.SharedInbox)
+	asserts.Equal(actor.ID+"#main-key", actor.PublicKey.ID)
+	key, _ := FindActorKey(jake.ID)
+	asserts.Equal(key.PublicKeyPEM, actor.PublicKey.PublicKeyPem)
+	asserts.Contains(w.Body.String(), image)
+	code, _ = getJSON(t, r, "/ap/users/nobody")
+	asserts.Equal(http.StatusNotFound, code)
+
+	// A Follow is recorded and accepted
+	follow := map[string]interface{}{"id": remote.URL + "/follows/1", "type": "Follow", "object": actor.ID}
+	w = serve(r, remote.request(t, "/ap/users/fedjake/inbox", follow, remote.key))
+	asserts.Equal(http.StatusAccepted, w.Code, w.Body.String())
+	count, _ := CountFollowers(jake.ID)
+	asserts.Equal(1, count)
+	_, followers := getJSON(t, r, "/ap/users/fedjake/followers")
+	asserts.Equal(float64(1), followers["totalItems"])
+	attempted, err := jobs.Drain(ctx, Queue, time.Now())
+	asserts.NoError(err)
+	asserts.Equal(1, attempted)
+	received := remote.activities()
+	if asserts.Len(received, 1) {
+		asserts.Equal("Accept", received[0]["type"])
+		asserts.Equal(actor.ID, received[0]["actor"])
+		asserts.Equal(remote.URL+"/follows/1", received[0]["object"].(map[string]interface{})["id"])
+	}
+
+	// Following again doesn't add a follower
+	serve(r, remote.request(t, "/ap/inbox", follow, remote.key))
+	count, _ = CountFollowers(jake.ID)
+	asserts.Equal(1, count)
+	jobs.Drain(ctx, Queue, time.Now())
+	remote.activities()
+
+	// Unsigned, wrongly signed, tampered and impersonating requests are refused
+	w = serve(r, remote.request(t, "/ap/inbox", follow, nil))
+	asserts.Equal(http.StatusUnauthorized, w.Code)
+	other, _ := rsa.GenerateKey(rand.Reader, KeyBits)
+	w = serve(r, remote.request(t, "/ap/inbox", follow, other))
+	asserts.Equal(http.StatusUnauthorized, w.Code)
+	request := remote.request(t, "/ap/inbox", follow, remote.key)
+	request.Body = io.NopCloser(bytes.NewReader([]byte(`{"type":"Follow","actor":"` + remote.actor() + `","object":"x"}`)))
+	w = serve(r, request)
+	asserts.Equal(http.StatusUnauthorized, w.Code, "the digest doesn't match")
+	request = remote.request(t, "/ap/inbox", follow, nil)
+	request.Header.Set("Date", time.Now().Add(-2*MaxClockSkew).UTC().Format(http.TimeFormat))
+	body, _ := io.ReadAll(request.Body)
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	Sign(request, remote.actor()+"#main-key", remote.key, body)
+	w = serve(r, request)
+	asserts.Equal(http.StatusUnauthorized, w.Code, "stale requests can't be replayed")
+	request = remote.request(t, "/ap/inbox", follow, remote.key)
+	body, _ = io.ReadAll(request.Body)
+	body = bytes.Replace(body, []byte(remote.actor()), []byte("https://victim.example/actor"), 1)
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.Header.Set("Digest", digestOf(body))
+	w = serve(r, request)
+	asserts.Equal(http.StatusUnauthorized, w.Code, "the digest is signed")
+	asserts.Equal(1, remote.fetched(), "bad signatures refresh the actor at most once per ActorRefreshInterval")
+
+	// Actor ids pointing into the server's own network aren't fetched
+	common.AllowPrivateAddresses = false
+	_, err = FindRemoteActor("http://169.254.169.254/latest/meta-data", false)
+	asserts.ErrorIs(err, ErrNotFederated)
+	asserts.ErrorIs(err, common.ErrPrivateAddress)
+	_, err = FindRemoteActor(remote.actor(), true)
+	asserts.NoError(err, "a refresh within ActorRefreshInterval serves the cached actor")
+	common.AllowPrivateAddresses = true
+
+	// New articles are delivered to the followers
+	article := articles.ArticleModel{
+		Slug: "fed-go", Title: "Go", Description: "About Go", Body: "**bold**",
+		AuthorID: articles.GetArticleUserModel(jake).ID, Tags: []articles.TagModel{{Tag: "fedgo"}},
+	}
+	asserts.NoError(articles.CreateArticle(&article))
+	common.Dispatch()
+	attempted, _ = jobs.Drain(ctx, Queue, time.Now())
+	asserts.Equal(1, attempted)
+	received = remote.activities()
+	if asserts.Len(received, 1) {
+		asserts.Equal("Create", received[0]["type"])
+		object := received[0]["object"].(map[string]interface{})
+		asserts.Equal(ArticleObjectURL(article.ID), object["id"])
+		asserts.Equal("Article", object["type"])
+		asserts.Equal("Go", object["name"])
+		asserts.Equal("<p><strong>bold</strong></p>\n", object["content"])
+		asserts.Equal(actor.ID, object["attributedTo"])
+	}
+
+	// A failed delivery is retried
+	remote.failing = true
+	other1 := articles.ArticleModel{Slug: "fed-rust", Title: "Rust", Body: "plain", AuthorID: article.AuthorID}
+	asserts.NoError(articles.CreateArticle(&other1))
+	common.Dispatch()
+	now := time.Now()
+	jobs.Drain(ctx, Queue, now)
+	remote.failing = false
+	attempted, _ = jobs.Drain(ctx, Queue, now.Add(jobs.RetryBaseDelay))
+	asserts.Equal(1, attempted)
+	asserts.Len(remote.activities(), 1)
+
+	// The outbox pages through the Create activities
+	_, outbox := getJSON(t, r, "/ap/users/fedjake/outbox")
+	asserts.Equal("OrderedCollection", outbox["type"])
+	asserts.Equal(float64(2), outbox["totalItems"])
+	asserts.Equal(actor.ID+"/outbox?page=1", outbox["first"])
+	_, page := getJSON(t, r, "/ap/users/fedjake/outbox?page=1")
+	asserts.Equal("OrderedCollectionPage", page["type"])
+	asserts.Len(page["orderedItems"], 2)
+	asserts.Nil(page["next"])
+	code, _ = getJSON(t, r, "/ap/users/fedjake/outbox?page=0")
+	asserts.Equal(http.StatusNotFound, code)
+	_, object := getJSON(t, r, "/ap/articles/"+fmt.Sprint(article.ID))
+	asserts.Equal("Article", object["type"])
+	_, created := getJSON(t, r, "/ap/articles/"+fmt.Sprint(article.ID)+"/activity")
+	asserts.Equal("Create", created["type"])
+	code, _ = getJSON(t, r, "/ap/articles/999999")
+	asserts.Equal(http.StatusNotFound, code)
+
+	// Likes count as favorites, once per actor, until they're undone
+	favorites := func() uint {
+		var model articles.ArticleModel
+		test_db.First(&model, article.ID)
+		return model.FavoritesCount
+	}
+	reader := gin.New()
+	reader.GET("/api/articles/:slug", func(c *gin.Context) {
+		c.Set("my_user_model", users.UserModel{})
+		articles.ArticleRetrieve(c)
+	})
+	servedFavorites := func() interface{} {
+		_, response := getJSON(t, reader, "/api/articles/"+article.Slug)
+		return response["article"].(map[string]interface{})["favoritesCount"]
+	}
+	asserts.Equal(float64(0), servedFavorites())
+	like := map[string]interface{}{"id": remote.URL + "/likes/1", "type": "Like", "object": ArticleObjectURL(article.ID)}
+	w = serve(r, remote.request(t, "/ap/inbox", like, remote.key))
+	asserts.Equal(http.StatusAccepted, w.Code)
+	serve(r, remote.request(t, "/ap/inbox", like, remote.key))
+	asserts.Equal(uint(1), favorites())
+	asserts.Equal(float64(1), servedFavorites(), "the cached article counts the like")
+	asserts.NoError(articles.ReconcileCounters(test_db))
+	asserts.NoError(ReconcileCounters(test_db))
+	asserts.Equal(uint(1), favorites(), "reconciling keeps the remote likes")
+	asserts.NoError(ReconcileCounters(test_db))
+	asserts.Equal(uint(1), favorites(), "reconciling again doesn't count the likes twice")
+	w = serve(r, remote.request(t, "/ap/inbox", map[string]interface{}{"id": remote.URL + "/likes/2", "type": "Like", "object": ArticleObjectURL(999999)}, remote.key))
+	asserts.Equal(http.StatusNotFound, w.Code)
+
+	undo := map[string]interface{}{"id": remote.URL + "/undo/1", "type": "Undo", "object": like}
+	w = serve(r, remote.request(t, "/ap/inbox", undo, remote.key))
+	asserts.Equal(http.StatusAccepted, w.Code)
+	asserts.Equal(uint(0), favorites())
+	asserts.Equal(float64(0), servedFavorites())
+	asserts.NoError(addLike(article.ID, remote.actor(), remote.URL+"/likes/3"))
+	asserts.NoError(addLike(article.ID, remote.actor(), remote.URL+"/likes/3"), "a Like stored twice at once is no error")
+	asserts.Equal(uint(1), favorites(), "a Like after an Undo counts again")
+	asserts.NoError(removeLike(remote.actor(), "", article.ID))
+	asserts.Equal(uint(0), favorites())
+
+	// An Undo naming only the Follow ends it
+	undo = map[string]interface{}{"id": remote.URL + "/undo/2", "type": "Undo", "object": remote.URL + "/follows/1"}
+	w = serve(r, remote.request(t, "/ap/inbox", undo, remote.key))
+	asserts.Equal(http.StatusAccepted, w.Code)
+	count, _ = CountFollowers(jake.ID)
+	asserts.Equal(0, count)
+	inboxes, _ := followerInboxes(jake.ID)
+	asserts.Empty(inboxes)
+	asserts.NoError(addFollower(jake, remote.actor(), remote.URL+"/follows/2"))
+	count, _ = CountFollowers(jake.ID)
+	asserts.Equal(1, count, "following again after an Undo")
+}
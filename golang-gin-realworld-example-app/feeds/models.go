@@ -0,0 +1,81 @@
+package feeds
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The secret in the URL of a user's private feed. Feed readers can't send a JWT, whoever has the URL
+// reads the feed, so it can be rotated.
+type FeedTokenModel struct {
+	gorm.Model
+	UserModelID uint   `gorm:"unique_index"`
+	Token       string `gorm:"unique_index"`
+}
+
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&FeedTokenModel{})
+}
+
+func newToken() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The feed token of a user, created on first use.
+func FindFeedToken(userID uint) (FeedTokenModel, error) {
+	db := common.GetDB()
+	var token FeedTokenModel
+	err := db.Where(FeedTokenModel{UserModelID: userID}).Attrs(FeedTokenModel{Token: newToken()}).FirstOrCreate(&token).Error
+	return token, err
+}
+
+// Give a user a new feed token, the URL with the old one stops working.
+func RotateFeedToken(userID uint) (FeedTokenModel, error) {
+	token, err := FindFeedToken(userID)
+	if err != nil {
+		return token, err
+	}
+	token.Token = newToken()
+	err = common.GetDB().Model(&token).Update("token", token.Token).Error
+	return token, err
+}
+
+// The user a feed token belongs to.
+func FindTokenUser(token string) (users.UserModel, error) {
+	db := common.GetDB()
+	var feedToken FeedTokenModel
+	if err := db.Where("token = ?", token).First(&feedToken).Error; err != nil {
+		return users.UserModel{}, err
+	}
+	return users.FindOneUser(&users.UserModel{ID: feedToken.UserModelID})
+}
+
+// The latest articles of a feed, newest first.
+type Feed struct {
+	Title    string
+	Self     string
+	Link     string
+	Articles []articles.ArticleModel
+}
+
+// When the feed last changed: the latest update of its articles, zero for an empty feed.
+func (feed Feed) Updated() time.Time {
+	var updated time.Time
+	for _, article := range feed.Articles {
+		if article.UpdatedAt.After(updated) {
+			updated = article.UpdatedAt
+		}
+	}
+	return updated
+}
@@ -0,0 +1,167 @@
+package feeds
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Public routes below /feeds. Every feed comes as Atom and as RSS, named by the extension:
+// /feeds/articles.atom, /feeds/tags/go.rss, /feeds/profiles/jake.atom, /feeds/private/<token>.atom.
+func FeedsRegister(router *gin.RouterGroup) {
+	router.GET("/articles.atom", GlobalFeed)
+	router.GET("/articles.rss", GlobalFeed)
+	router.GET("/tags/:file", TagFeed)
+	router.GET("/profiles/:file", AuthorFeed)
+	router.GET("/private/:file", PrivateFeed)
+}
+
+// Routes below /api/user for the URL of the current user's private feed.
+func FeedTokenRegister(router *gin.RouterGroup) {
+	router.GET("/feed", FeedTokenRetrieve)
+	router.POST("/feed/rotate", FeedTokenRotate)
+}
+
+// Split "go.atom" into the name and the format, ok is false for unknown formats.
+func splitFile(file string) (name, format string, ok bool) {
+	dot := strings.LastIndex(file, ".")
+	if dot <= 0 {
+		return "", "", false
+	}
+	name, format = file[:dot], file[dot+1:]
+	_, ok = contentTypes[format]
+	return name, format, ok
+}
+
+func selfURL(c *gin.Context) string {
+	return common.RequestOrigin(c) + c.Request.URL.Path
+}
+
+func feedNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Invalid feed")))
+}
+
+func GlobalFeed(c *gin.Context) {
+	_, format, _ := splitFile(c.Request.URL.Path)
+	models, _, err := articles.FindManyArticle("", "", c.Query("limit"), "0", "")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	renderFeed(c, format, Feed{Title: "Conduit", Self: selfURL(c), Link: common.SiteBase(c) + "/", Articles: models})
+}
+
+func TagFeed(c *gin.Context) {
+	tag, format, ok := splitFile(c.Param("file"))
+	if !ok {
+		feedNotFound(c)
+		return
+	}
+	// "Go" and the aliases of go get the feed of go, like ?tag= does
+	tagModel, err := articles.FindTag(tag)
+	if err != nil {
+		feedNotFound(c)
+		return
+	}
+	models, _, err := articles.FindManyArticle(tagModel.Tag, "", c.Query("limit"), "0", "")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	renderFeed(c, format, Feed{Title: "Conduit: #" + tagModel.Tag, Self: selfURL(c), Link: common.SiteBase(c) + "/", Articles: models})
+}
+
+func AuthorFeed(c *gin.Context) {
+	username, format, ok := splitFile(c.Param("file"))
+	if !ok {
+		feedNotFound(c)
+		return
+	}
+	if _, err := users.FindOneUser(&users.UserModel{Username: username}); err != nil {
+		feedNotFound(c)
+		return
+	}
+	models, _, err := articles.FindManyArticle("", username, c.Query("limit"), "0", "")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	renderFeed(c, format, Feed{Title: "Conduit: " + username, Self: selfURL(c), Link: common.ProfileURL(c, username), Articles: models})
+}
+
+// The feed of the authors a user follows, the token in the URL stands in for the JWT.
+func PrivateFeed(c *gin.Context) {
+	token, format, ok := splitFile(c.Param("file"))
+	if !ok {
+		feedNotFound(c)
+		return
+	}
+	userModel, err := FindTokenUser(token)
+	if err != nil {
+		feedNotFound(c)
+		return
+	}
+	articleUserModel := articles.GetArticleUserModel(userModel)
+	models, _, err := articleUserModel.GetArticleFeed(c.Query("limit"), "0")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.Header("Cache-Control", "private")
+	c.Header("X-Robots-Tag", "noindex")
+	renderFeed(c, format, Feed{Title: "Conduit: " + userModel.Username + "'s feed", Self: selfURL(c), Link: common.SiteBase(c) + "/", Articles: models})
+}
+
+// Send the feed with an ETag of the document, a client that sent it back in If-None-Match gets an empty
+// 304 Not Modified instead. Last-Modified is only informative: an article deleted or leaving the feed
+// doesn't make the latest update newer, so If-Modified-Since can't tell whether a feed changed.
+func renderFeed(c *gin.Context, format string, feed Feed) {
+	if updated := feed.Updated(); !updated.IsZero() {
+		c.Header("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+	serializer := FeedSerializer{c, feed}
+	var document interface{}
+	if format == FormatRSS {
+		document = serializer.RSS()
+	} else {
+		document = serializer.Atom()
+	}
+	body, err := xml.Marshal(document)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("xml", err))
+		return
+	}
+	common.DataWithETag(c, http.StatusOK, contentTypes[format], append([]byte(xml.Header), body...))
+}
+
+func feedURLs(c *gin.Context, token FeedTokenModel) gin.H {
+	base := common.RequestOrigin(c) + "/feeds/private/" + token.Token
+	return gin.H{"atom": base + ".atom", "rss": base + ".rss"}
+}
+
+func FeedTokenRetrieve(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	token, err := FindFeedToken(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"feed": feedURLs(c, token)})
+}
+
+func FeedTokenRotate(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	token, err := RotateFeedToken(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"feed": feedURLs(c, token)})
+}
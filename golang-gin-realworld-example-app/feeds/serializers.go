@@ -0,0 +1,187 @@
+package feeds
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FormatAtom = "atom"
+	FormatRSS  = "rss"
+)
+
+var contentTypes = map[string]string{
+	FormatAtom: "application/atom+xml; charset=utf-8",
+	FormatRSS:  "application/rss+xml; charset=utf-8",
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     atomPerson     `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    atomText       `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Author      string   `xml:"dc:creator"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type FeedSerializer struct {
+	C *gin.Context
+	Feed
+}
+
+// An id which survives changes to the slug of the article, see RFC 4151.
+func (s *FeedSerializer) entryID(article articles.ArticleModel) string {
+	return fmt.Sprintf("tag:%s,%s:articles/%d", common.SiteHost(s.C), article.CreatedAt.UTC().Format("2006-01-02"), article.ID)
+}
+
+// Rows saved before bodies were rendered at write time are rendered on the fly.
+func contentOf(article articles.ArticleModel) string {
+	if article.BodyHTML == "" && article.Body != "" {
+		return common.RenderMarkdown(article.Body)
+	}
+	return article.BodyHTML
+}
+
+func tagsOf(article articles.ArticleModel) []string {
+	tags := []string{}
+	for _, tag := range article.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	return tags
+}
+
+func (s *FeedSerializer) Atom() interface{} {
+	updated := s.Updated()
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed := atomFeed{
+		ID:    s.Self,
+		Title: s.Title,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: s.Self},
+			{Rel: "alternate", Type: "text/html", Href: s.Link},
+		},
+		Updated: updated.UTC().Format(time.RFC3339),
+		Entries: []atomEntry{},
+	}
+	for _, article := range s.Articles {
+		username := article.Author.UserModel.Username
+		entry := atomEntry{
+			ID:        s.entryID(article),
+			Title:     article.Title,
+			Links:     []atomLink{{Rel: "alternate", Type: "text/html", Href: common.ArticleURL(s.C, article.Slug)}},
+			Published: article.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:   article.UpdatedAt.UTC().Format(time.RFC3339),
+			Author:    atomPerson{Name: username, URI: common.ProfileURL(s.C, username)},
+			Content:   atomText{Type: "html", Body: contentOf(article)},
+		}
+		for _, tag := range tagsOf(article) {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		if article.Description != "" {
+			entry.Summary = &atomText{Type: "text", Body: article.Description}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+func (s *FeedSerializer) RSS() interface{} {
+	channel := rssChannel{
+		Title:       s.Title,
+		Link:        s.Link,
+		Description: s.Title,
+		Self:        atomLink{Rel: "self", Type: "application/rss+xml", Href: s.Self},
+	}
+	if updated := s.Updated(); !updated.IsZero() {
+		channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, article := range s.Articles {
+		channel.Items = append(channel.Items, rssItem{
+			Title:       article.Title,
+			Link:        common.ArticleURL(s.C, article.Slug),
+			GUID:        rssGUID{Value: s.entryID(article)},
+			PubDate:     article.CreatedAt.UTC().Format(time.RFC1123Z),
+			Author:      article.Author.UserModel.Username,
+			Categories:  tagsOf(article),
+			Description: contentOf(article),
+		})
+	}
+	return rss{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: channel,
+	}
+}
@@ -0,0 +1,219 @@
+package feeds
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() *gorm.DB {
+	db := common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	AutoMigrate()
+	return db
+}
+
+func TestSplitFile(t *testing.T) {
+	asserts := assert.New(t)
+
+	name, format, ok := splitFile("go.atom")
+	asserts.True(ok)
+	asserts.Equal("go", name)
+	asserts.Equal(FormatAtom, format)
+	name, format, ok = splitFile("jake.smith.rss")
+	asserts.True(ok)
+	asserts.Equal("jake.smith", name)
+	asserts.Equal(FormatRSS, format)
+	_, _, ok = splitFile("go.json")
+	asserts.False(ok)
+	_, _, ok = splitFile(".atom")
+	asserts.False(ok)
+	_, _, ok = splitFile("go")
+	asserts.False(ok)
+}
+
+func TestFeeds(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+	gin.SetMode(gin.TestMode)
+
+	jake := users.UserModel{Username: "feedjake", Email: "feedjake@test.com"}
+	anna := users.UserModel{Username: "feedanna", Email: "feedanna@test.com"}
+	reader := users.UserModel{Username: "feedreader", Email: "feedreader@test.com"}
+	test_db.Create(&jake)
+	test_db.Create(&anna)
+	test_db.Create(&reader)
+	test_db.Create(&users.FollowModel{FollowingID: jake.ID, FollowedByID: reader.ID})
+
+	goArticle := articles.ArticleModel{
+		Slug: "feed-go", Title: "Go", Description: "About Go", Body: "**bold** <script>x</script>",
+		AuthorID: articles.GetArticleUserModel(jake).ID, Tags: []articles.TagModel{{Tag: "feedgo"}},
+	}
+	goArticle.BodyHTML = common.RenderMarkdown(goArticle.Body)
+	asserts.NoError(articles.CreateArticle(&goArticle))
+	rustArticle := articles.ArticleModel{
+		Slug: "feed-rust", Title: "Rust", Body: "plain",
+		AuthorID: articles.GetArticleUserModel(anna).ID, Tags: []articles.TagModel{{Tag: "feedrust"}},
+	}
+	asserts.NoError(articles.CreateArticle(&rustArticle))
+
+	var me users.UserModel
+	router := gin.New()
+	FeedsRegister(router.Group("/feeds"))
+	api := router.Group("/api/user")
+	api.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	FeedTokenRegister(api)
+	request := func(url string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	atom := func(w *httptest.ResponseRecorder) atomFeed {
+		var feed atomFeed
+		asserts.NoError(xml.Unmarshal(w.Body.Bytes(), &feed))
+		return feed
+	}
+	rssItems := func(w *httptest.ResponseRecorder) []rssItem {
+		var document rss
+		asserts.NoError(xml.Unmarshal(w.Body.Bytes(), &document))
+		return document.Channel.Items
+	}
+
+	// The global feed, newest first, with the rendered body
+	w := request("/feeds/articles.atom", nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("application/atom+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	asserts.True(strings.HasPrefix(w.Body.String(), xml.Header))
+	feed := atom(w)
+	asserts.Equal("Conduit", feed.Title)
+	asserts.Equal("http://example.com/feeds/articles.atom", feed.Links[0].Href)
+	asserts.Len(feed.Entries, 2)
+	entry := feed.Entries[1]
+	asserts.Equal("Go", entry.Title)
+	asserts.Equal("http://example.com/article/feed-go", entry.Links[0].Href)
+	asserts.Equal("feedjake", entry.Author.Name)
+	asserts.Equal("About Go", entry.Summary.Body)
+	asserts.Equal([]atomCategory{{Term: "feedgo"}}, entry.Categories)
+	asserts.Equal("html", entry.Content.Type)
+	asserts.Contains(entry.Content.Body, "<strong>bold</strong>")
+	asserts.NotContains(entry.Content.Body, "<script>")
+	asserts.Contains(feed.Entries[0].Content.Body, "<p>plain</p>", "bodies without stored HTML are rendered")
+	asserts.True(strings.HasPrefix(entry.ID, "tag:example.com,"))
+
+	items := rssItems(request("/feeds/articles.rss", nil))
+	asserts.Len(items, 2)
+	asserts.Equal("Go", items[1].Title)
+	asserts.Equal(entry.ID, items[1].GUID.Value, "entries keep their id across formats")
+	asserts.False(items[1].GUID.IsPermaLink)
+	asserts.Equal([]string{"feedgo"}, items[1].Categories)
+	items = rssItems(request("/feeds/articles.rss?limit=1", nil))
+	asserts.Len(items, 1)
+	asserts.Equal("Rust", items[0].Title)
+
+	// Unchanged feeds answer 304
+	lastModified, etag := w.Header().Get("Last-Modified"), w.Header().Get("ETag")
+	asserts.NotEmpty(lastModified)
+	asserts.NotEmpty(etag)
+	w = request("/feeds/articles.atom", http.Header{"If-None-Match": {etag}})
+	asserts.Equal(http.StatusNotModified, w.Code)
+	asserts.Empty(w.Body.String())
+	w = request("/feeds/articles.rss", http.Header{"If-None-Match": {etag}})
+	asserts.Equal(http.StatusOK, w.Code, "each format has its own tag")
+	time.Sleep(time.Second)
+	asserts.NoError(goArticle.Update(articles.ArticleModel{Title: "Go again"}))
+	w = request("/feeds/articles.atom", http.Header{"If-None-Match": {etag}})
+	asserts.Equal(http.StatusOK, w.Code, "an updated article changes the feed")
+	asserts.NotEqual(lastModified, w.Header().Get("Last-Modified"))
+
+	// Tag and author feeds
+	items = rssItems(request("/feeds/tags/feedgo.rss", nil))
+	asserts.Len(items, 1)
+	asserts.Equal("Go again", items[0].Title)
+	asserts.Equal(http.StatusNotFound, request("/feeds/tags/nothing.rss", nil).Code)
+	// The tag is resolved like ?tag= does, differently written and by its aliases
+	tagModel, err := articles.FindTag("feedgo")
+	asserts.NoError(err)
+	asserts.NoError(tagModel.AddAlias("feedgolang"))
+	for _, file := range []string{"FeedGo.atom", "feedgolang.atom"} {
+		w = request("/feeds/tags/"+file, nil)
+		asserts.Equal(http.StatusOK, w.Code, file)
+		feed = atom(w)
+		asserts.Equal("Conduit: #feedgo", feed.Title, file)
+		asserts.Len(feed.Entries, 1, file)
+	}
+	asserts.Equal(http.StatusNotFound, request("/feeds/tags/feedgo.json", nil).Code)
+	feed = atom(request("/feeds/profiles/feedanna.atom", nil))
+	asserts.Equal("Conduit: feedanna", feed.Title)
+	asserts.Equal("http://example.com/profile/feedanna", feed.Links[1].Href)
+	asserts.Len(feed.Entries, 1)
+	asserts.Equal("Rust", feed.Entries[0].Title)
+	asserts.Equal(http.StatusNotFound, request("/feeds/profiles/nobody.atom", nil).Code)
+
+	// Links point at SITE_URL when it's set
+	common.SiteURL = "https://conduit.example.com/"
+	feed = atom(request("/feeds/profiles/feedanna.atom", nil))
+	common.SiteURL = ""
+	asserts.Equal("https://conduit.example.com/article/feed-rust", feed.Entries[0].Links[0].Href)
+	asserts.True(strings.HasPrefix(feed.Entries[0].ID, "tag:conduit.example.com,"))
+	asserts.Equal("http://example.com/feeds/profiles/feedanna.atom", feed.Links[0].Href, "feeds are served by the API")
+
+	// The private feed has the articles of followed authors, behind a token which can be rotated
+	me = reader
+	w = request("/api/user/feed", nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	var response map[string]map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	private := strings.TrimPrefix(response["feed"]["atom"], "http://example.com")
+	asserts.True(strings.HasPrefix(private, "/feeds/private/"))
+	asserts.Equal(strings.TrimSuffix(response["feed"]["atom"], ".atom")+".rss", response["feed"]["rss"])
+	w = request("/api/user/feed", nil)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal("http://example.com"+private, response["feed"]["atom"], "the token stays until rotated")
+
+	w = request(private, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("private", w.Header().Get("Cache-Control"))
+	feed = atom(w)
+	asserts.Len(feed.Entries, 1)
+	asserts.Equal("Go again", feed.Entries[0].Title)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/user/feed/rotate", nil))
+	asserts.Equal(http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.NotEqual("http://example.com"+private, response["feed"]["atom"])
+	asserts.Equal(http.StatusNotFound, request(private, nil).Code)
+	asserts.Equal(http.StatusOK, request(strings.TrimPrefix(response["feed"]["rss"], "http://example.com"), nil).Code)
+
+	// Deleting an older article leaves the latest update as it was, the feed still changed
+	w = request("/feeds/articles.atom", nil)
+	lastModified, etag = w.Header().Get("Last-Modified"), w.Header().Get("ETag")
+	asserts.NoError(articles.DeleteArticleModel(&articles.ArticleModel{Slug: "feed-rust"}))
+	w = request("/feeds/articles.atom", http.Header{"If-None-Match": {etag}, "If-Modified-Since": {lastModified}})
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(lastModified, w.Header().Get("Last-Modified"))
+	asserts.Len(atom(w).Entries, 1)
+}
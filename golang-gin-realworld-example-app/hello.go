@@ -1,25 +1,47 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 
 	"realworld-backend/articles"
 	"realworld-backend/common"
+	"realworld-backend/federation"
+	"realworld-backend/feeds"
+	"realworld-backend/jobs"
+	"realworld-backend/notifications"
+	"realworld-backend/realtime"
+	"realworld-backend/seo"
 	"realworld-backend/users"
+	"realworld-backend/webhooks"
 
 	"github.com/jinzhu/gorm"
 )
 
 func Migrate(db *gorm.DB) {
+	db.AutoMigrate(&common.OutboxModel{})
 	users.AutoMigrate()
-	db.AutoMigrate(&articles.ArticleModel{})
-	db.AutoMigrate(&articles.TagModel{})
-	db.AutoMigrate(&articles.FavoriteModel{})
-	db.AutoMigrate(&articles.ArticleUserModel{})
-	db.AutoMigrate(&articles.CommentModel{})
+	if err := articles.AutoMigrate(); err != nil {
+		fmt.Println("search index err: (Migrate) ", err)
+	}
+	notifications.AutoMigrate()
+	webhooks.AutoMigrate()
+	jobs.AutoMigrate()
+	feeds.AutoMigrate()
+	federation.AutoMigrate()
+	if err := articles.NormalizeExistingTags(); err != nil {
+		fmt.Println("tags err: (Migrate) ", err)
+	}
 
 	// Create performance indexes
 	createPerformanceIndexes(db)
@@ -36,7 +58,9 @@ func createPerformanceIndexes(db *gorm.DB) {
 		"CREATE INDEX IF NOT EXISTS idx_favorites_article_id ON favorite_models(favorite_id)",
 		"CREATE INDEX IF NOT EXISTS idx_favorites_user_id ON favorite_models(favorite_by_id)",
 		"CREATE INDEX IF NOT EXISTS idx_favorites_composite ON favorite_models(favorite_id, favorite_by_id)",
+		"CREATE INDEX IF NOT EXISTS idx_favorites_created_at ON favorite_models(created_at)",
 		"CREATE INDEX IF NOT EXISTS idx_tags_tag ON tag_models(tag)",
+		"CREATE INDEX IF NOT EXISTS idx_article_tags_tag_id ON article_tags(tag_model_id, article_model_id)",
 		"CREATE INDEX IF NOT EXISTS idx_users_email ON user_models(email)",
 		"CREATE INDEX IF NOT EXISTS idx_users_username ON user_models(username)",
 	}
@@ -48,33 +72,130 @@ func createPerformanceIndexes(db *gorm.DB) {
 	fmt.Println("✅ Performance indexes created")
 }
 
+// Recompute every maintained counter from the rows it counts, e.g. after upgrading a database
+// which had no counter columns yet:
+//
+//	go run hello.go reconcile
+func Reconcile(db *gorm.DB) error {
+	if err := articles.ReconcileCounters(db); err != nil {
+		return err
+	}
+	if err := federation.ReconcileCounters(db); err != nil {
+		return err
+	}
+	return users.ReconcileCounters(db)
+}
+
+// Reconcile can also run in the background:
+//
+//	go run hello.go jobs enqueue reconcile
+func init() {
+	jobs.Register("reconcile", func(ctx context.Context, job jobs.Job) error {
+		return Reconcile(common.GetDB())
+	})
+}
+
+// Cache keys and stream stats are for admins, the routes go behind AuthMiddleware(true).
+func MetricsRegister(router *gin.RouterGroup) {
+	router.Use(func(c *gin.Context) {
+		myUserModel := c.MustGet("my_user_model").(users.UserModel)
+		if !myUserModel.IsAdmin() {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("metrics", errors.New("only admins can read metrics")))
+			return
+		}
+		c.Next()
+	})
+	router.GET("/cache", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"cache": common.CacheMetrics()})
+	})
+	router.GET("/realtime", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"realtime": realtime.GetHub().Stats()})
+	})
+}
+
+// The frontend sends conditional requests, so it needs the precondition headers allowed and the
+// ETag of each response exposed to its scripts.
+func CORSConfig() cors.Config {
+	return cors.Config{
+		AllowOrigins:     []string{"http://localhost:4100"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "If-Match", "If-None-Match"},
+		ExposeHeaders:    []string{"ETag"},
+		AllowCredentials: true,
+	}
+}
+
 func main() {
 
 	db := common.Init()
 	Migrate(db)
 	defer db.Close()
 
+	if window := os.Getenv("COMMENT_EDIT_WINDOW"); window != "" {
+		duration, err := time.ParseDuration(window)
+		if err != nil {
+			fmt.Println("config err: COMMENT_EDIT_WINDOW ", err)
+			os.Exit(1)
+		}
+		articles.CommentEditWindow = duration
+	}
+
+	if emoji := os.Getenv("REACTION_EMOJIS"); emoji != "" {
+		articles.ReactionEmojis = strings.Split(emoji, ",")
+	}
+
+	common.SiteURL = os.Getenv("SITE_URL")
+	if base := os.Getenv("FEDERATION_URL"); base != "" {
+		federation.BaseURL = base
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		if err := Reconcile(db); err != nil {
+			fmt.Println("reconcile err: ", err)
+			os.Exit(1)
+		}
+		fmt.Println("✅ Counters reconciled")
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "jobs" {
+		if err := jobs.Command(os.Args[2:], os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	r := gin.Default()
 
 	// Configure CORS
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:4100"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		AllowCredentials: true,
-	}))
+	r.Use(cors.New(CORSConfig()))
+
+	feeds.FeedsRegister(r.Group("/feeds"))
+	seo.SitemapRegister(r.Group(""))
+	federation.WellKnownRegister(r.Group(""))
+	federation.FederationRegister(r.Group("/ap"))
 
 	v1 := r.Group("/api")
 	users.UsersRegister(v1.Group("/users"))
 	v1.Use(users.AuthMiddleware(false))
 	articles.ArticlesAnonymousRegister(v1.Group("/articles"))
 	articles.TagsAnonymousRegister(v1.Group("/tags"))
+	realtime.StreamRegister(v1.Group("/stream"))
+	seo.MetaRegister(v1.Group("/seo"))
 
 	v1.Use(users.AuthMiddleware(true))
 	users.UserRegister(v1.Group("/user"))
+	articles.MentionsRegister(v1.Group("/user"))
+	articles.FollowedTagsRegister(v1.Group("/user"))
+	notifications.NotificationsRegister(v1.Group("/user"))
+	feeds.FeedTokenRegister(v1.Group("/user"))
 	users.ProfileRegister(v1.Group("/profiles"))
 
 	articles.ArticlesRegister(v1.Group("/articles"))
+	articles.TagsRegister(v1.Group("/tags"))
+	webhooks.WebhooksRegister(v1.Group("/webhooks"))
+	MetricsRegister(v1.Group("/metrics"))
 
 	testAuth := r.Group("/api/ping")
 
@@ -105,5 +226,30 @@ func main() {
 	//}).First(&userAA)
 	//fmt.Println(userAA)
 
-	r.Run(":8081") // listen and serve on 0.0.0.0:8081
+	stopDispatcher := common.StartDispatcher(10 * time.Second)
+	worker := jobs.NewWorker(map[string]int{jobs.DefaultQueue: 2, webhooks.Queue: 4, federation.Queue: 4}, time.Second)
+	worker.Start()
+
+	srv := &http.Server{Addr: ":8081", Handler: r} // listen and serve on 0.0.0.0:8081
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println("server err: ", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Finish the requests and jobs in flight on SIGINT or SIGTERM, jobs still running after the
+	// timeout run again once their lease is up
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Println("server err: (Shutdown) ", err)
+	}
+	if err := worker.Shutdown(ctx); err != nil {
+		fmt.Println("jobs err: (Shutdown) ", err)
+	}
+	stopDispatcher()
 }
@@ -6,12 +6,20 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"realworld-backend/articles"
 	"realworld-backend/common"
+	"realworld-backend/federation"
+	"realworld-backend/feeds"
+	"realworld-backend/jobs"
+	"realworld-backend/notifications"
+	"realworld-backend/seo"
 	"realworld-backend/users"
+	"realworld-backend/webhooks"
 
+	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
@@ -28,17 +36,22 @@ func setupIntegrationTest() (*gin.Engine, *gorm.DB) {
 	db := common.TestDBInit()
 
 	// Auto-migrate all models
-	db.AutoMigrate(&users.UserModel{})
-	db.AutoMigrate(&users.FollowModel{})
-	db.AutoMigrate(&articles.ArticleModel{})
-	db.AutoMigrate(&articles.ArticleUserModel{})
-	db.AutoMigrate(&articles.FavoriteModel{})
-	db.AutoMigrate(&articles.TagModel{})
-	db.AutoMigrate(&articles.CommentModel{})
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	notifications.AutoMigrate()
+	webhooks.AutoMigrate()
+	jobs.AutoMigrate()
+	feeds.AutoMigrate()
+	federation.AutoMigrate()
 
 	// Setup routes
 	r := gin.New()
 
+	feeds.FeedsRegister(r.Group("/feeds"))
+	seo.SitemapRegister(r.Group(""))
+	federation.WellKnownRegister(r.Group(""))
+	federation.FederationRegister(r.Group("/ap"))
+
 	// API v1 routes
 	v1 := r.Group("/api")
 
@@ -49,13 +62,21 @@ func setupIntegrationTest() (*gin.Engine, *gorm.DB) {
 	v1Anon.Use(users.AuthMiddleware(false))
 	articles.ArticlesAnonymousRegister(v1Anon.Group("/articles"))
 	articles.TagsAnonymousRegister(v1Anon.Group("/tags"))
+	seo.MetaRegister(v1Anon.Group("/seo"))
 
 	// Protected routes (auth required)
 	v1Auth := v1.Group("")
 	v1Auth.Use(users.AuthMiddleware(true))
 	users.UserRegister(v1Auth.Group("/user"))
+	articles.MentionsRegister(v1Auth.Group("/user"))
+	articles.FollowedTagsRegister(v1Auth.Group("/user"))
+	notifications.NotificationsRegister(v1Auth.Group("/user"))
+	feeds.FeedTokenRegister(v1Auth.Group("/user"))
 	users.ProfileRegister(v1Auth.Group("/profiles"))
 	articles.ArticlesRegister(v1Auth.Group("/articles"))
+	articles.TagsRegister(v1Auth.Group("/tags"))
+	webhooks.WebhooksRegister(v1Auth.Group("/webhooks"))
+	MetricsRegister(v1Auth.Group("/metrics"))
 
 	return r, db
 }
@@ -556,3 +577,65 @@ func TestDeleteComment(t *testing.T) {
 
 	asserts.Equal(http.StatusOK, w.Code, "Should return 200 OK")
 }
+
+func TestCORSAllowsConditionalRequests(t *testing.T) {
+	asserts := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(cors.New(CORSConfig()))
+	r.GET("/api/articles/:slug", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.JSON(http.StatusOK, gin.H{})
+	})
+	r.PUT("/api/articles/:slug", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	// The browser asks before sending If-Match on a PUT
+	req, _ := http.NewRequest("OPTIONS", "/api/articles/slug", nil)
+	req.Header.Set("Origin", "http://localhost:4100")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "authorization,content-type,if-match,if-none-match")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusNoContent, w.Code, "Preflight should be allowed")
+	allowed := strings.ToLower(w.Header().Get("Access-Control-Allow-Headers"))
+	asserts.Contains(allowed, "if-match")
+	asserts.Contains(allowed, "if-none-match")
+
+	// The page's scripts can read the ETag to send it back
+	req, _ = http.NewRequest("GET", "/api/articles/slug", nil)
+	req.Header.Set("Origin", "http://localhost:4100")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(strings.ToLower(w.Header().Get("Access-Control-Expose-Headers")), "etag")
+}
+
+func TestMetricsNeedAdmin(t *testing.T) {
+	asserts := assert.New(t)
+	r, db := setupIntegrationTest()
+	defer common.TestDBFree(db)
+
+	w := makeAuthRequest(t, r, "GET", "/api/metrics/cache", "", "")
+	asserts.Equal(http.StatusUnauthorized, w.Code, "Anonymous users can't read metrics")
+
+	userData := `{"user":{"username":"metricsuser","email":"metricsuser@example.com","password":"password123"}}`
+	userResp := makeAuthRequest(t, r, "POST", "/api/users/", userData, "")
+	var userResponse map[string]interface{}
+	json.Unmarshal(userResp.Body.Bytes(), &userResponse)
+	token := userResponse["user"].(map[string]interface{})["token"].(string)
+
+	for _, url := range []string{"/api/metrics/cache", "/api/metrics/realtime"} {
+		w = makeAuthRequest(t, r, "GET", url, "", token)
+		asserts.Equal(http.StatusForbidden, w.Code, url)
+	}
+
+	db.Model(&users.UserModel{}).Where("username = ?", "metricsuser").Update("role", users.RoleAdmin)
+	w = makeAuthRequest(t, r, "GET", "/api/metrics/cache", "", token)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"cache"`)
+	w = makeAuthRequest(t, r, "GET", "/api/metrics/realtime", "", token)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"realtime"`)
+}
@@ -0,0 +1,131 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"realworld-backend/common"
+)
+
+const usage = `usage: jobs <command>
+
+  stats                     job counts by queue and status
+  list [status]             the latest 50 jobs, e.g. list dead
+  show <id>                 one job with its payload and last error
+  retry all | <id>...       queue dead jobs again
+  enqueue <kind> [payload]  add a job, payload is JSON`
+
+var ErrUsage = errors.New(usage)
+
+// The jobs command, for inspecting the queue and retrying dead jobs:
+//
+//	go run hello.go jobs list dead
+//	go run hello.go jobs retry 12 15
+func Command(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	switch args[0] {
+	case "stats":
+		stats, err := Stats()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "QUEUE\tSTATUS\tJOBS")
+		for _, stat := range stats {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", stat.Queue, stat.Status, stat.Count)
+		}
+		return w.Flush()
+
+	case "list":
+		status := ""
+		if len(args) > 1 {
+			status = args[1]
+		}
+		jobs, err := FindJobs(status, 50)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tQUEUE\tKIND\tSTATUS\tATTEMPTS\tRUN AT\tLAST ERROR")
+		for _, job := range jobs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d/%d\t%s\t%s\n", job.ID, job.Queue, job.Kind, job.Status,
+				job.Attempts, job.MaxAttempts, job.RunAt.Format(time.RFC3339), firstLine(job.LastError))
+		}
+		return w.Flush()
+
+	case "show":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		id, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return ErrUsage
+		}
+		var job JobModel
+		if err := common.GetDB().First(&job, id).Error; err != nil {
+			return err
+		}
+		body, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(body))
+		return err
+
+	case "retry":
+		if len(args) < 2 {
+			return ErrUsage
+		}
+		var ids []uint
+		if !(len(args) == 2 && args[1] == "all") {
+			for _, arg := range args[1:] {
+				id, err := strconv.ParseUint(arg, 10, 32)
+				if err != nil {
+					return ErrUsage
+				}
+				ids = append(ids, uint(id))
+			}
+		}
+		retried, err := Retry(ids...)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%d dead jobs queued again\n", retried)
+		return err
+
+	case "enqueue":
+		if len(args) < 2 || len(args) > 3 {
+			return ErrUsage
+		}
+		var payload json.RawMessage = []byte("null")
+		if len(args) == 3 {
+			payload = json.RawMessage(args[2])
+			if !json.Valid(payload) {
+				return errors.New("the payload isn't JSON")
+			}
+		}
+		job, err := Enqueue(common.GetDB(), args[1], payload, EnqueueOptions{})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "job %d %s\n", job.ID, job.Status)
+		return err
+	}
+	return ErrUsage
+}
+
+func firstLine(text string) string {
+	for i, r := range text {
+		if r == '\n' {
+			return text[:i]
+		}
+	}
+	return text
+}
@@ -0,0 +1,320 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"realworld-backend/common"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Jobs are pending until they run, and done or dead afterwards. Dead jobs failed MaxAttempts times,
+// they are kept as dead letters until retried with the jobs command.
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusDead    = "dead"
+)
+
+const DefaultQueue = "default"
+
+// Failed jobs run again after RetryBaseDelay, twice as long after every failure, at most RetryMaxDelay
+// later. A running job whose worker doesn't finish it within Lease is taken to have died with its
+// worker and runs again. Done jobs are pruned after DoneRetention.
+var (
+	DefaultMaxAttempts = 10
+	RetryBaseDelay     = 10 * time.Second
+	RetryMaxDelay      = time.Hour
+	Lease              = 5 * time.Minute
+	DoneRetention      = 7 * 24 * time.Hour
+)
+
+var ErrUnknownKind = errors.New("unknown job kind")
+
+// A unit of work, run by the handler registered for its Kind. Payload is JSON.
+// A job with a UniqueKey isn't enqueued again while one with the same key is pending or running.
+type JobModel struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Queue       string `gorm:"index:idx_job_due"`
+	Kind        string
+	Payload     string `gorm:"type:text"`
+	UniqueKey   string
+	Status      string    `gorm:"index:idx_job_due"`
+	RunAt       time.Time `gorm:"index:idx_job_due"`
+	LockedUntil *time.Time
+	Attempts    int
+	MaxAttempts int
+	LastError   string `gorm:"type:text"`
+	FinishedAt  *time.Time
+}
+
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&JobModel{})
+	// Partial unique index, pending and running jobs can't share a unique key
+	err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_job_unique ON job_models (unique_key) " +
+		"WHERE unique_key <> '' AND status IN ('pending', 'running')").Error
+	if err != nil {
+		fmt.Println("jobs err: (AutoMigrate) ", err)
+	}
+}
+
+// The job as its handler sees it. Attempt counts from 1, RetryAt is when the job runs again should
+// this attempt fail.
+type Job struct {
+	ID          uint
+	Queue       string
+	Kind        string
+	Payload     []byte
+	Attempt     int
+	MaxAttempts int
+	RetryAt     time.Time
+}
+
+// Read the payload into v.
+func (job Job) Decode(v interface{}) error {
+	return json.Unmarshal(job.Payload, v)
+}
+
+// The last attempt a job gets before it is dead.
+func (job Job) LastAttempt() bool {
+	return job.Attempt >= job.MaxAttempts
+}
+
+// Handlers return an error to have the job retried. They should stop when ctx is done, which happens
+// when the worker is shut down before the job finished.
+type Handler func(ctx context.Context, job Job) error
+
+var handlersMu sync.RWMutex
+var handlers = map[string]Handler{}
+
+// Register the handler of a kind of job, usually from the init function of the package which enqueues it.
+//
+//	jobs.Register("webhooks.deliver", deliver)
+func Register(kind string, handler Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[kind] = handler
+}
+
+func handlerOf(kind string) (Handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	handler, ok := handlers[kind]
+	return handler, ok
+}
+
+// How and when a job runs, the zero value runs it now in DefaultQueue with DefaultMaxAttempts.
+type EnqueueOptions struct {
+	Queue       string
+	RunAt       time.Time
+	UniqueKey   string
+	MaxAttempts int
+}
+
+// Add a job with the JSON encoding of payload, in the transaction tx when the job belongs to a change,
+// or common.GetDB(). A job with the UniqueKey of a pending or running job isn't added, that job is
+// returned instead.
+//
+//	job, err := jobs.Enqueue(tx, "webhooks.deliver", delivery{ID: 7}, jobs.EnqueueOptions{Queue: "webhooks"})
+func Enqueue(tx *gorm.DB, kind string, payload interface{}, options EnqueueOptions) (JobModel, error) {
+	if _, ok := handlerOf(kind); !ok {
+		return JobModel{}, fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return JobModel{}, err
+	}
+	if options.UniqueKey != "" {
+		var existing JobModel
+		query := tx.Where("unique_key = ? AND status IN (?)", options.UniqueKey, []string{StatusPending, StatusRunning}).First(&existing)
+		if query.Error == nil {
+			return existing, nil
+		}
+		if !query.RecordNotFound() {
+			return JobModel{}, query.Error
+		}
+	}
+	job := JobModel{
+		Queue:       options.Queue,
+		Kind:        kind,
+		Payload:     string(body),
+		UniqueKey:   options.UniqueKey,
+		Status:      StatusPending,
+		RunAt:       options.RunAt,
+		MaxAttempts: options.MaxAttempts,
+	}
+	if job.Queue == "" {
+		job.Queue = DefaultQueue
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = DefaultMaxAttempts
+	}
+	err = tx.Create(&job).Error
+	return job, err
+}
+
+// How long a job waits after its attempt-th failed attempt.
+func Backoff(attempt int) time.Duration {
+	delay := RetryBaseDelay
+	for i := 1; i < attempt && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	return delay
+}
+
+// Take the next job of the queue which is due at now, or a running one whose lease ran out.
+// The job is claimed with a conditional update, so concurrent workers never run it twice.
+func claim(queue string, now time.Time) (JobModel, bool, error) {
+	db := common.GetDB()
+	for {
+		var job JobModel
+		query := db.Where("queue = ? AND ((status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?))",
+			queue, StatusPending, now, StatusRunning, now).
+			Order("run_at").Order("id").First(&job)
+		if query.RecordNotFound() {
+			return job, false, nil
+		}
+		if query.Error != nil {
+			return job, false, query.Error
+		}
+		lockedUntil := now.Add(Lease)
+		claimed := db.Model(&JobModel{}).
+			Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts).
+			Updates(map[string]interface{}{"status": StatusRunning, "locked_until": lockedUntil, "attempts": job.Attempts + 1})
+		if claimed.Error != nil {
+			return job, false, claimed.Error
+		}
+		if claimed.RowsAffected == 1 {
+			job.Status, job.LockedUntil, job.Attempts = StatusRunning, &lockedUntil, job.Attempts+1
+			return job, true, nil
+		}
+	}
+}
+
+// Claim and run one job of the queue which is due at now. Returns false when there was none.
+//
+//	for ran, _ := jobs.Work(ctx, "webhooks", time.Now()); ran; ran, _ = jobs.Work(ctx, "webhooks", time.Now()) {
+//	}
+func Work(ctx context.Context, queue string, now time.Time) (bool, error) {
+	job, ok, err := claim(queue, now)
+	if !ok || err != nil {
+		return false, err
+	}
+	err = run(ctx, job, now)
+	return true, finish(job, now, err)
+}
+
+// Run every job of the queue due at now, returns how many ran.
+func Drain(ctx context.Context, queue string, now time.Time) (int, error) {
+	ran := 0
+	for {
+		ok, err := Work(ctx, queue, now)
+		if !ok || err != nil {
+			return ran, err
+		}
+		ran++
+	}
+}
+
+// Call the handler, a panic fails the job.
+func run(ctx context.Context, job JobModel, now time.Time) (err error) {
+	handler, ok := handlerOf(job.Kind)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKind, job.Kind)
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+	return handler(ctx, Job{
+		ID:          job.ID,
+		Queue:       job.Queue,
+		Kind:        job.Kind,
+		Payload:     []byte(job.Payload),
+		Attempt:     job.Attempts,
+		MaxAttempts: job.MaxAttempts,
+		RetryAt:     now.Add(Backoff(job.Attempts)),
+	})
+}
+
+// Record the outcome of an attempt: done, scheduled again, or dead after the last attempt.
+func finish(job JobModel, now time.Time, err error) error {
+	db := common.GetDB()
+	update := map[string]interface{}{"locked_until": nil}
+	switch {
+	case err == nil:
+		update["status"], update["finished_at"], update["last_error"] = StatusDone, now, ""
+	case job.Attempts >= job.MaxAttempts:
+		update["status"], update["finished_at"], update["last_error"] = StatusDead, now, err.Error()
+	default:
+		update["status"], update["run_at"], update["last_error"] = StatusPending, now.Add(Backoff(job.Attempts)), err.Error()
+	}
+	if err != nil {
+		fmt.Println("jobs err: ", job.Kind, job.ID, err)
+	}
+	// A job which outlived its lease may have been claimed again, that attempt records its own outcome
+	return db.Model(&JobModel{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, StatusRunning, job.Attempts).
+		Updates(update).Error
+}
+
+// Queue dead jobs again with fresh attempts. No ids retries every dead job, returns how many were queued.
+func Retry(ids ...uint) (int64, error) {
+	db := common.GetDB()
+	query := db.Model(&JobModel{}).Where("status = ?", StatusDead)
+	if len(ids) > 0 {
+		query = query.Where("id IN (?)", ids)
+	}
+	retried := query.Updates(map[string]interface{}{
+		"status": StatusPending, "attempts": 0, "run_at": time.Now(), "finished_at": nil,
+	})
+	return retried.RowsAffected, retried.Error
+}
+
+// Delete the jobs done before the time, dead jobs are kept.
+func Prune(before time.Time) error {
+	return common.GetDB().Where("status = ? AND finished_at < ?", StatusDone, before).Delete(&JobModel{}).Error
+}
+
+// The jobs with the status, all of them for "", most recent first.
+func FindJobs(status string, limit int) ([]JobModel, error) {
+	db := common.GetDB()
+	query := db.Order("id DESC").Limit(limit)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var jobs []JobModel
+	err := query.Find(&jobs).Error
+	return jobs, err
+}
+
+// Job counts by queue and status.
+type QueueStats struct {
+	Queue  string
+	Status string
+	Count  int
+}
+
+func Stats() ([]QueueStats, error) {
+	db := common.GetDB()
+	var stats []QueueStats
+	err := db.Model(&JobModel{}).Select("queue, status, count(*) AS count").
+		Group("queue, status").Order("queue").Order("status").Scan(&stats).Error
+	return stats, err
+}
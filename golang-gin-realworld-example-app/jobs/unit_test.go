@@ -0,0 +1,206 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"realworld-backend/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPayload struct {
+	Name string `json:"name"`
+}
+
+func TestBackoff(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal(RetryBaseDelay, Backoff(1))
+	asserts.Equal(2*RetryBaseDelay, Backoff(2))
+	asserts.Equal(8*RetryBaseDelay, Backoff(4))
+	asserts.Equal(RetryMaxDelay, Backoff(100))
+}
+
+func TestJobs(t *testing.T) {
+	asserts := assert.New(t)
+	db := common.TestDBInit()
+	defer common.TestDBFree(db)
+	AutoMigrate()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var ran []string
+	failures := map[string]int{}
+	Register("test.record", func(ctx context.Context, job Job) error {
+		var payload testPayload
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, payload.Name)
+		if failures[payload.Name] > 0 {
+			failures[payload.Name]--
+			return errors.New("not now")
+		}
+		return nil
+	})
+	Register("test.panic", func(ctx context.Context, job Job) error {
+		panic("broken handler")
+	})
+	took := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		names := ran
+		ran = nil
+		return names
+	}
+
+	_, err := Enqueue(db, "test.unknown", nil, EnqueueOptions{})
+	asserts.ErrorIs(err, ErrUnknownKind)
+
+	// Jobs run in their queue once they are due, rolled back jobs never run
+	now := time.Now()
+	tx := db.Begin()
+	Enqueue(tx, "test.record", testPayload{Name: "rolled back"}, EnqueueOptions{})
+	tx.Rollback()
+	first, err := Enqueue(db, "test.record", testPayload{Name: "first"}, EnqueueOptions{})
+	asserts.NoError(err)
+	asserts.Equal(DefaultQueue, first.Queue)
+	asserts.Equal(DefaultMaxAttempts, first.MaxAttempts)
+	Enqueue(db, "test.record", testPayload{Name: "later"}, EnqueueOptions{RunAt: now.Add(time.Hour)})
+	Enqueue(db, "test.record", testPayload{Name: "other"}, EnqueueOptions{Queue: "other"})
+
+	count, err := Drain(ctx, DefaultQueue, time.Now())
+	asserts.NoError(err)
+	asserts.Equal(1, count)
+	asserts.Equal([]string{"first"}, took(), "queues are worked separately")
+	db.First(&first, first.ID)
+	asserts.Equal(StatusDone, first.Status)
+	asserts.Equal(1, first.Attempts)
+	asserts.NotNil(first.FinishedAt)
+	asserts.Nil(first.LockedUntil)
+
+	count, _ = Drain(ctx, DefaultQueue, now.Add(time.Hour))
+	asserts.Equal(1, count)
+	asserts.Equal([]string{"later"}, took())
+	Drain(ctx, "other", time.Now())
+	asserts.Equal([]string{"other"}, took())
+
+	// Failed jobs are retried with a growing delay, then kept as dead letters
+	failures["flaky"] = 5
+	flaky, _ := Enqueue(db, "test.record", testPayload{Name: "flaky"}, EnqueueOptions{MaxAttempts: 3})
+	now = time.Now()
+	Drain(ctx, DefaultQueue, now)
+	db.First(&flaky, flaky.ID)
+	asserts.Equal(StatusPending, flaky.Status)
+	asserts.Equal("not now", flaky.LastError)
+	asserts.True(flaky.RunAt.Equal(now.Add(RetryBaseDelay)))
+	count, _ = Drain(ctx, DefaultQueue, now.Add(RetryBaseDelay-time.Second))
+	asserts.Equal(0, count)
+	now = now.Add(RetryBaseDelay)
+	Drain(ctx, DefaultQueue, now)
+	db.First(&flaky, flaky.ID)
+	asserts.True(flaky.RunAt.Equal(now.Add(2*RetryBaseDelay)), "the delay doubles")
+	Drain(ctx, DefaultQueue, now.Add(2*RetryBaseDelay))
+	db.First(&flaky, flaky.ID)
+	asserts.Equal(StatusDead, flaky.Status)
+	asserts.Equal(3, flaky.Attempts)
+	asserts.Len(took(), 3)
+	count, _ = Drain(ctx, DefaultQueue, now.Add(24*time.Hour))
+	asserts.Equal(0, count, "dead jobs aren't retried")
+
+	broken, _ := Enqueue(db, "test.panic", nil, EnqueueOptions{MaxAttempts: 1})
+	Drain(ctx, DefaultQueue, time.Now())
+	db.First(&broken, broken.ID)
+	asserts.Equal(StatusDead, broken.Status)
+	asserts.Equal("job panicked: broken handler", broken.LastError)
+
+	// Dead jobs run again when retried
+	retried, err := Retry(flaky.ID)
+	asserts.NoError(err)
+	asserts.Equal(int64(1), retried)
+	Drain(ctx, DefaultQueue, time.Now())
+	asserts.Equal([]string{"flaky"}, took())
+	db.First(&flaky, flaky.ID)
+	asserts.Equal(StatusPending, flaky.Status, "retried jobs get fresh attempts")
+	asserts.Equal(1, flaky.Attempts)
+
+	// A running job whose lease ran out runs again
+	failures["flaky"] = 0
+	stuck, _ := Enqueue(db, "test.record", testPayload{Name: "stuck"}, EnqueueOptions{})
+	claimed, ok, err := claim(DefaultQueue, time.Now())
+	asserts.NoError(err)
+	asserts.True(ok)
+	asserts.Equal(stuck.ID, claimed.ID)
+	Drain(ctx, DefaultQueue, time.Now().Add(time.Minute))
+	asserts.Equal([]string{"flaky"}, took(), "running jobs aren't taken while leased")
+	Drain(ctx, DefaultQueue, time.Now().Add(Lease+RetryBaseDelay+time.Minute))
+	asserts.Contains(took(), "stuck")
+	asserts.NoError(finish(claimed, time.Now(), nil), "the outcome of the lost attempt is ignored")
+	db.First(&stuck, stuck.ID)
+	asserts.Equal(StatusDone, stuck.Status)
+	asserts.Equal(2, stuck.Attempts)
+
+	// Unique jobs aren't enqueued twice while one is waiting
+	unique, err := Enqueue(db, "test.record", testPayload{Name: "unique"}, EnqueueOptions{UniqueKey: "unique"})
+	asserts.NoError(err)
+	again, err := Enqueue(db, "test.record", testPayload{Name: "unique"}, EnqueueOptions{UniqueKey: "unique"})
+	asserts.NoError(err)
+	asserts.Equal(unique.ID, again.ID)
+	Drain(ctx, DefaultQueue, time.Now())
+	asserts.Equal([]string{"unique"}, took())
+	again, _ = Enqueue(db, "test.record", testPayload{Name: "unique"}, EnqueueOptions{UniqueKey: "unique"})
+	asserts.NotEqual(unique.ID, again.ID, "done jobs don't hold the key")
+	Drain(ctx, DefaultQueue, time.Now())
+	took()
+
+	// The worker runs jobs as they come, and waits for them on shutdown
+	worker := NewWorker(map[string]int{DefaultQueue: 2}, 10*time.Millisecond)
+	worker.Start()
+	for _, name := range []string{"a", "b", "c"} {
+		Enqueue(db, "test.record", testPayload{Name: name}, EnqueueOptions{})
+	}
+	asserts.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(ran) == 3
+	}, time.Second, 10*time.Millisecond)
+	shutdown, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	asserts.NoError(worker.Shutdown(shutdown))
+	asserts.ElementsMatch([]string{"a", "b", "c"}, took())
+
+	// The jobs command
+	var out bytes.Buffer
+	asserts.ErrorIs(Command(nil, &out), ErrUsage)
+	asserts.NoError(Command([]string{"stats"}, &out))
+	asserts.Contains(out.String(), "default  dead")
+	out.Reset()
+	asserts.NoError(Command([]string{"list", StatusDead}, &out))
+	asserts.Contains(out.String(), "test.panic")
+	asserts.Contains(out.String(), "job panicked: broken handler")
+	asserts.NotContains(out.String(), "test.record")
+	out.Reset()
+	asserts.NoError(Command([]string{"retry", "all"}, &out))
+	asserts.Equal("1 dead jobs queued again\n", out.String())
+	out.Reset()
+	asserts.Error(Command([]string{"enqueue", "test.record", "{nope"}, &out))
+	asserts.NoError(Command([]string{"enqueue", "test.record", `{"name":"cli"}`}, &out))
+	asserts.Contains(out.String(), "pending")
+	Drain(ctx, DefaultQueue, time.Now())
+	asserts.Contains(took(), "cli")
+
+	// Done jobs are pruned, the others kept
+	asserts.NoError(Prune(time.Now().Add(time.Hour)))
+	var left int
+	db.Model(&JobModel{}).Where("status = ?", StatusDone).Count(&left)
+	asserts.Equal(0, left)
+	db.Model(&JobModel{}).Count(&left)
+	asserts.NotZero(left)
+}
@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Runs the jobs of some queues, each with its own number of concurrent jobs.
+//
+//	worker := jobs.NewWorker(map[string]int{jobs.DefaultQueue: 2, webhooks.Queue: 4}, time.Second)
+//	worker.Start()
+//	defer worker.Shutdown(ctx)
+type Worker struct {
+	queues   map[string]int
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// A worker running up to concurrency jobs of every queue at once, idle slots look for due jobs every interval.
+func NewWorker(queues map[string]int, interval time.Duration) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Worker{queues: queues, interval: interval, ctx: ctx, cancel: cancel, stop: make(chan struct{})}
+}
+
+func (w *Worker) Start() {
+	for queue, concurrency := range w.queues {
+		for i := 0; i < concurrency; i++ {
+			w.wg.Add(1)
+			go w.loop(queue)
+		}
+	}
+	w.wg.Add(1)
+	go w.prune()
+}
+
+// Work through the due jobs of the queue, then wait for the next tick.
+func (w *Worker) loop(queue string) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			select {
+			case <-w.stop:
+				return
+			default:
+			}
+			ran, err := Work(w.ctx, queue, time.Now())
+			if err != nil {
+				fmt.Println("jobs err: (Worker) ", queue, err)
+			}
+			if !ran {
+				break
+			}
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Worker) prune() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			if err := Prune(now.Add(-DoneRetention)); err != nil {
+				fmt.Println("jobs err: (Prune) ", err)
+			}
+		}
+	}
+}
+
+// Stop taking jobs and wait for the running ones to finish. When ctx is done first, the running jobs
+// are told to stop through their context. Jobs which don't finish anyway run again once their lease
+// runs out.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	close(w.stop)
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		w.cancel()
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,128 @@
+package notifications
+
+import (
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// Notifications are created from the events of the articles and users packages. An event handled
+// again after a failure doesn't notify a second time, the notifications carry the ID of their event.
+func init() {
+	common.Handle(func(e common.Event) error {
+		mention := e.Payload.(articles.MentionModel)
+		notification := NotificationModel{
+			UserModelID: mention.UserModelID,
+			Type:        TypeMention,
+			ActorID:     mention.MentionedBy.UserModelID,
+			ArticleID:   mention.ArticleID,
+			EventID:     e.ID,
+		}
+		if mention.SourceType == articles.MentionInComment {
+			notification.CommentID = mention.SourceID
+		}
+		return Notify(notification)
+	}, articles.EventUserMentioned)
+
+	common.Handle(func(e common.Event) error {
+		follow := e.Payload.(users.FollowModel)
+		notification := NotificationModel{
+			UserModelID: follow.Following.ID,
+			Type:        TypeFollow,
+			ActorID:     follow.FollowedBy.ID,
+			EventID:     e.ID,
+		}
+		return Notify(notification)
+	}, users.EventUserFollowed)
+
+	// Likes from other servers have no actor, folded together they count as one
+	common.Handle(func(e common.Event) error {
+		favorite := e.Payload.(articles.FavoriteModel)
+		notification := NotificationModel{
+			UserModelID: userOf(favorite.Favorite.AuthorID),
+			Type:        TypeFavorite,
+			ActorID:     userOf(favorite.FavoriteByID),
+			ArticleID:   favorite.FavoriteID,
+			EventID:     e.ID,
+		}
+		return Notify(notification)
+	}, articles.EventArticleFavorited)
+
+	// A reply notifies the author of the comment it answers, any comment the author of the article.
+	// An author replied to on their own article only hears about the reply.
+	common.Handle(func(e common.Event) error {
+		comment := e.Payload.(articles.CommentModel)
+		actorID := userOf(comment.AuthorID)
+		var replyTo uint
+		if comment.ParentID != nil {
+			replyTo = commentAuthor(*comment.ParentID)
+			notification := NotificationModel{
+				UserModelID: replyTo,
+				Type:        TypeReply,
+				ActorID:     actorID,
+				ArticleID:   comment.ArticleID,
+				CommentID:   *comment.ParentID,
+				EventID:     e.ID,
+			}
+			if err := Notify(notification); err != nil {
+				return err
+			}
+		}
+		if articleAuthor := articleAuthor(comment.ArticleID); articleAuthor != replyTo {
+			notification := NotificationModel{
+				UserModelID: articleAuthor,
+				Type:        TypeComment,
+				ActorID:     actorID,
+				ArticleID:   comment.ArticleID,
+				CommentID:   comment.ID,
+				EventID:     e.ID,
+			}
+			return Notify(notification)
+		}
+		return nil
+	}, articles.EventCommentCreated)
+
+	// The comment and mention notifications of a removed comment go with it, unless other actors
+	// were folded into them since. A reply notification points at the comment replied to, it goes when
+	// its actor has no other reply there left.
+	common.Handle(func(e common.Event) error {
+		comment := e.Payload.(articles.CommentModel)
+		db := common.GetDB()
+		err := db.Where("comment_id = ? AND type IN (?) AND actors_count = 1", comment.ID, []string{TypeComment, TypeMention}).
+			Delete(&NotificationModel{}).Error
+		if err != nil || comment.ParentID == nil {
+			return err
+		}
+		var replies int
+		err = db.Model(&articles.CommentModel{}).
+			Where("parent_id = ? AND author_id = ? AND id <> ? AND removed_at IS NULL", *comment.ParentID, comment.AuthorID, comment.ID).
+			Count(&replies).Error
+		if err != nil || replies > 0 {
+			return err
+		}
+		return db.Where("comment_id = ? AND type = ? AND actor_id = ? AND actors_count = 1", *comment.ParentID, TypeReply, userOf(comment.AuthorID)).
+			Delete(&NotificationModel{}).Error
+	}, articles.EventCommentDeleted)
+}
+
+// The user model id of an article user, 0 when there is none.
+func userOf(articleUserID uint) uint {
+	db := common.GetDB()
+	var id uint
+	db.Model(&articles.ArticleUserModel{}).Where("id = ?", articleUserID).Select("user_model_id").Row().Scan(&id)
+	return id
+}
+
+func articleAuthor(articleID uint) uint {
+	db := common.GetDB()
+	var authorID uint
+	db.Model(&articles.ArticleModel{}).Where("id = ?", articleID).Select("author_id").Row().Scan(&authorID)
+	return userOf(authorID)
+}
+
+func commentAuthor(commentID uint) uint {
+	db := common.GetDB()
+	var authorID uint
+	db.Model(&articles.CommentModel{}).Where("id = ?", commentID).Select("author_id").Row().Scan(&authorID)
+	return userOf(authorID)
+}
@@ -0,0 +1,290 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"realworld-backend/common"
+
+	"github.com/jinzhu/gorm"
+)
+
+// What a notification tells about.
+const (
+	TypeMention  = "mention"
+	TypeFollow   = "follow"
+	TypeFavorite = "favorite"
+	TypeComment  = "comment"
+	TypeReply    = "reply"
+)
+
+// Every notification type, users can mute each of them.
+var Types = []string{TypeMention, TypeFollow, TypeFavorite, TypeComment, TypeReply}
+
+var ErrUnknownType = errors.New("unknown notification type")
+
+// Published with the NotificationModel after a notification is stored or another one is folded into it.
+const EventNotificationCreated = "notification.created"
+
+// Something a user should learn about, caused by other users (the actors). ArticleID and CommentID
+// point to what it is about, 0 when it isn't about an article or a comment.
+// While a notification is unread, later ones with the same GroupKey are folded into it: it counts
+// the actors and shows the most recent one, e.g. "5 people favorited your article".
+type NotificationModel struct {
+	gorm.Model
+	UserModelID uint `gorm:"index"`
+	Type        string
+	GroupKey    string `gorm:"index"`
+	ActorID     uint
+	ActorsCount uint `gorm:"not null;default:1"`
+	ArticleID   uint
+	CommentID   uint
+	ReadAt      *time.Time
+	// The recorded event the notification comes from, 0 when there is none. Not stored with the
+	// notification, see NotificationSourceModel.
+	EventID uint `gorm:"-" json:"-"`
+}
+
+// The users folded into a notification, so an actor is only counted once.
+type NotificationActorModel struct {
+	gorm.Model
+	NotificationID uint `gorm:"index"`
+	ActorID        uint
+}
+
+// A notification type a user doesn't want to be notified about.
+type NotificationMuteModel struct {
+	UserModelID uint   `gorm:"primary_key;auto_increment:false"`
+	Type        string `gorm:"primary_key"`
+}
+
+// The recorded events a user was notified about. Events are delivered again after a handler failed,
+// Notify skips the events it has already seen for the user.
+type NotificationSourceModel struct {
+	EventID     uint `gorm:"primary_key;auto_increment:false"`
+	UserModelID uint `gorm:"primary_key;auto_increment:false"`
+}
+
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&NotificationModel{})
+	db.AutoMigrate(&NotificationActorModel{})
+	db.AutoMigrate(&NotificationMuteModel{})
+	db.AutoMigrate(&NotificationSourceModel{})
+}
+
+func isType(name string) bool {
+	for _, known := range Types {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The key unread notifications are folded by, mentions are never folded.
+func groupKey(notification NotificationModel) string {
+	switch notification.Type {
+	case TypeFollow:
+		return TypeFollow
+	case TypeFavorite, TypeComment:
+		return fmt.Sprintf("%s:%d", notification.Type, notification.ArticleID)
+	case TypeReply:
+		return fmt.Sprintf("%s:%d", TypeReply, notification.CommentID)
+	}
+	return ""
+}
+
+// Store a notification for its user, or fold it into the unread one of its group. Users are never
+// notified about what they did themselves, nor about the types they muted, nor twice about one event.
+//
+//	err := Notify(NotificationModel{UserModelID: author.ID, Type: TypeFavorite, ActorID: reader.ID, ArticleID: article.ID})
+func Notify(notification NotificationModel) error {
+	if notification.UserModelID == 0 || notification.UserModelID == notification.ActorID {
+		return nil
+	}
+	db := common.GetDB()
+	var mutes int
+	if err := db.Model(&NotificationMuteModel{}).Where(&NotificationMuteModel{UserModelID: notification.UserModelID, Type: notification.Type}).Count(&mutes).Error; err != nil {
+		return err
+	}
+	if mutes > 0 {
+		return nil
+	}
+	notification.GroupKey = groupKey(notification)
+
+	tx := db.Begin()
+	if notification.EventID != 0 {
+		err := tx.Create(&NotificationSourceModel{EventID: notification.EventID, UserModelID: notification.UserModelID}).Error
+		if common.IsUniqueViolation(err) {
+			tx.Rollback()
+			return nil
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var group NotificationModel
+	if notification.GroupKey != "" {
+		query := tx.Where("user_model_id = ? AND group_key = ? AND read_at IS NULL", notification.UserModelID, notification.GroupKey).First(&group)
+		if query.Error != nil && !query.RecordNotFound() {
+			tx.Rollback()
+			return query.Error
+		}
+	}
+	if group.ID == 0 {
+		notification.ActorsCount = 1
+		if err := tx.Create(&notification).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Create(&NotificationActorModel{NotificationID: notification.ID, ActorID: notification.ActorID}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+		common.Publish(common.Event{Name: EventNotificationCreated, Payload: notification})
+		return nil
+	}
+
+	var known int
+	if err := tx.Model(&NotificationActorModel{}).Where(&NotificationActorModel{NotificationID: group.ID, ActorID: notification.ActorID}).Count(&known).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if known > 0 {
+		return tx.Commit().Error
+	}
+	if err := tx.Create(&NotificationActorModel{NotificationID: group.ID, ActorID: notification.ActorID}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Model(&group).Updates(map[string]interface{}{
+		"actor_id":     notification.ActorID,
+		"actors_count": gorm.Expr("actors_count + 1"),
+		"comment_id":   notification.CommentID,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	group.ActorID, group.ActorsCount, group.CommentID = notification.ActorID, group.ActorsCount+1, notification.CommentID
+	common.Publish(common.Event{Name: EventNotificationCreated, Payload: group})
+	return nil
+}
+
+// Mark a notification of the user as read, read_at is set without moving the notification in the list.
+func MarkRead(userModelID, id uint) error {
+	db := common.GetDB()
+	var notification NotificationModel
+	if err := db.Where("id = ? AND user_model_id = ?", id, userModelID).First(&notification).Error; err != nil {
+		return err
+	}
+	if notification.ReadAt != nil {
+		return nil
+	}
+	return db.Model(&notification).UpdateColumn("read_at", time.Now()).Error
+}
+
+// Mark all notifications of the user as read.
+func MarkAllRead(userModelID uint) error {
+	db := common.GetDB()
+	return db.Model(&NotificationModel{}).
+		Where("user_model_id = ? AND read_at IS NULL", userModelID).
+		UpdateColumn("read_at", time.Now()).Error
+}
+
+// The notification types the user muted.
+func MutedTypes(userModelID uint) ([]string, error) {
+	db := common.GetDB()
+	var muted []string
+	err := db.Model(&NotificationMuteModel{}).Where("user_model_id = ?", userModelID).Order("type").Pluck("type", &muted).Error
+	return muted, err
+}
+
+// Replace the muted notification types of the user.
+func SetMutedTypes(userModelID uint, muted []string) error {
+	for _, name := range muted {
+		if !isType(name) {
+			return ErrUnknownType
+		}
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Where("user_model_id = ?", userModelID).Delete(NotificationMuteModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	seen := map[string]bool{}
+	for _, name := range muted {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if err := tx.Create(&NotificationMuteModel{UserModelID: userModelID, Type: name}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Which notifications of a user to list, most recently updated first. After is the cursor
+// handed out as nextCursor.
+type NotificationQuery struct {
+	UserModelID uint
+	Unread      bool
+	Limit       int
+	After       *notificationCursor
+}
+
+type notificationCursor struct {
+	Time time.Time `json:"t"`
+	ID   uint      `json:"i"`
+}
+
+type NotificationPage struct {
+	Notifications []NotificationModel
+	UnreadCount   int
+	NextCursor    string
+}
+
+// Find one page of notifications and how many notifications of the user are unread.
+func FindNotificationPage(query NotificationQuery) (NotificationPage, error) {
+	db := common.GetDB()
+	var page NotificationPage
+	err := db.Model(&NotificationModel{}).
+		Where("user_model_id = ? AND read_at IS NULL", query.UserModelID).
+		Count(&page.UnreadCount).Error
+	if err != nil {
+		return page, err
+	}
+
+	tx := db.Where("user_model_id = ?", query.UserModelID)
+	if query.Unread {
+		tx = tx.Where("read_at IS NULL")
+	}
+	if query.After != nil {
+		tx = tx.Where("(updated_at < ?) OR (updated_at = ? AND id < ?)", query.After.Time, query.After.Time, query.After.ID)
+	}
+	// One extra row tells whether there is a next page.
+	var models []NotificationModel
+	if err := tx.Order("updated_at DESC").Order("id DESC").Limit(query.Limit + 1).Find(&models).Error; err != nil {
+		return page, err
+	}
+	if len(models) > query.Limit {
+		models = models[:query.Limit]
+		last := models[len(models)-1]
+		page.NextCursor = common.EncodeCursor(notificationCursor{Time: last.UpdatedAt, ID: last.ID})
+	}
+	page.Notifications = models
+	return page, nil
+}
@@ -0,0 +1,115 @@
+package notifications
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Routes below /api/user for the current user.
+func NotificationsRegister(router *gin.RouterGroup) {
+	router.GET("/notifications", NotificationList)
+	router.POST("/notifications/read", NotificationReadAll)
+	router.POST("/notifications/:id/read", NotificationRead)
+	router.GET("/notifications/preferences", PreferencesRetrieve)
+	router.PUT("/notifications/preferences", PreferencesUpdate)
+}
+
+func NotificationList(c *gin.Context) {
+	notificationListValidator := NewNotificationListValidator()
+	if err := notificationListValidator.Bind(c); err != nil {
+		if _, ok := err.(validator.ValidationErrors); ok {
+			c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+			return
+		}
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("query", err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	notificationListValidator.query.UserModelID = myUserModel.ID
+	page, err := FindNotificationPage(notificationListValidator.query)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("notifications", errors.New("Invalid param")))
+		return
+	}
+	serializer := NotificationsSerializer{c, page.Notifications}
+	var nextCursor interface{}
+	if page.NextCursor != "" {
+		nextCursor = page.NextCursor
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"notifications": serializer.Response(),
+		"unreadCount":   page.UnreadCount,
+		"nextCursor":    nextCursor,
+	})
+}
+
+func NotificationRead(c *gin.Context) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("notification", errors.New("Invalid id")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err := MarkRead(myUserModel.ID, uint(id64)); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("notification", errors.New("Invalid id")))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notification": "Read"})
+}
+
+func NotificationReadAll(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err := MarkAllRead(myUserModel.ID); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notifications": "Read"})
+}
+
+func PreferencesRetrieve(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	muted, err := MutedTypes(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": preferencesResponse(muted)})
+}
+
+// Replace the muted notification types, {"preferences": {"muted": ["favorite", "follow"]}}
+func PreferencesUpdate(c *gin.Context) {
+	preferencesValidator := NewPreferencesValidator()
+	if err := preferencesValidator.Bind(c); err != nil {
+		if err == ErrUnknownType {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("muted", err))
+			return
+		}
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("preferences", err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err := SetMutedTypes(myUserModel.ID, preferencesValidator.Preferences.Muted); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	muted, err := MutedTypes(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": preferencesResponse(muted)})
+}
+
+func preferencesResponse(muted []string) gin.H {
+	if muted == nil {
+		muted = []string{}
+	}
+	return gin.H{"muted": muted, "types": Types}
+}
@@ -0,0 +1,111 @@
+package notifications
+
+import (
+	"fmt"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+)
+
+type NotificationsSerializer struct {
+	C             *gin.Context
+	Notifications []NotificationModel
+}
+
+// A notification shows its most recent actor and how many there are, article and commentId are
+// null when it isn't about one.
+type NotificationResponse struct {
+	ID          uint                  `json:"id"`
+	Type        string                `json:"type"`
+	Message     string                `json:"message"`
+	Read        bool                  `json:"read"`
+	CreatedAt   string                `json:"createdAt"`
+	UpdatedAt   string                `json:"updatedAt"`
+	Actor       users.ProfileResponse `json:"actor"`
+	ActorsCount uint                  `json:"actorsCount"`
+	Article     *NotificationArticle  `json:"article"`
+	CommentID   *uint                 `json:"commentId"`
+}
+
+type NotificationArticle struct {
+	Slug  string `json:"slug"`
+	Title string `json:"title"`
+}
+
+var messages = map[string]string{
+	TypeMention:  "mentioned you",
+	TypeFollow:   "followed you",
+	TypeFavorite: "favorited your article",
+	TypeComment:  "commented on your article",
+	TypeReply:    "replied to your comment",
+}
+
+// "alice favorited your article", or "5 people favorited your article" once several users did. Actors
+// who aren't users here, like the remote actors of a Like, are "someone".
+func message(notification NotificationModel, actor users.UserModel) string {
+	if notification.ActorsCount > 1 {
+		return fmt.Sprintf("%d people %s", notification.ActorsCount, messages[notification.Type])
+	}
+	if actor.ID == 0 {
+		return "someone " + messages[notification.Type]
+	}
+	return actor.Username + " " + messages[notification.Type]
+}
+
+// The actors and articles of the page are loaded with one query each.
+func (s *NotificationsSerializer) Response() []NotificationResponse {
+	db := common.GetDB()
+	actorIDs := make([]uint, 0, len(s.Notifications))
+	articleIDs := make([]uint, 0, len(s.Notifications))
+	for _, notification := range s.Notifications {
+		actorIDs = append(actorIDs, notification.ActorID)
+		if notification.ArticleID != 0 {
+			articleIDs = append(articleIDs, notification.ArticleID)
+		}
+	}
+	var actorModels []users.UserModel
+	if len(actorIDs) > 0 {
+		db.Where("id IN (?)", actorIDs).Find(&actorModels)
+	}
+	actors := map[uint]users.UserModel{}
+	for _, actor := range actorModels {
+		actors[actor.ID] = actor
+	}
+	var articleModels []articles.ArticleModel
+	if len(articleIDs) > 0 {
+		db.Where("id IN (?)", articleIDs).Find(&articleModels)
+	}
+	articlesByID := map[uint]articles.ArticleModel{}
+	for _, article := range articleModels {
+		articlesByID[article.ID] = article
+	}
+	users.PreloadFollowing(s.C, actorIDs)
+
+	response := []NotificationResponse{}
+	for _, notification := range s.Notifications {
+		actor := actors[notification.ActorID]
+		profileSerializer := users.ProfileSerializer{C: s.C, UserModel: actor}
+		notificationResponse := NotificationResponse{
+			ID:          notification.ID,
+			Type:        notification.Type,
+			Message:     message(notification, actor),
+			Read:        notification.ReadAt != nil,
+			CreatedAt:   notification.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			UpdatedAt:   notification.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			Actor:       profileSerializer.Response(),
+			ActorsCount: notification.ActorsCount,
+		}
+		if article, ok := articlesByID[notification.ArticleID]; ok {
+			notificationResponse.Article = &NotificationArticle{article.Slug, article.Title}
+		}
+		if notification.CommentID != 0 {
+			commentID := notification.CommentID
+			notificationResponse.CommentID = &commentID
+		}
+		response = append(response, notificationResponse)
+	}
+	return response
+}
@@ -0,0 +1,270 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() *gorm.DB {
+	db := common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	AutoMigrate()
+	return db
+}
+
+func TestMentionNotifications(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	author := users.UserModel{Username: "notifyauthor", Email: "notifyauthor@test.com"}
+	reader := users.UserModel{Username: "notifyreader", Email: "notifyreader@test.com"}
+	test_db.Create(&author)
+	test_db.Create(&reader)
+	authorModel := articles.GetArticleUserModel(author)
+
+	common.Publish(common.Event{Name: articles.EventUserMentioned, Payload: articles.MentionModel{
+		UserModelID: reader.ID, SourceType: articles.MentionInComment, SourceID: 7, ArticleID: 3, MentionedBy: authorModel,
+	}})
+	common.Publish(common.Event{Name: articles.EventUserMentioned, Payload: articles.MentionModel{
+		UserModelID: author.ID, SourceType: articles.MentionInArticle, SourceID: 3, ArticleID: 3, MentionedBy: authorModel,
+	}})
+
+	var notifications []NotificationModel
+	test_db.Find(&notifications)
+	asserts.Len(notifications, 1, "users aren't notified about their own mentions")
+	asserts.Equal(reader.ID, notifications[0].UserModelID)
+	asserts.Equal(TypeMention, notifications[0].Type)
+	asserts.Equal(author.ID, notifications[0].ActorID)
+	asserts.Equal(uint(3), notifications[0].ArticleID)
+	asserts.Equal(uint(7), notifications[0].CommentID)
+	asserts.Nil(notifications[0].ReadAt)
+
+	// A recorded event delivered again, after another handler failed, notifies only once
+	redelivered := common.Event{ID: 41, Name: articles.EventUserMentioned, Payload: articles.MentionModel{
+		UserModelID: reader.ID, SourceType: articles.MentionInArticle, SourceID: 4, ArticleID: 4, MentionedBy: authorModel,
+	}}
+	common.Publish(redelivered)
+	common.Publish(redelivered)
+	test_db.Find(&notifications)
+	asserts.Len(notifications, 2)
+	var sources int
+	test_db.Model(&NotificationSourceModel{}).Count(&sources)
+	asserts.Equal(1, sources)
+}
+
+func TestNotificationInbox(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+
+	author := users.UserModel{Username: "inboxauthor", Email: "inboxauthor@test.com"}
+	test_db.Create(&author)
+	var readers []users.UserModel
+	for i := 0; i < 7; i++ {
+		reader := users.UserModel{Username: fmt.Sprintf("inboxreader%d", i), Email: fmt.Sprintf("inboxreader%d@test.com", i)}
+		test_db.Create(&reader)
+		readers = append(readers, reader)
+	}
+	article := articles.ArticleModel{Slug: "inbox", Title: "Inbox", Author: articles.GetArticleUserModel(author)}
+	test_db.Create(&article)
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	router.POST("/api/articles/:slug/favorite", articles.ArticleFavorite)
+	router.POST("/api/articles/:slug/comments", articles.ArticleCommentCreate)
+	router.POST("/api/profiles/:username/follow", users.ProfileFollow)
+	NotificationsRegister(router.Group("/api/user"))
+	request := func(method, url, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	list := func(query string) ([]map[string]interface{}, map[string]interface{}) {
+		code, response := request("GET", "/api/user/notifications"+query, "")
+		asserts.Equal(200, code)
+		var notifications []map[string]interface{}
+		for _, notification := range response["notifications"].([]interface{}) {
+			notifications = append(notifications, notification.(map[string]interface{}))
+		}
+		return notifications, response
+	}
+
+	// Five favorites fold into one notification, favoriting twice counts once
+	for _, reader := range readers[:5] {
+		me = reader
+		code, _ := request("POST", "/api/articles/inbox/favorite", "")
+		asserts.Equal(200, code)
+	}
+	request("POST", "/api/articles/inbox/favorite", "")
+	me = readers[0]
+	request("POST", "/api/profiles/inboxauthor/follow", "")
+	me = readers[1]
+	code, response := request("POST", "/api/articles/inbox/comments", `{"comment":{"body":"nice"}}`)
+	asserts.Equal(201, code)
+	commentID := response["comment"].(map[string]interface{})["id"].(float64)
+	// The author replying on their own article only notifies the comment's author
+	me = author
+	request("POST", "/api/articles/inbox/comments", fmt.Sprintf(`{"comment":{"body":"thanks","parentId":%v}}`, commentID))
+
+	me = author
+	notifications, response := list("")
+	asserts.Equal(float64(3), response["unreadCount"])
+	asserts.Len(notifications, 3)
+	asserts.Equal(TypeComment, notifications[0]["type"])
+	asserts.Equal("inboxreader1 commented on your article", notifications[0]["message"])
+	asserts.Equal(commentID, notifications[0]["commentId"])
+	asserts.Equal(TypeFollow, notifications[1]["type"])
+	asserts.Nil(notifications[1]["article"])
+	favorites := notifications[2]
+	asserts.Equal(TypeFavorite, favorites["type"])
+	asserts.Equal(float64(5), favorites["actorsCount"])
+	asserts.Equal("5 people favorited your article", favorites["message"])
+	asserts.Equal("inboxreader4", favorites["actor"].(map[string]interface{})["username"])
+	asserts.Equal("inbox", favorites["article"].(map[string]interface{})["slug"])
+	asserts.Equal(false, favorites["read"])
+
+	me = readers[1]
+	notifications, _ = list("")
+	asserts.Len(notifications, 1)
+	asserts.Equal(TypeReply, notifications[0]["type"])
+	asserts.Equal(commentID, notifications[0]["commentId"])
+
+	// Pages continue after the cursor
+	me = author
+	notifications, response = list("?limit=2")
+	asserts.Len(notifications, 2)
+	notifications, response = list("?limit=2&after=" + response["nextCursor"].(string))
+	asserts.Len(notifications, 1)
+	asserts.Equal(TypeFavorite, notifications[0]["type"])
+	asserts.Nil(response["nextCursor"])
+	code, _ = request("GET", "/api/user/notifications?after=forged", "")
+	asserts.Equal(422, code)
+
+	// Read notifications stay in the list, a new favorite starts a new group
+	favoritesID := favorites["id"].(float64)
+	me = readers[1]
+	code, _ = request("POST", fmt.Sprintf("/api/user/notifications/%v/read", favoritesID), "")
+	asserts.Equal(404, code, "only the user's own notifications can be marked")
+	me = author
+	code, _ = request("POST", fmt.Sprintf("/api/user/notifications/%v/read", favoritesID), "")
+	asserts.Equal(200, code)
+	notifications, response = list("?unread=true")
+	asserts.Len(notifications, 2)
+	asserts.Equal(float64(2), response["unreadCount"])
+	me = readers[5]
+	request("POST", "/api/articles/inbox/favorite", "")
+	me = author
+	notifications, _ = list("")
+	asserts.Len(notifications, 4)
+	asserts.Equal(TypeFavorite, notifications[0]["type"])
+	asserts.Equal("inboxreader5 favorited your article", notifications[0]["message"])
+
+	code, _ = request("POST", "/api/user/notifications/read", "")
+	asserts.Equal(200, code)
+	_, response = list("")
+	asserts.Equal(float64(0), response["unreadCount"])
+
+	// Muted types aren't notified
+	code, response = request("PUT", "/api/user/notifications/preferences", `{"preferences":{"muted":["favorite","favorite"]}}`)
+	asserts.Equal(200, code)
+	asserts.Equal([]interface{}{"favorite"}, response["preferences"].(map[string]interface{})["muted"])
+	code, _ = request("PUT", "/api/user/notifications/preferences", `{"preferences":{"muted":["everything"]}}`)
+	asserts.Equal(422, code)
+	_, response = request("GET", "/api/user/notifications/preferences", "")
+	asserts.Equal([]interface{}{"favorite"}, response["preferences"].(map[string]interface{})["muted"])
+	me = readers[6]
+	request("POST", "/api/articles/inbox/favorite", "")
+	me = author
+	_, response = list("")
+	asserts.Equal(float64(0), response["unreadCount"])
+}
+
+func TestRemovedCommentNotifications(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	author := users.UserModel{Username: "removedauthor", Email: "removedauthor@test.com"}
+	reader := users.UserModel{Username: "removedreader", Email: "removedreader@test.com"}
+	test_db.Create(&author)
+	test_db.Create(&reader)
+	authorModel := articles.GetArticleUserModel(author)
+	readerModel := articles.GetArticleUserModel(reader)
+	article := articles.ArticleModel{Slug: "removed-comments", Title: "Removed", AuthorID: authorModel.ID}
+	asserts.NoError(articles.CreateArticle(&article))
+
+	comment := articles.CommentModel{ArticleID: article.ID, AuthorID: readerModel.ID, Body: "soon gone"}
+	asserts.NoError(articles.CreateComment(&comment))
+	var count int
+	test_db.Model(&NotificationModel{}).Where("user_model_id = ? AND comment_id = ?", author.ID, comment.ID).Count(&count)
+	asserts.Equal(1, count)
+
+	// A reply notification points at the comment replied to, it goes with the author's last reply there
+	var replies []articles.CommentModel
+	for _, body := range []string{"first", "second"} {
+		reply := articles.CommentModel{ArticleID: article.ID, AuthorID: authorModel.ID, Body: body, ParentID: &comment.ID}
+		asserts.NoError(articles.CreateComment(&reply))
+		replies = append(replies, reply)
+	}
+	replyNotifications := func() int {
+		var count int
+		test_db.Model(&NotificationModel{}).Where("user_model_id = ? AND type = ?", reader.ID, TypeReply).Count(&count)
+		return count
+	}
+	asserts.Equal(1, replyNotifications())
+	asserts.NoError(articles.RemoveComment(replies[0]))
+	asserts.Equal(1, replyNotifications(), "the other reply is still there")
+	asserts.NoError(articles.RemoveComment(replies[1]))
+	asserts.Equal(0, replyNotifications())
+
+	// The notification goes with the comment it is about
+	asserts.NoError(articles.RemoveComment(comment))
+	test_db.Model(&NotificationModel{}).Where("user_model_id = ? AND comment_id = ?", author.ID, comment.ID).Count(&count)
+	asserts.Equal(0, count)
+}
+
+func TestRemoteLikeNotifications(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	author := users.UserModel{Username: "likedauthor", Email: "likedauthor@test.com"}
+	test_db.Create(&author)
+	article := articles.ArticleModel{Slug: "liked", Title: "Liked", Author: articles.GetArticleUserModel(author)}
+	test_db.Create(&article)
+
+	// A Like from another server is a favorite without FavoriteBy
+	common.Publish(common.Event{Name: articles.EventArticleFavorited, Payload: articles.FavoriteModel{
+		Favorite: article, FavoriteID: article.ID,
+	}})
+	var notifications []NotificationModel
+	test_db.Where("user_model_id = ?", author.ID).Find(&notifications)
+	asserts.Len(notifications, 1)
+	asserts.Equal(TypeFavorite, notifications[0].Type)
+	asserts.Equal("someone favorited your article", message(notifications[0], users.UserModel{}))
+}
@@ -0,0 +1,57 @@
+package notifications
+
+import (
+	"realworld-backend/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Query string of the notification list, ?unread=true lists the unread ones only. Pages continue
+// after the cursor handed out as nextCursor.
+type NotificationListValidator struct {
+	Unread bool   `form:"unread"`
+	Limit  int    `form:"limit" binding:"min=0"`
+	After  string `form:"after"`
+	query  NotificationQuery
+}
+
+func NewNotificationListValidator() NotificationListValidator {
+	return NotificationListValidator{}
+}
+
+func (s *NotificationListValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	s.query.Unread = s.Unread
+	s.query.Limit = common.PageSize(s.Limit)
+	if s.After != "" {
+		s.query.After = &notificationCursor{}
+		if err := common.DecodeCursor(s.After, s.query.After); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type PreferencesValidator struct {
+	Preferences struct {
+		Muted []string `form:"muted" json:"muted"`
+	} `json:"preferences"`
+}
+
+func NewPreferencesValidator() PreferencesValidator {
+	return PreferencesValidator{}
+}
+
+func (s *PreferencesValidator) Bind(c *gin.Context) error {
+	if err := common.Bind(c, s); err != nil {
+		return err
+	}
+	for _, name := range s.Preferences.Muted {
+		if !isType(name) {
+			return ErrUnknownType
+		}
+	}
+	return nil
+}
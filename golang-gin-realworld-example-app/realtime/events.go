@@ -0,0 +1,153 @@
+package realtime
+
+import (
+	"fmt"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/notifications"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+)
+
+var hub = NewHub()
+
+// The hub the model events are forwarded to.
+func GetHub() *Hub {
+	return hub
+}
+
+// Comments, favorite counts and changes of one article.
+func articleTopic(articleID uint) string {
+	return fmt.Sprintf("article:%d", articleID)
+}
+
+// The notifications of one user.
+func notificationsTopic(userModelID uint) string {
+	return fmt.Sprintf("notifications:%d", userModelID)
+}
+
+// New articles of the authors and tags a user follows.
+func feedTopic(userModelID uint) string {
+	return fmt.Sprintf("feed:%d", userModelID)
+}
+
+func publish(topic, event string, data interface{}) {
+	if err := hub.Publish(topic, event, data); err != nil {
+		fmt.Println("realtime err: ", err)
+	}
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.999Z")
+}
+
+// The events carry just enough for a client to update what it shows, or to know what to refetch.
+func init() {
+	common.Subscribe(func(e common.Event) {
+		comment := e.Payload.(articles.CommentModel)
+		if !hub.Listening(articleTopic(comment.ArticleID)) {
+			return
+		}
+		author := authorOf(comment.AuthorID)
+		publish(articleTopic(comment.ArticleID), "comment", gin.H{"comment": gin.H{
+			"id":        comment.ID,
+			"parentId":  comment.ParentID,
+			"body":      comment.Body,
+			"author":    author.Username,
+			"createdAt": timestamp(comment.CreatedAt),
+		}})
+	}, articles.EventCommentCreated)
+
+	common.Subscribe(func(e common.Event) {
+		comment := e.Payload.(articles.CommentModel)
+		if !hub.Listening(articleTopic(comment.ArticleID)) {
+			return
+		}
+		publish(articleTopic(comment.ArticleID), "removed", gin.H{"comment": gin.H{
+			"id":       comment.ID,
+			"parentId": comment.ParentID,
+		}})
+	}, articles.EventCommentDeleted)
+
+	common.Subscribe(func(e common.Event) {
+		favorite := e.Payload.(articles.FavoriteModel)
+		if !hub.Listening(articleTopic(favorite.FavoriteID)) {
+			return
+		}
+		var count uint
+		common.GetDB().Model(&articles.ArticleModel{}).Where("id = ?", favorite.FavoriteID).Select("favorites_count").Row().Scan(&count)
+		publish(articleTopic(favorite.FavoriteID), "favorites", gin.H{"article": gin.H{
+			"slug":           favorite.Favorite.Slug,
+			"favoritesCount": count,
+		}})
+	}, articles.EventArticleFavorited, articles.EventArticleUnfavorited)
+
+	common.Subscribe(func(e common.Event) {
+		article := e.Payload.(articles.ArticleModel)
+		event := "article"
+		if e.Name == articles.EventArticleDeleted {
+			event = "deleted"
+		}
+		publish(articleTopic(article.ID), event, gin.H{"article": gin.H{
+			"slug":      article.Slug,
+			"title":     article.Title,
+			"updatedAt": timestamp(article.UpdatedAt),
+		}})
+	}, articles.EventArticleUpdated, articles.EventArticleDeleted)
+
+	common.Subscribe(func(e common.Event) {
+		article := e.Payload.(articles.ArticleModel)
+		if hub.Stats().Subscriptions == 0 {
+			return
+		}
+		author := authorOf(article.AuthorID)
+		// Whoever has the article in GET /api/articles/feed: the followers of its author and its tags
+		readers, err := articles.FeedReaders(article)
+		if err != nil {
+			fmt.Println("realtime err: ", err)
+			return
+		}
+		data := gin.H{"article": gin.H{
+			"slug":        article.Slug,
+			"title":       article.Title,
+			"description": article.Description,
+			"author":      author.Username,
+			"createdAt":   timestamp(article.CreatedAt),
+		}}
+		for _, reader := range readers {
+			publish(feedTopic(reader), "article", data)
+		}
+	}, articles.EventArticleCreated)
+
+	common.Subscribe(func(e common.Event) {
+		notification := e.Payload.(notifications.NotificationModel)
+		if !hub.Listening(notificationsTopic(notification.UserModelID)) {
+			return
+		}
+		var unread int
+		common.GetDB().Model(&notifications.NotificationModel{}).
+			Where("user_model_id = ? AND read_at IS NULL", notification.UserModelID).
+			Count(&unread)
+		publish(notificationsTopic(notification.UserModelID), "notification", gin.H{
+			"notification": gin.H{
+				"id":          notification.ID,
+				"type":        notification.Type,
+				"actorsCount": notification.ActorsCount,
+			},
+			"unreadCount": unread,
+		})
+	}, notifications.EventNotificationCreated)
+}
+
+// The user behind an article user, an empty user when there is none.
+func authorOf(articleUserID uint) users.UserModel {
+	var author users.UserModel
+	common.GetDB().
+		Joins("JOIN article_user_models ON article_user_models.user_model_id = user_models.id").
+		Where("article_user_models.id = ?", articleUserID).
+		First(&author)
+	return author
+}
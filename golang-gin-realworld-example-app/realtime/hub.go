@@ -0,0 +1,129 @@
+package realtime
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// A message for the subscribers of a topic, sent to clients as one server-sent event.
+type Message struct {
+	ID    uint64
+	Event string
+	Data  []byte
+}
+
+// A client's subscription to some topics. Messages arrive on C, which is closed when the subscription
+// ends. A subscriber which doesn't keep up is dropped instead of slowing down the publisher: its
+// buffer fills up, C is closed and Hub.Overflowed reports true.
+type Subscription struct {
+	C          <-chan Message
+	messages   chan Message
+	topics     []string
+	closed     bool
+	overflowed bool
+}
+
+// In-process pub/sub between the events of the models and the connected clients.
+// Publishing never blocks.
+type Hub struct {
+	mu      sync.Mutex
+	topics  map[string]map[*Subscription]bool
+	seq     uint64
+	dropped uint64
+}
+
+func NewHub() *Hub {
+	return &Hub{topics: map[string]map[*Subscription]bool{}}
+}
+
+// Subscribe to the topics, buffer is how many messages may wait for the client.
+func (h *Hub) Subscribe(buffer int, topics ...string) *Subscription {
+	messages := make(chan Message, buffer)
+	subscription := &Subscription{C: messages, messages: messages, topics: topics}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, topic := range topics {
+		if h.topics[topic] == nil {
+			h.topics[topic] = map[*Subscription]bool{}
+		}
+		h.topics[topic][subscription] = true
+	}
+	return subscription
+}
+
+// End a subscription, ending it twice is fine.
+func (h *Hub) Unsubscribe(subscription *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(subscription)
+}
+
+func (h *Hub) remove(subscription *Subscription) {
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	for _, topic := range subscription.topics {
+		delete(h.topics[topic], subscription)
+		if len(h.topics[topic]) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+	close(subscription.messages)
+}
+
+// Send an event with the JSON encoding of data to the subscribers of the topic.
+//
+//	hub.Publish(articleTopic(article.ID), "comment", gin.H{"comment": comment})
+func (h *Hub) Publish(topic, event string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	message := Message{ID: h.seq, Event: event, Data: body}
+	for subscription := range h.topics[topic] {
+		select {
+		case subscription.messages <- message:
+		default:
+			subscription.overflowed = true
+			h.remove(subscription)
+			h.dropped++
+		}
+	}
+	return nil
+}
+
+// Whether anyone subscribed to the topic, publishers can skip building messages nobody receives.
+func (h *Hub) Listening(topic string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.topics[topic]) > 0
+}
+
+// Whether the subscription ended because the client fell behind.
+func (h *Hub) Overflowed(subscription *Subscription) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return subscription.overflowed
+}
+
+// Connected subscriptions and subscriptions dropped for falling behind, for metrics.
+type HubStats struct {
+	Subscriptions int    `json:"subscriptions"`
+	Dropped       uint64 `json:"dropped"`
+}
+
+func (h *Hub) Stats() HubStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subscriptions := map[*Subscription]bool{}
+	for _, subscribers := range h.topics {
+		for subscription := range subscribers {
+			subscriptions[subscription] = true
+		}
+	}
+	return HubStats{Subscriptions: len(subscriptions), Dropped: h.dropped}
+}
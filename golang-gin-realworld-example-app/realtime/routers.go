@@ -0,0 +1,103 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How many messages may wait for a client before it is dropped as too slow, and how often a stream
+// gets a heartbeat so proxies keep it open and clients notice when the connection is gone.
+var (
+	SubscriberBuffer  = 64
+	HeartbeatInterval = 15 * time.Second
+)
+
+func StreamRegister(router *gin.RouterGroup) {
+	router.GET("/", Stream)
+}
+
+// A stream of server-sent events. It starts with a "ready" event and carries "comment", "removed" (a
+// comment), "favorites", "article", "deleted" and "notification" events with JSON data. A client which
+// falls behind gets an "overflow" event and the stream ends, it should refetch what it shows and reconnect.
+// EventSource can't send headers, the token may be passed as ?access_token=.
+func Stream(c *gin.Context) {
+	streamValidator := NewStreamValidator()
+	if err := streamValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("stream", err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if (streamValidator.Notifications || streamValidator.Feed) && myUserModel.ID == 0 {
+		c.JSON(http.StatusUnauthorized, common.NewError("stream", errors.New("sign in to follow notifications and the feed")))
+		return
+	}
+	var topics []string
+	for _, slug := range streamValidator.Articles {
+		articleModel, err := articles.FindOneArticle(&articles.ArticleModel{Slug: slug})
+		if err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+			return
+		}
+		topics = append(topics, articleTopic(articleModel.ID))
+	}
+	if streamValidator.Notifications {
+		topics = append(topics, notificationsTopic(myUserModel.ID))
+	}
+	if streamValidator.Feed {
+		topics = append(topics, feedTopic(myUserModel.ID))
+	}
+
+	subscription := hub.Subscribe(SubscriberBuffer, topics...)
+	defer hub.Unsubscribe(subscription)
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	ready, _ := json.Marshal(gin.H{
+		"articles":      streamValidator.Articles,
+		"notifications": streamValidator.Notifications,
+		"feed":          streamValidator.Feed,
+	})
+	writeEvent(c.Writer, Message{Event: "ready", Data: ready})
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case message, open := <-subscription.C:
+			if !open {
+				if hub.Overflowed(subscription) {
+					writeEvent(w, Message{Event: "overflow", Data: []byte("{}")})
+				}
+				return false
+			}
+			writeEvent(w, message)
+			return true
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// One event in the text/event-stream format, JSON data never spans lines.
+func writeEvent(w io.Writer, message Message) {
+	if message.ID != 0 {
+		fmt.Fprintf(w, "id: %d\n", message.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", message.Event, message.Data)
+}
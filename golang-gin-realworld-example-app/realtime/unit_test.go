@@ -0,0 +1,202 @@
+package realtime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/notifications"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() *gorm.DB {
+	db := common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	notifications.AutoMigrate()
+	return db
+}
+
+func TestHub(t *testing.T) {
+	asserts := assert.New(t)
+
+	hub := NewHub()
+	slow := hub.Subscribe(2, "a")
+	fast := hub.Subscribe(10, "a", "b")
+	asserts.True(hub.Listening("a"))
+	asserts.False(hub.Listening("c"))
+	asserts.Equal(2, hub.Stats().Subscriptions)
+
+	for i := 0; i < 3; i++ {
+		asserts.NoError(hub.Publish("a", "tick", i))
+	}
+	hub.Publish("b", "tock", "b")
+	hub.Publish("c", "lost", "nobody listens")
+
+	// The slow subscriber gets what fit into its buffer, then its channel is closed
+	var received []string
+	for message := range slow.C {
+		received = append(received, string(message.Data))
+	}
+	asserts.Equal([]string{"0", "1"}, received)
+	asserts.True(hub.Overflowed(slow))
+	asserts.Equal(HubStats{Subscriptions: 1, Dropped: 1}, hub.Stats())
+
+	// Everyone else isn't slowed down
+	received = nil
+	for i := 0; i < 4; i++ {
+		message := <-fast.C
+		received = append(received, message.Event+" "+string(message.Data))
+		if i > 0 {
+			asserts.True(message.ID > 1, "message ids grow")
+		}
+	}
+	asserts.Equal([]string{"tick 0", "tick 1", "tick 2", `tock "b"`}, received)
+	asserts.False(hub.Overflowed(fast))
+
+	hub.Unsubscribe(fast)
+	hub.Unsubscribe(fast)
+	_, open := <-fast.C
+	asserts.False(open)
+	asserts.False(hub.Listening("a"))
+	asserts.Equal(0, hub.Stats().Subscriptions)
+}
+
+type streamEvent struct {
+	Event string
+	Data  map[string]interface{}
+}
+
+func TestStream(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+	HeartbeatInterval = 20 * time.Millisecond
+	defer func() { HeartbeatInterval = 15 * time.Second }()
+
+	author := users.UserModel{Username: "streamauthor", Email: "streamauthor@test.com"}
+	reader := users.UserModel{Username: "streamreader", Email: "streamreader@test.com"}
+	test_db.Create(&author)
+	test_db.Create(&reader)
+	test_db.Create(&users.FollowModel{FollowingID: author.ID, FollowedByID: reader.ID})
+	authorModel := articles.GetArticleUserModel(author)
+	article := articles.ArticleModel{Slug: "streamed", Title: "Streamed", Author: authorModel}
+	test_db.Create(&article)
+
+	router := gin.New()
+	router.Use(users.AuthMiddleware(false))
+	StreamRegister(router.Group("/api/stream"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	code := func(query string) int {
+		response, err := http.Get(server.URL + "/api/stream/" + query)
+		asserts.NoError(err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	asserts.Equal(http.StatusUnprocessableEntity, code(""), "a stream needs a topic")
+	asserts.Equal(http.StatusNotFound, code("?article=missing"))
+	asserts.Equal(http.StatusUnauthorized, code("?feed=true"), "the feed needs a user")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/stream/?article=streamed&notifications=true&feed=true&access_token="+common.GenToken(reader.ID), nil)
+	response, err := http.DefaultClient.Do(request)
+	asserts.NoError(err)
+	defer response.Body.Close()
+	asserts.Equal(http.StatusOK, response.StatusCode)
+	asserts.Equal("text/event-stream", response.Header.Get("Content-Type"))
+
+	lines := bufio.NewReader(response.Body)
+	heartbeats := 0
+	next := func() streamEvent {
+		var event streamEvent
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == ": heartbeat":
+				heartbeats++
+			case strings.HasPrefix(line, "event: "):
+				event.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Data)
+			case line == "" && event.Event != "":
+				return event
+			}
+		}
+	}
+
+	ready := next()
+	asserts.Equal("ready", ready.Event)
+	asserts.Equal([]interface{}{"streamed"}, ready.Data["articles"])
+
+	comment := articles.CommentModel{ArticleID: article.ID, AuthorID: authorModel.ID, Body: "live"}
+	asserts.NoError(articles.CreateComment(&comment))
+	asserts.NoError(notifications.Notify(notifications.NotificationModel{UserModelID: reader.ID, Type: notifications.TypeFollow, ActorID: author.ID}))
+	asserts.NoError(articles.CreateArticle(&articles.ArticleModel{Slug: "fresh", Title: "Fresh", AuthorID: authorModel.ID}))
+
+	event := next()
+	asserts.Equal("comment", event.Event)
+	asserts.Equal("live", event.Data["comment"].(map[string]interface{})["body"])
+	asserts.Equal("streamauthor", event.Data["comment"].(map[string]interface{})["author"])
+	event = next()
+	asserts.Equal("notification", event.Event)
+	asserts.Equal(notifications.TypeFollow, event.Data["notification"].(map[string]interface{})["type"])
+	asserts.Equal(float64(1), event.Data["unreadCount"])
+	event = next()
+	asserts.Equal("article", event.Event)
+	asserts.Equal("fresh", event.Data["article"].(map[string]interface{})["slug"])
+	asserts.Equal("streamauthor", event.Data["article"].(map[string]interface{})["author"])
+
+	// Articles of authors the reader doesn't follow reach the feed by a followed tag, written as its alias
+	stranger := users.UserModel{Username: "streamstranger", Email: "streamstranger@test.com"}
+	test_db.Create(&stranger)
+	tagModel := articles.TagModel{Tag: "streamgo"}
+	test_db.Create(&tagModel)
+	asserts.NoError(tagModel.AddAlias("streamgolang"))
+	test_db.Create(&articles.TagFollowModel{UserModelID: reader.ID, TagModelID: tagModel.ID})
+	tagged, err := articles.FindTag("StreamGolang")
+	asserts.NoError(err)
+	strangerModel := articles.GetArticleUserModel(stranger)
+	asserts.NoError(articles.CreateArticle(&articles.ArticleModel{Slug: "untagged", Title: "Untagged", AuthorID: strangerModel.ID}))
+	asserts.NoError(articles.CreateArticle(&articles.ArticleModel{
+		Slug: "tagged", Title: "Tagged", AuthorID: strangerModel.ID, Tags: []articles.TagModel{tagged},
+	}))
+	event = next()
+	asserts.Equal("article", event.Event)
+	asserts.Equal("tagged", event.Data["article"].(map[string]interface{})["slug"])
+
+	// Idle streams get heartbeats
+	for heartbeats == 0 {
+		if line, _ := lines.ReadString('\n'); line == ": heartbeat\n" {
+			heartbeats++
+		}
+	}
+
+	// The subscription ends with the connection
+	cancel()
+	for i := 0; i < 100 && GetHub().Stats().Subscriptions > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	asserts.Equal(0, GetHub().Stats().Subscriptions)
+}
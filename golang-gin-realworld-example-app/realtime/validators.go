@@ -0,0 +1,29 @@
+package realtime
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Query string of a stream: ?article=<slug> for the comments and changes of articles (repeatable),
+// notifications=true for the user's notifications, feed=true for new articles of the authors they follow.
+type StreamValidator struct {
+	Articles      []string `form:"article"`
+	Notifications bool     `form:"notifications"`
+	Feed          bool     `form:"feed"`
+}
+
+func NewStreamValidator() StreamValidator {
+	return StreamValidator{}
+}
+
+func (s *StreamValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	if len(s.Articles) == 0 && !s.Notifications && !s.Feed {
+		return errors.New("nothing to subscribe to")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package seo
+
+import (
+	"time"
+
+	"realworld-backend/common"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A sitemap lists at most SitemapLimit URLs, bigger sites get a sitemap index pointing at several of them.
+var SitemapLimit = 50000
+
+// The two kinds of pages in the sitemaps.
+const (
+	SectionArticles = "articles"
+	SectionProfiles = "profiles"
+)
+
+var sections = []string{SectionArticles, SectionProfiles}
+
+// One URL of a sitemap: the slug or username it links to and when the page last changed. Users have no
+// timestamps, so profiles are listed without one.
+type sitemapEntry struct {
+	Name      string
+	UpdatedAt time.Time
+}
+
+// Every published article, and the profiles of users who published one. Both in id order so pages
+// of a section stay stable while new rows are added at the end.
+func sectionQuery(section string) *gorm.DB {
+	db := common.GetDB()
+	if section == SectionProfiles {
+		return db.Table("user_models").
+			Select("user_models.username AS name").
+			Joins("JOIN article_user_models ON article_user_models.user_model_id = user_models.id").
+			Where("article_user_models.deleted_at IS NULL AND article_user_models.articles_count > 0").
+			Order("user_models.id")
+	}
+	return db.Table("article_models").
+		Select("article_models.slug AS name, article_models.updated_at").
+		Where("article_models.deleted_at IS NULL").
+		Order("article_models.id")
+}
+
+func countSection(section string) (int, error) {
+	var count int
+	err := sectionQuery(section).Count(&count).Error
+	return count, err
+}
+
+// One page of a section, page counts from 1.
+func findSitemapEntries(section string, page int) ([]sitemapEntry, error) {
+	var entries []sitemapEntry
+	err := sectionQuery(section).Offset((page - 1) * SitemapLimit).Limit(SitemapLimit).Scan(&entries).Error
+	return entries, err
+}
+
+// When the latest page of a sitemap changed, zero for an empty one.
+func lastModified(entries []sitemapEntry) time.Time {
+	var updated time.Time
+	for _, entry := range entries {
+		if entry.UpdatedAt.After(updated) {
+			updated = entry.UpdatedAt
+		}
+	}
+	return updated
+}
+
+// When a page of a section last changed, without loading the page.
+func pageLastModified(section string, page int) (time.Time, error) {
+	var latest sitemapEntry
+	if section == SectionProfiles {
+		return latest.UpdatedAt, nil
+	}
+	paged := sectionQuery(section).Offset((page - 1) * SitemapLimit).Limit(SitemapLimit).SubQuery()
+	err := common.GetDB().Raw("SELECT page.name, page.updated_at FROM ? page ORDER BY page.updated_at DESC LIMIT 1", paged).
+		Scan(&latest).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return latest.UpdatedAt, nil
+	}
+	return latest.UpdatedAt, err
+}
+
+// How many sitemap pages a section needs.
+func pages(count int) int {
+	return (count + SitemapLimit - 1) / SitemapLimit
+}
@@ -0,0 +1,133 @@
+package seo
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Public routes at the root: /sitemap.xml, and the pages of the sitemap index at
+// /sitemaps/articles-1.xml, /sitemaps/profiles-1.xml...
+func SitemapRegister(router *gin.RouterGroup) {
+	router.GET("/sitemap.xml", Sitemap)
+	router.GET("/sitemaps/:file", SitemapPage)
+}
+
+// Routes below /api/seo, readable by everyone.
+func MetaRegister(router *gin.RouterGroup) {
+	router.GET("/articles/:slug", ArticleMeta)
+}
+
+func renderXML(c *gin.Context, document interface{}) {
+	body, err := xml.Marshal(document)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("xml", err))
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", append([]byte(xml.Header), body...))
+}
+
+// One sitemap with every URL while they fit, otherwise an index of the sitemap pages. Crawlers only
+// take the URLs of a sitemap on its own host, so the site serves the sitemaps at SITE_URL (proxied to
+// the API) and the index points there too.
+func Sitemap(c *gin.Context) {
+	counts := map[string]int{}
+	total := 0
+	for _, section := range sections {
+		count, err := countSection(section)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		counts[section] = count
+		total += count
+	}
+
+	if total <= SitemapLimit {
+		set := urlSet{XMLNS: sitemapNamespace, URLs: []sitemapURL{}}
+		for _, section := range sections {
+			entries, err := findSitemapEntries(section, 1)
+			if err != nil {
+				c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+				return
+			}
+			serializer := SitemapSerializer{c, section, entries}
+			set.URLs = append(set.URLs, serializer.Response()...)
+		}
+		renderXML(c, set)
+		return
+	}
+
+	index := sitemapIndex{XMLNS: sitemapNamespace, Sitemaps: []sitemapURL{}}
+	for _, section := range sections {
+		for page := 1; page <= pages(counts[section]); page++ {
+			updated, err := pageLastModified(section, page)
+			if err != nil {
+				c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+				return
+			}
+			index.Sitemaps = append(index.Sitemaps, sitemapURL{
+				Loc:     fmt.Sprintf("%s/sitemaps/%s-%d.xml", common.SiteBase(c), section, page),
+				LastMod: lastMod(updated),
+			})
+		}
+	}
+	renderXML(c, index)
+}
+
+// Split "articles-2.xml" into the section and the page.
+func parsePage(file string) (string, int, bool) {
+	name := strings.TrimSuffix(file, ".xml")
+	dash := strings.LastIndex(name, "-")
+	if name == file || dash < 0 {
+		return "", 0, false
+	}
+	section := name[:dash]
+	if section != SectionArticles && section != SectionProfiles {
+		return "", 0, false
+	}
+	page, err := strconv.Atoi(name[dash+1:])
+	if err != nil || page < 1 {
+		return "", 0, false
+	}
+	return section, page, true
+}
+
+func SitemapPage(c *gin.Context) {
+	section, page, ok := parsePage(c.Param("file"))
+	if !ok {
+		c.JSON(http.StatusNotFound, common.NewError("sitemap", errors.New("Invalid sitemap")))
+		return
+	}
+	entries, err := findSitemapEntries(section, page)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("sitemap", errors.New("Invalid sitemap")))
+		return
+	}
+	serializer := SitemapSerializer{c, section, entries}
+	renderXML(c, urlSet{XMLNS: sitemapNamespace, URLs: serializer.Response()})
+}
+
+// The metadata of an article, also found by a former slug. The canonical URL always has the current one.
+func ArticleMeta(c *gin.Context) {
+	articleModel, err := articles.FindArticleBySlug(c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	serializer := MetaSerializer{c, articleModel}
+	common.JSONWithETag(c, http.StatusOK, gin.H{"meta": serializer.Response()})
+}
@@ -0,0 +1,152 @@
+package seo
+
+import (
+	"encoding/xml"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+
+	"github.com/gin-gonic/gin"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type urlSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+func lastMod(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+type SitemapSerializer struct {
+	C       *gin.Context
+	Section string
+	Entries []sitemapEntry
+}
+
+func (s *SitemapSerializer) Response() []sitemapURL {
+	urls := []sitemapURL{}
+	for _, entry := range s.Entries {
+		loc := common.ArticleURL(s.C, entry.Name)
+		if s.Section == SectionProfiles {
+			loc = common.ProfileURL(s.C, entry.Name)
+		}
+		urls = append(urls, sitemapURL{Loc: loc, LastMod: lastMod(entry.UpdatedAt)})
+	}
+	return urls
+}
+
+// Length of the description made up from the body of articles without one.
+const excerptLength = 200
+
+var plainText = bluemonday.StrictPolicy()
+
+// The start of the rendered body as plain text, cut at a word.
+func excerpt(bodyHTML string) string {
+	text := strings.Join(strings.Fields(html.UnescapeString(plainText.Sanitize(bodyHTML))), " ")
+	if utf8.RuneCountInString(text) <= excerptLength {
+		return text
+	}
+	runes := []rune(text)[:excerptLength]
+	cut := string(runes)
+	if space := strings.LastIndex(cut, " "); space > 0 {
+		cut = cut[:space]
+	}
+	return cut + "…"
+}
+
+type MetaSerializer struct {
+	C *gin.Context
+	articles.ArticleModel
+}
+
+// What a page showing the article puts in its <head>: the plain values, and the same values as
+// OpenGraph and Twitter card properties ready to be written into <meta> tags.
+type MetaResponse struct {
+	Title         string            `json:"title"`
+	Description   string            `json:"description"`
+	CanonicalURL  string            `json:"canonicalUrl"`
+	Author        string            `json:"author"`
+	AuthorURL     string            `json:"authorUrl"`
+	Image         *string           `json:"image"`
+	PublishedTime string            `json:"publishedTime"`
+	ModifiedTime  string            `json:"modifiedTime"`
+	Tags          []string          `json:"tags"`
+	OpenGraph     map[string]string `json:"openGraph"`
+	Twitter       map[string]string `json:"twitter"`
+}
+
+func (s *MetaSerializer) Response() MetaResponse {
+	author := s.Author.UserModel
+	description := s.Description
+	if description == "" {
+		bodyHTML := s.BodyHTML
+		if bodyHTML == "" {
+			bodyHTML = common.RenderMarkdown(s.Body)
+		}
+		description = excerpt(bodyHTML)
+	}
+	response := MetaResponse{
+		Title:         s.Title,
+		Description:   description,
+		CanonicalURL:  common.ArticleURL(s.C, s.Slug),
+		Author:        author.Username,
+		AuthorURL:     common.ProfileURL(s.C, author.Username),
+		PublishedTime: s.CreatedAt.UTC().Format(time.RFC3339),
+		ModifiedTime:  s.UpdatedAt.UTC().Format(time.RFC3339),
+		Tags:          []string{},
+	}
+	if author.Image != nil && *author.Image != "" {
+		response.Image = author.Image
+	}
+	for _, tag := range s.Tags {
+		response.Tags = append(response.Tags, tag.Tag)
+	}
+
+	response.OpenGraph = map[string]string{
+		"og:type":                "article",
+		"og:site_name":           "Conduit",
+		"og:title":               response.Title,
+		"og:description":         response.Description,
+		"og:url":                 response.CanonicalURL,
+		"article:published_time": response.PublishedTime,
+		"article:modified_time":  response.ModifiedTime,
+		"article:author":         response.AuthorURL,
+	}
+	if len(response.Tags) > 0 {
+		// Repeated as one meta tag per tag, joined here to keep the map flat
+		response.OpenGraph["article:tag"] = strings.Join(response.Tags, ",")
+	}
+	response.Twitter = map[string]string{
+		"twitter:card":        "summary",
+		"twitter:title":       response.Title,
+		"twitter:description": response.Description,
+	}
+	if response.Image != nil {
+		response.OpenGraph["og:image"] = *response.Image
+		response.Twitter["twitter:image"] = *response.Image
+	}
+	return response
+}
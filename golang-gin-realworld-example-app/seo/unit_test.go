@@ -0,0 +1,170 @@
+package seo
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() *gorm.DB {
+	db := common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	return db
+}
+
+func TestExcerpt(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal("Title bold & more", excerpt(common.RenderMarkdown("# Title\n\n**bold** &amp; more")))
+	long := excerpt("<p>" + strings.Repeat("word ", 100) + "</p>")
+	asserts.True(strings.HasSuffix(long, "word…"), "long bodies are cut at a word")
+	asserts.LessOrEqual(len([]rune(long)), excerptLength+1)
+}
+
+func TestParsePage(t *testing.T) {
+	asserts := assert.New(t)
+
+	section, page, ok := parsePage("articles-12.xml")
+	asserts.True(ok)
+	asserts.Equal(SectionArticles, section)
+	asserts.Equal(12, page)
+	_, _, ok = parsePage("profiles-0.xml")
+	asserts.False(ok)
+	_, _, ok = parsePage("comments-1.xml")
+	asserts.False(ok)
+	_, _, ok = parsePage("articles-1.txt")
+	asserts.False(ok)
+}
+
+func TestSitemapAndMeta(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+	gin.SetMode(gin.TestMode)
+	defer func(limit int) { SitemapLimit = limit }(SitemapLimit)
+
+	image := "https://example.com/jake.png"
+	jake := users.UserModel{Username: "seojake", Email: "seojake@test.com", Image: &image}
+	lurker := users.UserModel{Username: "seolurker", Email: "seolurker@test.com"}
+	test_db.Create(&jake)
+	test_db.Create(&lurker)
+	articles.GetArticleUserModel(lurker)
+	jakeModel := articles.GetArticleUserModel(jake)
+	first := articles.ArticleModel{Slug: "seo-first", Title: "First", Description: "The first one", Body: "body",
+		AuthorID: jakeModel.ID, Tags: []articles.TagModel{{Tag: "seogo"}, {Tag: "seogin"}}}
+	asserts.NoError(articles.CreateArticle(&first))
+	second := articles.ArticleModel{Slug: "seo-second", Title: "Second", Body: "A **long** body\n\nwith paragraphs", AuthorID: jakeModel.ID}
+	asserts.NoError(articles.CreateArticle(&second))
+	gone := articles.ArticleModel{Slug: "seo-gone", Title: "Gone", AuthorID: jakeModel.ID}
+	asserts.NoError(articles.CreateArticle(&gone))
+	asserts.NoError(articles.DeleteArticleModel(&articles.ArticleModel{Slug: "seo-gone"}))
+
+	router := gin.New()
+	SitemapRegister(router.Group(""))
+	MetaRegister(router.Group("/api/seo"))
+	request := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	locs := func(urls []sitemapURL) []string {
+		names := []string{}
+		for _, url := range urls {
+			names = append(names, url.Loc)
+		}
+		return names
+	}
+
+	// Small sites get one sitemap with the published articles and the profiles of their authors
+	w := request("/sitemap.xml")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+	var set urlSet
+	asserts.NoError(xml.Unmarshal(w.Body.Bytes(), &set))
+	asserts.Equal([]string{
+		"http://example.com/article/seo-first",
+		"http://example.com/article/seo-second",
+		"http://example.com/profile/seojake",
+	}, locs(set.URLs))
+	asserts.NotEmpty(set.URLs[0].LastMod)
+
+	// Bigger ones get an index of sitemap pages
+	SitemapLimit = 1
+	w = request("/sitemap.xml")
+	asserts.Equal(http.StatusOK, w.Code)
+	var index sitemapIndex
+	asserts.NoError(xml.Unmarshal(w.Body.Bytes(), &index))
+	asserts.Equal([]string{
+		"http://example.com/sitemaps/articles-1.xml",
+		"http://example.com/sitemaps/articles-2.xml",
+		"http://example.com/sitemaps/profiles-1.xml",
+	}, locs(index.Sitemaps))
+	asserts.Equal(first.UpdatedAt.UTC().Format("2006-01-02T15:04:05Z07:00"), index.Sitemaps[0].LastMod)
+
+	// The pages are on SITE_URL like the URLs they list
+	common.SiteURL = "https://conduit.example.com/"
+	index = sitemapIndex{}
+	asserts.NoError(xml.Unmarshal(request("/sitemap.xml").Body.Bytes(), &index))
+	common.SiteURL = ""
+	asserts.Equal("https://conduit.example.com/sitemaps/articles-1.xml", index.Sitemaps[0].Loc)
+
+	set = urlSet{}
+	w = request("/sitemaps/articles-2.xml")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.NoError(xml.Unmarshal(w.Body.Bytes(), &set))
+	asserts.Equal([]string{"http://example.com/article/seo-second"}, locs(set.URLs))
+	asserts.Equal(http.StatusNotFound, request("/sitemaps/articles-3.xml").Code)
+	asserts.Equal(http.StatusNotFound, request("/sitemaps/tags-1.xml").Code)
+
+	// Metadata of an article, with the canonical URL on SITE_URL
+	common.SiteURL = "https://conduit.example.com"
+	defer func() { common.SiteURL = "" }()
+	meta := func(slug string) (int, MetaResponse) {
+		w := request("/api/seo/articles/" + slug)
+		var response struct{ Meta MetaResponse }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Meta
+	}
+	code, response := meta("seo-first")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("First", response.Title)
+	asserts.Equal("The first one", response.Description)
+	asserts.Equal("https://conduit.example.com/article/seo-first", response.CanonicalURL)
+	asserts.Equal("seojake", response.Author)
+	asserts.Equal("https://conduit.example.com/profile/seojake", response.AuthorURL)
+	asserts.Equal(image, *response.Image)
+	asserts.ElementsMatch([]string{"seogo", "seogin"}, response.Tags)
+	asserts.Equal("article", response.OpenGraph["og:type"])
+	asserts.Equal(response.CanonicalURL, response.OpenGraph["og:url"])
+	asserts.Equal(image, response.OpenGraph["og:image"])
+	asserts.Equal(response.PublishedTime, response.OpenGraph["article:published_time"])
+	asserts.Equal("summary", response.Twitter["twitter:card"])
+	asserts.Equal("The first one", response.Twitter["twitter:description"])
+
+	code, response = meta("seo-second")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal("A long body with paragraphs", response.Description, "articles without a description use their body")
+
+	asserts.NoError(second.Update(articles.ArticleModel{Slug: "seo-renamed"}))
+	test_db.Create(&articles.SlugHistoryModel{Slug: "seo-second", ArticleID: second.ID})
+	code, response = meta("seo-second")
+	asserts.Equal(http.StatusOK, code, "former slugs still find the article")
+	asserts.Equal("https://conduit.example.com/article/seo-renamed", response.CanonicalURL)
+
+	code, _ = meta("seo-gone")
+	asserts.Equal(http.StatusNotFound, code)
+}
@@ -0,0 +1,28 @@
+package users
+
+import (
+	"realworld-backend/common"
+	"strconv"
+	"time"
+)
+
+// How long a cached profile is served at most, follows and profile updates drop it right away.
+var ProfileCacheTTL = 30 * time.Second
+
+const profileKeyBase = "profile:"
+
+// Profiles are cached per viewer since they tell whether the viewer follows the user.
+func profileCacheKey(username string, viewerID uint) string {
+	return profileKeyBase + username + ":" + strconv.FormatUint(uint64(viewerID), 10)
+}
+
+func init() {
+	common.Subscribe(func(e common.Event) {
+		common.GetCache().DeletePrefix(profileKeyBase + e.Payload.(FollowModel).Following.Username + ":")
+	}, EventUserFollowed, EventUserUnfollowed)
+
+	// The username may have changed, so the old key is unknown.
+	common.Subscribe(func(e common.Event) {
+		common.GetCache().DeletePrefix(profileKeyBase)
+	}, EventUserUpdated)
+}
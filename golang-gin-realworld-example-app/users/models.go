@@ -18,7 +18,24 @@ type UserModel struct {
 	Email        string  `gorm:"column:email;unique_index"`
 	Bio          string  `gorm:"column:bio;size:1024"`
 	Image        *string `gorm:"column:image"`
-	PasswordHash string  `gorm:"column:password;not null"`
+	PasswordHash string  `gorm:"column:password;not null" json:"-"`
+	Role         string  `gorm:"column:role"`
+}
+
+// Roles granting more than a regular user, who has no role. Roles are assigned in the database.
+const (
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// You could check whether userModel may moderate content of other users
+// 	if userModel.IsModerator() { ... }
+func (u UserModel) IsModerator() bool {
+	return u.Role == RoleModerator || u.Role == RoleAdmin
+}
+
+func (u UserModel) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
 
 // A hack way to save ManyToMany relationship,
@@ -39,12 +56,38 @@ type FollowModel struct {
 	FollowedByID uint
 }
 
+// Counters maintained by following and unFollowing, so nobody has to count follow_models rows.
+// They live in their own table, a user's row is created by the first follow that touches it.
+//
+// Recompute them from follow_models with ReconcileCounters.
+type UserStatsModel struct {
+	UserModelID    uint `gorm:"primary_key;auto_increment:false"`
+	FollowersCount uint `gorm:"column:followers_count;not null;default:0"`
+	FollowingCount uint `gorm:"column:following_count;not null;default:0"`
+}
+
+// Events recorded with a change to users and dispatched once it is committed, see common.Record.
+// The follow events carry a FollowModel with Following and FollowedBy filled in, EventUserUpdated the UserModel.
+// Payloads never contain the password hash.
+const (
+	EventUserUpdated    = "user.updated"
+	EventUserFollowed   = "user.followed"
+	EventUserUnfollowed = "user.unfollowed"
+)
+
+func init() {
+	common.RegisterEvent(EventUserUpdated, UserModel{})
+	common.RegisterEvent(EventUserFollowed, FollowModel{})
+	common.RegisterEvent(EventUserUnfollowed, FollowModel{})
+}
+
 // Migrate the schema of database if needed
 func AutoMigrate() {
 	db := common.GetDB()
 
 	db.AutoMigrate(&UserModel{})
 	db.AutoMigrate(&FollowModel{})
+	db.AutoMigrate(&UserStatsModel{})
 }
 
 // What's bcrypt? https://en.wikipedia.org/wiki/Bcrypt
@@ -90,21 +133,107 @@ func SaveOne(data interface{}) error {
 // You could update properties of an UserModel to database returning with error info.
 //  err := db.Model(userModel).Update(UserModel{Username: "wangzitian0"}).Error
 func (model *UserModel) Update(data interface{}) error {
+	return model.update(data, false)
+}
+
+// Update the user unless it was written since it was loaded, for writes made with If-Match.
+// Returns common.ErrPreconditionFailed when the row changed in between.
+func (model *UserModel) UpdateUnmodified(data interface{}) error {
+	return model.update(data, true)
+}
+
+// The version of the user for If-Match. User rows have no updated_at, the version is made of the
+// columns a user edits.
+func (model UserModel) Version() string {
+	var image interface{}
+	if model.Image != nil {
+		image = *model.Image
+	}
+	return common.Version(model.ID, model.Username, model.Email, model.Bio, image, model.PasswordHash)
+}
+
+// Restrict a query to the row as it was loaded.
+func (model UserModel) unmodified(db *gorm.DB) *gorm.DB {
+	db = db.Where("id = ? AND username = ? AND email = ? AND bio = ? AND password = ?",
+		model.ID, model.Username, model.Email, model.Bio, model.PasswordHash)
+	if model.Image == nil {
+		return db.Where("image IS NULL")
+	}
+	return db.Where("image = ?", *model.Image)
+}
+
+func (model *UserModel) update(data interface{}, unmodified bool) error {
 	db := common.GetDB()
-	err := db.Model(model).Update(data).Error
-	return err
+	tx := db.Begin()
+	loaded := *model
+	query := tx.Model(model)
+	if unmodified {
+		query = loaded.unmodified(query)
+	}
+	result := query.Update(data)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if unmodified && result.RowsAffected == 0 {
+		// Nothing is written when nothing changed, the precondition fails only when the row did
+		var count int
+		if err := loaded.unmodified(tx.Model(&UserModel{})).Count(&count).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if count == 0 {
+			tx.Rollback()
+			return common.ErrPreconditionFailed
+		}
+	}
+	if err := common.Record(tx, common.Event{Name: EventUserUpdated, Payload: *model}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
 }
 
 // You could add a following relationship as userModel1 following userModel2
 // 	err = userModel1.following(userModel2)
 func (u UserModel) following(v UserModel) error {
 	db := common.GetDB()
+	tx := db.Begin()
 	var follow FollowModel
-	err := db.FirstOrCreate(&follow, &FollowModel{
+	query := tx.Where(&FollowModel{
 		FollowingID:  v.ID,
 		FollowedByID: u.ID,
-	}).Error
-	return err
+	}).First(&follow)
+	if query.Error != nil && !query.RecordNotFound() {
+		tx.Rollback()
+		return query.Error
+	}
+	if follow.ID != 0 {
+		return tx.Commit().Error
+	}
+	follow = FollowModel{FollowingID: v.ID, FollowedByID: u.ID}
+	if err := tx.Create(&follow).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := adjustFollowCounts(tx, u.ID, v.ID, 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	follow.Following, follow.FollowedBy = v, u
+	if err := common.Record(tx, common.Event{Name: EventUserFollowed, Payload: follow}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
 }
 
 // You could check whether  userModel1 following userModel2
@@ -123,11 +252,79 @@ func (u UserModel) isFollowing(v UserModel) bool {
 // 	err = userModel1.unFollowing(userModel2)
 func (u UserModel) unFollowing(v UserModel) error {
 	db := common.GetDB()
-	err := db.Where(FollowModel{
+	tx := db.Begin()
+	deleted := tx.Where(FollowModel{
 		FollowingID:  v.ID,
 		FollowedByID: u.ID,
-	}).Delete(FollowModel{}).Error
-	return err
+	}).Delete(FollowModel{})
+	if deleted.Error != nil {
+		tx.Rollback()
+		return deleted.Error
+	}
+	if deleted.RowsAffected == 0 {
+		return tx.Commit().Error
+	}
+	if err := adjustFollowCounts(tx, u.ID, v.ID, -deleted.RowsAffected); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := common.Record(tx, common.Event{Name: EventUserUnfollowed, Payload: FollowModel{
+		Following: v, FollowingID: v.ID, FollowedBy: u, FollowedByID: u.ID,
+	}})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	common.Dispatch()
+	return nil
+}
+
+// Add delta to the following count of the follower and to the followers count of the followed user.
+func adjustFollowCounts(tx *gorm.DB, followerID, followingID uint, delta int64) error {
+	for _, id := range []uint{followerID, followingID} {
+		if err := tx.FirstOrCreate(&UserStatsModel{}, UserStatsModel{UserModelID: id}).Error; err != nil {
+			return err
+		}
+	}
+	err := common.AdjustCounter(tx, "user_stats_models", "user_model_id", followerID, "following_count", delta)
+	if err != nil {
+		return err
+	}
+	return common.AdjustCounter(tx, "user_stats_models", "user_model_id", followingID, "followers_count", delta)
+}
+
+// You could read the follower and following counts of userModel, zero for users nobody followed yet
+// 	stats := userModel.Stats()
+func (u UserModel) Stats() UserStatsModel {
+	db := common.GetDB()
+	stats := UserStatsModel{UserModelID: u.ID}
+	db.Where(&UserStatsModel{UserModelID: u.ID}).First(&stats)
+	return stats
+}
+
+// Recompute the follower and following counts of every user from follow_models.
+//
+//	err := users.ReconcileCounters(db)
+func ReconcileCounters(db *gorm.DB) error {
+	tx := db.Begin()
+	statements := []string{
+		"DELETE FROM user_stats_models",
+		`INSERT INTO user_stats_models (user_model_id, followers_count, following_count)
+			SELECT user_models.id,
+				(SELECT COUNT(*) FROM follow_models WHERE follow_models.following_id = user_models.id AND follow_models.deleted_at IS NULL),
+				(SELECT COUNT(*) FROM follow_models WHERE follow_models.followed_by_id = user_models.id AND follow_models.deleted_at IS NULL)
+			FROM user_models`,
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
 }
 
 // You could get a following list of userModel
@@ -148,3 +345,23 @@ func (u UserModel) GetFollowings() []UserModel {
 	tx.Commit()
 	return followings
 }
+
+// You could check which of many users userModel1 is following with a single query,
+// every id is in the result, the ones that aren't followed map to false
+// 	following := myUserModel.FollowingSet([]uint{2, 3, 5})
+func (u UserModel) FollowingSet(ids []uint) map[uint]bool {
+	following := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		following[id] = false
+	}
+	if u.ID == 0 || len(ids) == 0 {
+		return following
+	}
+	db := common.GetDB()
+	var follows []FollowModel
+	db.Where("followed_by_id = ? AND following_id IN (?)", u.ID, ids).Find(&follows)
+	for _, follow := range follows {
+		following[follow.FollowingID] = true
+	}
+	return following
+}
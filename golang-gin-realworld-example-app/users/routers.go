@@ -25,13 +25,15 @@ func ProfileRegister(router *gin.RouterGroup) {
 
 func ProfileRetrieve(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
-	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
-		return
-	}
-	profileSerializer := ProfileSerializer{c, userModel}
-	c.JSON(http.StatusOK, gin.H{"profile": profileSerializer.Response()})
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	common.ServeCachedJSON(c, profileCacheKey(username, myUserModel.ID), ProfileCacheTTL, func() (int, interface{}) {
+		userModel, err := FindOneUser(&UserModel{Username: username})
+		if err != nil {
+			return http.StatusNotFound, common.NewError("profile", errors.New("Invalid username"))
+		}
+		profileSerializer := ProfileSerializer{c, userModel}
+		return http.StatusOK, gin.H{"profile": profileSerializer.Response()}
+	})
 }
 
 func ProfileFollow(c *gin.Context) {
@@ -109,11 +111,17 @@ func UsersLogin(c *gin.Context) {
 
 func UserRetrieve(c *gin.Context) {
 	serializer := UserSerializer{c}
+	c.Header("ETag", serializer.ETag())
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
 
 func UserUpdate(c *gin.Context) {
 	myUserModel := c.MustGet("my_user_model").(UserModel)
+	// The write checks the version again, so a change made after the check isn't overwritten
+	conditional := c.GetHeader("If-Match") != ""
+	if !common.CheckIfMatch(c, myUserModel.Version) {
+		return
+	}
 	userModelValidator := NewUserModelValidatorFillWith(myUserModel)
 	if err := userModelValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
@@ -121,11 +129,19 @@ func UserUpdate(c *gin.Context) {
 	}
 
 	userModelValidator.userModel.ID = myUserModel.ID
-	if err := myUserModel.Update(userModelValidator.userModel); err != nil {
+	update := myUserModel.Update
+	if conditional {
+		update = myUserModel.UpdateUnmodified
+	}
+	if err := update(userModelValidator.userModel); errors.Is(err, common.ErrPreconditionFailed) {
+		common.PreconditionFailed(c)
+		return
+	} else if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
 	UpdateContextUserModel(c, myUserModel.ID)
 	serializer := UserSerializer{c}
+	c.Header("ETag", serializer.ETag())
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
@@ -20,19 +20,52 @@ type ProfileResponse struct {
 	Following bool    `json:"following"`
 }
 
+// Serializers of lists load the following state of all their profiles at once with PreloadFollowing,
+// ProfileSerializer reads it from the context instead of running a query per profile.
+const followingKey = "following_set"
+
+// Load whether the current user follows each of the users with a single query.
+//
+//	users.PreloadFollowing(c, authorIDs)
+func PreloadFollowing(c *gin.Context, ids []uint) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	following := myUserModel.FollowingSet(ids)
+	if loaded, ok := c.Get(followingKey); ok {
+		for id, followed := range loaded.(map[uint]bool) {
+			if _, ok := following[id]; !ok {
+				following[id] = followed
+			}
+		}
+	}
+	c.Set(followingKey, following)
+}
+
 // Put your response logic including wrap the userModel here.
 func (self *ProfileSerializer) Response() ProfileResponse {
 	myUserModel := self.C.MustGet("my_user_model").(UserModel)
 	profile := ProfileResponse{
-		ID:        self.ID,
-		Username:  self.Username,
-		Bio:       self.Bio,
-		Image:     self.Image,
-		Following: myUserModel.isFollowing(self.UserModel),
+		ID:       self.ID,
+		Username: self.Username,
+		Bio:      self.Bio,
+		Image:    self.Image,
+	}
+	if followed, ok := self.preloadedFollowing(); ok {
+		profile.Following = followed
+	} else {
+		profile.Following = myUserModel.isFollowing(self.UserModel)
 	}
 	return profile
 }
 
+func (self *ProfileSerializer) preloadedFollowing() (bool, bool) {
+	loaded, ok := self.C.Get(followingKey)
+	if !ok {
+		return false, false
+	}
+	followed, ok := loaded.(map[uint]bool)[self.ID]
+	return followed, ok
+}
+
 type UserSerializer struct {
 	c *gin.Context
 }
@@ -45,6 +78,13 @@ type UserResponse struct {
 	Token    string  `json:"token"`
 }
 
+// The ETag of the current user is its version, the token changes with every response.
+// Only If-Match uses it, GET /api/user is never answered with 304 so clients always get a token.
+func (self *UserSerializer) ETag() string {
+	myUserModel := self.c.MustGet("my_user_model").(UserModel)
+	return `"` + myUserModel.Version() + `"`
+}
+
 func (self *UserSerializer) Response() UserResponse {
 	myUserModel := self.c.MustGet("my_user_model").(UserModel)
 	user := UserResponse{
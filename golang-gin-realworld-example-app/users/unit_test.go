@@ -455,6 +455,118 @@ var unauthRequestTests = []struct {
 	},
 }
 
+func TestFollowCounters(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(3)
+	a, b, c := users[0], users[1], users[2]
+	asserts.Equal(UserStatsModel{UserModelID: b.ID}, b.Stats(), "Users nobody followed have zero counts")
+
+	asserts.NoError(a.following(b))
+	asserts.NoError(a.following(b), "Following twice shouldn't count twice")
+	asserts.NoError(c.following(b))
+	asserts.NoError(a.following(c))
+	asserts.Equal(uint(2), a.Stats().FollowingCount)
+	asserts.Equal(uint(2), b.Stats().FollowersCount)
+	asserts.Equal(uint(0), b.Stats().FollowingCount)
+	asserts.Equal(uint(1), c.Stats().FollowersCount)
+
+	asserts.NoError(a.unFollowing(b))
+	asserts.NoError(a.unFollowing(b), "Unfollowing twice shouldn't count twice")
+	asserts.Equal(uint(1), a.Stats().FollowingCount)
+	asserts.Equal(uint(1), b.Stats().FollowersCount)
+
+	test_db.Model(&UserStatsModel{}).Where("user_model_id = ?", b.ID).UpdateColumn("followers_count", 42)
+	test_db.Where(&UserStatsModel{UserModelID: c.ID}).Delete(&UserStatsModel{})
+	asserts.NoError(ReconcileCounters(test_db))
+	asserts.Equal(uint(1), b.Stats().FollowersCount, "Reconciling should fix drifted counts")
+	asserts.Equal(uint(1), c.Stats().FollowersCount, "Reconciling should restore missing counts")
+	asserts.Equal(uint(1), c.Stats().FollowingCount)
+}
+
+func TestProfileCaching(t *testing.T) {
+	asserts := assert.New(t)
+	gin.SetMode(gin.TestMode)
+
+	users := userModelMocker(2)
+	viewer, profile := users[0], users[1]
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", viewer)
+		c.Next()
+	})
+	router.GET("/profiles/:username", ProfileRetrieve)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/profiles/"+profile.Username, nil))
+		return w
+	}
+
+	asserts.Equal("MISS", get().Header().Get("X-Cache"))
+	asserts.Equal("HIT", get().Header().Get("X-Cache"))
+
+	viewer.following(profile)
+	w := get()
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "Following should drop the cached profile")
+	asserts.Contains(w.Body.String(), `"following":true`)
+
+	viewer.unFollowing(profile)
+	w = get()
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "Unfollowing should drop the cached profile")
+	asserts.Contains(w.Body.String(), `"following":false`)
+
+	profile.Update(UserModel{Bio: "changed"})
+	w = get()
+	asserts.Equal("MISS", w.Header().Get("X-Cache"), "Updating the user should drop the cached profile")
+	asserts.Contains(w.Body.String(), `"bio":"changed"`)
+}
+
+func TestUserConditionalUpdate(t *testing.T) {
+	asserts := assert.New(t)
+	gin.SetMode(gin.TestMode)
+
+	me := userModelMocker(1)[0]
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		UpdateContextUserModel(c, me.ID)
+		c.Next()
+	})
+	router.GET("/user", UserRetrieve)
+	router.PUT("/user", UserUpdate)
+	request := func(method, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/user", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	read := request("GET", "", "").Header().Get("ETag")
+	asserts.NotEmpty(read)
+	asserts.Equal(read, request("GET", "", "").Header().Get("ETag"), "The ETag shouldn't change with the token")
+
+	w := request("PUT", `{"user":{"bio":"first"}}`, read)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.NotEqual(read, w.Header().Get("ETag"))
+	asserts.Equal(w.Header().Get("ETag"), request("GET", "", "").Header().Get("ETag"))
+
+	w = request("PUT", `{"user":{"bio":"second"}}`, read)
+	asserts.Equal(http.StatusPreconditionFailed, w.Code, "An update based on a stale read should be refused")
+	updated, _ := FindOneUser(&UserModel{ID: me.ID})
+	asserts.Equal("first", updated.Bio)
+
+	// Two edits of the same read, the second finds the row changed inside its write
+	first, _ := FindOneUser(&UserModel{ID: me.ID})
+	second, _ := FindOneUser(&UserModel{ID: me.ID})
+	asserts.NoError(first.UpdateUnmodified(UserModel{Bio: "won"}))
+	asserts.Equal(common.ErrPreconditionFailed, second.UpdateUnmodified(UserModel{Bio: "lost"}))
+	updated, _ = FindOneUser(&UserModel{ID: me.ID})
+	asserts.Equal("won", updated.Bio)
+}
+
 func TestWithoutAuth(t *testing.T) {
 	asserts := assert.New(t)
 	//You could write the reset database code here if you want to create a database for this block
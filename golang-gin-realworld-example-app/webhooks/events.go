@@ -0,0 +1,77 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+)
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.999Z")
+}
+
+// Every delivery has the same envelope: the id of the event, the event, when it happened and the
+// data of the event. Events are delivered at least once, receivers can drop an id they have seen.
+func queue(e common.Event, authorID uint, data gin.H) error {
+	payload, err := json.Marshal(gin.H{
+		"id":        e.ID,
+		"event":     e.Name,
+		"createdAt": timestamp(time.Now()),
+		"data":      data,
+	})
+	if err != nil {
+		return err
+	}
+	return enqueue(e.Name, authorID, payload)
+}
+
+// Deliveries are queued from the events of the articles package, the worker sends them.
+func init() {
+	common.Handle(func(e common.Event) error {
+		article := e.Payload.(articles.ArticleModel)
+		author := authorOf(article.AuthorID)
+		tags := []string{}
+		for _, tag := range article.Tags {
+			tags = append(tags, tag.Tag)
+		}
+		return queue(e, author.ID, gin.H{"article": gin.H{
+			"slug":        article.Slug,
+			"title":       article.Title,
+			"description": article.Description,
+			"tagList":     tags,
+			"author":      author.Username,
+			"updatedAt":   timestamp(article.UpdatedAt),
+		}})
+	}, articles.EventArticleCreated, articles.EventArticleUpdated, articles.EventArticleDeleted)
+
+	common.Handle(func(e common.Event) error {
+		comment := e.Payload.(articles.CommentModel)
+		var article articles.ArticleModel
+		common.GetDB().Unscoped().First(&article, comment.ArticleID)
+		return queue(e, authorOf(article.AuthorID).ID, gin.H{
+			"article": gin.H{"slug": article.Slug, "title": article.Title},
+			"comment": gin.H{
+				"id":        comment.ID,
+				"parentId":  comment.ParentID,
+				"body":      comment.Body,
+				"author":    authorOf(comment.AuthorID).Username,
+				"createdAt": timestamp(comment.CreatedAt),
+			},
+		})
+	}, articles.EventCommentCreated, articles.EventCommentDeleted)
+}
+
+// The user behind an article user, an empty user when there is none.
+func authorOf(articleUserID uint) users.UserModel {
+	var author users.UserModel
+	common.GetDB().
+		Joins("JOIN article_user_models ON article_user_models.user_model_id = user_models.id").
+		Where("article_user_models.id = ?", articleUserID).
+		First(&author)
+	return author
+}
@@ -0,0 +1,350 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/jobs"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The events a webhook can subscribe to.
+var Events = []string{
+	articles.EventArticleCreated,
+	articles.EventArticleUpdated,
+	articles.EventArticleDeleted,
+	articles.EventCommentCreated,
+	articles.EventCommentDeleted,
+}
+
+var ErrUnknownEvent = errors.New("unknown event")
+
+// Delivery states: pending deliveries are (re)tried once NextAttemptAt has passed, failed ones gave up
+// after MaxAttempts.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Deliveries are sent by jobs of the Queue queue, which back off like every job.
+const (
+	Queue      = "webhooks"
+	deliverJob = "webhooks.deliver"
+)
+
+// A delivery gives up after MaxAttempts. A receiver has to answer within DeliveryTimeout.
+var (
+	MaxAttempts     = 8
+	DeliveryTimeout = 10 * time.Second
+)
+
+// An endpoint which is sent the events it subscribed to, no events means all of them.
+// Webhooks of regular users only hear about their own articles, webhooks registered by an admin
+// about all articles (AllArticles).
+type WebhookModel struct {
+	gorm.Model
+	OwnerID     uint `gorm:"index"`
+	URL         string
+	Secret      string
+	Events      string
+	AllArticles bool
+	Active      bool
+}
+
+// One event sent to a webhook, kept as the delivery log. Payload is the exact body sent, so a
+// redelivery sends the same event again.
+type WebhookDeliveryModel struct {
+	gorm.Model
+	WebhookID     uint `gorm:"index"`
+	Event         string
+	Payload       string `gorm:"type:text"`
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	ResponseCode  int
+	LastError     string
+	DeliveredAt   *time.Time
+}
+
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&WebhookModel{})
+	db.AutoMigrate(&WebhookDeliveryModel{})
+}
+
+func (webhook WebhookModel) events() []string {
+	if webhook.Events == "" {
+		return []string{}
+	}
+	return strings.Split(webhook.Events, ",")
+}
+
+func (webhook WebhookModel) wants(event string) bool {
+	if webhook.Events == "" {
+		return true
+	}
+	for _, name := range webhook.events() {
+		if name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the names of an event filter and join them for storage.
+func joinEvents(events []string) (string, error) {
+	var known []string
+	seen := map[string]bool{}
+	for _, event := range events {
+		valid := false
+		for _, name := range Events {
+			valid = valid || name == event
+		}
+		if !valid {
+			return "", ErrUnknownEvent
+		}
+		if !seen[event] {
+			seen[event] = true
+			known = append(known, event)
+		}
+	}
+	return strings.Join(known, ","), nil
+}
+
+// The webhooks of a user, oldest first.
+func FindWebhooks(ownerID uint) ([]WebhookModel, error) {
+	db := common.GetDB()
+	var webhooks []WebhookModel
+	err := db.Where("owner_id = ?", ownerID).Order("id").Find(&webhooks).Error
+	return webhooks, err
+}
+
+// A webhook of the user, gorm.ErrRecordNotFound for webhooks of someone else.
+func FindWebhook(ownerID, id uint) (WebhookModel, error) {
+	db := common.GetDB()
+	var webhook WebhookModel
+	err := db.Where("owner_id = ? AND id = ?", ownerID, id).First(&webhook).Error
+	return webhook, err
+}
+
+// Register a webhook with a new secret. Admins get the events of all articles.
+func CreateWebhook(webhook *WebhookModel, admin bool) error {
+	db := common.GetDB()
+	webhook.Secret = newSecret()
+	webhook.AllArticles = admin
+	return db.Create(webhook).Error
+}
+
+func (webhook *WebhookModel) Update(data WebhookModel) error {
+	db := common.GetDB()
+	return db.Model(webhook).Updates(map[string]interface{}{
+		"url":    data.URL,
+		"events": data.Events,
+		"active": data.Active,
+	}).Error
+}
+
+// Delete a webhook with its delivery log, deliveries still pending are dropped.
+func DeleteWebhook(webhook WebhookModel) error {
+	tx := common.GetDB().Begin()
+	if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&WebhookDeliveryModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(&webhook).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// The delivery log of a webhook, newest first.
+func FindDeliveries(webhookID uint, limit, offset int) ([]WebhookDeliveryModel, int, error) {
+	db := common.GetDB()
+	var deliveries []WebhookDeliveryModel
+	var count int
+	query := db.Model(&WebhookDeliveryModel{}).Where("webhook_id = ?", webhookID)
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("id DESC").Limit(limit).Offset(offset).Find(&deliveries).Error
+	return deliveries, count, err
+}
+
+func FindDelivery(webhookID, id uint) (WebhookDeliveryModel, error) {
+	db := common.GetDB()
+	var delivery WebhookDeliveryModel
+	err := db.Where("webhook_id = ? AND id = ?", webhookID, id).First(&delivery).Error
+	return delivery, err
+}
+
+// A random secret to sign the deliveries of a webhook with.
+func newSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// The X-Webhook-Signature of a body: "sha256=" and the hex HMAC-SHA256 of the body keyed with the secret.
+// Receivers compute it the same way and compare in constant time.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queue an event for every active webhook which wants it. authorID is the user model id of the
+// author of the article the event is about.
+func enqueue(event string, authorID uint, payload []byte) error {
+	db := common.GetDB()
+	var webhooks []WebhookModel
+	if err := db.Where("active = ? AND (all_articles = ? OR owner_id = ?)", true, true, authorID).Find(&webhooks).Error; err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if !webhook.wants(event) {
+			continue
+		}
+		if _, err := createDelivery(webhook.ID, event, string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queue the payload of a delivery once more, as a new delivery.
+func Redeliver(delivery WebhookDeliveryModel) (WebhookDeliveryModel, error) {
+	return createDelivery(delivery.WebhookID, delivery.Event, delivery.Payload)
+}
+
+// Save a pending delivery together with the job which sends it.
+func createDelivery(webhookID uint, event string, payload string) (WebhookDeliveryModel, error) {
+	delivery := WebhookDeliveryModel{
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       payload,
+		Status:        StatusPending,
+		NextAttemptAt: time.Now(),
+	}
+	tx := common.GetDB().Begin()
+	if err := tx.Create(&delivery).Error; err != nil {
+		tx.Rollback()
+		return delivery, err
+	}
+	options := jobs.EnqueueOptions{Queue: Queue, MaxAttempts: MaxAttempts}
+	if _, err := jobs.Enqueue(tx, deliverJob, deliveryJob{DeliveryID: delivery.ID}, options); err != nil {
+		tx.Rollback()
+		return delivery, err
+	}
+	return delivery, tx.Commit().Error
+}
+
+type deliveryJob struct {
+	DeliveryID uint `json:"deliveryId"`
+}
+
+func init() {
+	jobs.Register(deliverJob, deliver)
+}
+
+// Deliveries never reach private addresses, whatever the host name of the webhook resolves to.
+var client = common.NewPublicClient(0)
+
+// Send a delivery once and record the outcome. The job fails while the receiver does, so the job queue
+// retries it; a delivery which was dead and is retried from the jobs command is sent again as well.
+func deliver(ctx context.Context, job jobs.Job) error {
+	var payload deliveryJob
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	db := common.GetDB()
+	var delivery WebhookDeliveryModel
+	query := db.First(&delivery, payload.DeliveryID)
+	if query.RecordNotFound() {
+		// Deleted together with its webhook
+		return nil
+	}
+	if query.Error != nil {
+		return query.Error
+	}
+	if delivery.Status == StatusDelivered {
+		return nil
+	}
+	var webhook WebhookModel
+	if err := db.First(&webhook, delivery.WebhookID).Error; err != nil {
+		return db.Model(&delivery).Updates(map[string]interface{}{
+			"status": StatusFailed, "last_error": "webhook deleted",
+		}).Error
+	}
+
+	delivery.Attempts++
+	delivery.Status, delivery.ResponseCode, delivery.LastError = StatusPending, 0, ""
+	code, err := send(ctx, webhook, delivery)
+	delivery.ResponseCode = code
+	switch {
+	case err == nil && code >= 200 && code < 300:
+		delivery.Status = StatusDelivered
+		delivered := time.Now()
+		delivery.DeliveredAt = &delivered
+	case job.LastAttempt():
+		delivery.Status = StatusFailed
+	default:
+		delivery.NextAttemptAt = job.RetryAt
+	}
+	if err == nil && delivery.Status != StatusDelivered {
+		err = fmt.Errorf("unexpected status %d", code)
+	}
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+	update := db.Model(&delivery).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"response_code":   delivery.ResponseCode,
+		"last_error":      delivery.LastError,
+		"delivered_at":    delivery.DeliveredAt,
+	})
+	if update.Error != nil {
+		return update.Error
+	}
+	return err
+}
+
+// POST the payload, signed with the secret of the webhook. Returns the response status.
+func send(ctx context.Context, webhook WebhookModel, delivery WebhookDeliveryModel) (int, error) {
+	body := []byte(delivery.Payload)
+	ctx, cancel := context.WithTimeout(ctx, DeliveryTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "realworld-webhooks")
+	request.Header.Set("X-Webhook-Event", delivery.Event)
+	request.Header.Set("X-Webhook-Delivery", fmt.Sprint(delivery.ID))
+	request.Header.Set("X-Webhook-Signature", Signature(webhook.Secret, body))
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	return response.StatusCode, nil
+}
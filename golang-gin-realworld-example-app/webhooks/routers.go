@@ -0,0 +1,176 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Routes below /api/webhooks, a user only sees their own webhooks.
+func WebhooksRegister(router *gin.RouterGroup) {
+	router.POST("", WebhookCreate)
+	router.POST("/", WebhookCreate)
+	router.GET("", WebhookList)
+	router.GET("/", WebhookList)
+	router.GET("/:id", WebhookRetrieve)
+	router.PUT("/:id", WebhookUpdate)
+	router.DELETE("/:id", WebhookDelete)
+	router.GET("/:id/deliveries", DeliveryList)
+	router.POST("/:id/deliveries/:deliveryId/redeliver", DeliveryRedeliver)
+}
+
+// Answer 422 for a failed Bind, key names the errors which aren't validation errors.
+func bindError(c *gin.Context, key string, err error) {
+	if err == ErrUnknownEvent {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("events", err))
+		return
+	}
+	if errors.Is(err, common.ErrURLScheme) || errors.Is(err, common.ErrPrivateAddress) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("url", err))
+		return
+	}
+	if _, ok := err.(validator.ValidationErrors); ok {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	c.JSON(http.StatusUnprocessableEntity, common.NewError(key, err))
+}
+
+func parseID(value string) (uint, bool) {
+	id64, err := strconv.ParseUint(value, 10, 32)
+	return uint(id64), err == nil
+}
+
+// The webhook of the :id param, answers 404 when it isn't one of the current user's.
+func findWebhook(c *gin.Context) (WebhookModel, bool) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	id, ok := parseID(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, common.NewError("webhook", errors.New("Invalid id")))
+		return WebhookModel{}, false
+	}
+	webhookModel, err := FindWebhook(myUserModel.ID, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("webhook", errors.New("Invalid id")))
+		return WebhookModel{}, false
+	}
+	return webhookModel, true
+}
+
+func WebhookCreate(c *gin.Context) {
+	webhookModelValidator := NewWebhookModelValidator()
+	if err := webhookModelValidator.Bind(c); err != nil {
+		bindError(c, "webhook", err)
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	webhookModel := webhookModelValidator.webhookModel
+	webhookModel.OwnerID = myUserModel.ID
+	if err := CreateWebhook(&webhookModel, myUserModel.IsAdmin()); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.Set(showSecretKey, true)
+	serializer := WebhookSerializer{c, webhookModel}
+	c.JSON(http.StatusCreated, gin.H{"webhook": serializer.Response()})
+}
+
+func WebhookList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	webhookModels, err := FindWebhooks(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := WebhooksSerializer{c, webhookModels}
+	c.JSON(http.StatusOK, gin.H{"webhooks": serializer.Response()})
+}
+
+func WebhookRetrieve(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	serializer := WebhookSerializer{c, webhookModel}
+	c.JSON(http.StatusOK, gin.H{"webhook": serializer.Response()})
+}
+
+func WebhookUpdate(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	webhookModelValidator := NewWebhookModelValidatorFillWith(webhookModel)
+	if err := webhookModelValidator.Bind(c); err != nil {
+		bindError(c, "webhook", err)
+		return
+	}
+	if err := webhookModel.Update(webhookModelValidator.webhookModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := WebhookSerializer{c, webhookModel}
+	c.JSON(http.StatusOK, gin.H{"webhook": serializer.Response()})
+}
+
+func WebhookDelete(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	if err := DeleteWebhook(webhookModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": "Delete success"})
+}
+
+func DeliveryList(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	deliveryListValidator := NewDeliveryListValidator()
+	if err := deliveryListValidator.Bind(c); err != nil {
+		bindError(c, "query", err)
+		return
+	}
+	deliveryModels, count, err := FindDeliveries(webhookModel.ID, deliveryListValidator.Limit, deliveryListValidator.Offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := DeliveriesSerializer{c, deliveryModels}
+	c.JSON(http.StatusOK, gin.H{"deliveries": serializer.Response(), "deliveriesCount": count})
+}
+
+// Queue the payload of a logged delivery again as a new delivery, e.g. after the receiver was fixed.
+func DeliveryRedeliver(c *gin.Context) {
+	webhookModel, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c.Param("deliveryId"))
+	if !ok {
+		c.JSON(http.StatusNotFound, common.NewError("delivery", errors.New("Invalid id")))
+		return
+	}
+	deliveryModel, err := FindDelivery(webhookModel.ID, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("delivery", errors.New("Invalid id")))
+		return
+	}
+	again, err := Redeliver(deliveryModel)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := DeliverySerializer{c, again}
+	c.JSON(http.StatusAccepted, gin.H{"delivery": serializer.Response()})
+}
@@ -0,0 +1,111 @@
+package webhooks
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set by WebhookCreate: the secret is only shown in the response which registered the webhook.
+const showSecretKey = "webhook_show_secret"
+
+type WebhookSerializer struct {
+	C *gin.Context
+	WebhookModel
+}
+
+type WebhookResponse struct {
+	ID          uint     `json:"id"`
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Active      bool     `json:"active"`
+	AllArticles bool     `json:"allArticles"`
+	Secret      string   `json:"secret,omitempty"`
+	CreatedAt   string   `json:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt"`
+}
+
+func (s *WebhookSerializer) Response() WebhookResponse {
+	response := WebhookResponse{
+		ID:          s.ID,
+		URL:         s.URL,
+		Events:      s.events(),
+		Active:      s.Active,
+		AllArticles: s.AllArticles,
+		CreatedAt:   timestamp(s.CreatedAt),
+		UpdatedAt:   timestamp(s.UpdatedAt),
+	}
+	if s.C.GetBool(showSecretKey) {
+		response.Secret = s.Secret
+	}
+	return response
+}
+
+type WebhooksSerializer struct {
+	C        *gin.Context
+	Webhooks []WebhookModel
+}
+
+func (s *WebhooksSerializer) Response() []WebhookResponse {
+	response := []WebhookResponse{}
+	for _, webhook := range s.Webhooks {
+		serializer := WebhookSerializer{s.C, webhook}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type DeliverySerializer struct {
+	C *gin.Context
+	WebhookDeliveryModel
+}
+
+// nextAttemptAt is null unless the delivery is pending, deliveredAt until it was delivered.
+type DeliveryResponse struct {
+	ID            uint            `json:"id"`
+	Event         string          `json:"event"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	ResponseCode  int             `json:"responseCode"`
+	LastError     string          `json:"lastError"`
+	NextAttemptAt *string         `json:"nextAttemptAt"`
+	DeliveredAt   *string         `json:"deliveredAt"`
+	CreatedAt     string          `json:"createdAt"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+func (s *DeliverySerializer) Response() DeliveryResponse {
+	response := DeliveryResponse{
+		ID:           s.ID,
+		Event:        s.Event,
+		Status:       s.Status,
+		Attempts:     s.Attempts,
+		ResponseCode: s.ResponseCode,
+		LastError:    s.LastError,
+		CreatedAt:    timestamp(s.CreatedAt),
+		Payload:      json.RawMessage(s.Payload),
+	}
+	if s.Status == StatusPending {
+		nextAttemptAt := timestamp(s.NextAttemptAt)
+		response.NextAttemptAt = &nextAttemptAt
+	}
+	if s.DeliveredAt != nil {
+		deliveredAt := timestamp(*s.DeliveredAt)
+		response.DeliveredAt = &deliveredAt
+	}
+	return response
+}
+
+type DeliveriesSerializer struct {
+	C          *gin.Context
+	Deliveries []WebhookDeliveryModel
+}
+
+func (s *DeliveriesSerializer) Response() []DeliveryResponse {
+	response := []DeliveryResponse{}
+	for _, delivery := range s.Deliveries {
+		serializer := DeliverySerializer{s.C, delivery}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
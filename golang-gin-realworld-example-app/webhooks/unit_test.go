@@ -0,0 +1,257 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/common"
+	"realworld-backend/jobs"
+	"realworld-backend/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+var test_db *gorm.DB
+
+func setupTestDB() *gorm.DB {
+	db := common.TestDBInit()
+	users.AutoMigrate()
+	articles.AutoMigrate()
+	jobs.AutoMigrate()
+	AutoMigrate()
+	return db
+}
+
+// What the receiver got, with the signature checked against the secret of the webhook.
+type received struct {
+	Event    string
+	Delivery string
+	Valid    bool
+	Body     map[string]interface{}
+}
+
+func TestWebhooks(t *testing.T) {
+	asserts := assert.New(t)
+	test_db = setupTestDB()
+	defer common.TestDBFree(test_db)
+
+	gin.SetMode(gin.TestMode)
+	defer func(attempts int) { MaxAttempts = attempts }(MaxAttempts)
+	MaxAttempts = 3
+	// The receiver listens on localhost
+	common.AllowPrivateAddresses = true
+	defer func() { common.AllowPrivateAddresses = false }()
+
+	owner := users.UserModel{Username: "hookowner", Email: "hookowner@test.com"}
+	admin := users.UserModel{Username: "hookadmin", Email: "hookadmin@test.com", Role: users.RoleAdmin}
+	other := users.UserModel{Username: "hookother", Email: "hookother@test.com"}
+	test_db.Create(&owner)
+	test_db.Create(&admin)
+	test_db.Create(&other)
+
+	var mu sync.Mutex
+	status := http.StatusOK
+	secrets := map[string]string{}
+	deliveries := map[string][]received{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		delivery := received{
+			Event:    r.Header.Get("X-Webhook-Event"),
+			Delivery: r.Header.Get("X-Webhook-Delivery"),
+			Valid:    r.Header.Get("X-Webhook-Signature") == Signature(secrets[r.URL.Path], body),
+		}
+		json.Unmarshal(body, &delivery.Body)
+		deliveries[r.URL.Path] = append(deliveries[r.URL.Path], delivery)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+	events := func(path string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		names := []string{}
+		for _, delivery := range deliveries[path] {
+			asserts.True(delivery.Valid, "deliveries are signed with the secret of the webhook")
+			names = append(names, delivery.Event)
+		}
+		deliveries[path] = nil
+		return names
+	}
+
+	var me users.UserModel
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("my_user_model", me)
+		c.Next()
+	})
+	WebhooksRegister(router.Group("/api/webhooks"))
+	request := func(method, url, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	// Registering returns the secret once, admins hear about all articles
+	me = owner
+	code, response := request("POST", "/api/webhooks", fmt.Sprintf(`{"webhook":{"url":"%s/owner","events":["article.created","comment.created"]}}`, receiver.URL))
+	asserts.Equal(http.StatusCreated, code)
+	ownerHook := response["webhook"].(map[string]interface{})
+	asserts.Equal(false, ownerHook["allArticles"])
+	asserts.Equal(true, ownerHook["active"])
+	asserts.Len(ownerHook["secret"], 64)
+	secrets["/owner"] = ownerHook["secret"].(string)
+	me = admin
+	code, response = request("POST", "/api/webhooks", fmt.Sprintf(`{"webhook":{"url":"%s/admin"}}`, receiver.URL))
+	asserts.Equal(http.StatusCreated, code)
+	adminHook := response["webhook"].(map[string]interface{})
+	asserts.Equal(true, adminHook["allArticles"])
+	asserts.Equal([]interface{}{}, adminHook["events"])
+	secrets["/admin"] = adminHook["secret"].(string)
+
+	code, _ = request("POST", "/api/webhooks", `{"webhook":{"url":"not a url"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	code, response = request("POST", "/api/webhooks", `{"webhook":{"url":"ftp://example.com/hook"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Contains(response["errors"], "url")
+	common.AllowPrivateAddresses = false
+	for _, url := range []string{receiver.URL, "http://169.254.169.254/latest/meta-data", "http://localhost:6379", "http://[::1]/", "http://10.1.2.3/hook"} {
+		code, response = request("POST", "/api/webhooks", fmt.Sprintf(`{"webhook":{"url":"%s"}}`, url))
+		asserts.Equal(http.StatusUnprocessableEntity, code, url)
+		asserts.Contains(response["errors"], "url", url)
+	}
+	common.AllowPrivateAddresses = true
+	code, response = request("POST", "/api/webhooks", fmt.Sprintf(`{"webhook":{"url":"%s","events":["everything"]}}`, receiver.URL))
+	asserts.Equal(http.StatusUnprocessableEntity, code)
+	asserts.Contains(response["errors"], "events")
+
+	me = owner
+	code, response = request("GET", "/api/webhooks", "")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Len(response["webhooks"], 1)
+	asserts.Nil(response["webhooks"].([]interface{})[0].(map[string]interface{})["secret"])
+	me = other
+	code, _ = request("GET", fmt.Sprintf("/api/webhooks/%v", ownerHook["id"]), "")
+	asserts.Equal(http.StatusNotFound, code, "webhooks are private to their owner")
+	code, _ = request("GET", fmt.Sprintf("/api/webhooks/%v/deliveries", ownerHook["id"]), "")
+	asserts.Equal(http.StatusNotFound, code)
+
+	// Events are queued, the worker sends them
+	ownerModel := articles.GetArticleUserModel(owner)
+	otherModel := articles.GetArticleUserModel(other)
+	article := articles.ArticleModel{Slug: "hooked", Title: "Hooked", AuthorID: ownerModel.ID}
+	asserts.NoError(articles.CreateArticle(&article))
+	asserts.NoError(articles.CreateArticle(&articles.ArticleModel{Slug: "unhooked", Title: "Unhooked", AuthorID: otherModel.ID}))
+	asserts.NoError(articles.CreateComment(&articles.CommentModel{ArticleID: article.ID, AuthorID: otherModel.ID, Body: "hi"}))
+	asserts.Empty(events("/owner"), "nothing is sent before the worker runs")
+
+	ctx := context.Background()
+
+	attempted, err := jobs.Drain(ctx, Queue, time.Now())
+	asserts.NoError(err)
+	asserts.Equal(5, attempted)
+	asserts.Equal([]string{articles.EventArticleCreated, articles.EventCommentCreated}, events("/owner"), "users only hear about their own articles")
+	asserts.Equal([]string{articles.EventArticleCreated, articles.EventArticleCreated, articles.EventCommentCreated}, events("/admin"))
+	attempted, _ = jobs.Drain(ctx, Queue, time.Now())
+	asserts.Equal(0, attempted, "delivered events aren't sent again")
+
+	var comment WebhookDeliveryModel
+	test_db.Where("event = ?", articles.EventCommentCreated).First(&comment)
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(comment.Payload), &payload)
+	asserts.Equal(articles.EventCommentCreated, payload["event"])
+	asserts.NotZero(payload["id"], "receivers can drop events delivered twice by their id")
+	asserts.Equal("hooked", payload["data"].(map[string]interface{})["article"].(map[string]interface{})["slug"])
+	asserts.Equal("hookother", payload["data"].(map[string]interface{})["comment"].(map[string]interface{})["author"])
+
+	// Failed deliveries are retried with a growing delay until they give up
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	asserts.NoError(article.Update(articles.ArticleModel{Title: "Rehooked"}))
+	now := time.Now()
+	attempted, _ = jobs.Drain(ctx, Queue, now)
+	asserts.Equal(1, attempted, "the owner's webhook doesn't want updates")
+	asserts.Equal([]string{articles.EventArticleUpdated}, events("/admin"))
+	var failing WebhookDeliveryModel
+	test_db.Where("event = ?", articles.EventArticleUpdated).First(&failing)
+	asserts.Equal(StatusPending, failing.Status)
+	asserts.Equal(1, failing.Attempts)
+	asserts.Equal(500, failing.ResponseCode)
+	asserts.True(failing.NextAttemptAt.Equal(now.Add(jobs.RetryBaseDelay)))
+
+	attempted, _ = jobs.Drain(ctx, Queue, now.Add(jobs.RetryBaseDelay-time.Second))
+	asserts.Equal(0, attempted)
+	now = now.Add(jobs.RetryBaseDelay)
+	attempted, _ = jobs.Drain(ctx, Queue, now)
+	asserts.Equal(1, attempted)
+	test_db.First(&failing, failing.ID)
+	asserts.True(failing.NextAttemptAt.Equal(now.Add(2*jobs.RetryBaseDelay)), "the delay doubles")
+	jobs.Drain(ctx, Queue, now.Add(2*jobs.RetryBaseDelay))
+	test_db.First(&failing, failing.ID)
+	asserts.Equal(StatusFailed, failing.Status)
+	asserts.Equal(3, failing.Attempts)
+	asserts.Equal("unexpected status 500", failing.LastError)
+	asserts.Len(events("/admin"), 2)
+	attempted, _ = jobs.Drain(ctx, Queue, now.Add(24*time.Hour))
+	asserts.Equal(0, attempted, "failed deliveries aren't retried")
+
+	// The delivery log shows the outcome, a delivery can be sent again
+	me = admin
+	code, response = request("GET", fmt.Sprintf("/api/webhooks/%v/deliveries?limit=2", adminHook["id"]), "")
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(float64(4), response["deliveriesCount"])
+	log := response["deliveries"].([]interface{})
+	asserts.Len(log, 2)
+	asserts.Equal(StatusFailed, log[0].(map[string]interface{})["status"])
+	asserts.Equal(float64(500), log[0].(map[string]interface{})["responseCode"])
+	asserts.Nil(log[0].(map[string]interface{})["nextAttemptAt"])
+	asserts.Equal("Rehooked", log[0].(map[string]interface{})["payload"].(map[string]interface{})["data"].(map[string]interface{})["article"].(map[string]interface{})["title"])
+	asserts.Equal(StatusDelivered, log[1].(map[string]interface{})["status"])
+	asserts.NotNil(log[1].(map[string]interface{})["deliveredAt"])
+
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+	code, response = request("POST", fmt.Sprintf("/api/webhooks/%v/deliveries/%v/redeliver", adminHook["id"], failing.ID), "")
+	asserts.Equal(http.StatusAccepted, code)
+	asserts.Equal(StatusPending, response["delivery"].(map[string]interface{})["status"])
+	me = owner
+	code, _ = request("POST", fmt.Sprintf("/api/webhooks/%v/deliveries/%v/redeliver", ownerHook["id"], failing.ID), "")
+	asserts.Equal(http.StatusNotFound, code, "deliveries belong to their webhook")
+	jobs.Drain(ctx, Queue, time.Now())
+	asserts.Equal([]string{articles.EventArticleUpdated}, events("/admin"))
+
+	// Inactive webhooks get nothing, deleted ones take their log with them
+	code, response = request("PUT", fmt.Sprintf("/api/webhooks/%v", ownerHook["id"]), `{"webhook":{"active":false}}`)
+	asserts.Equal(http.StatusOK, code)
+	asserts.Equal(false, response["webhook"].(map[string]interface{})["active"])
+	asserts.Equal([]interface{}{articles.EventArticleCreated, articles.EventCommentCreated}, response["webhook"].(map[string]interface{})["events"])
+	asserts.NoError(articles.CreateComment(&articles.CommentModel{ArticleID: article.ID, AuthorID: otherModel.ID, Body: "again"}))
+	jobs.Drain(ctx, Queue, time.Now())
+	asserts.Empty(events("/owner"))
+	asserts.Len(events("/admin"), 1)
+
+	code, _ = request("DELETE", fmt.Sprintf("/api/webhooks/%v", ownerHook["id"]), "")
+	asserts.Equal(http.StatusOK, code)
+	var count int
+	test_db.Model(&WebhookDeliveryModel{}).Where("webhook_id = ?", ownerHook["id"]).Count(&count)
+	asserts.Equal(0, count)
+	code, _ = request("GET", fmt.Sprintf("/api/webhooks/%v", ownerHook["id"]), "")
+	asserts.Equal(http.StatusNotFound, code)
+}
@@ -0,0 +1,66 @@
+package webhooks
+
+import (
+	"realworld-backend/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// {"webhook": {"url": "https://example.com/hook", "events": ["article.created"], "active": true}}
+// No events subscribes to all of them, active defaults to true. The URL has to be http or https and
+// must not point at a private address.
+type WebhookModelValidator struct {
+	Webhook struct {
+		URL    string   `form:"url" json:"url" binding:"required,url"`
+		Events []string `form:"events" json:"events"`
+		Active *bool    `form:"active" json:"active"`
+	} `json:"webhook"`
+	webhookModel WebhookModel `json:"-"`
+}
+
+func NewWebhookModelValidator() WebhookModelValidator {
+	return WebhookModelValidator{}
+}
+
+func NewWebhookModelValidatorFillWith(webhookModel WebhookModel) WebhookModelValidator {
+	validator := NewWebhookModelValidator()
+	validator.Webhook.URL = webhookModel.URL
+	validator.Webhook.Events = webhookModel.events()
+	validator.Webhook.Active = &webhookModel.Active
+	validator.webhookModel = webhookModel
+	return validator
+}
+
+func (s *WebhookModelValidator) Bind(c *gin.Context) error {
+	if err := common.Bind(c, s); err != nil {
+		return err
+	}
+	if err := common.CheckPublicURL(s.Webhook.URL); err != nil {
+		return err
+	}
+	events, err := joinEvents(s.Webhook.Events)
+	if err != nil {
+		return err
+	}
+	s.webhookModel.URL = s.Webhook.URL
+	s.webhookModel.Events = events
+	s.webhookModel.Active = s.Webhook.Active == nil || *s.Webhook.Active
+	return nil
+}
+
+type DeliveryListValidator struct {
+	Limit  int `form:"limit" binding:"min=0"`
+	Offset int `form:"offset" binding:"min=0"`
+}
+
+func NewDeliveryListValidator() DeliveryListValidator {
+	return DeliveryListValidator{}
+}
+
+func (s *DeliveryListValidator) Bind(c *gin.Context) error {
+	if err := c.ShouldBindQuery(s); err != nil {
+		return err
+	}
+	s.Limit = common.PageSize(s.Limit)
+	return nil
+}